@@ -0,0 +1,516 @@
+package abb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/identity"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+// autoscalerActor is the actor of the scale events made by the autoscaler
+const autoscalerActor = "autoscaler"
+
+const (
+	defaultAutoscalingWindow  = 120 * time.Second
+	defaultScaleUpCooldown    = 60 * time.Second
+	defaultScaleDownCooldown  = 300 * time.Second
+	autoscalingTolerance      = 0.1 // the usage within 10% of the target doesn't change the replicas
+	autoscalingDecisionsLimit = 100 // the decisions kept for each service
+)
+
+var _autoscaler = &autoscaler{
+	decisions:  map[string][]*types.AutoscalingDecision{},
+	lastScaled: map[string]time.Time{},
+}
+
+var _metricClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// EnableAutoscaler evaluates the autoscaling policies of the services of every cluster and scales them.
+func EnableAutoscaler() {
+	interval := _config.Autoscaling.IntervalInSec
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for range ticker.C {
+		_autoscaler.run()
+	}
+}
+
+type autoscaler struct {
+	mutex      sync.Mutex
+	decisions  map[string][]*types.AutoscalingDecision // cluster id/service id => the latest decisions first
+	lastScaled map[string]time.Time
+}
+
+func autoscalingKey(clusterID, serviceID string) string {
+	return clusterID + "/" + serviceID
+}
+
+func (a *autoscaler) run() {
+	ctx := identity.NewContext(context.Background(), jwt.MapClaims{"sub": autoscalerActor})
+
+	clusters, err := _clusterManager.ClusterList(ctx)
+	if err != nil {
+		log.Errorf("abb: autoscaler lists clusters fail: %v", err)
+		return
+	}
+
+	for _, cluster := range clusters {
+		a.scaleCluster(ctx, cluster)
+	}
+}
+
+func (a *autoscaler) scaleCluster(ctx context.Context, cluster *types.Cluster) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("abb: autoscaler on cluster %s fail: %v", cluster.Name, r)
+		}
+	}()
+
+	manager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		log.Errorf("abb: autoscaler on cluster %s fail: %v", cluster.Name, err)
+		return
+	}
+	defer manager.DockerClient().Close()
+
+	services, err := manager.List(ctx, types.ServiceFilterOptions{})
+	if err != nil {
+		log.Errorf("abb: autoscaler on cluster %s fail: %v", cluster.Name, err)
+		return
+	}
+
+	for _, service := range services {
+		if !service.Spec.Autoscaling.Enabled {
+			continue
+		}
+		decision := a.evaluate(ctx, cluster, manager, service)
+		a.record(decision)
+	}
+}
+
+// evaluate decides the replicas of the service by its policy, and scales the service when the replicas change
+// and the service isn't in cooldown.
+func (a *autoscaler) evaluate(ctx context.Context, cluster *types.Cluster, manager types.ServiceService, service *types.Service) *types.AutoscalingDecision {
+	policy := service.Spec.Autoscaling
+	now := time.Now().UTC()
+
+	decision := &types.AutoscalingDecision{
+		Time:      now,
+		ClusterID: cluster.ID,
+		ServiceID: service.ID,
+		Service:   service.Name,
+		Action:    types.AutoscalingActionNone,
+		Reasons:   []string{},
+	}
+	reason := func(format string, args ...interface{}) {
+		decision.Reasons = append(decision.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	dockerSvc, _, err := manager.DockerClient().ServiceInspectWithRaw(ctx, service.Name, dockerTypes.ServiceInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			reason("the service isn't deployed")
+			return decision
+		}
+		decision.Error = err.Error()
+		return decision
+	}
+	if dockerSvc.Spec.Mode.Replicated == nil || dockerSvc.Spec.Mode.Replicated.Replicas == nil {
+		reason("global services can't be scaled")
+		return decision
+	}
+
+	current := *dockerSvc.Spec.Mode.Replicated.Replicas
+	decision.CurrentReplicas = current
+	decision.DesiredReplicas = current
+
+	if dockerSvc.UpdateStatus != nil && (dockerSvc.UpdateStatus.State == swarm.UpdateStateUpdating || dockerSvc.UpdateStatus.State == swarm.UpdateStateRollbackStarted) {
+		reason("a rolling update is in progress")
+		return decision
+	}
+
+	// the desired replicas are the most which any trigger asks for
+	desired, proposed := current, false
+	propose := func(replicas uint64) {
+		if !proposed || replicas > desired {
+			desired = replicas
+			proposed = true
+		}
+	}
+
+	if policy.TargetCPUPercent > 0 || policy.TargetMemoryPercent > 0 {
+		window := defaultAutoscalingWindow
+		if policy.WindowInSec > 0 {
+			window = time.Duration(policy.WindowInSec) * time.Second
+		}
+
+		cpuPercent, memoryPercent, tasks := _metricsStore.average(cluster.ID, dockerSvc.ID, now.Add(-window))
+		switch {
+		case tasks == 0:
+			reason("no container stats of the service in the last %s, the metrics collector must be enabled", window)
+		default:
+			if policy.TargetCPUPercent > 0 {
+				// the cpu percent is of one cpu, it is compared with the limit when the service has one
+				cpuLimit := 1.0
+				if resources := dockerSvc.Spec.TaskTemplate.Resources; resources != nil && resources.Limits != nil && resources.Limits.NanoCPUs > 0 {
+					cpuLimit = float64(resources.Limits.NanoCPUs) / 1e9
+				}
+				utilization := cpuPercent / cpuLimit
+				replicas := proportionalReplicas(current, utilization, policy.TargetCPUPercent)
+				propose(replicas)
+				reason("average cpu of %d tasks is %.1f%% against the target %.1f%%, %d replicas are needed", tasks, utilization, policy.TargetCPUPercent, replicas)
+			}
+			if policy.TargetMemoryPercent > 0 {
+				replicas := proportionalReplicas(current, memoryPercent, policy.TargetMemoryPercent)
+				propose(replicas)
+				reason("average memory of %d tasks is %.1f%% against the target %.1f%%, %d replicas are needed", tasks, memoryPercent, policy.TargetMemoryPercent, replicas)
+			}
+		}
+	}
+
+	if metric := policy.Metric; metric != nil && metric.TargetPerReplica > 0 {
+		value, err := scrapeServiceMetric(ctx, *metric)
+		if err != nil {
+			reason("scrape metric %s fail: %v", metric.Name, err)
+		} else {
+			replicas := uint64(math.Ceil(math.Max(value, 0) / metric.TargetPerReplica))
+			propose(replicas)
+			reason("metric %s is %g with %g per replica, %d replicas are needed", metric.Name, value, metric.TargetPerReplica, replicas)
+		}
+	}
+
+	// the schedules raise the min replicas while they are active
+	minReplicas := policy.MinReplicas
+	for _, schedule := range policy.Schedules {
+		since, active, err := autoscalingScheduleActive(schedule, now)
+		if err != nil {
+			reason("schedule %s was invalid: %v", schedule.Name, err)
+			continue
+		}
+		if active && schedule.MinReplicas > minReplicas {
+			minReplicas = schedule.MinReplicas
+			reason("schedule %s is active since %s, it needs at least %d replicas", schedule.Name, since.Format(time.RFC3339), schedule.MinReplicas)
+		}
+	}
+
+	if desired < minReplicas {
+		desired = minReplicas
+		reason("raised to the min replicas %d", minReplicas)
+	}
+	if policy.MaxReplicas > 0 && desired > policy.MaxReplicas {
+		desired = policy.MaxReplicas
+		reason("capped by the max replicas %d", policy.MaxReplicas)
+	}
+
+	if desired > current && policy.MaxScaleUpStep > 0 && desired-current > policy.MaxScaleUpStep {
+		desired = current + policy.MaxScaleUpStep
+		reason("limited to %d replicas added at a time", policy.MaxScaleUpStep)
+	}
+	if desired < current && policy.MaxScaleDownStep > 0 && current-desired > policy.MaxScaleDownStep {
+		desired = current - policy.MaxScaleDownStep
+		reason("limited to %d replicas removed at a time", policy.MaxScaleDownStep)
+	}
+
+	decision.DesiredReplicas = desired
+	cooldown := defaultScaleUpCooldown
+	switch {
+	case desired > current:
+		decision.Action = types.AutoscalingActionScaleUp
+		if policy.ScaleUpCooldownInSec > 0 {
+			cooldown = time.Duration(policy.ScaleUpCooldownInSec) * time.Second
+		}
+	case desired < current:
+		decision.Action = types.AutoscalingActionScaleDown
+		cooldown = defaultScaleDownCooldown
+		if policy.ScaleDownCooldownInSec > 0 {
+			cooldown = time.Duration(policy.ScaleDownCooldownInSec) * time.Second
+		}
+	default:
+		if !proposed && len(decision.Reasons) == 0 {
+			reason("the replicas are within the min and max replicas")
+		}
+		return decision
+	}
+
+	key := autoscalingKey(cluster.ID, service.ID)
+	if lastScaled, found := a.lastScaledAt(key); found && now.Sub(lastScaled) < cooldown {
+		reason("in cooldown until %s", lastScaled.Add(cooldown).Format(time.RFC3339))
+		return decision
+	}
+
+	_, err = manager.Scale(ctx, service.ID, desired, 0)
+	if err != nil {
+		decision.Error = err.Error()
+		return decision
+	}
+	decision.Applied = true
+
+	a.mutex.Lock()
+	a.lastScaled[key] = now
+	a.mutex.Unlock()
+
+	return decision
+}
+
+// proportionalReplicas returns the replicas which bring the usage to the target, like the usage is spread evenly on the tasks.
+func proportionalReplicas(current uint64, usage, target float64) uint64 {
+	ratio := usage / target
+	if math.Abs(ratio-1) <= autoscalingTolerance {
+		return current
+	}
+	replicas := uint64(math.Ceil(float64(current) * ratio))
+	if replicas < 1 {
+		replicas = 1
+	}
+	return replicas
+}
+
+func (a *autoscaler) lastScaledAt(key string) (time.Time, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	lastScaled, found := a.lastScaled[key]
+	return lastScaled, found
+}
+
+func (a *autoscaler) record(decision *types.AutoscalingDecision) {
+	reasons := strings.Join(decision.Reasons, "; ")
+	switch {
+	case len(decision.Error) > 0:
+		log.Errorf("abb: autoscaler on service %s fail: %s, reasons: %s", decision.Service, decision.Error, reasons)
+	case decision.Applied:
+		log.Infof("abb: autoscaler scaled service %s from %d to %d replicas: %s", decision.Service, decision.CurrentReplicas, decision.DesiredReplicas, reasons)
+	default:
+		log.Debugf("abb: autoscaler keeps service %s at %d replicas: %s", decision.Service, decision.CurrentReplicas, reasons)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := autoscalingKey(decision.ClusterID, decision.ServiceID)
+	decisions := append([]*types.AutoscalingDecision{decision}, a.decisions[key]...)
+	if len(decisions) > autoscalingDecisionsLimit {
+		decisions = decisions[:autoscalingDecisionsLimit]
+	}
+	a.decisions[key] = decisions
+}
+
+// status returns the policy and the decisions of the service.
+func (a *autoscaler) status(clusterID string, service *types.Service) *types.AutoscalingStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := autoscalingKey(clusterID, service.ID)
+	result := &types.AutoscalingStatus{
+		Policy:    service.Spec.Autoscaling,
+		Decisions: append([]*types.AutoscalingDecision{}, a.decisions[key]...),
+	}
+	if lastScaled, found := a.lastScaled[key]; found {
+		result.LastScaledAt = &lastScaled
+	}
+	return result
+}
+
+func autoscalingScheduleActive(schedule types.AutoscalingSchedule, now time.Time) (time.Time, bool, error) {
+	cron, err := parseCron(schedule.Cron)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	location := time.UTC
+	if len(schedule.Timezone) > 0 {
+		location, err = time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+
+	since, active := cron.activeSince(now.In(location), time.Duration(schedule.DurationInMin)*time.Minute)
+	return since, active, nil
+}
+
+// scrapeServiceMetric reads the metric in the prometheus text format and sums up the samples which match the labels.
+func scrapeServiceMetric(ctx context.Context, metric types.AutoscalingMetric) (float64, error) {
+	req, err := http.NewRequest("GET", metric.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/plain")
+
+	resp, err := _metricClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", metric.URL, resp.Status)
+	}
+
+	found := false
+	total := 0.0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, value, err := parsePrometheusSample(line)
+		if err != nil || name != metric.Name {
+			continue
+		}
+		matched := true
+		for key, val := range metric.Labels {
+			if labels[key] != val {
+				matched = false
+				break
+			}
+		}
+		if !matched || math.IsNaN(value) {
+			continue
+		}
+		found = true
+		total += value
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("metric %s wasn't found", metric.Name)
+	}
+	return total, nil
+}
+
+// parsePrometheusSample parses a sample line, such as `http_requests{method="GET",code="200"} 1027 1395066363000`.
+func parsePrometheusSample(line string) (string, map[string]string, float64, error) {
+	labels := map[string]string{}
+
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd < 0 {
+		return "", nil, 0, fmt.Errorf("sample %s was invalid", line)
+	}
+	name := line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if strings.HasPrefix(rest, "{") {
+		idx := 1
+		for {
+			for idx < len(rest) && (rest[idx] == ' ' || rest[idx] == ',') {
+				idx++
+			}
+			if idx >= len(rest) {
+				return "", nil, 0, fmt.Errorf("sample %s was invalid", line)
+			}
+			if rest[idx] == '}' {
+				idx++
+				break
+			}
+
+			eq := strings.Index(rest[idx:], "=\"")
+			if eq < 0 {
+				return "", nil, 0, fmt.Errorf("sample %s was invalid", line)
+			}
+			key := strings.TrimSpace(rest[idx : idx+eq])
+			idx += eq + 2
+
+			val := strings.Builder{}
+			closed := false
+			for idx < len(rest) {
+				ch := rest[idx]
+				idx++
+				if ch == '\\' && idx < len(rest) {
+					next := rest[idx]
+					idx++
+					if next == 'n' {
+						val.WriteByte('\n')
+					} else {
+						val.WriteByte(next)
+					}
+					continue
+				}
+				if ch == '"' {
+					closed = true
+					break
+				}
+				val.WriteByte(ch)
+			}
+			if !closed {
+				return "", nil, 0, fmt.Errorf("sample %s was invalid", line)
+			}
+			labels[key] = val.String()
+		}
+		rest = rest[idx:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("sample %s was invalid", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("sample %s was invalid", line)
+	}
+	return name, labels, value, nil
+}
+
+// validateAutoscalingPolicy checks the policy before the spec is saved, so the autoscaler doesn't fail on it later.
+func validateAutoscalingPolicy(spec types.ServiceSpec) error {
+	policy := spec.Autoscaling
+	if !policy.Enabled {
+		return nil
+	}
+
+	invalid := func(format string, args ...interface{}) error {
+		return app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf(format, args...)}
+	}
+
+	if strings.EqualFold(spec.Deploy.Mode, "global") {
+		return invalid("global services can't be autoscaled")
+	}
+	if policy.MaxReplicas == 0 || policy.MinReplicas > policy.MaxReplicas {
+		return invalid("autoscaling needs max replicas which are at least the min replicas")
+	}
+	if policy.TargetCPUPercent < 0 || policy.TargetMemoryPercent < 0 || policy.WindowInSec < 0 || policy.ScaleUpCooldownInSec < 0 || policy.ScaleDownCooldownInSec < 0 {
+		return invalid("autoscaling targets, window and cooldowns can't be negative")
+	}
+	if metric := policy.Metric; metric != nil {
+		if len(metric.URL) == 0 || len(metric.Name) == 0 || metric.TargetPerReplica <= 0 {
+			return invalid("autoscaling metric needs the url, name and a positive target per replica")
+		}
+		if !strings.HasPrefix(metric.URL, "http://") && !strings.HasPrefix(metric.URL, "https://") {
+			return invalid("autoscaling metric url %s was invalid", metric.URL)
+		}
+	}
+	for _, schedule := range policy.Schedules {
+		if schedule.DurationInMin <= 0 || schedule.DurationInMin > 7*24*60 {
+			return invalid("autoscaling schedule %s needs a duration between 1 minute and 7 days", schedule.Name)
+		}
+		if schedule.MinReplicas > policy.MaxReplicas {
+			return invalid("autoscaling schedule %s needs more than the max replicas", schedule.Name)
+		}
+		if _, _, err := autoscalingScheduleActive(schedule, time.Now()); err != nil {
+			return invalid("autoscaling schedule %s was invalid: %v", schedule.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package abb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+type CapacityManager struct {
+	client  *client.Client
+	cluster *types.Cluster
+}
+
+func newCapacityManager(cluster *types.Cluster) (*CapacityManager, error) {
+	client, err := newDockerClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CapacityManager{
+		client:  client,
+		cluster: cluster,
+	}, nil
+}
+
+func newSwarmResources(target types.Resources) *swarm.Resources {
+	if target.CPUs <= 0 && target.MemoryBytes <= 0 {
+		return nil
+	}
+	return &swarm.Resources{
+		NanoCPUs:    int64(target.CPUs * 1e9),
+		MemoryBytes: target.MemoryBytes,
+	}
+}
+
+func newSwarmResourceRequirements(target types.ResourceRequirements) *swarm.ResourceRequirements {
+	limits := newSwarmResources(target.Limits)
+	reservations := newSwarmResources(target.Reservations)
+	if limits == nil && reservations == nil {
+		return nil
+	}
+	return &swarm.ResourceRequirements{
+		Limits:       limits,
+		Reservations: reservations,
+	}
+}
+
+func addSwarmResources(total *types.Resources, resources *swarm.Resources) {
+	if resources == nil {
+		return
+	}
+	total.CPUs += float64(resources.NanoCPUs) / 1e9
+	total.MemoryBytes += resources.MemoryBytes
+}
+
+// taskHoldsResources tells whether the scheduler counts the reservations of the task on its node
+func taskHoldsResources(task swarm.Task) bool {
+	if len(task.NodeID) == 0 || task.DesiredState != swarm.TaskStateRunning {
+		return false
+	}
+	switch task.Status.State {
+	case swarm.TaskStateComplete, swarm.TaskStateShutdown, swarm.TaskStateFailed, swarm.TaskStateRejected:
+		return false
+	}
+	return true
+}
+
+func nodeIsSchedulable(node swarm.Node) bool {
+	return node.Status.State == swarm.NodeStateReady && node.Spec.Availability == swarm.NodeAvailabilityActive
+}
+
+func (m *CapacityManager) load(ctx context.Context) ([]swarm.Node, []swarm.Task, error) {
+	nodes, err := m.client.NodeList(ctx, dockerTypes.NodeListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tasks, err := m.client.TaskList(ctx, dockerTypes.TaskListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nodes, tasks, nil
+}
+
+func nodeCapacities(nodes []swarm.Node, tasks []swarm.Task) []*types.NodeCapacity {
+	result := []*types.NodeCapacity{}
+	for _, node := range nodes {
+		nodeCapacity := &types.NodeCapacity{
+			ID:           node.ID,
+			Hostname:     node.Description.Hostname,
+			Role:         string(node.Spec.Role),
+			Availability: string(node.Spec.Availability),
+			State:        string(node.Status.State),
+		}
+		addSwarmResources(&nodeCapacity.Capacity, &node.Description.Resources)
+
+		for _, task := range tasks {
+			if task.NodeID != node.ID || !taskHoldsResources(task) {
+				continue
+			}
+			if task.Status.State == swarm.TaskStateRunning {
+				nodeCapacity.RunningTasks++
+			}
+			if task.Spec.Resources != nil {
+				addSwarmResources(&nodeCapacity.Reserved, task.Spec.Resources.Reservations)
+				addSwarmResources(&nodeCapacity.Limited, task.Spec.Resources.Limits)
+			}
+		}
+
+		result = append(result, nodeCapacity)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Hostname < result[j].Hostname
+	})
+	return result
+}
+
+// Overview returns the capacity, reservations and limits of every node and the whole cluster.
+func (m *CapacityManager) Overview(ctx context.Context) (*types.ClusterCapacity, error) {
+	logger := log.FromContext(ctx)
+
+	nodes, tasks, err := m.load(ctx)
+	if err != nil {
+		logger.Errorf("abb: get cluster capacity err: %v", err)
+		return nil, err
+	}
+
+	result := &types.ClusterCapacity{
+		Nodes:                       nodeCapacities(nodes, tasks),
+		ServicesWithoutReservations: []string{},
+	}
+
+	schedulable := map[string]bool{}
+	for _, node := range nodes {
+		schedulable[node.ID] = nodeIsSchedulable(node)
+	}
+	for _, nodeCapacity := range result.Nodes {
+		if !schedulable[nodeCapacity.ID] {
+			continue
+		}
+		result.Capacity.CPUs += nodeCapacity.Capacity.CPUs
+		result.Capacity.MemoryBytes += nodeCapacity.Capacity.MemoryBytes
+		result.Reserved.CPUs += nodeCapacity.Reserved.CPUs
+		result.Reserved.MemoryBytes += nodeCapacity.Reserved.MemoryBytes
+		result.Limited.CPUs += nodeCapacity.Limited.CPUs
+		result.Limited.MemoryBytes += nodeCapacity.Limited.MemoryBytes
+		result.RunningTasks += nodeCapacity.RunningTasks
+	}
+
+	dockerServices, err := m.client.ServiceList(ctx, dockerTypes.ServiceListOptions{})
+	if err != nil {
+		logger.Errorf("abb: get cluster capacity err: %v", err)
+		return nil, err
+	}
+	for _, svc := range dockerServices {
+		resources := svc.Spec.TaskTemplate.Resources
+		if resources == nil || resources.Reservations == nil || (resources.Reservations.NanoCPUs == 0 && resources.Reservations.MemoryBytes == 0) {
+			result.ServicesWithoutReservations = append(result.ServicesWithoutReservations, svc.Spec.Name)
+		}
+	}
+	sort.Strings(result.ServicesWithoutReservations)
+
+	return result, nil
+}
+
+// Fit tells whether the tasks of the service spec can be scheduled on the nodes, which are filtered by the
+// constraints and the free resources like the swarm scheduler does.
+func (m *CapacityManager) Fit(ctx context.Context, spec types.ServiceSpec) (*types.CapacityFit, error) {
+	logger := log.FromContext(ctx)
+
+	nodes, tasks, err := m.load(ctx)
+	if err != nil {
+		logger.Errorf("abb: check capacity fit err: %v", err)
+		return nil, err
+	}
+
+	capacities := map[string]*types.NodeCapacity{}
+	for _, nodeCapacity := range nodeCapacities(nodes, tasks) {
+		capacities[nodeCapacity.ID] = nodeCapacity
+	}
+
+	reservation := spec.Deploy.Resources.Reservations
+	global := strings.EqualFold(spec.Deploy.Mode, "global")
+
+	result := &types.CapacityFit{
+		Nodes: []*types.NodeFit{},
+	}
+
+	eligible := 0
+	totalTasks := 0
+	unlimited := false
+	for _, node := range nodes {
+		nodeFit := &types.NodeFit{
+			ID:       node.ID,
+			Hostname: node.Description.Hostname,
+		}
+		result.Nodes = append(result.Nodes, nodeFit)
+
+		if !nodeIsSchedulable(node) {
+			nodeFit.Reason = fmt.Sprintf("node is %s and %s", node.Status.State, node.Spec.Availability)
+			continue
+		}
+
+		matched, constraint, err := matchConstraints(node, spec.Deploy.Constraints)
+		if err != nil {
+			return nil, app.AppError{ErrorCode: "invalid_input", Message: err.Error()}
+		}
+		if !matched {
+			nodeFit.Reason = fmt.Sprintf("constraint %s isn't matched", constraint)
+			continue
+		}
+		eligible++
+
+		nodeCapacity := capacities[node.ID]
+		freeCPUs := nodeCapacity.Capacity.CPUs - nodeCapacity.Reserved.CPUs
+		freeMemory := nodeCapacity.Capacity.MemoryBytes - nodeCapacity.Reserved.MemoryBytes
+
+		nodeFit.Tasks = -1
+		if reservation.CPUs > 0 {
+			nodeFit.Tasks = int(math.Floor(freeCPUs/reservation.CPUs + 1e-9))
+		}
+		if reservation.MemoryBytes > 0 {
+			memoryTasks := int(freeMemory / reservation.MemoryBytes)
+			if nodeFit.Tasks < 0 || memoryTasks < nodeFit.Tasks {
+				nodeFit.Tasks = memoryTasks
+			}
+		}
+		if nodeFit.Tasks < 0 && (reservation.CPUs > 0 || reservation.MemoryBytes > 0) {
+			// the node is already overcommitted
+			nodeFit.Tasks = 0
+		}
+
+		if nodeFit.Tasks == 0 {
+			switch {
+			case reservation.CPUs > 0 && freeCPUs < reservation.CPUs:
+				nodeFit.Reason = fmt.Sprintf("insufficient cpu: %.2f free, %.2f reserved per task", math.Max(freeCPUs, 0), reservation.CPUs)
+			default:
+				nodeFit.Reason = fmt.Sprintf("insufficient memory: %d bytes free, %d bytes reserved per task", freeMemory, reservation.MemoryBytes)
+			}
+			continue
+		}
+
+		if nodeFit.Tasks < 0 {
+			unlimited = true
+		} else {
+			totalTasks += nodeFit.Tasks
+		}
+	}
+
+	if global {
+		result.Replicas = eligible
+		blocked := 0
+		for _, nodeFit := range result.Nodes {
+			if nodeFit.Tasks == 0 && strings.HasPrefix(nodeFit.Reason, "insufficient") {
+				blocked++
+			}
+		}
+		result.Fits = eligible > 0 && blocked == 0
+		switch {
+		case eligible == 0:
+			result.Message = "no node matches the constraints"
+		case blocked > 0:
+			result.Message = fmt.Sprintf("%d of %d eligible nodes don't have enough free resources", blocked, eligible)
+		default:
+			result.Message = fmt.Sprintf("a task fits on each of the %d eligible nodes", eligible)
+		}
+		return result, nil
+	}
+
+	result.Replicas = int(spec.Deploy.Replicas)
+	result.Fits = unlimited || totalTasks >= result.Replicas
+	if eligible == 0 && result.Replicas > 0 {
+		result.Fits = false
+	}
+	switch {
+	case eligible == 0:
+		result.Message = "no node matches the constraints"
+	case result.Fits && unlimited:
+		result.Message = "the service doesn't reserve resources, it fits on any eligible node"
+	case result.Fits:
+		result.Message = fmt.Sprintf("%d replicas fit, the eligible nodes can take %d tasks", result.Replicas, totalTasks)
+	default:
+		result.Message = fmt.Sprintf("only %d of %d replicas fit on the eligible nodes", totalTasks, result.Replicas)
+	}
+
+	return result, nil
+}
+
+// matchConstraints evaluates the placement constraints against the node, it returns the first constraint which isn't matched.
+func matchConstraints(node swarm.Node, constraints []string) (bool, string, error) {
+	for _, constraint := range constraints {
+		operator := "=="
+		idx := strings.Index(constraint, "==")
+		if notIdx := strings.Index(constraint, "!="); notIdx >= 0 && (idx < 0 || notIdx < idx) {
+			idx = notIdx
+			operator = "!="
+		}
+		if idx < 0 {
+			return false, constraint, fmt.Errorf("constraint %s was invalid", constraint)
+		}
+
+		key := strings.TrimSpace(constraint[:idx])
+		expected := strings.TrimSpace(constraint[idx+2:])
+
+		actual, found := "", true
+		switch {
+		case key == "node.id":
+			actual = node.ID
+		case key == "node.hostname":
+			actual = node.Description.Hostname
+		case key == "node.role":
+			actual = string(node.Spec.Role)
+		case key == "node.platform.os":
+			actual = node.Description.Platform.OS
+		case key == "node.platform.arch":
+			actual = node.Description.Platform.Architecture
+		case strings.HasPrefix(key, "node.labels."):
+			actual, found = node.Spec.Labels[strings.TrimPrefix(key, "node.labels.")]
+		case strings.HasPrefix(key, "engine.labels."):
+			actual, found = node.Description.Engine.Labels[strings.TrimPrefix(key, "engine.labels.")]
+		default:
+			return false, constraint, fmt.Errorf("constraint %s was invalid", constraint)
+		}
+
+		equal := found && strings.EqualFold(actual, expected)
+		if (operator == "==" && !equal) || (operator == "!=" && equal) {
+			return false, constraint, nil
+		}
+	}
+	return true, "", nil
+}
+
+func (m *CapacityManager) Close(ctx context.Context) error {
+	return m.client.Close()
+}
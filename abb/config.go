@@ -18,7 +18,7 @@ type ConfigManager struct {
 }
 
 func newConfigManager(cluster *types.Cluster) (*ConfigManager, error) {
-	client, err := client.NewClient(cluster.Host, "1.30", nil, nil)
+	client, err := newDockerClient(cluster)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,131 @@
+package abb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard cron expression with five fields: minute, hour, day of month, month and day of week.
+// The fields support *, lists, ranges and steps, such as "*/15 8-18 * * 1-5".
+type cronSchedule struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	anyDom      bool
+	anyDow      bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %s needs 5 fields", expr)
+	}
+
+	schedule := &cronSchedule{
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron %s was invalid: minute %v", expr, err)
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron %s was invalid: hour %v", expr, err)
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron %s was invalid: day of month %v", expr, err)
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron %s was invalid: month %v", expr, err)
+	}
+	// sunday is 0 or 7
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron %s was invalid: day of week %v", expr, err)
+	}
+	if schedule.daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("step %s was invalid", part[idx+1:])
+			}
+			part = part[:idx]
+		}
+
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("%s was invalid", part)
+			}
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("%s was invalid", part)
+			}
+		default:
+			val, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("%s was invalid", part)
+			}
+			start, end = val, val
+			if step > 1 {
+				// such as 5/15 means from 5 to the end every 15
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for val := start; val <= end; val += step {
+			values[val] = true
+		}
+	}
+	return values, nil
+}
+
+// matches tells whether the minute of the time matches the schedule.  Like cron, when both the day of month and
+// the day of week are restricted, either of them matches the day.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+
+	domMatched := s.daysOfMonth[t.Day()]
+	dowMatched := s.daysOfWeek[int(t.Weekday())]
+	switch {
+	case s.anyDom && s.anyDow:
+		return true
+	case s.anyDom:
+		return dowMatched
+	case s.anyDow:
+		return domMatched
+	}
+	return domMatched || dowMatched
+}
+
+// activeSince returns the last time the schedule matched within the duration before now.
+func (s *cronSchedule) activeSince(now time.Time, duration time.Duration) (time.Time, bool) {
+	t := now.Truncate(time.Minute)
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += time.Minute {
+		if s.matches(t.Add(-elapsed)) {
+			return t.Add(-elapsed), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,79 @@
+package abb
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+)
+
+// ************************
+// Database
+// ************************
+
+type deploymentDAO struct {
+	db *sqlx.DB
+}
+
+func newDeploymentDAO(db *sqlx.DB) types.DeploymentRepository {
+	return &deploymentDAO{
+		db: db,
+	}
+}
+
+const insertDeploymentSQL = "INSERT INTO `deployments` (`id`, `cluster_id`, `service_id`, `service_name`, `image`, `digest`, `actor`, `state`, `message`, `created_at`) VALUES (UNHEX(:id), UNHEX(:cluster_id), UNHEX(:service_id), :service_name, :image, :digest, :actor, :state, :message, :created_at);"
+
+func (repo *deploymentDAO) Insert(ctx context.Context, entity *types.Deployment) error {
+	logger := log.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.ID = strings.Replace(entity.ID, "-", "", -1)
+	entity.CreatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertDeploymentSQL, entity)
+	if err != nil {
+		logger.Errorf("abb: insert deployment fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const findDeploymentSQL = "SELECT LOWER(HEX(id)) as `id`, LOWER(HEX(cluster_id)) as `cluster_id`, LOWER(HEX(service_id)) as `service_id`, `service_name`, `image`, `digest`, `actor`, `state`, `message`, `created_at` FROM deployments WHERE 1=1"
+
+func (repo *deploymentDAO) Find(ctx context.Context, opts types.DeploymentFilterOptions) ([]*types.Deployment, error) {
+	logger := log.FromContext(ctx)
+
+	findSQL := findDeploymentSQL
+	param := map[string]interface{}{}
+
+	if len(opts.ClusterID) > 0 {
+		findSQL += " AND cluster_id = UNHEX(:cluster_id)"
+		param["cluster_id"] = opts.ClusterID
+	}
+
+	if len(opts.ServiceID) > 0 {
+		findSQL += " AND service_id = UNHEX(:service_id)"
+		param["service_id"] = opts.ServiceID
+	}
+
+	findSQL += " ORDER BY created_at DESC"
+
+	deployments := []*types.Deployment{}
+	findSQLStmt, err := repo.db.PrepareNamed(findSQL)
+	if err != nil {
+		logger.Errorf("abb: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer findSQLStmt.Close()
+
+	err = findSQLStmt.Select(&deployments, param)
+	if err != nil {
+		logger.Errorf("abb: list deployments fail: %v", err)
+		return nil, err
+	}
+
+	return deployments, nil
+}
@@ -1,9 +1,15 @@
 package abb
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jasonsoft/abb/app"
 	"github.com/jasonsoft/abb/identity"
@@ -12,12 +18,13 @@ import (
 	"github.com/jasonsoft/log"
 	"github.com/jasonsoft/napnap"
 
-	dockerTypes "github.com/docker/docker/api/types"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/docker/docker/api/types/swarm"
+	uuid "github.com/satori/go.uuid"
 )
 
 func NewAbbRouter() *napnap.Router {
-	router := napnap.NewRouter()
+	router := app.NewRouter()
 
 	// clusters
 	router.Post("/v1/clusters", clusterCreateEndpoint)
@@ -27,24 +34,53 @@ func NewAbbRouter() *napnap.Router {
 	router.Get("/v1/clusters/:cluster_name/nodes", nodeListEndpoint)
 	router.Get("/v1/clusters/:cluster_name/nodes/:node_id", nodeGetEndpoint)
 	router.Post("/v1/clusters/:cluster_name/nodes/:node_id", nodeUpdateEndpoint)
+	router.Delete("/v1/clusters/:cluster_name/nodes/:node_id", nodeDeleteEndpoint)
+	router.Put("/v1/clusters/:cluster_name/nodes/:node_id/availability", nodeAvailabilityEndpoint)
+	router.Put("/v1/clusters/:cluster_name/nodes/:node_id/labels", nodeLabelsEndpoint)
+	router.Post("/v1/clusters/:cluster_name/nodes/:node_id/promote", nodePromoteEndpoint)
+	router.Post("/v1/clusters/:cluster_name/nodes/:node_id/demote", nodeDemoteEndpoint)
+
+	// maintenance
+	router.Get("/v1/clusters/:cluster_name/maintenance", maintenanceListEndpoint)
+	router.Post("/v1/clusters/:cluster_name/maintenance", maintenanceCreateEndpoint)
+	router.Get("/v1/clusters/:cluster_name/maintenance/:job_id", maintenanceGetEndpoint)
+	router.Post("/v1/clusters/:cluster_name/maintenance/:job_id/continue", maintenanceContinueEndpoint)
+	router.Post("/v1/clusters/:cluster_name/maintenance/:job_id/abort", maintenanceAbortEndpoint)
+
+	// capacity
+	router.Get("/v1/clusters/:cluster_name/capacity", capacityGetEndpoint)
+	router.Post("/v1/clusters/:cluster_name/capacity/fit", capacityFitEndpoint)
 
 	// network
 	router.Get("/v1/clusters/:cluster_name/networks", networkListEndpoint)
+	router.Post("/v1/clusters/:cluster_name/networks", networkCreateEndpoint)
+	router.Get("/v1/clusters/:cluster_name/networks/:network_id", networkGetEndpoint)
+	router.Delete("/v1/clusters/:cluster_name/networks/:network_id", networkDeleteEndpoint)
 
 	// service
 	router.Post("/v1/clusters/:cluster_name/services/:service_id/redeploy", serviceRedeployEndpoint)
 	router.Post("/v1/clusters/:cluster_name/services/:service_id/rollback", serviceRollbackEndpoint)
 	router.Post("/v1/clusters/:cluster_name/services/:service_id/stop", serviceStopEndpoint)
+	router.Post("/v1/clusters/:cluster_name/services/:service_id/scale", serviceScaleEndpoint)
 	router.Get("/v1/clusters/:cluster_name/services/:service_id/raw", serviceRawEndpoint)
+	router.Get("/v1/clusters/:cluster_name/services/:service_id/diagnosis", serviceDiagnosisEndpoint)
+	router.Get("/v1/clusters/:cluster_name/services/:service_id/metrics", serviceMetricsEndpoint)
+	router.Get("/v1/clusters/:cluster_name/services/:service_id/autoscaling", serviceAutoscalingEndpoint)
 	router.Get("/v1/clusters/:cluster_name/services/:service_id/logs", serviceLogsEndpoint)
+	router.Get("/v1/clusters/:cluster_name/services/:service_id/deployments", serviceDeploymentListEndpoint)
+	router.Get("/v1/clusters/:cluster_name/services/:service_id/image_update", serviceImageUpdateEndpoint)
 	router.Get("/v1/clusters/:cluster_name/services/:service_id", serviceGetEndpoint)
 	router.Put("/v1/clusters/:cluster_name/services/:service_id", serviceUpdateEndpoint)
 	router.Delete("/v1/clusters/:cluster_name/services/:service_id", serviceDeleteEndpoint)
 	router.Get("/v1/clusters/:cluster_name/services", serviceListEndpoint)
+	router.Post("/v1/clusters/:cluster_name/scale", servicesScaleEndpoint)
 	router.Post("/v1/clusters/:cluster_name/services", serviceCreateEndpoint)
 
 	// task
 	router.Get("/v1/clusters/:cluster_name/tasks", taskListEndpoint)
+	router.Get("/v1/clusters/:cluster_name/tasks/:task_id", taskGetEndpoint)
+	router.Get("/v1/clusters/:cluster_name/tasks/:task_id/exec", taskExecEndpoint)
+	router.Get("/v1/clusters/:cluster_name/exec_recordings/:session_id", execRecordingGetEndpoint)
 
 	// config
 	router.Get("/v1/clusters/:cluster_name/configs", configListEndpoint)
@@ -52,13 +88,39 @@ func NewAbbRouter() *napnap.Router {
 	router.Post("/v1/clusters/:cluster_name/configs", configCreateEndpoint)
 	router.Delete("/v1/clusters/:cluster_name/configs/:config_id", configDeleteEndpoint)
 
+	// registry
+	router.Get("/v1/clusters/:cluster_name/registries", registryCredentialListEndpoint)
+	router.Post("/v1/clusters/:cluster_name/registries", registryCredentialCreateEndpoint)
+	router.Get("/v1/clusters/:cluster_name/registries/:registry_id", registryCredentialGetEndpoint)
+	router.Put("/v1/clusters/:cluster_name/registries/:registry_id", registryCredentialUpdateEndpoint)
+	router.Delete("/v1/clusters/:cluster_name/registries/:registry_id", registryCredentialDeleteEndpoint)
+	router.Post("/v1/clusters/:cluster_name/registries/:registry_id/login", registryCredentialLoginEndpoint)
+	router.Get("/v1/clusters/:cluster_name/registries/:registry_id/repositories", registryRepositoryListEndpoint)
+	router.Get("/v1/clusters/:cluster_name/registries/:registry_id/tags", registryTagListEndpoint)
+	router.Get("/v1/clusters/:cluster_name/registries/:registry_id/manifest", registryManifestGetEndpoint)
+
+	// webhook
+	router.Get("/v1/clusters/:cluster_name/webhooks", webhookListEndpoint)
+	router.Post("/v1/clusters/:cluster_name/webhooks", webhookCreateEndpoint)
+	router.Get("/v1/clusters/:cluster_name/webhooks/:webhook_id", webhookGetEndpoint)
+	router.Delete("/v1/clusters/:cluster_name/webhooks/:webhook_id", webhookDeleteEndpoint)
+	router.Post("/v1/clusters/:cluster_name/webhooks/:webhook_id/secret", webhookSecretEndpoint)
+
 	// health
 	router.Get("/v1/clusters/:cluster_name/healthcheck", healthCheckListEndpoint)
 	router.Get("/v1/clusters/:cluster_name/healthcheck/:health_id", healthCheckGetEndpoint)
 	router.Post("/v1/clusters/:cluster_name/healthcheck", healthCheckCreateEndpoint)
 	router.Delete("/v1/clusters/:cluster_name/healthcheck/:health_id", healthCheckDeleteEndpoint)
 
-	return router
+	return router.Router
+}
+
+// NewWebhookRouter returns the router of inbound webhooks which are authorized by their own secrets instead of jwt.
+func NewWebhookRouter() *napnap.Router {
+	router := app.NewRouter()
+	router.Post("/v1/hooks/:webhook_id", webhookTriggerEndpoint)
+	router.Post("/v1/hooks/maintenance/:job_id", maintenanceHookEndpoint)
+	return router.Router
 }
 
 func healthCheckListEndpoint(c *napnap.Context) {
@@ -175,47 +237,8 @@ func configGetEndpoint(c *napnap.Context) {
 	}
 
 	// check permission
-	claims, found := identity.FromContext(ctx)
-	if found == false {
-		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
-		panic(appError)
-	}
-	roles := claims["roles"]
-
-	slicB, err := json.Marshal(roles)
-	if err != nil {
-		panic(err)
-	}
-
-	var newRoles []*identity.Role
-	err = json.Unmarshal(slicB, &newRoles)
-	if err != nil {
-		panic(err)
-	}
-
-	isValid := false
-	for _, role := range newRoles {
-		for _, rule := range role.Rules {
-			if rule.Namespace != "*" && rule.Namespace != clusterName {
-				continue
-			}
-
-			for _, res := range rule.Resources {
-				if res != "*" && res != "configs" {
-					continue
-				}
-
-				for _, verb := range rule.Verbs {
-					if verb == "*" || verb == "get" {
-						log.Debugf("rule: %v", rule)
-						isValid = true
-					}
-				}
-			}
-		}
-	}
-
-	if isValid == false {
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "configs", Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
 		c.SetStatus(403)
 		return
 	}
@@ -325,47 +348,8 @@ func configListEndpoint(c *napnap.Context) {
 	}
 
 	// check permission
-	claims, found := identity.FromContext(ctx)
-	if found == false {
-		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
-		panic(appError)
-	}
-	roles := claims["roles"]
-
-	slicB, err := json.Marshal(roles)
-	if err != nil {
-		panic(err)
-	}
-
-	var newRoles []*identity.Role
-	err = json.Unmarshal(slicB, &newRoles)
-	if err != nil {
-		panic(err)
-	}
-
-	isValid := false
-	for _, role := range newRoles {
-		for _, rule := range role.Rules {
-			if rule.Namespace != "*" && rule.Namespace != clusterName {
-				continue
-			}
-
-			for _, res := range rule.Resources {
-				if res != "*" && res != "configs" {
-					continue
-				}
-
-				for _, verb := range rule.Verbs {
-					if verb == "*" || verb == "list" {
-						log.Debugf("rule: %v", rule)
-						isValid = true
-					}
-				}
-			}
-		}
-	}
-
-	if isValid == false {
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "configs", Verb: "list"}
+	if !identity.IsAllowed(ctx, req) {
 		c.SetStatus(403)
 		return
 	}
@@ -486,60 +470,22 @@ func clusterListEndpoint(c *napnap.Context) {
 		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
 		panic(appError)
 	}
-	roles := claims["roles"]
-
-	slicB, err := json.Marshal(roles)
-	if err != nil {
-		panic(err)
-	}
-
-	var newRoles []*identity.Role
-	err = json.Unmarshal(slicB, &newRoles)
+	roles, err := identity.RolesFromClaims(claims)
 	if err != nil {
 		panic(err)
 	}
 
-	var clustersFound map[string]bool
-	clustersFound = make(map[string]bool)
-
-	isValid := false
+	// the clusters are authorized one by one, so the roles scoped to some clusters can list them
+	req := identity.AccessRequest{Resource: "clusters", Verb: "list"}
 	resultClusters := []*types.Cluster{}
-	for _, role := range newRoles {
-		for _, rule := range role.Rules {
-			if len(rule.Namespace) > 0 && rule.Namespace != "*" {
-				continue
-			}
-
-			for _, res := range rule.Resources {
-				if res != "*" && res != "clusters" {
-					continue
-				}
-
-				for _, resName := range rule.ResourceNames {
-					for _, verb := range rule.Verbs {
-						if verb == "*" || verb == "list" {
-							log.Debugf("rule: %v", rule)
-							isValid = true
-							for _, cluster := range clusters {
-								if resName == "*" || cluster.Name == resName {
-									if _, find := clustersFound[cluster.Name]; !find {
-										resultClusters = append(resultClusters, cluster)
-										clustersFound[cluster.Name] = true
-									}
-								}
-							}
-						}
-					}
-				}
-			}
+	for _, cluster := range clusters {
+		req.Cluster = cluster.Name
+		req.ResourceName = cluster.Name
+		if identity.Authorize(roles, req).Allowed {
+			resultClusters = append(resultClusters, cluster)
 		}
 	}
 
-	if isValid == false {
-		c.SetStatus(403)
-		return
-	}
-
 	//Sort number from small to larger
 	sort.Slice(resultClusters, func(i, j int) bool { return resultClusters[i].Sort < resultClusters[j].Sort })
 
@@ -566,16 +512,14 @@ func networkListEndpoint(c *napnap.Context) {
 		panic(err)
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	networkManager, err := newNetworkManager(cluster, _serviceRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer networkManager.Close(ctx)
 
-	dockerClient := serviceManager.DockerClient()
-	defer dockerClient.Close()
-
-	opt := dockerTypes.NetworkListOptions{}
-	networkList, err := dockerClient.NetworkList(ctx, opt)
+	opts := types.NetworkListOption{}
+	networkList, err := networkManager.List(ctx, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -589,7 +533,7 @@ func networkListEndpoint(c *napnap.Context) {
 	c.JSON(200, apiResult)
 }
 
-func nodeGetEndpoint(c *napnap.Context) {
+func networkGetEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -601,31 +545,49 @@ func nodeGetEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	networkID := c.Param("network_id")
+	if len(networkID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "network_id parameter was invalid"})
+	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	networkManager, err := newNetworkManager(cluster, _serviceRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer networkManager.Close(ctx)
 
-	dockerClient := serviceManager.DockerClient()
-	defer dockerClient.Close()
+	network, err := networkManager.Get(ctx, networkID)
+	if err != nil {
+		panic(err)
+	}
 
-	nodeID := c.Param("node_id")
-	if len(nodeID) <= 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "node_id parameter was invalid"})
+	if network == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "network was not found"})
 	}
 
-	node, _, err := dockerClient.NodeInspectWithRaw(ctx, nodeID)
-	if err != nil {
-		panic(err)
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "networks", ResourceName: network.Name, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
 	}
 
-	c.JSON(200, node)
+	c.JSON(200, network)
 }
 
-func nodeUpdateEndpoint(c *napnap.Context) {
+func networkCreateEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
+	var network types.Network
+	err := c.BindJSON(&network)
+	if err != nil {
+		panic(err)
+	}
+
 	clusterName := c.Param("cluster_name")
 	if len(clusterName) <= 0 {
 		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
@@ -635,48 +597,45 @@ func nodeUpdateEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
-
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
-	if err != nil {
-		panic(err)
-	}
-
-	dockerClient := serviceManager.DockerClient()
-	defer dockerClient.Close()
-
-	nodeID := c.Param("node_id")
-	if len(nodeID) <= 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "node_id parameter was invalid"})
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
 	}
 
-	nodeSpec := swarm.NodeSpec{}
-	err = c.BindJSON(&nodeSpec)
-	if err != nil {
-		panic(err)
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "networks", ResourceName: network.Name, Verb: "create"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
 	}
 
-	node, _, err := dockerClient.NodeInspectWithRaw(ctx, nodeID)
+	networkManager, err := newNetworkManager(cluster, _serviceRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer networkManager.Close(ctx)
 
-	err = dockerClient.NodeUpdate(ctx, nodeID, node.Version, nodeSpec)
+	err = networkManager.Create(ctx, &network)
 	if err != nil {
 		panic(err)
 	}
 
-	// refresh
-	node, _, err = dockerClient.NodeInspectWithRaw(ctx, nodeID)
-	if err != nil {
-		panic(err)
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.networks", clusterName),
+		TargetID:  network.ID,
+		Actor:     claims["sub"].(string),
+		Action:    "create",
+		State:     audit.SUCCESS,
+		Message:   network.Name,
 	}
+	audit.Log(event)
 
-	c.JSON(200, node)
+	c.JSON(201, network)
 }
 
-func nodeListEndpoint(c *napnap.Context) {
+func networkDeleteEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
-	pagination := app.GetPaginationFromContext(c)
 
 	clusterName := c.Param("cluster_name")
 	if len(clusterName) <= 0 {
@@ -687,135 +646,58 @@ func nodeListEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
-
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
-	if err != nil {
-		panic(err)
-	}
-
-	dockerClient := serviceManager.DockerClient()
-	defer dockerClient.Close()
-
-	opt := dockerTypes.NodeListOptions{}
-	nodeList, err := dockerClient.NodeList(ctx, opt)
-	if err != nil {
-		panic(err)
-	}
-
-	pagination.SetTotalCount(len(nodeList))
-	apiResult := app.ApiPagiationResult{
-		Pagination: pagination,
-		Data:       nodeList,
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
 	}
 
-	c.JSON(200, apiResult)
-}
-
-func serviceRollbackEndpoint(c *napnap.Context) {
-	// ctx := c.StdContext()
-
-	// clusterName := c.Param("cluster_name")
-	// if len(clusterName) <= 0 {
-	// 	panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
-	// }
-
-	// cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	// serviceManager, err := NewServiceManager(cluster)
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	// dockerClient := serviceManager.DockerClient()
-	// defer dockerClient.Close()
-
-	// serviceID := c.Param("service_id")
-	// if len(serviceID) <= 0 {
-	// 	panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
-	// }
-
-	// // get service and rollback
-	// getServiceOpt := types.ServiceGetOptions{
-	// 	ServiceID: serviceID,
-	// }
-	// svc, err := serviceManager.ServiceGet(ctx, getServiceOpt)
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	// updateOpt := dockerTypes.ServiceUpdateOptions{
-	// 	Rollback: "previous",
-	// }
-	// _, err = dockerClient.ServiceUpdate(ctx, serviceID, svc.Version, svc.Spec, updateOpt)
-	// if err != nil {
-	// 	log.Panicf("abb: rollback service fail: %s", err.Error())
-	// }
-
-	// c.SetStatus(200)
-}
-
-func serviceStopEndpoint(c *napnap.Context) {
-	ctx := c.StdContext()
-
-	clusterName := c.Param("cluster_name")
-	if len(clusterName) <= 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	networkID := c.Param("network_id")
+	if len(networkID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "network_id parameter was invalid"})
 	}
 
-	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	networkManager, err := newNetworkManager(cluster, _serviceRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer networkManager.Close(ctx)
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	// the network can be given by id or name, so the permission is checked against its name
+	network, err := networkManager.Get(ctx, networkID)
 	if err != nil {
 		panic(err)
 	}
+	if network == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "network was not found"})
+	}
 
-	serviceID := c.Param("service_id")
-	if len(serviceID) == 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "networks", ResourceName: network.Name, Verb: "delete"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
 	}
 
-	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	err = networkManager.Delete(ctx, network.ID)
 	if err != nil {
 		panic(err)
 	}
 
-	if svc == nil {
-		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
-	}
-
-	err = serviceManager.ServiceStop(ctx, serviceID)
-
 	// audit the action
 	claims, _ := identity.FromContext(ctx)
-	actor := claims["sub"].(string)
-	namespace := fmt.Sprintf("%s.services", clusterName)
 	event := &audit.Event{
-		Namespace: namespace,
-		TargetID:  serviceID,
-		Actor:     actor,
-		Action:    "stop",
-	}
-
-	if err != nil {
-		event.State = audit.FAILED
-		event.Message = err.Error()
-		audit.Log(event)
-		panic(err)
+		Namespace: fmt.Sprintf("%s.networks", clusterName),
+		TargetID:  network.ID,
+		Actor:     claims["sub"].(string),
+		Action:    "delete",
+		State:     audit.SUCCESS,
+		Message:   network.Name,
 	}
-
-	event.State = audit.SUCCESS
 	audit.Log(event)
 
-	c.SetStatus(200)
+	c.SetStatus(204)
 }
 
-func serviceRawEndpoint(c *napnap.Context) {
+func nodeGetEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -828,29 +710,28 @@ func serviceRawEndpoint(c *napnap.Context) {
 		panic(err)
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
 	if err != nil {
 		panic(err)
 	}
 
-	serviceID := c.Param("service_id")
-	if len(serviceID) == 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	dockerClient := serviceManager.DockerClient()
+	defer dockerClient.Close()
+
+	nodeID := c.Param("node_id")
+	if len(nodeID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "node_id parameter was invalid"})
 	}
 
-	svc, err := serviceManager.ServiceRawByID(ctx, serviceID)
+	node, _, err := dockerClient.NodeInspectWithRaw(ctx, nodeID)
 	if err != nil {
 		panic(err)
 	}
 
-	if svc == nil {
-		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
-	}
-
-	c.JSON(200, svc)
+	c.JSON(200, node)
 }
 
-func serviceLogsEndpoint(c *napnap.Context) {
+func nodeUpdateEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -863,64 +744,1907 @@ func serviceLogsEndpoint(c *napnap.Context) {
 		panic(err)
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
 	if err != nil {
 		panic(err)
 	}
 
-	serviceID := c.Param("service_id")
-	if len(serviceID) == 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
-	}
+	dockerClient := serviceManager.DockerClient()
+	defer dockerClient.Close()
 
-	logs, err := serviceManager.ServiceLogsByID(ctx, serviceID)
-	if err != nil {
+	nodeID := c.Param("node_id")
+	if len(nodeID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "node_id parameter was invalid"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "nodes", ResourceName: nodeID, Verb: "update"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	nodeSpec := swarm.NodeSpec{}
+	err = c.BindJSON(&nodeSpec)
+	if err != nil {
 		panic(err)
 	}
 
-	// result := types.ServiceLogResult{
-	// 	Logs: logs,
+	node, _, err := dockerClient.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		panic(err)
+	}
+
+	err = dockerClient.NodeUpdate(ctx, nodeID, node.Version, nodeSpec)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.nodes", clusterName),
+		TargetID:  nodeID,
+		Actor:     actorFromContext(ctx),
+		Action:    "update",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+
+	// refresh
+	node, _, err = dockerClient.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(200, node)
+}
+
+func nodeListEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	pagination := app.GetPaginationFromContext(c)
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "nodes", Verb: "list"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	nodeManager, err := newNodeManager(cluster)
+	if err != nil {
+		panic(err)
+	}
+	defer nodeManager.Close(ctx)
+
+	nodeList, err := nodeManager.List(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	pagination.SetTotalCount(len(nodeList))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       nodeList,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+// nodeOperation runs the typed operation on the node after the permission is checked, and audits it.
+func nodeOperation(c *napnap.Context, verb, action string, operation func(ctx context.Context, nodeManager *NodeManager, nodeID string) (string, error)) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	nodeID := c.Param("node_id")
+	if len(nodeID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "node_id parameter was invalid"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "nodes", ResourceName: nodeID, Verb: verb}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	nodeManager, err := newNodeManager(cluster)
+	if err != nil {
+		panic(err)
+	}
+	defer nodeManager.Close(ctx)
+
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.nodes", clusterName),
+		TargetID:  nodeID,
+		Actor:     actorFromContext(ctx),
+		Action:    action,
+	}
+
+	message, err := operation(ctx, nodeManager, nodeID)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+
+	event.State = audit.SUCCESS
+	event.Message = message
+	audit.Log(event)
+}
+
+func nodeAvailabilityEndpoint(c *napnap.Context) {
+	var update types.NodeAvailabilityUpdate
+	err := c.BindJSON(&update)
+	if err != nil {
+		panic(err)
+	}
+
+	nodeOperation(c, "update", "set_availability", func(ctx context.Context, nodeManager *NodeManager, nodeID string) (string, error) {
+		node, err := nodeManager.SetAvailability(ctx, nodeID, update)
+		if err != nil {
+			return "", err
+		}
+		c.JSON(200, node)
+		return update.Availability, nil
+	})
+}
+
+func nodeLabelsEndpoint(c *napnap.Context) {
+	var update types.NodeLabelsUpdate
+	err := c.BindJSON(&update)
+	if err != nil {
+		panic(err)
+	}
+
+	nodeOperation(c, "update", "update_labels", func(ctx context.Context, nodeManager *NodeManager, nodeID string) (string, error) {
+		node, err := nodeManager.UpdateLabels(ctx, nodeID, update)
+		if err != nil {
+			return "", err
+		}
+		c.JSON(200, node)
+
+		added := []string{}
+		for key, val := range update.Add {
+			added = append(added, key+"="+val)
+		}
+		return fmt.Sprintf("add: %s; remove: %s", strings.Join(added, ","), strings.Join(update.Remove, ",")), nil
+	})
+}
+
+func nodePromoteEndpoint(c *napnap.Context) {
+	nodeOperation(c, "update", "promote", func(ctx context.Context, nodeManager *NodeManager, nodeID string) (string, error) {
+		node, err := nodeManager.SetRole(ctx, nodeID, swarm.NodeRoleManager)
+		if err != nil {
+			return "", err
+		}
+		c.JSON(200, node)
+		return "", nil
+	})
+}
+
+func nodeDemoteEndpoint(c *napnap.Context) {
+	nodeOperation(c, "update", "demote", func(ctx context.Context, nodeManager *NodeManager, nodeID string) (string, error) {
+		node, err := nodeManager.SetRole(ctx, nodeID, swarm.NodeRoleWorker)
+		if err != nil {
+			return "", err
+		}
+		c.JSON(200, node)
+		return "", nil
+	})
+}
+
+func nodeDeleteEndpoint(c *napnap.Context) {
+	nodeOperation(c, "delete", "delete", func(ctx context.Context, nodeManager *NodeManager, nodeID string) (string, error) {
+		err := nodeManager.Remove(ctx, nodeID)
+		if err != nil {
+			return "", err
+		}
+		c.SetStatus(204)
+		return "", nil
+	})
+}
+
+func serviceRollbackEndpoint(c *napnap.Context) {
+	// ctx := c.StdContext()
+
+	// clusterName := c.Param("cluster_name")
+	// if len(clusterName) <= 0 {
+	// 	panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
 	// }
 
-	c.String(200, logs)
+	// cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	// if err != nil {
+	// 	panic(err)
+	// }
+
+	// serviceManager, err := NewServiceManager(cluster)
+	// if err != nil {
+	// 	panic(err)
+	// }
+
+	// dockerClient := serviceManager.DockerClient()
+	// defer dockerClient.Close()
+
+	// serviceID := c.Param("service_id")
+	// if len(serviceID) <= 0 {
+	// 	panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	// }
+
+	// // get service and rollback
+	// getServiceOpt := types.ServiceGetOptions{
+	// 	ServiceID: serviceID,
+	// }
+	// svc, err := serviceManager.ServiceGet(ctx, getServiceOpt)
+	// if err != nil {
+	// 	panic(err)
+	// }
+
+	// updateOpt := dockerTypes.ServiceUpdateOptions{
+	// 	Rollback: "previous",
+	// }
+	// _, err = dockerClient.ServiceUpdate(ctx, serviceID, svc.Version, svc.Spec, updateOpt)
+	// if err != nil {
+	// 	log.Panicf("abb: rollback service fail: %s", err.Error())
+	// }
+
+	// c.SetStatus(200)
 }
 
-func serviceGetEndpoint(c *napnap.Context) {
+func serviceStopEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	if svc == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	err = serviceManager.ServiceStop(ctx, serviceID)
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.services", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  serviceID,
+		Actor:     actor,
+		Action:    "stop",
+	}
+
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+
+	event.State = audit.SUCCESS
+	audit.Log(event)
+
+	c.SetStatus(200)
+}
+
+func serviceRawEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	svc, err := serviceManager.ServiceRawByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	if svc == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	c.JSON(200, svc)
+}
+
+func serviceLogsEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	logs, err := serviceManager.ServiceLogsByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	// result := types.ServiceLogResult{
+	// 	Logs: logs,
+	// }
+
+	c.String(200, logs)
+}
+
+func serviceDeploymentListEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	pagination := app.GetPaginationFromContext(c)
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	service, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+	if service == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: service.Name, Labels: service.Spec.Labels, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	deployments, err := serviceManager.DeploymentList(ctx, service.ID)
+	if err != nil {
+		panic(err)
+	}
+
+	pagination.SetTotalCount(len(deployments))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       deployments,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func serviceImageUpdateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	service, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+	if service == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	// the editor of the service uses it to change the image, so it needs the same permission as the update
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: service.Name, Labels: service.Spec.Labels, Verb: "update"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	imageUpdate, err := serviceManager.ImageUpdate(ctx, service.ID)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.services", clusterName),
+		TargetID:  service.ID,
+		Actor:     actorFromContext(ctx),
+		Action:    "image_update",
+		State:     audit.SUCCESS,
+		Message:   fmt.Sprintf("%s, latest tag %s", imageUpdate.Image, imageUpdate.LatestTag),
+	}
+	audit.Log(event)
+
+	c.JSON(200, imageUpdate)
+}
+
+func serviceGetEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	if svc == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	c.JSON(200, svc)
+}
+
+func serviceRedeployEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	if svc == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: svc.Name, Labels: svc.Spec.Labels, Verb: "redeploy"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	redeployOpts := types.RedeployOptions{
+		CreateNetworks: _config.Network.AutoCreate,
+	}
+	if createNetworks := c.Query("create_networks"); len(createNetworks) > 0 {
+		redeployOpts.CreateNetworks = createNetworks == "true"
+	}
+
+	err = serviceManager.Redeploy(ctx, serviceID, redeployOpts)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.services", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  serviceID,
+		Actor:     actor,
+		Action:    "redeploy",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+
+	c.SetStatus(200)
+}
+
+// maxServicesScale is the most services which can be scaled in one call
+const maxServicesScale = 100
+
+// scaleService checks the permission of the service and scales it, the scale is audited whether it succeeds or not.
+// It returns false when the actor isn't allowed to scale the service.
+func scaleService(ctx context.Context, clusterName string, serviceManager types.ServiceService, target types.ServiceScale) (*types.ServiceScaleResult, bool, error) {
+	if len(target.ServiceID) == 0 {
+		return nil, true, app.AppError{ErrorCode: "invalid_input", Message: "service_id was invalid"}
+	}
+	if target.Replicas == nil {
+		return nil, true, app.AppError{ErrorCode: "invalid_input", Message: "replicas was invalid"}
+	}
+
+	service, err := serviceManager.ServiceGetByID(ctx, target.ServiceID)
+	if err != nil {
+		return nil, true, err
+	}
+	if service == nil {
+		return nil, true, app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: service.Name, Labels: service.Spec.Labels, Verb: "scale"}
+	if !identity.IsAllowed(ctx, req) {
+		return nil, false, nil
+	}
+
+	result, err := serviceManager.Scale(ctx, service.ID, *target.Replicas, target.Version)
+
+	// audit the action
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.services", clusterName),
+		TargetID:  service.Name,
+		Actor:     actorFromContext(ctx),
+		Action:    "scale",
+		State:     audit.SUCCESS,
+	}
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = fmt.Sprintf("scale to %d replicas fail: %v", *target.Replicas, err)
+	} else {
+		event.Message = fmt.Sprintf("scaled from %d to %d replicas", result.PreviousReplicas, result.Replicas)
+	}
+	audit.Log(event)
+
+	return result, true, err
+}
+
+func serviceScaleEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster was not found"})
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	var target types.ServiceScale
+	err = c.BindJSON(&target)
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	target.ServiceID = serviceID
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+	defer serviceManager.DockerClient().Close()
+
+	result, allowed, err := scaleService(ctx, clusterName, serviceManager, target)
+	if !allowed {
+		c.SetStatus(403)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(200, result)
+}
+
+// servicesScaleEndpoint scales many services of the cluster; a service which fails doesn't stop the others,
+// its error is returned in its result.
+func servicesScaleEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster was not found"})
+	}
+
+	var target types.ServicesScale
+	err = c.BindJSON(&target)
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: err.Error()})
+	}
+	if len(target.Services) == 0 || len(target.Services) > maxServicesScale {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("services must have 1 to %d services", maxServicesScale)})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+	defer serviceManager.DockerClient().Close()
+
+	results := []*types.ServiceScaleResult{}
+	for _, serviceScale := range target.Services {
+		result, allowed, err := scaleService(ctx, clusterName, serviceManager, serviceScale)
+		if result == nil {
+			result = &types.ServiceScaleResult{ServiceID: serviceScale.ServiceID}
+			if serviceScale.Replicas != nil {
+				result.Replicas = *serviceScale.Replicas
+			}
+		}
+		switch {
+		case !allowed:
+			result.Error = "forbidden"
+		case err != nil:
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	c.JSON(200, results)
+}
+
+func serviceDeleteEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	if svc == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
+
+	err = serviceManager.ServiceDelete(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.services", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  serviceID,
+		Actor:     actor,
+		Action:    "delete",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+	c.SetStatus(204)
+}
+
+func serviceCreateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	var service types.Service
+	err = c.BindJSON(&service)
+	if err != nil {
+		panic(err)
+	}
+
+	err = validateAutoscalingPolicy(service.Spec)
+	if err != nil {
+		panic(err)
+	}
+
+	err = serviceManager.ServiceCreate(ctx, &service)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.services", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  service.Name,
+		Actor:     actor,
+		Action:    "create",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+	c.JSON(200, service)
+
+}
+
+func serviceUpdateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	oldService, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	if err != nil {
+		panic(err)
+	}
+
+	if oldService == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "the service was not found"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: oldService.Name, Labels: oldService.Spec.Labels, Verb: "update"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	var service types.Service
+	err = c.BindJSON(&service)
+	if err != nil {
+		panic(err)
+	}
+
+	err = validateAutoscalingPolicy(service.Spec)
+	if err != nil {
+		panic(err)
+	}
+
+	service.ID = oldService.ID
+	service.CreatedAt = oldService.CreatedAt
+	err = serviceManager.ServiceUpdate(ctx, &service)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.services", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  serviceID,
+		Actor:     actor,
+		Action:    "save",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+	c.JSON(200, service)
+}
+
+func serviceListEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	pagination := app.GetPaginationFromContext(c)
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		panic(err)
+	}
+
+	// team=mine lists the services of the teams of the current user
+	opts := types.ServiceFilterOptions{}
+	switch team := c.Query("team"); team {
+	case "":
+	case "mine":
+		opts.Teams, err = identity.CurrentUserTeamNames(ctx)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		opts.Teams = []string{team}
+	}
+	result, err := serviceManager.List(ctx, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(result) == 0 {
+		result = []*types.Service{}
+	}
+
+	// check permission
+	claims, found := identity.FromContext(ctx)
+	if found == false {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+	roles, err := identity.RolesFromClaims(claims)
+	if err != nil {
+		panic(err)
+	}
+
+	// the services are authorized one by one, so the rules scoped by names or labels can list their services
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", Verb: "list"}
+	resultService := []*types.Service{}
+	for _, service := range result {
+		req.ResourceName = service.Name
+		req.Labels = service.Spec.Labels
+		if identity.Authorize(roles, req).Allowed {
+			resultService = append(resultService, service)
+		}
+	}
+
+	pagination.SetTotalCount(len(resultService))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       resultService,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func registryCredentialListEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	pagination := app.GetPaginationFromContext(c)
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", Verb: "list"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	list, err := manager.List(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	pagination.SetTotalCount(len(list))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       list,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func registryCredentialGetEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	cred, err := manager.Get(ctx, registryID)
+	if err != nil {
+		panic(err)
+	}
+	if cred == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "registry credential was not found"})
+	}
+
+	c.JSON(200, cred)
+}
+
+func registryCredentialCreateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	var cred types.RegistryCredential
+	err = c.BindJSON(&cred)
+	if err != nil {
+		panic(err)
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: cred.Host, Verb: "create"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	err = manager.Create(ctx, &cred)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.registries", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  cred.Host,
+		Actor:     actor,
+		Action:    "create",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+	c.JSON(201, cred)
+}
+
+func registryCredentialUpdateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "update"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	var cred types.RegistryCredential
+	err = c.BindJSON(&cred)
+	if err != nil {
+		panic(err)
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	cred.ID = registryID
+	err = manager.Update(ctx, &cred)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.registries", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  cred.Host,
+		Actor:     actor,
+		Action:    "save",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+	c.JSON(200, cred)
+}
+
+func registryCredentialDeleteEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "delete"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	err = manager.Delete(ctx, registryID)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.registries", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  registryID,
+		Actor:     actor,
+		Action:    "delete",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+	c.SetStatus(204)
+}
+
+func registryCredentialLoginEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	cred := types.RegistryCredential{
+		ID: registryID,
+	}
+	err = manager.Login(ctx, &cred)
+	if err != nil {
+		panic(err)
+	}
+
+	c.SetStatus(200)
+}
+
+func registryRepositoryListEndpoint(c *napnap.Context) {
+	pagination := app.GetPaginationFromContext(c)
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	repositories, err := manager.Repositories(ctx, registryID)
+	if err != nil {
+		panic(err)
+	}
+
+	pagination.SetTotalCount(len(repositories))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       repositories,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func registryTagListEndpoint(c *napnap.Context) {
+	pagination := app.GetPaginationFromContext(c)
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	repository := c.Query("repository")
+	if len(repository) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "repository parameter was invalid"})
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	tags, err := manager.Tags(ctx, registryID, repository)
+	if err != nil {
+		panic(err)
+	}
+
+	pagination.SetTotalCount(len(tags))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       tags,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func registryManifestGetEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	registryID := c.Param("registry_id")
+	if len(registryID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "registry_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "registries", ResourceName: registryID, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	repository := c.Query("repository")
+	if len(repository) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "repository parameter was invalid"})
+	}
+
+	manager := NewRegistryCredentialManager(cluster, _credentialRepo)
+	manifest, err := manager.Manifest(ctx, registryID, repository, c.Query("tag"))
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(200, manifest)
+}
+
+func webhookListEndpoint(c *napnap.Context) {
+	pagination := app.GetPaginationFromContext(c)
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "webhooks", Verb: "list"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewWebhookManager(cluster, _webhookRepo)
+	list, err := manager.List(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	pagination.SetTotalCount(len(list))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       list,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func webhookGetEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	webhookID := c.Param("webhook_id")
+	if len(webhookID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "webhook_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "webhooks", ResourceName: webhookID, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewWebhookManager(cluster, _webhookRepo)
+	webhook, err := manager.Get(ctx, webhookID)
+	if err != nil {
+		panic(err)
+	}
+	if webhook == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "webhook was not found"})
+	}
+
+	c.JSON(200, webhook)
+}
+
+func webhookCreateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "webhooks", Verb: "create"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	var webhook types.Webhook
+	err = c.BindJSON(&webhook)
+	if err != nil {
+		panic(err)
+	}
+
+	manager := NewWebhookManager(cluster, _webhookRepo)
+	err = manager.Create(ctx, &webhook)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.webhooks", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  webhook.ID,
+		Actor:     actor,
+		Action:    "create",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+
+	c.JSON(201, webhook)
+}
+
+func webhookDeleteEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	webhookID := c.Param("webhook_id")
+	if len(webhookID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "webhook_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "webhooks", ResourceName: webhookID, Verb: "delete"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewWebhookManager(cluster, _webhookRepo)
+	err = manager.Delete(ctx, webhookID)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.webhooks", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  webhookID,
+		Actor:     actor,
+		Action:    "delete",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+
+	c.SetStatus(204)
+}
+
+func webhookSecretEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	webhookID := c.Param("webhook_id")
+	if len(webhookID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "webhook_id parameter was invalid"})
+	}
+
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "webhooks", ResourceName: webhookID, Verb: "update"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	manager := NewWebhookManager(cluster, _webhookRepo)
+	webhook, err := manager.RegenerateSecret(ctx, webhookID)
+	if err != nil {
+		panic(err)
+	}
+
+	// audit the action
+	claims, _ := identity.FromContext(ctx)
+	actor := claims["sub"].(string)
+	namespace := fmt.Sprintf("%s.webhooks", clusterName)
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  webhookID,
+		Actor:     actor,
+		Action:    "regenerate_secret",
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+
+	c.JSON(200, webhook)
+}
+
+func webhookTriggerEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	webhookID := c.Param("webhook_id")
+	if len(webhookID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "webhook_id parameter was invalid"})
+	}
+
+	if _webhookRepo == nil {
+		// webhooks are only stored by mysql
+		panic(app.AppError{ErrorCode: "not_found", Message: "webhook was not found"})
+	}
+
+	webhook, err := _webhookRepo.FindOne(ctx, types.WebhookFilterOptions{ID: webhookID})
+	if err != nil {
+		panic(err)
+	}
+	if webhook == nil {
+		panic(app.AppError{ErrorCode: "unauthorized", Message: "webhook or signature was invalid"})
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		panic(err)
+	}
+
+	cluster, err := clusterByID(ctx, webhook.ClusterID)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
+
+	// audit the action, the webhook is the actor
+	namespace := fmt.Sprintf("%s.services", cluster.Name)
+	target := webhook.ServiceID
+	if len(target) == 0 {
+		target = webhook.Stack
+	}
+	event := &audit.Event{
+		Namespace: namespace,
+		TargetID:  target,
+		Actor:     webhook.ID,
+		Action:    "redeploy",
+		State:     audit.FAILED,
+	}
+
+	if !verifyWebhookRequest(webhook, c.Request.Header, c.Query("token"), body) {
+		event.Message = "signature was invalid"
+		audit.Log(event)
+		panic(app.AppError{ErrorCode: "unauthorized", Message: "webhook or signature was invalid"})
+	}
+
+	// only the verified requests are counted, so the callers without the secret can't use up the limit of the webhook
+	if !_webhookLimiter.Allow(webhookID) {
+		event.Message = "too many requests"
+		audit.Log(event)
+		panic(app.AppError{ErrorCode: "too_many_requests", Message: "too many requests of the webhook"})
+	}
+
+	repository, tag, err := parseWebhookPayload(body)
+	if err != nil {
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+
+	ctx = identity.NewContext(ctx, jwt.MapClaims{"sub": webhook.ID})
+	services, err := triggerWebhook(ctx, cluster, webhook, repository, tag)
+	if err != nil {
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+
+	event.Message = fmt.Sprintf("%s deployed to %s", tag, strings.Join(services, ", "))
+	event.State = audit.SUCCESS
+	audit.Log(event)
+
+	c.JSON(200, map[string]interface{}{
+		"tag":      tag,
+		"services": services,
+	})
+}
+
+// maintenanceCluster returns the cluster of the request after the permission of the nodes is checked
+func maintenanceCluster(c *napnap.Context, verb string) (*types.Cluster, bool) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster was not found"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "nodes", Verb: verb}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return nil, false
+	}
+
+	return cluster, true
+}
+
+func auditMaintenance(ctx context.Context, clusterName, jobID, action, message string) {
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.maintenance", clusterName),
+		TargetID:  jobID,
+		Actor:     actorFromContext(ctx),
+		Action:    action,
+		State:     audit.SUCCESS,
+		Message:   message,
+	}
+	audit.Log(event)
+}
+
+func maintenanceListEndpoint(c *napnap.Context) {
+	pagination := app.GetPaginationFromContext(c)
+
+	cluster, ok := maintenanceCluster(c, "list")
+	if !ok {
+		return
+	}
+
+	jobs := ListMaintenanceJobs(cluster.ID)
+
+	pagination.SetTotalCount(len(jobs))
+	apiResult := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       jobs,
+	}
+
+	c.JSON(200, apiResult)
+}
+
+func maintenanceCreateEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	var job types.MaintenanceJob
+	err := c.BindJSON(&job)
+	if err != nil {
+		panic(err)
+	}
+
+	cluster, ok := maintenanceCluster(c, "update")
+	if !ok {
+		return
+	}
+
+	result, err := StartMaintenanceJob(ctx, cluster, job)
+	if err != nil {
+		panic(err)
+	}
+
+	auditMaintenance(ctx, cluster.Name, result.ID, "create", strings.Join(result.NodeIDs, ","))
+	c.JSON(201, result)
+}
+
+func maintenanceGetEndpoint(c *napnap.Context) {
+	cluster, ok := maintenanceCluster(c, "get")
+	if !ok {
+		return
+	}
+
+	job := GetMaintenanceJob(cluster.ID, c.Param("job_id"))
+	if job == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "maintenance job was not found"})
+	}
+
+	c.JSON(200, job)
+}
+
+func maintenanceContinueEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	cluster, ok := maintenanceCluster(c, "update")
+	if !ok {
+		return
+	}
+
+	jobID := c.Param("job_id")
+	err := ContinueMaintenanceJob(cluster.ID, jobID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditMaintenance(ctx, cluster.Name, jobID, "continue", "")
+	c.SetStatus(202)
+}
+
+func maintenanceAbortEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
-	clusterName := c.Param("cluster_name")
-	if len(clusterName) <= 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	cluster, ok := maintenanceCluster(c, "update")
+	if !ok {
+		return
 	}
 
-	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	jobID := c.Param("job_id")
+	err := AbortMaintenanceJob(cluster.ID, jobID)
 	if err != nil {
 		panic(err)
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
-	if err != nil {
-		panic(err)
+	auditMaintenance(ctx, cluster.Name, jobID, "abort", "")
+	c.SetStatus(202)
+}
+
+// maintenanceHookEndpoint continues the maintenance job; it is authorized by the continue token of the job
+// which is passed as token query string or X-Abb-Token header.
+func maintenanceHookEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	jobID := c.Param("job_id")
+	if len(jobID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "job_id parameter was invalid"})
 	}
 
-	serviceID := c.Param("service_id")
-	if len(serviceID) == 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	// the requests are counted by the client, so the callers without the token can't block the real continue signal
+	if !_webhookLimiter.Allow("maintenance:" + c.RemoteIPAddress()) {
+		panic(app.AppError{ErrorCode: "too_many_requests", Message: "too many requests of the webhook"})
 	}
 
-	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	token := c.Query("token")
+	if len(token) == 0 {
+		token = c.Request.Header.Get("X-Abb-Token")
+	}
+
+	job, err := ContinueMaintenanceJobByToken(jobID, token)
 	if err != nil {
 		panic(err)
 	}
 
-	if svc == nil {
-		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	cluster, err := clusterByID(ctx, job.ClusterID)
+	if err != nil {
+		panic(err)
+	}
+	if cluster != nil {
+		ctx = identity.NewContext(ctx, jwt.MapClaims{"sub": "maintenance-webhook"})
+		auditMaintenance(ctx, cluster.Name, jobID, "continue", "webhook")
 	}
 
-	c.JSON(200, svc)
+	c.SetStatus(202)
 }
 
-func serviceRedeployEndpoint(c *napnap.Context) {
+func capacityGetEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -933,47 +2657,68 @@ func serviceRedeployEndpoint(c *napnap.Context) {
 		panic(err)
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "nodes", Verb: "list"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	capacityManager, err := newCapacityManager(cluster)
 	if err != nil {
 		panic(err)
 	}
+	defer capacityManager.Close(ctx)
 
-	serviceID := c.Param("service_id")
-	if len(serviceID) <= 0 {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
+	capacity, err := capacityManager.Overview(ctx)
+	if err != nil {
+		panic(err)
 	}
 
-	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	c.JSON(200, capacity)
+}
+
+func capacityFitEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	var spec types.ServiceSpec
+	err := c.BindJSON(&spec)
 	if err != nil {
 		panic(err)
 	}
 
-	if svc == nil {
-		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
 	}
 
-	err = serviceManager.Redeploy(ctx, serviceID)
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
 	if err != nil {
 		panic(err)
 	}
 
-	// audit the action
-	claims, _ := identity.FromContext(ctx)
-	actor := claims["sub"].(string)
-	namespace := fmt.Sprintf("%s.services", clusterName)
-	event := &audit.Event{
-		Namespace: namespace,
-		TargetID:  serviceID,
-		Actor:     actor,
-		Action:    "redeploy",
-		State:     audit.SUCCESS,
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "nodes", Verb: "list"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
 	}
-	audit.Log(event)
 
-	c.SetStatus(200)
+	capacityManager, err := newCapacityManager(cluster)
+	if err != nil {
+		panic(err)
+	}
+	defer capacityManager.Close(ctx)
+
+	fit, err := capacityManager.Fit(ctx, spec)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(200, fit)
 }
 
-func serviceDeleteEndpoint(c *napnap.Context) {
+func serviceDiagnosisEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -986,50 +2731,47 @@ func serviceDeleteEndpoint(c *napnap.Context) {
 		panic(err)
 	}
 
-	if cluster == nil {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
-	}
-
 	serviceID := c.Param("service_id")
 	if len(serviceID) <= 0 {
 		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer serviceManager.DockerClient().Close()
 
-	svc, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	dockerService, err := serviceManager.ServiceRawByID(ctx, serviceID)
 	if err != nil {
 		panic(err)
 	}
-
-	if svc == nil {
+	if dockerService == nil {
 		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
 	}
 
-	err = serviceManager.ServiceDelete(ctx, serviceID)
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: dockerService.Spec.Name, Labels: dockerService.Spec.Labels, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	taskManager, err := newTaskManager(cluster)
 	if err != nil {
 		panic(err)
 	}
+	defer taskManager.Close(ctx)
 
-	// audit the action
-	claims, _ := identity.FromContext(ctx)
-	actor := claims["sub"].(string)
-	namespace := fmt.Sprintf("%s.services", clusterName)
-	event := &audit.Event{
-		Namespace: namespace,
-		TargetID:  serviceID,
-		Actor:     actor,
-		Action:    "delete",
-		State:     audit.SUCCESS,
+	diagnosis, err := taskManager.Diagnose(ctx, dockerService.ID)
+	if err != nil {
+		panic(err)
 	}
-	audit.Log(event)
-	c.SetStatus(204)
+
+	c.JSON(200, diagnosis)
 }
 
-func serviceCreateEndpoint(c *napnap.Context) {
+func serviceMetricsEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -1041,43 +2783,47 @@ func serviceCreateEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
-	if cluster == nil {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
+
+	serviceID := c.Param("service_id")
+	if len(serviceID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
-	if err != nil {
-		panic(err)
+	// only the samples of the last minutes are returned when since_in_min is set
+	since := time.Time{}
+	if sinceStr := c.Query("since_in_min"); len(sinceStr) > 0 {
+		sinceInMin, err := strconv.Atoi(sinceStr)
+		if err != nil || sinceInMin <= 0 {
+			panic(app.AppError{ErrorCode: "invalid_input", Message: "since_in_min parameter was invalid"})
+		}
+		since = time.Now().Add(-time.Duration(sinceInMin) * time.Minute)
 	}
 
-	var service types.Service
-	err = c.BindJSON(&service)
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer serviceManager.DockerClient().Close()
 
-	err = serviceManager.ServiceCreate(ctx, &service)
+	dockerService, err := serviceManager.ServiceRawByID(ctx, serviceID)
 	if err != nil {
 		panic(err)
 	}
+	if dockerService == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
 
-	// audit the action
-	claims, _ := identity.FromContext(ctx)
-	actor := claims["sub"].(string)
-	namespace := fmt.Sprintf("%s.services", clusterName)
-	event := &audit.Event{
-		Namespace: namespace,
-		TargetID:  service.Name,
-		Actor:     actor,
-		Action:    "create",
-		State:     audit.SUCCESS,
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: dockerService.Spec.Name, Labels: dockerService.Spec.Labels, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
 	}
-	audit.Log(event)
-	c.JSON(200, service)
 
+	c.JSON(200, getServiceMetrics(cluster, dockerService, since))
 }
 
-func serviceUpdateEndpoint(c *napnap.Context) {
+func serviceAutoscalingEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
 
 	clusterName := c.Param("cluster_name")
@@ -1089,60 +2835,86 @@ func serviceUpdateEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
-	if cluster == nil {
-		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster was not found"})
-	}
 
 	serviceID := c.Param("service_id")
 	if len(serviceID) <= 0 {
 		panic(app.AppError{ErrorCode: "invalid_input", Message: "service_id parameter was invalid"})
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
 	if err != nil {
 		panic(err)
 	}
+	defer serviceManager.DockerClient().Close()
 
-	oldService, err := serviceManager.ServiceGetByID(ctx, serviceID)
+	service, err := serviceManager.ServiceGetByID(ctx, serviceID)
 	if err != nil {
 		panic(err)
 	}
+	if service == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "service was not found"})
+	}
 
-	if oldService == nil {
-		panic(app.AppError{ErrorCode: "not_found", Message: "the service was not found"})
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: service.Name, Labels: service.Spec.Labels, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
 	}
 
-	var service types.Service
-	err = c.BindJSON(&service)
+	c.JSON(200, _autoscaler.status(cluster.ID, service))
+}
+
+func taskGetEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
 	if err != nil {
 		panic(err)
 	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
+	}
 
-	service.ID = oldService.ID
-	service.CreatedAt = oldService.CreatedAt
-	err = serviceManager.ServiceUpdate(ctx, &service)
+	taskID := c.Param("task_id")
+	if len(taskID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "task_id parameter was invalid"})
+	}
+
+	taskManager, err := newTaskManager(cluster)
 	if err != nil {
 		panic(err)
 	}
+	defer taskManager.Close(ctx)
 
-	// audit the action
-	claims, _ := identity.FromContext(ctx)
-	actor := claims["sub"].(string)
-	namespace := fmt.Sprintf("%s.services", clusterName)
-	event := &audit.Event{
-		Namespace: namespace,
-		TargetID:  serviceID,
-		Actor:     actor,
-		Action:    "save",
-		State:     audit.SUCCESS,
+	task, err := taskManager.Get(ctx, taskID)
+	if err != nil {
+		panic(err)
 	}
-	audit.Log(event)
-	c.JSON(200, service)
+	if task == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "task was not found"})
+	}
+
+	// check permission
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: task.ServiceName, Verb: "get"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	c.JSON(200, task)
 }
 
-func serviceListEndpoint(c *napnap.Context) {
+// taskExecEndpoint runs the command in the container of the task over websocket.  The command is passed by the
+// repeated command query string, such as ?command=/bin/sh&command=-c&command=ls, /bin/sh by default.
+func taskExecEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
-	pagination := app.GetPaginationFromContext(c)
+	logger := log.FromContext(ctx)
 
 	clusterName := c.Param("cluster_name")
 	if len(clusterName) <= 0 {
@@ -1157,86 +2929,143 @@ func serviceListEndpoint(c *napnap.Context) {
 		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
 	}
 
-	serviceManager, err := NewServiceManager(cluster, _serviceRepo)
+	taskID := c.Param("task_id")
+	if len(taskID) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "task_id parameter was invalid"})
+	}
+
+	taskManager, err := newTaskManager(cluster)
 	if err != nil {
 		panic(err)
 	}
+	defer taskManager.Close(ctx)
 
-	opts := types.ServiceFilterOptions{}
-	result, err := serviceManager.List(ctx, opts)
+	task, err := taskManager.Get(ctx, taskID)
 	if err != nil {
 		panic(err)
 	}
-
-	if len(result) == 0 {
-		result = []*types.Service{}
+	if task == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "task was not found"})
 	}
 
 	// check permission
-	claims, found := identity.FromContext(ctx)
-	if found == false {
-		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
-		panic(appError)
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: task.ServiceName, Verb: "exec"}
+	if !identity.IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	if task.State != string(swarm.TaskStateRunning) || len(task.ContainerID) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "task isn't running"})
+	}
+
+	opts := ExecOptions{
+		Command: c.Request.URL.Query()["command"],
+		User:    c.Query("user"),
+		Tty:     c.Query("tty") != "false",
+		Cols:    80,
+		Rows:    24,
+	}
+	if len(opts.Command) == 0 {
+		opts.Command = []string{"/bin/sh"}
+	}
+	if cols, err := strconv.Atoi(c.Query("cols")); err == nil && cols > 0 {
+		opts.Cols = uint(cols)
+	}
+	if rows, err := strconv.Atoi(c.Query("rows")); err == nil && rows > 0 {
+		opts.Rows = uint(rows)
 	}
-	roles := claims["roles"]
 
-	slicB, err := json.Marshal(roles)
+	dockerClient, owned, err := nodeDockerClient(ctx, cluster, taskManager.DockerClient(), task.NodeID)
 	if err != nil {
 		panic(err)
 	}
+	if owned {
+		defer dockerClient.Close()
+	}
 
-	var newRoles []*identity.Role
-	err = json.Unmarshal(slicB, &newRoles)
+	conn, err := _execUpgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		panic(err)
+		// the upgrader has written the error response
+		logger.Warnf("abb: upgrade exec websocket fail: %v", err)
+		return
 	}
+	defer conn.Close()
 
-	var serviceFound map[string]bool
-	serviceFound = make(map[string]bool)
+	sessionID := uuid.NewV4().String()
+	command := strings.Join(opts.Command, " ")
+	event := &audit.Event{
+		Namespace: fmt.Sprintf("%s.services", clusterName),
+		TargetID:  task.ServiceName,
+		Actor:     actorFromContext(ctx),
+		Action:    "exec",
+		State:     audit.SUCCESS,
+		Message:   fmt.Sprintf("session %s started: %s in task %s on %s", sessionID, command, task.ID, task.Node),
+	}
+	audit.Log(event)
 
-	resultService := []*types.Service{}
-	isValid := false
-	for _, role := range newRoles {
-		for _, rule := range role.Rules {
-			if rule.Namespace != "*" && rule.Namespace != clusterName {
-				continue
-			}
+	recorder, err := newExecRecorder(cluster.ID, task.ServiceName, sessionID, opts)
+	if err != nil {
+		logger.Errorf("abb: create exec recording fail: %v", err)
+	}
+	defer recorder.Close()
 
-			for _, res := range rule.Resources {
-				if res != "*" && res != "services" {
-					continue
-				}
-
-				for _, resName := range rule.ResourceNames {
-					for _, verb := range rule.Verbs {
-						if verb == "*" || verb == "list" {
-							log.Debugf("rule: %v", rule)
-							isValid = true
-							for _, service := range result {
-								if resName == "*" || service.Name == resName {
-									if _, find := serviceFound[service.Name]; !find {
-										resultService = append(resultService, service)
-										serviceFound[service.Name] = true
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
+	start := time.Now()
+	exitCode, err := runExecSession(ctx, conn, dockerClient, task.ContainerID, opts, recorder)
+	event.Message = fmt.Sprintf("session %s ended in %s with exit code %d: %s", sessionID, time.Since(start).Round(time.Second), exitCode, command)
+	if err != nil {
+		_ = conn.WriteJSON(execMessage{Type: "error", Data: err.Error()})
+		event.State = audit.FAILED
+		event.Message = fmt.Sprintf("session %s failed: %s: %v", sessionID, command, err)
+	}
+	audit.Log(event)
+}
+
+func execRecordingGetEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	clusterName := c.Param("cluster_name")
+	if len(clusterName) <= 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "cluster_name parameter was invalid"})
+	}
+
+	cluster, err := _clusterManager.ClusterByName(ctx, clusterName)
+	if err != nil {
+		panic(err)
+	}
+	if cluster == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "cluster doesn't exist"})
 	}
 
-	if isValid == false {
+	sessionID := c.Param("session_id")
+	if _, err := uuid.FromString(sessionID); err != nil || len(_config.Exec.RecordingDir) == 0 {
+		panic(app.AppError{ErrorCode: "not_found", Message: "recording was not found"})
+	}
+
+	serviceName, path, err := findExecRecording(cluster.ID, sessionID)
+	if err != nil {
+		panic(err)
+	}
+	if len(serviceName) == 0 {
+		panic(app.AppError{ErrorCode: "not_found", Message: "recording was not found"})
+	}
+
+	// the recordings may contain secrets typed in the sessions, so only who can exec into the service may replay them
+	req := identity.AccessRequest{Cluster: clusterName, Namespace: clusterName, Resource: "services", ResourceName: serviceName, Verb: "exec"}
+	if !identity.IsAllowed(ctx, req) {
 		c.SetStatus(403)
 		return
 	}
 
-	pagination.SetTotalCount(len(resultService))
-	apiResult := app.ApiPagiationResult{
-		Pagination: pagination,
-		Data:       resultService,
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			panic(app.AppError{ErrorCode: "not_found", Message: "recording was not found"})
+		}
+		panic(err)
 	}
 
-	c.JSON(200, apiResult)
+	c.Writer.Header().Set("Content-Type", "application/x-asciicast")
+	c.SetStatus(200)
+	c.Writer.Write(data)
 }
@@ -22,9 +22,19 @@ func (m *ErrorHandlingMiddleware) Invoke(c *napnap.Context, next napnap.HandlerF
 			// bad request.  http status code is 400 series.
 			appError, ok := r.(app.AppError)
 			if ok {
-				if appError.ErrorCode == "not_found" {
+				switch appError.ErrorCode {
+				case "not_found":
 					c.JSON(404, appError)
 					return
+				case "unauthorized":
+					c.JSON(401, appError)
+					return
+				case "forbidden":
+					c.JSON(403, appError)
+					return
+				case "too_many_requests":
+					c.JSON(429, appError)
+					return
 				}
 				c.JSON(400, appError)
 				return
@@ -0,0 +1,302 @@
+package abb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/gorilla/websocket"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+// The token is passed by the authorization header or query string instead of cookies, so the requests
+// from other origins can't ride on the session of the user.
+var _execUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// execMessage is the message of the exec websocket.  The client sends stdin and resize messages,
+// abb sends the output as binary messages and an exit message when the command ends.
+type execMessage struct {
+	Type     string `json:"type"` // stdin, resize, exit or error
+	Data     string `json:"data,omitempty"`
+	Cols     uint   `json:"cols,omitempty"`
+	Rows     uint   `json:"rows,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+type ExecOptions struct {
+	Command []string
+	User    string
+	Tty     bool
+	Cols    uint
+	Rows    uint
+}
+
+// nodeDockerClient returns the client of the docker daemon which runs the containers of the node.  The cluster
+// connection is used when it is the daemon of the node, otherwise the endpoint in the node label is used.
+// The caller closes the client when owned is true.
+func nodeDockerClient(ctx context.Context, cluster *types.Cluster, clusterClient *client.Client, nodeID string) (dockerClient *client.Client, owned bool, err error) {
+	info, err := clusterClient.Info(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Swarm.NodeID == nodeID {
+		return clusterClient, false, nil
+	}
+
+	node, _, err := clusterClient.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, false, app.AppError{ErrorCode: "not_found", Message: "node was not found"}
+		}
+		return nil, false, err
+	}
+
+	endpoint := node.Spec.Labels[_config.Exec.NodeEndpointLabel]
+	if len(endpoint) == 0 {
+		msg := fmt.Sprintf("node %s can't be reached, set its docker endpoint to the node label %s", node.Description.Hostname, _config.Exec.NodeEndpointLabel)
+		return nil, false, app.AppError{ErrorCode: "invalid_input", Message: msg}
+	}
+
+	dockerClient, err = newDockerClientWithHost(cluster.Name, endpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	return dockerClient, true, nil
+}
+
+// execRecorder records the output of the exec session as an asciicast v2 file, so it can be replayed by asciinema.
+type execRecorder struct {
+	mutex sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+func newExecRecorder(clusterID string, serviceName string, sessionID string, opts ExecOptions) (*execRecorder, error) {
+	if len(_config.Exec.RecordingDir) == 0 {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(execRecordingDir(clusterID, serviceName), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(execRecordingDir(clusterID, serviceName), filepath.Base(sessionID)+".cast"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &execRecorder{
+		file:  file,
+		start: time.Now(),
+	}
+
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     opts.Cols,
+		"height":    opts.Rows,
+		"timestamp": recorder.start.Unix(),
+		"command":   strings.Join(opts.Command, " "),
+	}
+	err = json.NewEncoder(file).Encode(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return recorder, nil
+}
+
+// execRecordingDir returns the directory of the recordings of the service, so the recordings are authorized by the
+// cluster and service they were recorded in.  The names can't contain slashes, so they can't escape the directory.
+func execRecordingDir(clusterID string, serviceName string) string {
+	return filepath.Join(_config.Exec.RecordingDir, filepath.Base(clusterID), filepath.Base(serviceName))
+}
+
+// findExecRecording returns the service and the file of the recording of the cluster, the service is empty when the
+// recording doesn't exist.
+func findExecRecording(clusterID string, sessionID string) (string, string, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(_config.Exec.RecordingDir, filepath.Base(clusterID)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		path := filepath.Join(execRecordingDir(clusterID, dir.Name()), filepath.Base(sessionID)+".cast")
+		_, err := os.Stat(path)
+		if err == nil {
+			return dir.Name(), path, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	return "", "", nil
+}
+
+func (r *execRecorder) record(eventType string, data string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	event := []interface{}{time.Since(r.start).Seconds(), eventType, data}
+	if err := json.NewEncoder(r.file).Encode(event); err != nil {
+		log.Errorf("abb: record exec session fail: %v", err)
+	}
+}
+
+func (r *execRecorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.file.Close()
+}
+
+// runExecSession runs the command in the container and streams it over the websocket until the command exits
+// or the client goes away.  It returns the exit code of the command.
+func runExecSession(ctx context.Context, conn *websocket.Conn, dockerClient *client.Client, containerID string, opts ExecOptions, recorder *execRecorder) (int, error) {
+	execConfig := dockerTypes.ExecConfig{
+		User:         opts.User,
+		Tty:          opts.Tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          opts.Command,
+	}
+	execResp, err := dockerClient.ContainerExecCreate(ctx, containerID, execConfig)
+	if err != nil {
+		return -1, err
+	}
+
+	hijacked, err := dockerClient.ContainerExecAttach(ctx, execResp.ID, dockerTypes.ExecStartCheck{Tty: opts.Tty})
+	if err != nil {
+		return -1, err
+	}
+	defer hijacked.Close()
+
+	if opts.Tty && opts.Cols > 0 && opts.Rows > 0 {
+		_ = dockerClient.ContainerExecResize(ctx, execResp.ID, dockerTypes.ResizeOptions{Width: opts.Cols, Height: opts.Rows})
+	}
+
+	// output: only this goroutine writes to the websocket until the command ends
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+
+		write := func(data []byte) error {
+			recorder.record("o", string(data))
+			return conn.WriteMessage(websocket.BinaryMessage, data)
+		}
+
+		if opts.Tty {
+			buf := make([]byte, 4096)
+			for {
+				n, err := hijacked.Reader.Read(buf)
+				if n > 0 {
+					if writeErr := write(buf[:n]); writeErr != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		_ = demuxExecOutput(hijacked.Reader, write)
+	}()
+
+	// input: the client closes the websocket to end the session
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				hijacked.Close()
+				return
+			}
+
+			msg := execMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+
+			switch msg.Type {
+			case "stdin":
+				recorder.record("i", msg.Data)
+				if _, err := hijacked.Conn.Write([]byte(msg.Data)); err != nil {
+					return
+				}
+			case "resize":
+				if opts.Tty && msg.Cols > 0 && msg.Rows > 0 {
+					_ = dockerClient.ContainerExecResize(ctx, execResp.ID, dockerTypes.ResizeOptions{Width: msg.Cols, Height: msg.Rows})
+				}
+			}
+		}
+	}()
+
+	<-outputDone
+
+	exitCode := -1
+	inspect, err := dockerClient.ContainerExecInspect(ctx, execResp.ID)
+	if err == nil && !inspect.Running {
+		exitCode = inspect.ExitCode
+	}
+
+	_ = conn.WriteJSON(execMessage{Type: "exit", ExitCode: exitCode})
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return exitCode, nil
+}
+
+// demuxExecOutput splits the stdout and stderr which docker multiplexes when there is no tty.
+// Each frame has an 8 bytes header: the stream, 3 bytes of padding and the big endian size of the payload.
+func demuxExecOutput(reader *bufio.Reader, write func(data []byte) error) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return err
+		}
+
+		size := binary.BigEndian.Uint32(header[4:])
+		payload := make([]byte, size)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return err
+		}
+
+		err = write(payload)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package abb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindExecRecordingIsScopedByCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordingDir := _config.Exec.RecordingDir
+	_config.Exec.RecordingDir = dir
+	t.Cleanup(func() {
+		_config.Exec.RecordingDir = recordingDir
+		os.RemoveAll(dir)
+	})
+
+	sessionID := "0b5c2c6e-4d3c-4f4e-9c4a-7b9d1c2e3f40"
+	recorder, err := newExecRecorder("prod", "payments", sessionID, ExecOptions{Command: []string{"/bin/sh"}, Cols: 80, Rows: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+
+	serviceName, path, err := findExecRecording("prod", sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serviceName != "payments" || path != filepath.Join(dir, "prod", "payments", sessionID+".cast") {
+		t.Errorf("expected the recording of payments, got %s %s", serviceName, path)
+	}
+
+	// the recordings of prod can't be found through the other clusters
+	serviceName, _, err = findExecRecording("dev", sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serviceName) > 0 {
+		t.Errorf("expected no recording in dev, got %s", serviceName)
+	}
+}
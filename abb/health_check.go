@@ -107,7 +107,7 @@ func (repo *HealthCheckDAO) Find(ctx context.Context, opts types.HealthCheckFilt
 	if opts.IsEnabled > -1 {
 		findSQL += " And is_enabled = :is_enabled"
 		param["is_enabled"] = opts.IsEnabled
-		logger.Debugf("abb: find healthcheck: isEnabled: %s", opts.IsEnabled)
+		logger.Debugf("abb: find healthcheck: isEnabled: %d", opts.IsEnabled)
 	}
 
 	healthCheckList := []*types.HealthCheck{}
@@ -165,9 +165,11 @@ func EnableHealthCheck() {
 			failedCount := 0
 			for _ = range ticker.C {
 				log.Debugf("healthcheck: %s", h.Name)
+				start := time.Now()
 				resp, err := request.
 					GET(h.URL).
 					End()
+				_healthCheckDuration.Observe(time.Since(start).Seconds(), h.Name)
 
 				if err != nil {
 					log.Errorf("abb: healthcheck failed: %s, err: %v", h.Name, err)
@@ -176,8 +178,12 @@ func EnableHealthCheck() {
 
 				if resp != nil && resp.OK {
 					failedCount = 0
+					_healthCheckProbes.Inc(h.Name, "success")
+					_healthCheckUp.Set(1, h.Name)
 				} else {
 					failedCount++
+					_healthCheckProbes.Inc(h.Name, "failure")
+					_healthCheckUp.Set(0, h.Name)
 				}
 
 				if h.IsHealth && failedCount >= 3 {
@@ -0,0 +1,391 @@
+package abb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/docker/distribution/reference"
+	"github.com/jasonsoft/abb/identity"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+// imageWatcherActor is the actor of the deployments made by the image watcher
+const imageWatcherActor = "image-watcher"
+
+// EnableImageWatcher polls the registries and handles the new images of the services whose update policy isn't manual.
+func EnableImageWatcher() {
+	interval := _config.Registry.WatchIntervalInSec
+	if interval <= 0 {
+		return
+	}
+
+	watcher := &imageWatcher{
+		handled: map[string]string{},
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for range ticker.C {
+		watcher.run()
+	}
+}
+
+type imageWatcher struct {
+	mu      sync.Mutex
+	handled map[string]string // service id => the last new image which was notified or deployed
+}
+
+func (w *imageWatcher) run() {
+	ctx := identity.NewContext(context.Background(), jwt.MapClaims{"sub": imageWatcherActor})
+
+	clusters, err := _clusterManager.ClusterList(ctx)
+	if err != nil {
+		log.Errorf("abb: image watcher lists clusters fail: %v", err)
+		return
+	}
+
+	for _, cluster := range clusters {
+		w.watchCluster(ctx, cluster)
+	}
+}
+
+func (w *imageWatcher) watchCluster(ctx context.Context, cluster *types.Cluster) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("abb: image watcher on cluster %s fail: %v", cluster.Name, r)
+		}
+	}()
+
+	manager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		log.Errorf("abb: image watcher on cluster %s fail: %v", cluster.Name, err)
+		return
+	}
+
+	services, err := manager.List(ctx, types.ServiceFilterOptions{})
+	if err != nil {
+		log.Errorf("abb: image watcher on cluster %s fail: %v", cluster.Name, err)
+		return
+	}
+
+	var credentials []*types.RegistryCredential
+	for _, service := range services {
+		mode := service.Spec.UpdatePolicy.Mode
+		if mode != types.UpdatePolicyNotify && mode != types.UpdatePolicyAuto {
+			continue
+		}
+
+		if credentials == nil {
+			credentials, err = loadRegistryCredentials(ctx, _credentialRepo, cluster.ID)
+			if err != nil {
+				return
+			}
+		}
+
+		err = w.watchService(ctx, cluster, manager, newRegistryClient(credentials), service)
+		if err != nil {
+			log.Warnf("abb: image watcher on service %s fail: %v", service.Name, err)
+		}
+	}
+}
+
+func (w *imageWatcher) watchService(ctx context.Context, cluster *types.Cluster, manager types.ServiceService, registry *registryClient, service *types.Service) error {
+	newImage, err := findNewImage(ctx, registry, service)
+	if err != nil {
+		return err
+	}
+	if len(newImage) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	if w.handled[service.ID] == newImage {
+		w.mu.Unlock()
+		return nil
+	}
+	w.handled[service.ID] = newImage
+	w.mu.Unlock()
+
+	if service.Spec.UpdatePolicy.Mode == types.UpdatePolicyNotify {
+		sendSlackMessage(fmt.Sprintf("new image %s is available for the service %s on the cluster %s", newImage, service.Name, cluster.Name))
+		return nil
+	}
+
+	// the digest is pinned by redeploy, so only the tag is stored
+	image := newImage
+	if idx := strings.LastIndex(image, "@"); idx >= 0 {
+		image = image[:idx]
+	}
+	if image != service.Spec.Image {
+		service.Spec.Image = image
+		err = manager.ServiceUpdate(ctx, service)
+		if err != nil {
+			w.forget(service.ID, newImage)
+			return err
+		}
+	}
+
+	err = manager.Redeploy(ctx, service.ID, types.RedeployOptions{CreateNetworks: _config.Network.AutoCreate})
+	if err != nil {
+		// the image is deployed again on the next check
+		w.forget(service.ID, newImage)
+		sendSlackMessage(fmt.Sprintf("service %s on the cluster %s fails to update to %s: %v", service.Name, cluster.Name, newImage, err))
+		return err
+	}
+
+	sendSlackMessage(fmt.Sprintf("service %s on the cluster %s was updated to %s", service.Name, cluster.Name, newImage))
+	return nil
+}
+
+// forget removes the image from the handled images when the deployment fails.
+func (w *imageWatcher) forget(serviceID string, image string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.handled[serviceID] == image {
+		delete(w.handled, serviceID)
+	}
+}
+
+// findNewImage returns the newer matching tag of the service image, or the current tag with its new digest.
+// An empty string is returned when the service is up to date.
+func findNewImage(ctx context.Context, registry *registryClient, service *types.Service) (string, error) {
+	named, err := reference.ParseNormalizedNamed(service.Spec.Image)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := named.(reference.Digested); ok {
+		// the image is pinned by the user
+		return "", nil
+	}
+
+	named = reference.TagNameOnly(named)
+	currentTag := named.(reference.Tagged).Tag()
+	repository := reference.TrimNamed(named)
+
+	policy := service.Spec.UpdatePolicy
+	if len(policy.FilterType) > 0 {
+		newTag, err := findNewerTag(ctx, registry, repository, currentTag, policy)
+		if err != nil {
+			return "", err
+		}
+		if len(newTag) > 0 {
+			return reference.FamiliarName(repository) + ":" + newTag, nil
+		}
+	}
+
+	// the current tag was pushed again
+	runningDigest := service.DeploymentStatus.Digest
+	if len(runningDigest) == 0 {
+		return "", nil
+	}
+	_, dgst, err := registry.ResolveDigest(ctx, reference.FamiliarString(named))
+	if err != nil {
+		return "", err
+	}
+	if dgst.String() == runningDigest {
+		return "", nil
+	}
+	return reference.FamiliarString(named) + "@" + dgst.String(), nil
+}
+
+func findNewerTag(ctx context.Context, registry *registryClient, repository reference.Named, currentTag string, policy types.UpdatePolicy) (string, error) {
+	names, err := registry.TagNames(ctx, repository)
+	if err != nil {
+		return "", err
+	}
+
+	switch policy.FilterType {
+	case types.UpdateFilterSemver:
+		current, ok := parseSemver(currentTag)
+		if !ok {
+			return "", fmt.Errorf("tag %s isn't a semantic version", currentTag)
+		}
+
+		newTag := ""
+		latest := current
+		for _, name := range names {
+			version, ok := parseSemver(name)
+			if !ok || !version.match(policy.Filter) {
+				continue
+			}
+			if version.compare(latest) > 0 {
+				latest = version
+				newTag = name
+			}
+		}
+		return newTag, nil
+	case types.UpdateFilterRegex:
+		pattern, err := regexp.Compile(policy.Filter)
+		if err != nil {
+			return "", err
+		}
+
+		matched := []string{currentTag}
+		for _, name := range names {
+			if name != currentTag && pattern.MatchString(name) {
+				matched = append(matched, name)
+			}
+		}
+		if len(matched) == 1 {
+			return "", nil
+		}
+
+		var current *types.ImageTag
+		tags := registry.describeTags(ctx, repository, matched)
+		for _, tag := range tags {
+			if tag.Name == currentTag {
+				current = tag
+			}
+		}
+
+		// tags are sorted by the creation time, so the first one is the newest
+		newest := tags[0]
+		if newest.Name == currentTag || newest.CreatedAt == nil {
+			return "", nil
+		}
+		if current != nil && current.CreatedAt != nil && !newest.CreatedAt.After(*current.CreatedAt) {
+			return "", nil
+		}
+		return newest.Name, nil
+	}
+
+	return "", fmt.Errorf("unknown filter type: %s", policy.FilterType)
+}
+
+type semver struct {
+	major      int
+	minor      int
+	patch      int
+	prerelease string
+}
+
+// parseSemver parses versions such as "1.2.3", "v1.2" and "1.2.3-rc.1"; the build metadata is ignored.
+func parseSemver(s string) (semver, bool) {
+	result := semver{}
+
+	s = strings.TrimPrefix(s, "v")
+	if idx := strings.Index(s, "+"); idx >= 0 {
+		s = s[:idx]
+	}
+	if idx := strings.Index(s, "-"); idx >= 0 {
+		result.prerelease = s[idx+1:]
+		s = s[:idx]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return result, false
+	}
+	numbers := []*int{&result.major, &result.minor, &result.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return result, false
+		}
+		*numbers[i] = n
+	}
+
+	return result, true
+}
+
+func (v semver) compare(other semver) int {
+	switch {
+	case v.major != other.major:
+		return compareInt(v.major, other.major)
+	case v.minor != other.minor:
+		return compareInt(v.minor, other.minor)
+	case v.patch != other.patch:
+		return compareInt(v.patch, other.patch)
+	case v.prerelease == other.prerelease:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(other.prerelease) == 0:
+		return -1
+	}
+	return comparePrerelease(v.prerelease, other.prerelease)
+}
+
+// comparePrerelease compares the dot separated identifiers as SemVer 11 describes: numeric identifiers are
+// compared numerically and have lower precedence than alphanumeric ones, a larger set of identifiers has higher
+// precedence when the preceding identifiers are equal.
+func comparePrerelease(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] == bParts[i] {
+			continue
+		}
+		aNumber, aErr := strconv.Atoi(aParts[i])
+		bNumber, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNumber != bNumber {
+				return compareInt(aNumber, bNumber)
+			}
+			// leading zeros such as "01" aren't valid semver, the strings decide
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		}
+		return strings.Compare(aParts[i], bParts[i])
+	}
+	if len(aParts) == len(bParts) {
+		return 0
+	}
+	return compareInt(len(aParts), len(bParts))
+}
+
+// match checks the version against a range such as "1.x", "1.2", "^1.2.0", "~1.2.0" or ">=1.2.0".
+// Prereleases only match a range which contains a prerelease.
+func (v semver) match(constraint string) bool {
+	constraint = strings.TrimSpace(constraint)
+	if len(v.prerelease) > 0 && !strings.Contains(constraint, "-") {
+		return false
+	}
+
+	switch {
+	case len(constraint) == 0 || constraint == "*" || constraint == "x":
+		return true
+	case strings.HasPrefix(constraint, ">="):
+		base, ok := parseSemver(strings.TrimSpace(constraint[2:]))
+		return ok && v.compare(base) >= 0
+	case strings.HasPrefix(constraint, "^"):
+		base, ok := parseSemver(constraint[1:])
+		return ok && v.major == base.major && v.compare(base) >= 0
+	case strings.HasPrefix(constraint, "~"):
+		base, ok := parseSemver(constraint[1:])
+		return ok && v.major == base.major && v.minor == base.minor && v.compare(base) >= 0
+	}
+
+	// the given parts must be equal, "x" and "*" match any number
+	numbers := []int{v.major, v.minor, v.patch}
+	parts := strings.Split(strings.TrimPrefix(constraint, "v"), ".")
+	if len(parts) > 3 {
+		return false
+	}
+	for i, part := range parts {
+		if part == "x" || part == "*" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n != numbers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareInt(a, b int) int {
+	if a > b {
+		return 1
+	}
+	return -1
+}
@@ -0,0 +1,98 @@
+package abb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/abb/types"
+)
+
+func TestSemverCompare(t *testing.T) {
+	testCases := []struct {
+		a      string
+		b      string
+		result int
+	}{
+		{a: "1.2.3", b: "1.2.3", result: 0},
+		{a: "1.10.0", b: "1.9.0", result: 1},
+		{a: "1.0.0-rc.1", b: "1.0.0", result: -1},
+		{a: "1.0.0-rc.10", b: "1.0.0-rc.9", result: 1},
+		{a: "1.0.0-alpha", b: "1.0.0-alpha.1", result: -1},
+		{a: "1.0.0-alpha.1", b: "1.0.0-alpha.beta", result: -1},
+		{a: "1.0.0-beta.11", b: "1.0.0-beta.2", result: 1},
+		{a: "1.0.0-beta", b: "1.0.0-alpha.beta", result: 1},
+	}
+
+	for _, tc := range testCases {
+		a, ok := parseSemver(tc.a)
+		if !ok {
+			t.Fatalf("failed to parse %s", tc.a)
+		}
+		b, ok := parseSemver(tc.b)
+		if !ok {
+			t.Fatalf("failed to parse %s", tc.b)
+		}
+		if result := a.compare(b); result != tc.result {
+			t.Errorf("expected %s compared to %s to be %d, got %d", tc.a, tc.b, tc.result, result)
+		}
+	}
+}
+
+type fakeServiceManager struct {
+	types.ServiceService
+	redeployErr error
+	redeployed  int
+}
+
+func (m *fakeServiceManager) ServiceUpdate(ctx context.Context, target *types.Service) error {
+	return nil
+}
+
+func (m *fakeServiceManager) Redeploy(ctx context.Context, serviceName string, opts types.RedeployOptions) error {
+	m.redeployed++
+	return m.redeployErr
+}
+
+func TestImageWatcherRetriesFailedRedeploy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", testManifestDigest)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	service := &types.Service{ID: "svc", Name: "myapp"}
+	service.Spec.Image = host + "/myapp:1.0"
+	service.Spec.UpdatePolicy.Mode = types.UpdatePolicyAuto
+	service.DeploymentStatus.Digest = "sha256:old"
+
+	watcher := &imageWatcher{handled: map[string]string{}}
+	manager := &fakeServiceManager{redeployErr: errors.New("swarm is down")}
+	cluster := &types.Cluster{Name: "dev"}
+
+	err := watcher.watchService(context.Background(), cluster, manager, newTestRegistryClient(), service)
+	if err == nil {
+		t.Fatal("expected the redeploy error")
+	}
+
+	manager.redeployErr = nil
+	err = watcher.watchService(context.Background(), cluster, manager, newTestRegistryClient(), service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.redeployed != 2 {
+		t.Errorf("expected the image to be deployed again after the failure, got %d redeploys", manager.redeployed)
+	}
+
+	// the deployed image isn't handled again
+	err = watcher.watchService(context.Background(), cluster, manager, newTestRegistryClient(), service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.redeployed != 2 {
+		t.Errorf("expected the deployed image to be skipped, got %d redeploys", manager.redeployed)
+	}
+}
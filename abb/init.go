@@ -1,10 +1,13 @@
 package abb
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jasonsoft/abb/app"
 	"github.com/jasonsoft/abb/config"
+	"github.com/jasonsoft/abb/identity"
 	"github.com/jasonsoft/abb/types"
 	"github.com/nlopes/slack"
 	mgo "gopkg.in/mgo.v2"
@@ -14,10 +17,14 @@ var (
 	_config         *config.Configuration
 	_clusterManager types.ClusterService
 	_slack          *slack.RTM
+	_webhookLimiter *app.RateLimiter
 
 	// repository
 	_serviceRepo     types.ServiceRepository
 	_healthCheckRepo types.HealthCheckerRepository
+	_deploymentRepo  types.DeploymentRepository
+	_credentialRepo  types.RegistryCredentialRepository
+	_webhookRepo     types.WebhookRepository
 
 	_mongoSession *mgo.Session
 )
@@ -32,6 +39,16 @@ func init() {
 
 	go _slack.ManageConnection()
 
+	_webhookLimiter = app.NewRateLimiter(_config.Webhook.RateLimitPerMin, time.Minute)
+
+	identity.OnAccountLocked(func(username string, lockedUntil *time.Time) {
+		if lockedUntil == nil {
+			sendSlackMessage(fmt.Sprintf("account %s was locked by too many failed logins", username))
+			return
+		}
+		sendSlackMessage(fmt.Sprintf("account %s was locked by too many failed logins until %s", username, lockedUntil.Format(time.RFC3339)))
+	})
+
 	var err error
 
 	switch strings.ToLower(_config.Database.Type) {
@@ -44,6 +61,9 @@ func init() {
 
 		_serviceRepo = newServiceDAO(dbx)
 		_healthCheckRepo = newHealthChecker(dbx)
+		_deploymentRepo = newDeploymentDAO(dbx)
+		_credentialRepo = newRegistryCredentialDAO(dbx)
+		_webhookRepo = newWebhookDAO(dbx)
 	case "mongo":
 		_mongoSession, err = mgo.Dial(_config.Database.ConnectionString)
 		if err != nil {
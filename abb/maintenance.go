@@ -0,0 +1,427 @@
+package abb
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+// The maintenance jobs live in memory; a job which is running when abb restarts is lost and the node
+// in maintenance stays drained until it is activated again.
+var (
+	_maintenanceMutex sync.Mutex
+	_maintenanceJobs  = map[string]*maintenanceRunner{}
+)
+
+type maintenanceRunner struct {
+	job     *types.MaintenanceJob
+	cluster *types.Cluster
+	resume  chan struct{}
+	abort   chan struct{}
+	aborted bool
+}
+
+// StartMaintenanceJob validates the nodes and starts to drain them one at a time in the background.
+// The returned job is the only one which contains the continue token.
+func StartMaintenanceJob(ctx context.Context, cluster *types.Cluster, target types.MaintenanceJob) (*types.MaintenanceJob, error) {
+	job := &target
+	if len(job.NodeIDs) == 0 {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "node_ids can't be empty"}
+	}
+	if job.TimeoutInSec <= 0 {
+		job.TimeoutInSec = 600
+	}
+
+	nodeManager, err := newNodeManager(cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer nodeManager.Close(ctx)
+
+	nodes := []*types.MaintenanceNode{}
+	seen := map[string]bool{}
+	for _, nodeID := range job.NodeIDs {
+		node, _, err := nodeManager.DockerClient().NodeInspectWithRaw(ctx, nodeID)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				return nil, app.AppError{ErrorCode: "not_found", Message: fmt.Sprintf("node %s was not found", nodeID)}
+			}
+			return nil, err
+		}
+		if seen[node.ID] {
+			continue
+		}
+		seen[node.ID] = true
+
+		nodes = append(nodes, &types.MaintenanceNode{
+			ID:       node.ID,
+			Hostname: node.Description.Hostname,
+			State:    types.MaintenanceNodePending,
+			Services: []string{},
+		})
+	}
+
+	token, err := app.RandomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	for _, runner := range _maintenanceJobs {
+		if runner.job.ClusterID == cluster.ID && runner.job.State == types.MaintenanceStateRunning {
+			return nil, app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("maintenance job %s is still running on the cluster", runner.job.ID)}
+		}
+	}
+
+	now := time.Now().UTC()
+	job.ID = uuid.NewV4().String()
+	job.ClusterID = cluster.ID
+	job.State = types.MaintenanceStateRunning
+	job.Nodes = nodes
+	job.Current = 0
+	job.ContinueToken = token
+	job.Actor = actorFromContext(ctx)
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	runner := &maintenanceRunner{
+		job:     job,
+		cluster: cluster,
+		resume:  make(chan struct{}, 1),
+		abort:   make(chan struct{}),
+	}
+	_maintenanceJobs[job.ID] = runner
+
+	result := copyMaintenanceJob(job)
+	result.ContinueToken = token
+
+	go runner.run()
+	return result, nil
+}
+
+// copyMaintenanceJob returns a snapshot of the job without the continue token; the caller must hold the mutex.
+func copyMaintenanceJob(job *types.MaintenanceJob) *types.MaintenanceJob {
+	result := *job
+	result.ContinueToken = ""
+	result.Nodes = []*types.MaintenanceNode{}
+	for _, node := range job.Nodes {
+		nodeCopy := *node
+		result.Nodes = append(result.Nodes, &nodeCopy)
+	}
+	return &result
+}
+
+func GetMaintenanceJob(clusterID, jobID string) *types.MaintenanceJob {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	runner, found := _maintenanceJobs[jobID]
+	if !found || runner.job.ClusterID != clusterID {
+		return nil
+	}
+	return copyMaintenanceJob(runner.job)
+}
+
+func ListMaintenanceJobs(clusterID string) []*types.MaintenanceJob {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	result := []*types.MaintenanceJob{}
+	for _, runner := range _maintenanceJobs {
+		if runner.job.ClusterID == clusterID {
+			result = append(result, copyMaintenanceJob(runner.job))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+// ContinueMaintenanceJob signals the job that the node in maintenance is ready to be activated again.
+func ContinueMaintenanceJob(clusterID, jobID string) error {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	runner, found := _maintenanceJobs[jobID]
+	if !found || runner.job.ClusterID != clusterID {
+		return app.AppError{ErrorCode: "not_found", Message: "maintenance job was not found"}
+	}
+	return runner.signalContinue()
+}
+
+// ContinueMaintenanceJobByToken is used by the webhook, which is authorized by the continue token instead of jwt.
+func ContinueMaintenanceJobByToken(jobID, token string) (*types.MaintenanceJob, error) {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	runner, found := _maintenanceJobs[jobID]
+	if !found || len(token) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(runner.job.ContinueToken)) != 1 {
+		return nil, app.AppError{ErrorCode: "unauthorized", Message: "maintenance job or token was invalid"}
+	}
+
+	err := runner.signalContinue()
+	if err != nil {
+		return nil, err
+	}
+	return copyMaintenanceJob(runner.job), nil
+}
+
+func (r *maintenanceRunner) signalContinue() error {
+	if r.job.State != types.MaintenanceStateRunning || r.job.Nodes[r.job.Current].State != types.MaintenanceNodeWaiting {
+		return app.AppError{ErrorCode: "invalid_input", Message: "maintenance job isn't waiting for the continue signal"}
+	}
+
+	select {
+	case r.resume <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// AbortMaintenanceJob stops the job.  The node in maintenance is left as it is, because it may be in the middle of patching.
+func AbortMaintenanceJob(clusterID, jobID string) error {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	runner, found := _maintenanceJobs[jobID]
+	if !found || runner.job.ClusterID != clusterID {
+		return app.AppError{ErrorCode: "not_found", Message: "maintenance job was not found"}
+	}
+	if runner.job.State != types.MaintenanceStateRunning {
+		return app.AppError{ErrorCode: "invalid_input", Message: "maintenance job isn't running"}
+	}
+	if !runner.aborted {
+		runner.aborted = true
+		close(runner.abort)
+	}
+	return nil
+}
+
+func (r *maintenanceRunner) update(change func(job *types.MaintenanceJob)) {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+
+	change(r.job)
+	r.job.UpdatedAt = time.Now().UTC()
+}
+
+func (r *maintenanceRunner) finish(state, message string) {
+	r.update(func(job *types.MaintenanceJob) {
+		now := time.Now().UTC()
+		job.State = state
+		job.Message = message
+		job.FinishedAt = &now
+	})
+	sendSlackMessage(fmt.Sprintf("maintenance job %s on the cluster %s %s: %s", r.job.ID, r.cluster.Name, state, message))
+}
+
+func (r *maintenanceRunner) failNode(node *types.MaintenanceNode, err error) {
+	r.update(func(job *types.MaintenanceJob) {
+		node.State = types.MaintenanceNodeFailed
+		node.Message = err.Error()
+	})
+	r.finish(types.MaintenanceStateFailed, fmt.Sprintf("node %s: %v", node.Hostname, err))
+}
+
+func (r *maintenanceRunner) run() {
+	ctx := context.Background()
+	logger := log.FromContext(ctx)
+
+	nodeManager, err := newNodeManager(r.cluster)
+	if err != nil {
+		logger.Errorf("abb: maintenance job %s fail: %v", r.job.ID, err)
+		r.finish(types.MaintenanceStateFailed, err.Error())
+		return
+	}
+	defer nodeManager.Close(ctx)
+
+	for idx, node := range r.job.Nodes {
+		r.update(func(job *types.MaintenanceJob) {
+			now := time.Now().UTC()
+			job.Current = idx
+			node.State = types.MaintenanceNodeDraining
+			node.StartedAt = &now
+		})
+		sendSlackMessage(fmt.Sprintf("maintenance job %s: draining node %s on the cluster %s", r.job.ID, node.Hostname, r.cluster.Name))
+
+		services, err := servicesOnNode(ctx, nodeManager.DockerClient(), node.ID)
+		if err != nil {
+			r.failNode(node, err)
+			return
+		}
+		r.update(func(job *types.MaintenanceJob) {
+			for _, svc := range services {
+				node.Services = append(node.Services, svc.Spec.Name)
+			}
+		})
+
+		_, err = nodeManager.SetAvailability(ctx, node.ID, types.NodeAvailabilityUpdate{Availability: string(swarm.NodeAvailabilityDrain)})
+		if err != nil {
+			r.failNode(node, err)
+			return
+		}
+
+		err = r.waitForServices(ctx, nodeManager.DockerClient(), node.ID, services)
+		if err != nil {
+			if r.isAborted() {
+				r.finish(types.MaintenanceStateAborted, fmt.Sprintf("node %s was left drained", node.Hostname))
+				return
+			}
+			r.failNode(node, err)
+			return
+		}
+
+		r.update(func(job *types.MaintenanceJob) {
+			node.State = types.MaintenanceNodeWaiting
+		})
+		sendSlackMessage(fmt.Sprintf("maintenance job %s: node %s on the cluster %s is drained and ready for maintenance, continue the job when it is done", r.job.ID, node.Hostname, r.cluster.Name))
+
+		select {
+		case <-r.resume:
+		case <-r.abort:
+			r.finish(types.MaintenanceStateAborted, fmt.Sprintf("node %s was left drained", node.Hostname))
+			return
+		}
+
+		r.update(func(job *types.MaintenanceJob) {
+			node.State = types.MaintenanceNodeReactivating
+		})
+		_, err = nodeManager.SetAvailability(ctx, node.ID, types.NodeAvailabilityUpdate{Availability: string(swarm.NodeAvailabilityActive)})
+		if err != nil {
+			r.failNode(node, err)
+			return
+		}
+
+		r.update(func(job *types.MaintenanceJob) {
+			now := time.Now().UTC()
+			node.State = types.MaintenanceNodeDone
+			node.DoneAt = &now
+		})
+		sendSlackMessage(fmt.Sprintf("maintenance job %s: node %s on the cluster %s is active again", r.job.ID, node.Hostname, r.cluster.Name))
+
+		if r.isAborted() {
+			r.finish(types.MaintenanceStateAborted, fmt.Sprintf("aborted after node %s", node.Hostname))
+			return
+		}
+	}
+
+	r.finish(types.MaintenanceStateCompleted, fmt.Sprintf("%d nodes were maintained", len(r.job.Nodes)))
+}
+
+func (r *maintenanceRunner) isAborted() bool {
+	_maintenanceMutex.Lock()
+	defer _maintenanceMutex.Unlock()
+	return r.aborted
+}
+
+// servicesOnNode returns the services which have running tasks on the node
+func servicesOnNode(ctx context.Context, dockerClient *client.Client, nodeID string) ([]swarm.Service, error) {
+	taskFilters := filters.NewArgs()
+	taskFilters.Add("node", nodeID)
+	taskFilters.Add("desired-state", "running")
+	tasks, err := dockerClient.TaskList(ctx, dockerTypes.TaskListOptions{Filters: taskFilters})
+	if err != nil {
+		return nil, err
+	}
+
+	serviceIDs := map[string]bool{}
+	for _, task := range tasks {
+		serviceIDs[task.ServiceID] = true
+	}
+
+	dockerServices, err := dockerClient.ServiceList(ctx, dockerTypes.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []swarm.Service{}
+	for _, svc := range dockerServices {
+		if serviceIDs[svc.ID] {
+			result = append(result, svc)
+		}
+	}
+	return result, nil
+}
+
+// waitForServices blocks until every service has all its replicas running on the other nodes.
+func (r *maintenanceRunner) waitForServices(ctx context.Context, dockerClient *client.Client, nodeID string, services []swarm.Service) error {
+	deadline := time.Now().Add(time.Duration(r.job.TimeoutInSec) * time.Second)
+
+	for {
+		pending, err := unconvergedServices(ctx, dockerClient, nodeID, services)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("services %v didn't reconverge in %d seconds", pending, r.job.TimeoutInSec)
+		}
+
+		select {
+		case <-r.abort:
+			return fmt.Errorf("maintenance job was aborted")
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// unconvergedServices returns the names of the services whose available replicas don't equal the replicas,
+// or which still run tasks on the drained node.
+func unconvergedServices(ctx context.Context, dockerClient *client.Client, nodeID string, services []swarm.Service) ([]string, error) {
+	nodeList, err := dockerClient.NodeList(ctx, dockerTypes.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	dockerSvcList, err := dockerClient.ServiceList(ctx, dockerTypes.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	taskList, err := dockerClient.TaskList(ctx, dockerTypes.TaskListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	statusList := getServicesStatus(dockerSvcList, nodeList, taskList)
+
+	result := []string{}
+	for _, svc := range services {
+		status, found := statusList[svc.ID]
+		if !found {
+			// the service was removed in the meantime
+			continue
+		}
+
+		runningOnNode := false
+		for _, task := range taskList {
+			if task.ServiceID == svc.ID && task.NodeID == nodeID && task.Status.State == swarm.TaskStateRunning {
+				runningOnNode = true
+				break
+			}
+		}
+
+		if runningOnNode || status.AvailableReplicas != status.Replicas {
+			result = append(result, status.ServiceName)
+		}
+	}
+	return result, nil
+}
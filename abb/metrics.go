@@ -0,0 +1,342 @@
+package abb
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/identity"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+// metricsCollectorActor is the actor of the requests made by the metrics collector
+const metricsCollectorActor = "metrics-collector"
+
+var _metricsStore = &metricsStore{
+	tasks: map[string]*taskSeries{},
+}
+
+// EnableMetricsCollector polls the stats of the task containers of every cluster and keeps them in memory.
+func EnableMetricsCollector() {
+	interval := _config.Metrics.CollectIntervalInSec
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for range ticker.C {
+		collectMetrics(time.Duration(interval) * time.Second)
+	}
+}
+
+// taskSeries is the samples of a task container, the task id is unique across the clusters.
+type taskSeries struct {
+	clusterID   string
+	serviceID   string
+	taskID      string
+	nodeID      string
+	slot        int
+	containerID string
+	samples     []types.ResourceSample
+}
+
+type metricsStore struct {
+	mutex sync.RWMutex
+	tasks map[string]*taskSeries
+}
+
+func (s *metricsStore) add(clusterID string, task swarm.Task, sample types.ResourceSample) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	series, found := s.tasks[task.ID]
+	if !found {
+		series = &taskSeries{
+			clusterID:   clusterID,
+			serviceID:   task.ServiceID,
+			taskID:      task.ID,
+			nodeID:      task.NodeID,
+			slot:        task.Slot,
+			containerID: task.Status.ContainerStatus.ContainerID,
+		}
+		s.tasks[task.ID] = series
+	}
+	series.samples = append(series.samples, sample)
+}
+
+// prune drops the samples which are older than the retention, and the tasks which have no samples left
+func (s *metricsStore) prune(retention time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deadline := time.Now().Add(-retention)
+	for taskID, series := range s.tasks {
+		idx := sort.Search(len(series.samples), func(i int) bool {
+			return series.samples[i].Timestamp.After(deadline)
+		})
+		if idx >= len(series.samples) {
+			delete(s.tasks, taskID)
+			continue
+		}
+		series.samples = append([]types.ResourceSample{}, series.samples[idx:]...)
+	}
+}
+
+// service returns the samples of the tasks of the service since the time, and sums them up by the collection time.
+func (s *metricsStore) service(clusterID, serviceID string, since time.Time) *types.ServiceMetrics {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := &types.ServiceMetrics{
+		ServiceID:            serviceID,
+		CollectIntervalInSec: _config.Metrics.CollectIntervalInSec,
+		Samples:              []types.ResourceSample{},
+		Tasks:                []*types.TaskMetrics{},
+	}
+
+	totals := map[time.Time]*types.ResourceSample{}
+	for _, series := range s.tasks {
+		if series.clusterID != clusterID || series.serviceID != serviceID {
+			continue
+		}
+
+		taskMetrics := &types.TaskMetrics{
+			ID:          series.taskID,
+			NodeID:      series.nodeID,
+			Slot:        series.slot,
+			ContainerID: series.containerID,
+			Samples:     []types.ResourceSample{},
+		}
+		for _, sample := range series.samples {
+			if sample.Timestamp.Before(since) {
+				continue
+			}
+			taskMetrics.Samples = append(taskMetrics.Samples, sample)
+
+			total, found := totals[sample.Timestamp]
+			if !found {
+				total = &types.ResourceSample{Timestamp: sample.Timestamp}
+				totals[sample.Timestamp] = total
+			}
+			total.CPUPercent += sample.CPUPercent
+			total.MemoryBytes += sample.MemoryBytes
+			total.MemoryLimitBytes += sample.MemoryLimitBytes
+			total.NetworkRxBytes += sample.NetworkRxBytes
+			total.NetworkTxBytes += sample.NetworkTxBytes
+			total.BlockReadBytes += sample.BlockReadBytes
+			total.BlockWriteBytes += sample.BlockWriteBytes
+		}
+		if len(taskMetrics.Samples) == 0 {
+			continue
+		}
+		latest := taskMetrics.Samples[len(taskMetrics.Samples)-1]
+		taskMetrics.Latest = &latest
+		result.Tasks = append(result.Tasks, taskMetrics)
+	}
+
+	for _, total := range totals {
+		result.Samples = append(result.Samples, *total)
+	}
+	sort.Slice(result.Samples, func(i, j int) bool {
+		return result.Samples[i].Timestamp.Before(result.Samples[j].Timestamp)
+	})
+	if len(result.Samples) > 0 {
+		latest := result.Samples[len(result.Samples)-1]
+		result.Latest = &latest
+	}
+
+	sort.Slice(result.Tasks, func(i, j int) bool {
+		if result.Tasks[i].Slot != result.Tasks[j].Slot {
+			return result.Tasks[i].Slot < result.Tasks[j].Slot
+		}
+		return result.Tasks[i].ID < result.Tasks[j].ID
+	})
+
+	return result
+}
+
+// average returns the average cpu percent and memory percent of the limit of the tasks of the service since the time.
+// Each task is averaged first, so the tasks which were collected more often don't weigh more.
+func (s *metricsStore) average(clusterID, serviceID string, since time.Time) (cpuPercent float64, memoryPercent float64, tasks int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, series := range s.tasks {
+		if series.clusterID != clusterID || series.serviceID != serviceID {
+			continue
+		}
+
+		count := 0
+		taskCPU, taskMemory := 0.0, 0.0
+		for _, sample := range series.samples {
+			if sample.Timestamp.Before(since) {
+				continue
+			}
+			count++
+			taskCPU += sample.CPUPercent
+			if sample.MemoryLimitBytes > 0 {
+				taskMemory += float64(sample.MemoryBytes) / float64(sample.MemoryLimitBytes) * 100
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		tasks++
+		cpuPercent += taskCPU / float64(count)
+		memoryPercent += taskMemory / float64(count)
+	}
+
+	if tasks == 0 {
+		return 0, 0, 0
+	}
+	return cpuPercent / float64(tasks), memoryPercent / float64(tasks), tasks
+}
+
+func collectMetrics(timeout time.Duration) {
+	ctx := identity.NewContext(context.Background(), jwt.MapClaims{"sub": metricsCollectorActor})
+
+	clusters, err := _clusterManager.ClusterList(ctx)
+	if err != nil {
+		log.Errorf("abb: metrics collector lists clusters fail: %v", err)
+		return
+	}
+
+	for _, cluster := range clusters {
+		collectClusterMetrics(ctx, cluster, timeout)
+	}
+
+	_metricsStore.prune(time.Duration(_config.Metrics.RetentionInMin) * time.Minute)
+}
+
+func collectClusterMetrics(ctx context.Context, cluster *types.Cluster, timeout time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("abb: metrics collector on cluster %s fail: %v", cluster.Name, r)
+		}
+	}()
+
+	// a slow cluster can't hold up the next run
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	clusterClient, err := newDockerClient(cluster)
+	if err != nil {
+		log.Errorf("abb: metrics collector on cluster %s fail: %v", cluster.Name, err)
+		return
+	}
+	defer clusterClient.Close()
+
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("desired-state", "running")
+	tasks, err := clusterClient.TaskList(ctx, dockerTypes.TaskListOptions{Filters: filterArgs})
+	if err != nil {
+		log.Errorf("abb: metrics collector on cluster %s fail: %v", cluster.Name, err)
+		return
+	}
+
+	// the containers only can be reached by the daemon of their node
+	nodeTasks := map[string][]swarm.Task{}
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning || task.Status.ContainerStatus == nil || len(task.Status.ContainerStatus.ContainerID) == 0 {
+			continue
+		}
+		nodeTasks[task.NodeID] = append(nodeTasks[task.NodeID], task)
+	}
+
+	// all the samples of the run share the timestamp, so they can be summed up by service
+	timestamp := time.Now().UTC()
+	for nodeID, tasks := range nodeTasks {
+		dockerClient, owned, err := nodeDockerClient(ctx, cluster, clusterClient, nodeID)
+		if err != nil {
+			log.Warnf("abb: metrics collector can't reach node %s on cluster %s: %v", nodeID, cluster.Name, err)
+			continue
+		}
+
+		for _, task := range tasks {
+			sample, err := containerResourceSample(ctx, dockerClient, task.Status.ContainerStatus.ContainerID)
+			if err != nil {
+				log.Warnf("abb: metrics collector gets stats of task %s fail: %v", task.ID, err)
+				continue
+			}
+			sample.Timestamp = timestamp
+			_metricsStore.add(cluster.ID, task, *sample)
+		}
+
+		if owned {
+			dockerClient.Close()
+		}
+	}
+}
+
+// containerResourceSample reads the stats of the container once.  The daemon reads the cgroups twice for the
+// request, so the cpu usage is the delta between the two reads.
+func containerResourceSample(ctx context.Context, dockerClient *client.Client, containerID string) (*types.ResourceSample, error) {
+	resp, err := dockerClient.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	stats := dockerTypes.StatsJSON{}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := &types.ResourceSample{
+		CPUPercent:       cpuPercent(stats),
+		MemoryLimitBytes: stats.MemoryStats.Limit,
+	}
+
+	// the page cache can be reclaimed, it isn't counted like docker stats does
+	sample.MemoryBytes = stats.MemoryStats.Usage
+	if cache := stats.MemoryStats.Stats["cache"]; cache < sample.MemoryBytes {
+		sample.MemoryBytes -= cache
+	}
+
+	for _, network := range stats.Networks {
+		sample.NetworkRxBytes += network.RxBytes
+		sample.NetworkTxBytes += network.TxBytes
+	}
+
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			sample.BlockReadBytes += entry.Value
+		case "write":
+			sample.BlockWriteBytes += entry.Value
+		}
+	}
+
+	return sample, nil
+}
+
+func cpuPercent(stats dockerTypes.StatsJSON) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	return cpuDelta / systemDelta * onlineCPUs * 100
+}
+
+// getServiceMetrics returns the metrics of the service which were collected since the time.  The service id is the id of docker service.
+func getServiceMetrics(cluster *types.Cluster, dockerService *swarm.Service, since time.Time) *types.ServiceMetrics {
+	result := _metricsStore.service(cluster.ID, dockerService.ID, since)
+	result.Service = dockerService.Spec.Name
+	return result
+}
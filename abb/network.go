@@ -0,0 +1,347 @@
+package abb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+type NetworkManager struct {
+	client      *client.Client
+	cluster     *types.Cluster
+	serviceRepo types.ServiceRepository
+}
+
+func newNetworkManager(cluster *types.Cluster, serviceRepo types.ServiceRepository) (*NetworkManager, error) {
+	client, err := newDockerClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NetworkManager{
+		client:      client,
+		cluster:     cluster,
+		serviceRepo: serviceRepo,
+	}, nil
+}
+
+func newNetworkFromNetworkResource(resource dockerTypes.NetworkResource) *types.Network {
+	result := &types.Network{
+		ID:         resource.ID,
+		Name:       resource.Name,
+		Driver:     resource.Driver,
+		Scope:      resource.Scope,
+		Attachable: resource.Attachable,
+		Internal:   resource.Internal,
+		Ingress:    resource.Ingress,
+		Subnets:    []types.Subnet{},
+		Labels:     resource.Labels,
+		CreatedAt:  resource.Created,
+	}
+
+	// the overlay driver encrypts the traffic when the option exists, whatever the value is
+	_, result.Encrypted = resource.Options["encrypted"]
+
+	for _, ipam := range resource.IPAM.Config {
+		subnet := types.Subnet{
+			Subnet:  ipam.Subnet,
+			IPRange: ipam.IPRange,
+			Gateway: ipam.Gateway,
+		}
+		result.Subnets = append(result.Subnets, subnet)
+	}
+
+	return result
+}
+
+func (m *NetworkManager) DockerClient() *client.Client {
+	return m.client
+}
+
+// Get returns the network with the services and tasks attached to it
+func (m *NetworkManager) Get(ctx context.Context, networkID string) (*types.Network, error) {
+	logger := log.FromContext(ctx)
+
+	resource, err := m.client.NetworkInspect(ctx, networkID, dockerTypes.NetworkInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, nil
+		}
+		logger.Errorf("abb: get network err: %v", err)
+		return nil, err
+	}
+	result := newNetworkFromNetworkResource(resource)
+
+	dockerServices, err := m.client.ServiceList(ctx, dockerTypes.ServiceListOptions{})
+	if err != nil {
+		logger.Errorf("abb: get network err: %v", err)
+		return nil, err
+	}
+
+	taskFilters := filters.NewArgs()
+	taskFilters.Add("desired-state", "running")
+	dockerTasks, err := m.client.TaskList(ctx, dockerTypes.TaskListOptions{Filters: taskFilters})
+	if err != nil {
+		logger.Errorf("abb: get network err: %v", err)
+		return nil, err
+	}
+
+	result.Services = []types.AttachedService{}
+	for _, dockerService := range dockerServices {
+		attached := false
+		svc := types.AttachedService{
+			ID:    dockerService.ID,
+			Name:  dockerService.Spec.Name,
+			Tasks: []types.AttachedTask{},
+		}
+
+		for _, vip := range dockerService.Endpoint.VirtualIPs {
+			if vip.NetworkID == resource.ID {
+				attached = true
+				svc.VirtualIP = vip.Addr
+			}
+		}
+
+		for _, dockerTask := range dockerTasks {
+			if dockerTask.ServiceID != dockerService.ID {
+				continue
+			}
+			for _, attachment := range dockerTask.NetworksAttachments {
+				if attachment.Network.ID != resource.ID {
+					continue
+				}
+				attached = true
+				task := types.AttachedTask{
+					ID:        dockerTask.ID,
+					Slot:      dockerTask.Slot,
+					NodeID:    dockerTask.NodeID,
+					State:     string(dockerTask.Status.State),
+					Addresses: attachment.Addresses,
+				}
+				svc.Tasks = append(svc.Tasks, task)
+			}
+		}
+
+		if attached {
+			result.Services = append(result.Services, svc)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *NetworkManager) List(ctx context.Context, opts types.NetworkListOption) ([]*types.Network, error) {
+	logger := log.FromContext(ctx)
+
+	resources, err := m.client.NetworkList(ctx, dockerTypes.NetworkListOptions{})
+	if err != nil {
+		logger.Errorf("abb: list network err: %v", err)
+		return nil, err
+	}
+
+	result := []*types.Network{}
+	for _, resource := range resources {
+		result = append(result, newNetworkFromNetworkResource(resource))
+	}
+
+	return result, nil
+}
+
+// Create creates the network.  Networks of swarm are overlay networks unless the driver is given.
+func (m *NetworkManager) Create(ctx context.Context, target *types.Network) error {
+	logger := log.FromContext(ctx)
+
+	target.Name = strings.TrimSpace(target.Name)
+	if len(target.Name) == 0 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "name can't be empty"}
+	}
+	if len(target.Driver) == 0 {
+		target.Driver = "overlay"
+	}
+
+	opts := dockerTypes.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         target.Driver,
+		Scope:          "swarm",
+		Attachable:     target.Attachable,
+		Internal:       target.Internal,
+		Labels:         target.Labels,
+		Options:        map[string]string{},
+	}
+
+	if target.Encrypted {
+		if target.Driver != "overlay" {
+			return app.AppError{ErrorCode: "invalid_input", Message: "only overlay networks can be encrypted"}
+		}
+		opts.Options["encrypted"] = ""
+	}
+
+	if len(target.Subnets) > 0 {
+		opts.IPAM = &network.IPAM{
+			Driver: "default",
+		}
+		for _, subnet := range target.Subnets {
+			if _, _, err := net.ParseCIDR(subnet.Subnet); err != nil {
+				return app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("subnet %s was invalid", subnet.Subnet)}
+			}
+			if len(subnet.IPRange) > 0 {
+				if _, _, err := net.ParseCIDR(subnet.IPRange); err != nil {
+					return app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("ip range %s was invalid", subnet.IPRange)}
+				}
+			}
+			if len(subnet.Gateway) > 0 && net.ParseIP(subnet.Gateway) == nil {
+				return app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("gateway %s was invalid", subnet.Gateway)}
+			}
+
+			ipam := network.IPAMConfig{
+				Subnet:  subnet.Subnet,
+				IPRange: subnet.IPRange,
+				Gateway: subnet.Gateway,
+			}
+			opts.IPAM.Config = append(opts.IPAM.Config, ipam)
+		}
+	}
+
+	createResp, err := m.client.NetworkCreate(ctx, target.Name, opts)
+	if err != nil {
+		logger.Errorf("abb: create network err: %v", err)
+		return err
+	}
+	if len(createResp.Warning) > 0 {
+		logger.Warnf("abb: create network %s warning: %s", target.Name, createResp.Warning)
+	}
+
+	target.ID = createResp.ID
+	target.Scope = opts.Scope
+	return nil
+}
+
+// ServicesUsing returns the names of the services whose spec declares the network
+func (m *NetworkManager) ServicesUsing(ctx context.Context, networkName string) ([]string, error) {
+	opts := types.ServiceFilterOptions{
+		ClusterID: m.cluster.ID,
+	}
+	services, err := m.serviceRepo.Find(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, svc := range services {
+		for _, name := range svc.Spec.Networks {
+			if name == networkName {
+				result = append(result, svc.Name)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// Delete removes the network.  The network can't be removed while any service declares it in the spec,
+// otherwise the next deployment of the service is silently left off the network.
+func (m *NetworkManager) Delete(ctx context.Context, networkID string) error {
+	logger := log.FromContext(ctx)
+
+	resource, err := m.client.NetworkInspect(ctx, networkID, dockerTypes.NetworkInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return app.AppError{ErrorCode: "not_found", Message: "network was not found"}
+		}
+		logger.Errorf("abb: delete network err: %v", err)
+		return err
+	}
+
+	if resource.Ingress || resource.Scope != "swarm" {
+		return app.AppError{ErrorCode: "invalid_input", Message: "only swarm networks can be removed"}
+	}
+
+	serviceNames, err := m.ServicesUsing(ctx, resource.Name)
+	if err != nil {
+		logger.Errorf("abb: delete network err: %v", err)
+		return err
+	}
+	if len(serviceNames) > 0 {
+		return app.AppError{ErrorCode: "network_in_use", Message: fmt.Sprintf("network is used by services: %s", strings.Join(serviceNames, ", "))}
+	}
+
+	err = m.client.NetworkRemove(ctx, resource.ID)
+	if err != nil {
+		logger.Errorf("abb: delete network err: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *NetworkManager) Close(ctx context.Context) error {
+	return m.client.Close()
+}
+
+// ensureNetworks creates the overlay networks which are declared in the service spec but don't exist yet
+func ensureNetworks(ctx context.Context, dockerClient *client.Client, target *types.Service, networks []dockerTypes.NetworkResource) ([]dockerTypes.NetworkResource, error) {
+	logger := log.FromContext(ctx)
+
+	for _, name := range missingNetworks(target, networks) {
+		opts := dockerTypes.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         "overlay",
+			Scope:          "swarm",
+			Attachable:     true,
+			Options:        map[string]string{},
+			Labels: map[string]string{
+				"abb.created_by": target.Name,
+			},
+		}
+		if _config.Network.Encrypted {
+			opts.Options["encrypted"] = ""
+		}
+
+		createResp, err := dockerClient.NetworkCreate(ctx, name, opts)
+		if err != nil {
+			logger.Errorf("abb: auto create network %s for service %s err: %v", name, target.Name, err)
+			return nil, err
+		}
+		logger.Infof("abb: network %s was created for service %s", name, target.Name)
+
+		resource := dockerTypes.NetworkResource{
+			ID:     createResp.ID,
+			Name:   name,
+			Driver: opts.Driver,
+			Scope:  opts.Scope,
+		}
+		networks = append(networks, resource)
+	}
+
+	return networks, nil
+}
+
+// missingNetworks returns the networks declared in the service spec which don't exist
+func missingNetworks(target *types.Service, networks []dockerTypes.NetworkResource) []string {
+	result := []string{}
+	for _, name := range target.Spec.Networks {
+		if len(name) == 0 {
+			continue
+		}
+		found := false
+		for _, dockerNetwork := range networks {
+			if dockerNetwork.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, name)
+		}
+	}
+	return result
+}
@@ -1,2 +1,279 @@
 package abb
 
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+type NodeManager struct {
+	client  *client.Client
+	cluster *types.Cluster
+}
+
+func newNodeManager(cluster *types.Cluster) (*NodeManager, error) {
+	client, err := newDockerClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NodeManager{
+		client:  client,
+		cluster: cluster,
+	}, nil
+}
+
+func newNodeSummaryFromSwarmNode(node swarm.Node, tasks []swarm.Task) *types.NodeSummary {
+	result := &types.NodeSummary{
+		ID:            node.ID,
+		Hostname:      node.Description.Hostname,
+		Role:          string(node.Spec.Role),
+		Availability:  string(node.Spec.Availability),
+		State:         string(node.Status.State),
+		Addr:          node.Status.Addr,
+		EngineVersion: node.Description.Engine.EngineVersion,
+		OS:            node.Description.Platform.OS,
+		Architecture:  node.Description.Platform.Architecture,
+		CPUs:          float64(node.Description.Resources.NanoCPUs) / 1e9,
+		MemoryBytes:   node.Description.Resources.MemoryBytes,
+		Labels:        node.Spec.Labels,
+		CreatedAt:     node.CreatedAt,
+		UpdatedAt:     node.UpdatedAt,
+	}
+
+	if node.ManagerStatus != nil {
+		result.Leader = node.ManagerStatus.Leader
+		result.Reachability = string(node.ManagerStatus.Reachability)
+	}
+
+	for _, task := range tasks {
+		if task.NodeID != node.ID || task.DesiredState != swarm.TaskStateRunning {
+			continue
+		}
+		result.TotalTasks++
+		if task.Status.State == swarm.TaskStateRunning {
+			result.RunningTasks++
+		}
+	}
+
+	return result
+}
+
+func (m *NodeManager) DockerClient() *client.Client {
+	return m.client
+}
+
+func (m *NodeManager) List(ctx context.Context) ([]*types.NodeSummary, error) {
+	logger := log.FromContext(ctx)
+
+	nodes, err := m.client.NodeList(ctx, dockerTypes.NodeListOptions{})
+	if err != nil {
+		logger.Errorf("abb: list node err: %v", err)
+		return nil, err
+	}
+
+	tasks, err := m.client.TaskList(ctx, dockerTypes.TaskListOptions{})
+	if err != nil {
+		logger.Errorf("abb: list node err: %v", err)
+		return nil, err
+	}
+
+	result := []*types.NodeSummary{}
+	for _, node := range nodes {
+		result = append(result, newNodeSummaryFromSwarmNode(node, tasks))
+	}
+
+	return result, nil
+}
+
+// updateSpec applies the change to the latest spec of the node, so only the changed fields are written
+func (m *NodeManager) updateSpec(ctx context.Context, nodeID string, change func(spec *swarm.NodeSpec) error) (*swarm.Node, error) {
+	node, _, err := m.client.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, app.AppError{ErrorCode: "not_found", Message: "node was not found"}
+		}
+		return nil, err
+	}
+
+	err = change(&node.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.client.NodeUpdate(ctx, node.ID, node.Version, node.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	node, _, err = m.client.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// SetAvailability changes the availability of the node.  When the node is drained and wait is set,
+// it blocks until no task runs on the node any more.
+func (m *NodeManager) SetAvailability(ctx context.Context, nodeID string, opts types.NodeAvailabilityUpdate) (*swarm.Node, error) {
+	logger := log.FromContext(ctx)
+
+	availability := swarm.NodeAvailability(strings.ToLower(opts.Availability))
+	switch availability {
+	case swarm.NodeAvailabilityActive, swarm.NodeAvailabilityPause, swarm.NodeAvailabilityDrain:
+	default:
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "availability must be active, pause or drain"}
+	}
+
+	node, err := m.updateSpec(ctx, nodeID, func(spec *swarm.NodeSpec) error {
+		spec.Availability = availability
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("abb: set node availability err: %v", err)
+		return nil, err
+	}
+
+	if !opts.Wait || availability != swarm.NodeAvailabilityDrain {
+		return node, nil
+	}
+
+	timeout := time.Duration(opts.TimeoutInSec) * time.Second
+	if timeout <= 0 {
+		timeout = 120 * time.Second
+	}
+	err = m.waitForTasksMoved(ctx, node.ID, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (m *NodeManager) waitForTasksMoved(ctx context.Context, nodeID string, timeout time.Duration) error {
+	logger := log.FromContext(ctx)
+
+	taskFilters := filters.NewArgs()
+	taskFilters.Add("node", nodeID)
+	opts := dockerTypes.TaskListOptions{Filters: taskFilters}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		tasks, err := m.client.TaskList(ctx, opts)
+		if err != nil {
+			logger.Errorf("abb: wait for node %s to drain err: %v", nodeID, err)
+			return err
+		}
+
+		remaining := 0
+		for _, task := range tasks {
+			if task.Status.State == swarm.TaskStateRunning || task.Status.State == swarm.TaskStateStarting {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return app.AppError{ErrorCode: "timeout", Message: fmt.Sprintf("%d tasks are still running on the node", remaining)}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// UpdateLabels adds and removes the labels of the node, the other labels are kept.
+func (m *NodeManager) UpdateLabels(ctx context.Context, nodeID string, update types.NodeLabelsUpdate) (*swarm.Node, error) {
+	logger := log.FromContext(ctx)
+
+	for key := range update.Add {
+		if len(strings.TrimSpace(key)) == 0 {
+			return nil, app.AppError{ErrorCode: "invalid_input", Message: "label key can't be empty"}
+		}
+	}
+
+	node, err := m.updateSpec(ctx, nodeID, func(spec *swarm.NodeSpec) error {
+		if spec.Labels == nil {
+			spec.Labels = map[string]string{}
+		}
+		for _, key := range update.Remove {
+			delete(spec.Labels, key)
+		}
+		for key, val := range update.Add {
+			spec.Labels[strings.TrimSpace(key)] = val
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("abb: update node labels err: %v", err)
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// SetRole promotes the node to a manager or demotes it to a worker.
+func (m *NodeManager) SetRole(ctx context.Context, nodeID string, role swarm.NodeRole) (*swarm.Node, error) {
+	logger := log.FromContext(ctx)
+
+	node, err := m.updateSpec(ctx, nodeID, func(spec *swarm.NodeSpec) error {
+		if spec.Role == role {
+			return app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("node is already a %s", role)}
+		}
+		spec.Role = role
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("abb: set node role err: %v", err)
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// Remove removes the node from the swarm.  Only the nodes which are down can be removed.
+func (m *NodeManager) Remove(ctx context.Context, nodeID string) error {
+	logger := log.FromContext(ctx)
+
+	node, _, err := m.client.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return app.AppError{ErrorCode: "not_found", Message: "node was not found"}
+		}
+		logger.Errorf("abb: remove node err: %v", err)
+		return err
+	}
+
+	if node.Status.State != swarm.NodeStateDown {
+		return app.AppError{ErrorCode: "invalid_input", Message: "only the nodes which are down can be removed"}
+	}
+	if node.Spec.Role == swarm.NodeRoleManager {
+		return app.AppError{ErrorCode: "invalid_input", Message: "manager must be demoted before it is removed"}
+	}
+
+	err = m.client.NodeRemove(ctx, node.ID, dockerTypes.NodeRemoveOptions{})
+	if err != nil {
+		logger.Errorf("abb: remove node err: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *NodeManager) Close(ctx context.Context) error {
+	return m.client.Close()
+}
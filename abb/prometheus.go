@@ -0,0 +1,220 @@
+package abb
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/identity"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+	"github.com/jasonsoft/napnap"
+)
+
+// prometheusActor is the actor of the requests made when /metrics is scraped
+const prometheusActor = "prometheus"
+
+var (
+	_dockerRequestDuration = app.NewHistogramVec("abb_docker_request_duration_seconds", "Latency of the docker api calls by cluster and operation.", app.DefaultBuckets, "cluster", "operation")
+	_dockerErrorsTotal     = app.NewCounterVec("abb_docker_errors_total", "Count of the docker api calls which failed to connect or returned a server error.", "cluster", "operation")
+
+	_healthCheckDuration = app.NewHistogramVec("abb_health_check_duration_seconds", "Duration of the health check probes.", app.DefaultBuckets, "name")
+	_healthCheckProbes   = app.NewCounterVec("abb_health_check_probes_total", "Count of the health check probes by result.", "name", "result")
+	_healthCheckUp       = app.NewGaugeVec("abb_health_check_up", "Whether the last probe of the health check succeeded.", "name")
+
+	_deploymentsTotal = app.NewCounterVec("abb_deployments_total", "Count of the deployments by cluster, service and state.", "cluster", "service", "state")
+
+	_clusterUp               = app.NewGaugeVec("abb_cluster_up", "Whether the cluster could be reached when the metrics were scraped.", "cluster")
+	_serviceDesiredReplicas  = app.NewGaugeVec("abb_service_desired_replicas", "Desired replicas of the services.", "cluster", "service", "mode")
+	_serviceRunningReplicas  = app.NewGaugeVec("abb_service_running_replicas", "Running replicas of the services.", "cluster", "service", "mode")
+	_serviceUpdateInProgress = app.NewGaugeVec("abb_service_update_in_progress", "Whether a rolling update of the service is in progress.", "cluster", "service")
+)
+
+// dockerTransport records the latency and errors of the docker api calls of the cluster.
+type dockerTransport struct {
+	cluster   string
+	transport http.RoundTripper
+}
+
+func (t *dockerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+
+	operation := dockerOperation(req)
+	_dockerRequestDuration.Observe(time.Since(start).Seconds(), t.cluster, operation)
+	if err != nil || resp.StatusCode >= 500 {
+		_dockerErrorsTotal.Inc(t.cluster, operation)
+	}
+	return resp, err
+}
+
+// dockerOperation returns the method and the resource of the docker api, such as "GET /services".  The ids
+// are dropped to keep the number of the series small.
+func dockerOperation(req *http.Request) string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(segments) > 1 && strings.HasPrefix(segments[0], "v") {
+		// the version of the api, such as v1.30
+		segments = segments[1:]
+	}
+	return req.Method + " /" + segments[0]
+}
+
+// newDockerClient connects to the docker daemon of the cluster.  All the docker clients must be created by it,
+// so the calls are recorded by the metrics.
+func newDockerClient(cluster *types.Cluster) (*client.Client, error) {
+	return newDockerClientWithHost(cluster.Name, cluster.Host)
+}
+
+func newDockerClientWithHost(clusterName, host string) (*client.Client, error) {
+	hostURL, err := client.ParseHostURL(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client can't close the idle connections of a wrapped transport, so they are closed by the timeout
+	transport := &http.Transport{
+		IdleConnTimeout: 90 * time.Second,
+	}
+	err = sockets.ConfigureTransport(transport, hostURL.Scheme, hostURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{
+		Transport: &dockerTransport{
+			cluster:   clusterName,
+			transport: transport,
+		},
+		CheckRedirect: client.CheckRedirect,
+	}
+	return client.NewClient(host, "1.30", httpClient, nil)
+}
+
+// NewMetricsRouter returns the router of /metrics which is scraped by prometheus.  It is authorized by the
+// scrape token instead of jwt; the metrics expose the clusters and services, so /metrics isn't served
+// when no token is configured.
+func NewMetricsRouter() *napnap.Router {
+	if len(_config.Metrics.ScrapeToken) == 0 {
+		log.Info("abb: /metrics is disabled because the scrape token isn't configured")
+	}
+
+	router := app.NewRouter()
+	router.Get("/metrics", prometheusMetricsEndpoint)
+	return router.Router
+}
+
+func prometheusMetricsEndpoint(c *napnap.Context) {
+	token := _config.Metrics.ScrapeToken
+	if len(token) == 0 {
+		c.SetStatus(404)
+		return
+	}
+	bearer := strings.TrimPrefix(c.RequestHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		c.SetStatus(401)
+		return
+	}
+
+	ctx := identity.NewContext(c.StdContext(), jwt.MapClaims{"sub": prometheusActor})
+	refreshServiceMetrics(ctx)
+
+	c.RespHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.SetStatus(200)
+	if err := app.WriteMetrics(c.Writer); err != nil {
+		log.Errorf("abb: write metrics fail: %v", err)
+	}
+}
+
+type serviceReplicas struct {
+	cluster string
+	status  types.DeploymentStatus
+}
+
+// refreshServiceMetrics reads the replicas of the services of every cluster.  The series of the services which were
+// removed are dropped, and the clusters which can't be reached are reported by abb_cluster_up.
+func refreshServiceMetrics(ctx context.Context) {
+	clusters, err := _clusterManager.ClusterList(ctx)
+	if err != nil {
+		log.Errorf("abb: list clusters for metrics fail: %v", err)
+		return
+	}
+
+	up := map[string]bool{}
+	replicas := []serviceReplicas{}
+	for _, cluster := range clusters {
+		statuses, err := clusterServicesStatus(ctx, cluster)
+		if err != nil {
+			log.Warnf("abb: get services status of cluster %s for metrics fail: %v", cluster.Name, err)
+			up[cluster.Name] = false
+			continue
+		}
+		up[cluster.Name] = true
+		for _, status := range statuses {
+			replicas = append(replicas, serviceReplicas{cluster: cluster.Name, status: status})
+		}
+	}
+
+	_clusterUp.Replace(func(set func(value float64, labelValues ...string)) {
+		for name, isUp := range up {
+			set(boolToFloat(isUp), name)
+		}
+	})
+	_serviceDesiredReplicas.Replace(func(set func(value float64, labelValues ...string)) {
+		for _, r := range replicas {
+			set(float64(r.status.Replicas), r.cluster, r.status.ServiceName, r.status.Mode)
+		}
+	})
+	_serviceRunningReplicas.Replace(func(set func(value float64, labelValues ...string)) {
+		for _, r := range replicas {
+			set(float64(r.status.AvailableReplicas), r.cluster, r.status.ServiceName, r.status.Mode)
+		}
+	})
+	_serviceUpdateInProgress.Replace(func(set func(value float64, labelValues ...string)) {
+		for _, r := range replicas {
+			set(boolToFloat(r.status.UpdateState == "updating" || r.status.UpdateState == "rollback_started"), r.cluster, r.status.ServiceName)
+		}
+	})
+}
+
+func clusterServicesStatus(ctx context.Context, cluster *types.Cluster) (map[string]types.DeploymentStatus, error) {
+	// a cluster which is down can't hold up the scrape
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	dockerClient, err := newDockerClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer dockerClient.Close()
+
+	services, err := dockerClient.ServiceList(ctx, dockerTypes.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := dockerClient.NodeList(ctx, dockerTypes.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := dockerClient.TaskList(ctx, dockerTypes.TaskListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return getServicesStatus(services, nodes, tasks), nil
+}
+
+func boolToFloat(val bool) float64 {
+	if val {
+		return 1
+	}
+	return 0
+}
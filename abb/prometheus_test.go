@@ -0,0 +1,45 @@
+package abb
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jasonsoft/napnap"
+)
+
+func TestMetricsNeedScrapeToken(t *testing.T) {
+	token := _config.Metrics.ScrapeToken
+	t.Cleanup(func() { _config.Metrics.ScrapeToken = token })
+
+	nap := napnap.New()
+	nap.Use(NewMetricsRouter())
+
+	testCases := []struct {
+		name          string
+		scrapeToken   string
+		authorization string
+		status        int
+	}{
+		{name: "disabled without scrape token", scrapeToken: "", authorization: "", status: 404},
+		{name: "disabled without scrape token even with bearer", scrapeToken: "", authorization: "Bearer ", status: 404},
+		{name: "missing bearer", scrapeToken: "s3cret", authorization: "", status: 401},
+		{name: "wrong bearer", scrapeToken: "s3cret", authorization: "Bearer guess", status: 401},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_config.Metrics.ScrapeToken = tc.scrapeToken
+
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if len(tc.authorization) > 0 {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			nap.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,600 @@
+package abb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultDockerDomain = "docker.io"
+	defaultRegistryHost = "registry-1.docker.io"
+
+	mediaTypeManifestV2   = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+var manifestAcceptHeaders = []string{
+	mediaTypeManifestList,
+	mediaTypeManifestV2,
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+}
+
+// registryClient talks to a docker registry through the registry HTTP API V2.
+type registryClient struct {
+	httpClient         *http.Client
+	insecureRegistries []string
+	credentials        []*types.RegistryCredential
+}
+
+// newRegistryClient creates a registry client, the credentials must be decrypted already.
+func newRegistryClient(credentials []*types.RegistryCredential) *registryClient {
+	return &registryClient{
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		insecureRegistries: _config.Registry.InsecureRegistries,
+		credentials:        credentials,
+	}
+}
+
+// registryHost returns the host which serves the API for the given reference domain.
+func registryHost(domain string) string {
+	if domain == defaultDockerDomain {
+		return defaultRegistryHost
+	}
+	return domain
+}
+
+// normalizeRegistryHost turns the user input such as `https://index.docker.io/v1/` into the reference domain.
+func normalizeRegistryHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if idx := strings.Index(host, "/"); idx >= 0 {
+		host = host[:idx]
+	}
+
+	switch host {
+	case "", "index.docker.io", defaultRegistryHost:
+		return defaultDockerDomain
+	}
+	return host
+}
+
+// credentialFor returns the credential of the registry which serves the host.
+func (r *registryClient) credentialFor(host string) *types.RegistryCredential {
+	domain := normalizeRegistryHost(host)
+	for _, cred := range r.credentials {
+		if normalizeRegistryHost(cred.Host) == domain {
+			return cred
+		}
+	}
+	return nil
+}
+
+// baseURL returns the registry endpoint; like the docker daemon, localhost and
+// the configured insecure registries are reached over plain http.
+func (r *registryClient) baseURL(host string) string {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	insecure := hostname == "localhost"
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		insecure = true
+	}
+	for _, val := range r.insecureRegistries {
+		if strings.EqualFold(strings.TrimSpace(val), host) {
+			insecure = true
+		}
+	}
+
+	if insecure {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// do sends the request and answers a bearer or basic challenge once when the registry asks for it.
+func (r *registryClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	cred := r.credentialFor(req.URL.Host)
+	scheme, params := parseAuthChallenge(challenge)
+	switch {
+	case scheme == "bearer":
+		token, err := r.fetchToken(ctx, params, cred)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case scheme == "basic" && cred != nil:
+		req.SetBasicAuth(cred.Username, cred.Password)
+	default:
+		return nil, fmt.Errorf("registry: unauthorized: %s", req.URL.Host)
+	}
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+	return r.httpClient.Do(req)
+}
+
+type registryToken struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+func (r *registryClient) fetchToken(ctx context.Context, params map[string]string, cred *types.RegistryCredential) (string, error) {
+	realm := params["realm"]
+	if len(realm) == 0 {
+		return "", fmt.Errorf("registry: token realm is missing from the challenge")
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if cred != nil {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+
+	resp, err := r.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry: get token fail: %s", resp.Status)
+	}
+
+	token := registryToken{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if len(token.Token) > 0 {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return "", params
+	}
+
+	idx := strings.Index(header, " ")
+	if idx < 0 {
+		return strings.ToLower(header), params
+	}
+	scheme := strings.ToLower(header[:idx])
+
+	rest := header[idx+1:]
+	for len(rest) > 0 {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value = rest[1:]
+				rest = ""
+			} else {
+				value = rest[1 : end+1]
+				rest = rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value = rest
+				rest = ""
+			} else {
+				value = rest[:end]
+				rest = rest[end:]
+			}
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return scheme, params
+}
+
+// ResolveDigest resolves the tag of the image to the manifest digest in the registry and
+// returns the image pinned by digest, e.g. `myapp:latest@sha256:...`.
+func (r *registryClient) ResolveDigest(ctx context.Context, image string) (string, digest.Digest, error) {
+	logger := log.FromContext(ctx)
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the image is pinned already
+	if canonical, ok := named.(reference.Canonical); ok {
+		return reference.FamiliarString(canonical), canonical.Digest(), nil
+	}
+
+	named = reference.TagNameOnly(named)
+	tagged, _ := named.(reference.Tagged)
+
+	host := registryHost(reference.Domain(named))
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", r.baseURL(host), reference.Path(named), tagged.Tag())
+
+	req, err := http.NewRequest("HEAD", manifestURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptHeaders, ", "))
+
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		logger.Errorf("abb: resolve image digest fail: %v", err)
+		return "", "", err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("registry: resolve %s fail: %s", image, resp.Status)
+	}
+
+	dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return "", "", fmt.Errorf("registry: %s doesn't return a valid digest: %v", host, err)
+	}
+
+	canonical, err := reference.WithDigest(named, dgst)
+	if err != nil {
+		return "", "", err
+	}
+
+	return reference.FamiliarString(canonical), dgst, nil
+}
+
+// Login verifies the credential against the `/v2/` endpoint of the registry.
+func (r *registryClient) Login(ctx context.Context, cred *types.RegistryCredential) error {
+	logger := log.FromContext(ctx)
+
+	r.credentials = []*types.RegistryCredential{cred}
+	host := registryHost(normalizeRegistryHost(cred.Host))
+
+	req, err := http.NewRequest("GET", r.baseURL(host)+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		logger.Errorf("abb: registry login fail: %v", err)
+		return app.AppError{ErrorCode: "registry_login_fail", Message: err.Error()}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return app.AppError{ErrorCode: "registry_login_fail", Message: fmt.Sprintf("registry %s returns %s", host, resp.Status)}
+	}
+	return nil
+}
+
+// repositoryNamed returns the named reference of the repository in the registry host.
+func repositoryNamed(host string, repository string) (reference.Named, error) {
+	domain := normalizeRegistryHost(host)
+	named, err := reference.ParseNormalizedNamed(domain + "/" + strings.Trim(repository, "/"))
+	if err != nil {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "repository was invalid"}
+	}
+	return reference.TrimNamed(named), nil
+}
+
+// get sends a GET request and decodes the JSON body; the next page from the Link header is returned as well.
+func (r *registryClient) get(ctx context.Context, target string, accept []string, out interface{}) (*http.Response, string, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", app.AppError{ErrorCode: "not_found", Message: "registry resource was not found"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("registry: get %s fail: %s", req.URL.Path, resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp, nextPage(req.URL, resp.Header.Get("Link")), nil
+}
+
+// nextPage parses a Link header such as `</v2/_catalog?last=b&n=100>; rel="next"`.
+func nextPage(base *url.URL, link string) string {
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end <= start || !strings.Contains(link[end:], `rel="next"`) {
+		return ""
+	}
+
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+	return next.String()
+}
+
+type catalogResult struct {
+	Repositories []string `json:"repositories"`
+}
+
+// Catalog lists all repositories of the registry.
+func (r *registryClient) Catalog(ctx context.Context, host string) ([]string, error) {
+	result := []string{}
+	next := r.baseURL(registryHost(normalizeRegistryHost(host))) + "/v2/_catalog?n=100"
+	for len(next) > 0 {
+		catalog := catalogResult{}
+		_, page, err := r.get(ctx, next, nil, &catalog)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, catalog.Repositories...)
+		next = page
+	}
+	return result, nil
+}
+
+type tagListResult struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// TagNames lists the tag names of the repository.
+func (r *registryClient) TagNames(ctx context.Context, named reference.Named) ([]string, error) {
+	result := []string{}
+	next := fmt.Sprintf("%s/v2/%s/tags/list?n=100", r.baseURL(registryHost(reference.Domain(named))), reference.Path(named))
+	for len(next) > 0 {
+		tagList := tagListResult{}
+		_, page, err := r.get(ctx, next, nil, &tagList)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, tagList.Tags...)
+		next = page
+	}
+	return result, nil
+}
+
+// Manifest returns the summary of the image; for a multi-arch image, the linux/amd64 image is described.
+func (r *registryClient) Manifest(ctx context.Context, named reference.Named, tag string) (*types.ImageManifest, error) {
+	baseURL := fmt.Sprintf("%s/v2/%s", r.baseURL(registryHost(reference.Domain(named))), reference.Path(named))
+
+	raw := json.RawMessage{}
+	resp, _, err := r.get(ctx, baseURL+"/manifests/"+tag, manifestAcceptHeaders, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &types.ImageManifest{
+		Repository: reference.FamiliarName(named),
+		Tag:        tag,
+		MediaType:  resp.Header.Get("Content-Type"),
+		Digest:     resp.Header.Get("Docker-Content-Digest"),
+	}
+	if len(result.Digest) == 0 {
+		result.Digest = digest.FromBytes(raw).String()
+	}
+
+	manifest := ocispec.Manifest{}
+	switch result.MediaType {
+	case mediaTypeManifestList, mediaTypeOCIIndex:
+		index := ocispec.Index{}
+		if err := json.Unmarshal(raw, &index); err != nil {
+			return nil, err
+		}
+		if len(index.Manifests) == 0 {
+			return nil, fmt.Errorf("registry: %s:%s has no manifest", result.Repository, tag)
+		}
+
+		desc := index.Manifests[0]
+		for _, val := range index.Manifests {
+			if val.Platform != nil && val.Platform.OS == "linux" && val.Platform.Architecture == "amd64" {
+				desc = val
+				break
+			}
+		}
+
+		_, _, err = r.get(ctx, baseURL+"/manifests/"+desc.Digest.String(), manifestAcceptHeaders, &manifest)
+		if err != nil {
+			return nil, err
+		}
+	case mediaTypeManifestV2, mediaTypeOCIManifest:
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("registry: unsupported manifest media type: %s", result.MediaType)
+	}
+
+	result.Size = manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		result.Size += layer.Size
+	}
+
+	config := ocispec.Image{}
+	_, _, err = r.get(ctx, baseURL+"/blobs/"+manifest.Config.Digest.String(), nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	result.Architecture = config.Architecture
+	result.OS = config.OS
+	result.CreatedAt = config.Created
+	result.Labels = config.Config.Labels
+
+	return result, nil
+}
+
+// Tags lists the tags of the repository, the newest pushed tag is first.  The registry API doesn't expose
+// the push time, so the creation time of the image is used.
+func (r *registryClient) Tags(ctx context.Context, named reference.Named) ([]*types.ImageTag, error) {
+	names, err := r.TagNames(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	return r.describeTags(ctx, named, names), nil
+}
+
+// describeTags fetches the digest and creation time of the tags, the newest pushed tag is first.
+func (r *registryClient) describeTags(ctx context.Context, named reference.Named, names []string) []*types.ImageTag {
+	logger := log.FromContext(ctx)
+
+	result := make([]*types.ImageTag, len(names))
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, 5)
+	for i, name := range names {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(i int, name string) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+
+			tag := &types.ImageTag{
+				Name: name,
+			}
+			manifest, err := r.Manifest(ctx, named, name)
+			if err != nil {
+				logger.Warnf("abb: get manifest of %s:%s fail: %v", reference.FamiliarName(named), name, err)
+			} else {
+				tag.Digest = manifest.Digest
+				tag.CreatedAt = manifest.CreatedAt
+			}
+			result[i] = tag
+		}(i, name)
+	}
+	wg.Wait()
+
+	sortImageTags(result)
+	return result
+}
+
+func sortImageTags(tags []*types.ImageTag) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		a, b := tags[i].CreatedAt, tags[j].CreatedAt
+		switch {
+		case a == nil && b == nil:
+			return tags[i].Name > tags[j].Name
+		case a == nil:
+			return false
+		case b == nil:
+			return true
+		case a.Equal(*b):
+			return tags[i].Name > tags[j].Name
+		}
+		return a.After(*b)
+	})
+}
+
+// imageHost returns the reference domain of the image, e.g. `docker.io`.
+func imageHost(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	return reference.Domain(named)
+}
+
+// encodeRegistryAuth encodes the credential in the format of the X-Registry-Auth header.
+func encodeRegistryAuth(cred *types.RegistryCredential) (string, error) {
+	authConfig := dockerTypes.AuthConfig{
+		Username:      cred.Username,
+		Password:      cred.Password,
+		ServerAddress: normalizeRegistryHost(cred.Host),
+	}
+	buf, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// imageDigest returns the digest part of an image reference or an empty string.
+func imageDigest(image string) string {
+	idx := strings.LastIndex(image, "@")
+	if idx < 0 {
+		return ""
+	}
+	return image[idx+1:]
+}
@@ -0,0 +1,357 @@
+package abb
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ************************
+// Business
+// ************************
+
+type RegistryCredentialManager struct {
+	cluster *types.Cluster
+	repo    types.RegistryCredentialRepository
+}
+
+func NewRegistryCredentialManager(cluster *types.Cluster, repo types.RegistryCredentialRepository) types.RegistryCredentialService {
+	return &RegistryCredentialManager{
+		cluster: cluster,
+		repo:    repo,
+	}
+}
+
+func (m *RegistryCredentialManager) Create(ctx context.Context, entity *types.RegistryCredential) error {
+	entity.Host = normalizeRegistryHost(entity.Host)
+	if len(entity.Username) == 0 || len(entity.Password) == 0 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "username and password can't be empty"}
+	}
+
+	encrypted, err := encryptRegistryPassword(entity.Password)
+	if err != nil {
+		return err
+	}
+
+	entity.ID = uuid.NewV4().String()
+	entity.ClusterID = m.cluster.ID
+	entity.PasswordEncrypted = encrypted
+	err = m.repo.Insert(ctx, entity)
+	if err != nil {
+		return err
+	}
+
+	entity.Password = ""
+	return nil
+}
+
+func (m *RegistryCredentialManager) Update(ctx context.Context, entity *types.RegistryCredential) error {
+	old, err := m.Get(ctx, entity.ID)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "registry credential was not found"}
+	}
+
+	entity.ClusterID = old.ClusterID
+	entity.CreatedAt = old.CreatedAt
+	entity.Host = normalizeRegistryHost(entity.Host)
+
+	// keep the old password when the password isn't changed
+	if len(entity.Password) == 0 {
+		entity.PasswordEncrypted = old.PasswordEncrypted
+	} else {
+		entity.PasswordEncrypted, err = encryptRegistryPassword(entity.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.repo.Update(ctx, entity)
+	if err != nil {
+		return err
+	}
+
+	entity.Password = ""
+	return nil
+}
+
+// encryptRegistryPassword refuses to store the password when the secret key isn't configured, otherwise
+// everyone could decrypt it with the empty key.
+func encryptRegistryPassword(password string) (string, error) {
+	if len(_config.Registry.SecretKey) == 0 {
+		return "", app.AppError{ErrorCode: "invalid_config", Message: "registry secret key isn't configured"}
+	}
+	return app.AESEncryptToBase64(password, _config.Registry.SecretKey)
+}
+
+func (m *RegistryCredentialManager) Delete(ctx context.Context, id string) error {
+	old, err := m.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "registry credential was not found"}
+	}
+	return m.repo.Delete(ctx, old.ID)
+}
+
+func (m *RegistryCredentialManager) Get(ctx context.Context, id string) (*types.RegistryCredential, error) {
+	opts := types.RegistryCredentialFilterOptions{
+		ID:        id,
+		ClusterID: m.cluster.ID,
+	}
+	return m.repo.FindOne(ctx, opts)
+}
+
+func (m *RegistryCredentialManager) List(ctx context.Context) ([]*types.RegistryCredential, error) {
+	opts := types.RegistryCredentialFilterOptions{
+		ClusterID: m.cluster.ID,
+	}
+	return m.repo.Find(ctx, opts)
+}
+
+// Login verifies the credential against the registry.  When the password is empty, the stored credential is tested.
+func (m *RegistryCredentialManager) Login(ctx context.Context, entity *types.RegistryCredential) error {
+	cred := *entity
+	if len(cred.Password) == 0 && len(cred.ID) > 0 {
+		old, err := m.Get(ctx, cred.ID)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return app.AppError{ErrorCode: "not_found", Message: "registry credential was not found"}
+		}
+
+		cred.Host = old.Host
+		cred.Username = old.Username
+		cred.Password, err = app.AESDecryptFromBase64(old.PasswordEncrypted, _config.Registry.SecretKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return newRegistryClient(nil).Login(ctx, &cred)
+}
+
+// client returns the registry client and the host of the stored credential.
+func (m *RegistryCredentialManager) client(ctx context.Context, id string) (*registryClient, string, error) {
+	cred, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if cred == nil {
+		return nil, "", app.AppError{ErrorCode: "not_found", Message: "registry credential was not found"}
+	}
+
+	cred.Password, err = app.AESDecryptFromBase64(cred.PasswordEncrypted, _config.Registry.SecretKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return newRegistryClient([]*types.RegistryCredential{cred}), cred.Host, nil
+}
+
+// Repositories lists the repositories of the registry.
+func (m *RegistryCredentialManager) Repositories(ctx context.Context, id string) ([]string, error) {
+	registry, host, err := m.client(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Catalog(ctx, host)
+}
+
+// Tags lists the tags of the repository, the newest pushed tag is first.
+func (m *RegistryCredentialManager) Tags(ctx context.Context, id string, repository string) ([]*types.ImageTag, error) {
+	registry, host, err := m.client(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	named, err := repositoryNamed(host, repository)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Tags(ctx, named)
+}
+
+// Manifest returns the summary of the tag.
+func (m *RegistryCredentialManager) Manifest(ctx context.Context, id string, repository string, tag string) (*types.ImageManifest, error) {
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+
+	registry, host, err := m.client(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	named, err := repositoryNamed(host, repository)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Manifest(ctx, named, tag)
+}
+
+// loadRegistryCredentials returns the decrypted credentials of the cluster, they are only used to talk to registries.
+func loadRegistryCredentials(ctx context.Context, repo types.RegistryCredentialRepository, clusterID string) ([]*types.RegistryCredential, error) {
+	if repo == nil {
+		return nil, nil
+	}
+
+	opts := types.RegistryCredentialFilterOptions{
+		ClusterID: clusterID,
+	}
+	credentials, err := repo.Find(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cred := range credentials {
+		cred.Password, err = app.AESDecryptFromBase64(cred.PasswordEncrypted, _config.Registry.SecretKey)
+		if err != nil {
+			log.FromContext(ctx).Errorf("abb: decrypt registry credential %s fail: %v", cred.Host, err)
+			return nil, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// ************************
+// Database
+// ************************
+
+type registryCredentialDAO struct {
+	db *sqlx.DB
+}
+
+func newRegistryCredentialDAO(db *sqlx.DB) types.RegistryCredentialRepository {
+	return &registryCredentialDAO{
+		db: db,
+	}
+}
+
+const insertRegistryCredentialSQL = "INSERT INTO `registry_credentials` (`id`, `cluster_id`, `host`, `username`, `password_encrypted`, `created_at`, `updated_at`) VALUES (UNHEX(:id), UNHEX(:cluster_id), :host, :username, :password_encrypted, :created_at, :updated_at);"
+
+func (repo *registryCredentialDAO) Insert(ctx context.Context, entity *types.RegistryCredential) error {
+	logger := log.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.ID = strings.Replace(entity.ID, "-", "", -1)
+	entity.CreatedAt = &nowUTC
+	entity.UpdatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertRegistryCredentialSQL, entity)
+	if err != nil {
+		mysqlerr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlerr.Number == 1062 {
+			return app.AppError{ErrorCode: "registry_credential_exists", Message: "the credential of the registry already exists"}
+		}
+		logger.Errorf("abb: insert registry credential fail: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+const updateRegistryCredentialSQL = "UPDATE `registry_credentials` SET `host` = :host, `username` = :username, `password_encrypted` = :password_encrypted, `updated_at` = :updated_at WHERE id = UNHEX(:id);"
+
+func (repo *registryCredentialDAO) Update(ctx context.Context, entity *types.RegistryCredential) error {
+	logger := log.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.UpdatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(updateRegistryCredentialSQL, entity)
+	if err != nil {
+		mysqlerr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlerr.Number == 1062 {
+			return app.AppError{ErrorCode: "registry_credential_exists", Message: "the credential of the registry already exists"}
+		}
+		logger.Errorf("abb: update registry credential fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const deleteRegistryCredentialSQL = "DELETE FROM `registry_credentials` WHERE `id` = UNHEX(:id);"
+
+func (repo *registryCredentialDAO) Delete(ctx context.Context, id string) error {
+	logger := log.FromContext(ctx)
+	m := map[string]interface{}{
+		"id": id,
+	}
+
+	_, err := repo.db.NamedExec(deleteRegistryCredentialSQL, m)
+	if err != nil {
+		logger.Errorf("abb: delete registry credential fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const findRegistryCredentialSQL = "SELECT LOWER(HEX(id)) as `id`, LOWER(HEX(cluster_id)) as `cluster_id`, `host`, `username`, `password_encrypted`, `created_at`, `updated_at` FROM registry_credentials WHERE 1=1"
+
+func (repo *registryCredentialDAO) Find(ctx context.Context, opts types.RegistryCredentialFilterOptions) ([]*types.RegistryCredential, error) {
+	logger := log.FromContext(ctx)
+
+	findSQL := findRegistryCredentialSQL
+	param := map[string]interface{}{}
+
+	if len(opts.ID) > 0 {
+		findSQL += " AND id = UNHEX(:id)"
+		param["id"] = strings.Replace(opts.ID, "-", "", -1)
+	}
+
+	if len(opts.ClusterID) > 0 {
+		findSQL += " AND cluster_id = UNHEX(:cluster_id)"
+		param["cluster_id"] = opts.ClusterID
+	}
+
+	if len(opts.Host) > 0 {
+		findSQL += " AND host = :host"
+		param["host"] = opts.Host
+	}
+
+	credentials := []*types.RegistryCredential{}
+	findSQLStmt, err := repo.db.PrepareNamed(findSQL)
+	if err != nil {
+		logger.Errorf("abb: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer findSQLStmt.Close()
+
+	err = findSQLStmt.Select(&credentials, param)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return credentials, nil
+		}
+		logger.Errorf("abb: list registry credentials fail: %v", err)
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func (repo *registryCredentialDAO) FindOne(ctx context.Context, opts types.RegistryCredentialFilterOptions) (*types.RegistryCredential, error) {
+	result, err := repo.Find(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	return result[0], nil
+}
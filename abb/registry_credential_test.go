@@ -0,0 +1,28 @@
+package abb
+
+import (
+	"testing"
+
+	"github.com/jasonsoft/abb/app"
+)
+
+func TestEncryptRegistryPasswordNeedsSecretKey(t *testing.T) {
+	secretKey := _config.Registry.SecretKey
+	defer func() { _config.Registry.SecretKey = secretKey }()
+
+	_config.Registry.SecretKey = ""
+	_, err := encryptRegistryPassword("s3cret")
+	if appErr, ok := err.(app.AppError); !ok || appErr.ErrorCode != "invalid_config" {
+		t.Fatalf("expected invalid_config, got %v", err)
+	}
+
+	_config.Registry.SecretKey = "key"
+	encrypted, err := encryptRegistryPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := app.AESDecryptFromBase64(encrypted, "key")
+	if err != nil || password != "s3cret" {
+		t.Fatalf("expected the password to be decrypted, got %q %v", password, err)
+	}
+}
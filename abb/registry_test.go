@@ -0,0 +1,141 @@
+package abb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const testManifestDigest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func newTestRegistryClient() *registryClient {
+	return &registryClient{
+		httpClient: http.DefaultClient,
+	}
+}
+
+func TestResolveDigestAnswersBearerChallenge(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.URL.Query().Get("scope") != "repository:myapp:pull" {
+				t.Errorf("unexpected scope: %s", r.URL.Query().Get("scope"))
+			}
+			w.Write([]byte(`{"token":"abc"}`))
+		case "/v2/myapp/manifests/1.0":
+			if r.Method != "HEAD" {
+				t.Errorf("unexpected method: %s", r.Method)
+			}
+			if !strings.Contains(r.Header.Get("Accept"), mediaTypeManifestList) {
+				t.Errorf("manifest list isn't accepted: %s", r.Header.Get("Accept"))
+			}
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:myapp:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", testManifestDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	image, dgst, err := newTestRegistryClient().ResolveDigest(context.Background(), host+"/myapp:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst != digest.Digest(testManifestDigest) {
+		t.Errorf("expected digest %s, got %s", testManifestDigest, dgst)
+	}
+	if expected := host + "/myapp:1.0@" + testManifestDigest; image != expected {
+		t.Errorf("expected image %s, got %s", expected, image)
+	}
+}
+
+func TestResolveDigestFailsWithoutDigestHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	_, _, err := newTestRegistryClient().ResolveDigest(context.Background(), host+"/myapp:1.0")
+	if err == nil {
+		t.Fatal("expected an error when the registry returns no digest")
+	}
+}
+
+func TestResolveDigestFailsWhenTagIsMissing(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	_, _, err := newTestRegistryClient().ResolveDigest(context.Background(), host+"/myapp:missing")
+	if err == nil {
+		t.Fatal("expected an error when the tag is missing")
+	}
+}
+
+func TestResolveDigestKeepsPinnedImage(t *testing.T) {
+	image := "myapp:1.0@" + testManifestDigest
+	result, dgst, err := newTestRegistryClient().ResolveDigest(context.Background(), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != image || dgst != digest.Digest(testManifestDigest) {
+		t.Errorf("pinned image was changed: %s %s", result, dgst)
+	}
+}
+
+func newBasicAuthRegistry(t *testing.T, username, password string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+}
+
+func TestRegistryLogin(t *testing.T) {
+	server := newBasicAuthRegistry(t, "deployer", "s3cret")
+	defer server.Close()
+
+	cred := &types.RegistryCredential{
+		Host:     server.URL,
+		Username: "deployer",
+		Password: "s3cret",
+	}
+	err := newTestRegistryClient().Login(context.Background(), cred)
+	if err != nil {
+		t.Fatalf("expected login to succeed, got %v", err)
+	}
+}
+
+func TestRegistryLoginFailsWithWrongPassword(t *testing.T) {
+	server := newBasicAuthRegistry(t, "deployer", "s3cret")
+	defer server.Close()
+
+	cred := &types.RegistryCredential{
+		Host:     server.URL,
+		Username: "deployer",
+		Password: "wrong",
+	}
+	err := newTestRegistryClient().Login(context.Background(), cred)
+	appErr, ok := err.(app.AppError)
+	if !ok || appErr.ErrorCode != "registry_login_fail" {
+		t.Fatalf("expected registry_login_fail, got %v", err)
+	}
+}
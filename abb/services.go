@@ -3,6 +3,7 @@ package abb
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
+	"github.com/docker/distribution/reference"
 	dockerTypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
@@ -54,6 +56,7 @@ func newDockerServiceSpec(target *types.Service, networks []dockerTypes.NetworkR
 	}
 
 	spec.Annotations.Name = target.Name
+	spec.Annotations.Labels = target.Spec.Labels
 	spec.TaskTemplate.ContainerSpec.Image = target.Spec.Image
 	spec.TaskTemplate.ContainerSpec.Env = target.Spec.Environments
 	spec.TaskTemplate.ContainerSpec.Command = target.Spec.Command
@@ -133,6 +136,9 @@ func newDockerServiceSpec(target *types.Service, networks []dockerTypes.NetworkR
 		spec.TaskTemplate.Placement.Constraints = append(spec.TaskTemplate.Placement.Constraints, placement)
 	}
 
+	// resources
+	spec.TaskTemplate.Resources = newSwarmResourceRequirements(target.Spec.Deploy.Resources)
+
 	// secrets
 	secretRefs := []*swarm.SecretReference{}
 	for _, secret := range target.Spec.Secrets {
@@ -199,21 +205,25 @@ func newDockerServiceSpec(target *types.Service, networks []dockerTypes.NetworkR
 // ************************
 
 type ServiceManager struct {
-	client  *client.Client
-	cluster *types.Cluster
-	repo    types.ServiceRepository
+	client         *client.Client
+	cluster        *types.Cluster
+	repo           types.ServiceRepository
+	deploymentRepo types.DeploymentRepository
+	credentialRepo types.RegistryCredentialRepository
 }
 
-func NewServiceManager(cluster *types.Cluster, repo types.ServiceRepository) (types.ServiceService, error) {
-	client, err := client.NewClient(cluster.Host, "1.30", nil, nil)
+func NewServiceManager(cluster *types.Cluster, repo types.ServiceRepository, deploymentRepo types.DeploymentRepository, credentialRepo types.RegistryCredentialRepository) (types.ServiceService, error) {
+	client, err := newDockerClient(cluster)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ServiceManager{
-		client:  client,
-		cluster: cluster,
-		repo:    repo,
+		client:         client,
+		cluster:        cluster,
+		repo:           repo,
+		deploymentRepo: deploymentRepo,
+		credentialRepo: credentialRepo,
 	}, nil
 }
 
@@ -448,6 +458,19 @@ func (m *ServiceManager) List(ctx context.Context, opts types.ServiceFilterOptio
 		panic(err)
 	}
 
+	if opts.Teams != nil {
+		ownedList := []*types.Service{}
+		for _, svc := range svcList {
+			for _, team := range opts.Teams {
+				if strings.EqualFold(svc.Team, team) {
+					ownedList = append(ownedList, svc)
+					break
+				}
+			}
+		}
+		svcList = ownedList
+	}
+
 	if len(svcList) > 0 {
 		dockerServiceStatus := m.deploymentStatusList(ctx)
 
@@ -463,36 +486,121 @@ func (m *ServiceManager) List(ctx context.Context, opts types.ServiceFilterOptio
 	return svcList, nil
 }
 
-func (m *ServiceManager) Redeploy(ctx context.Context, id string) error {
+func (m *ServiceManager) Redeploy(ctx context.Context, id string, opts types.RedeployOptions) (err error) {
 	logger := log.FromContext(ctx)
 
+	// get service
+	service, err := m.ServiceGetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if service == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+	}
+
+	deployment := &types.Deployment{
+		ID:          uuid.NewV4().String(),
+		ClusterID:   m.cluster.ID,
+		ServiceID:   service.ID,
+		ServiceName: service.Name,
+		Image:       service.Spec.Image,
+		Actor:       actorFromContext(ctx),
+	}
+	// the deployments which fail before they reach the swarm are recorded as well
+	defer func() {
+		m.recordDeployment(ctx, deployment, err)
+	}()
+
 	// get docker networks
 	networkOpts := dockerTypes.NetworkListOptions{}
 	networkList, err := m.client.NetworkList(ctx, networkOpts)
+	if err != nil {
+		return err
+	}
 
 	// get docker configs
 	configOpts := dockerTypes.ConfigListOptions{}
 	configList, err := m.client.ConfigList(ctx, configOpts)
+	if err != nil {
+		return err
+	}
 
 	// get docker secrets
 	secretOpts := dockerTypes.SecretListOptions{}
 	secretList, err := m.client.SecretList(ctx, secretOpts)
-
-	// get service
-	service, err := m.ServiceGetByID(ctx, id)
 	if err != nil {
 		return err
 	}
 
+	if opts.CreateNetworks {
+		networkList, err = ensureNetworks(ctx, m.client, service, networkList)
+		if err != nil {
+			return err
+		}
+	} else if missing := missingNetworks(service, networkList); len(missing) > 0 {
+		return app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("networks %s were not found", strings.Join(missing, ", "))}
+	}
+
 	dockerSvcSpec := newDockerServiceSpec(service, networkList, configList, secretList)
 
+	credentials, err := loadRegistryCredentials(ctx, m.credentialRepo, m.cluster.ID)
+	if err != nil {
+		return err
+	}
+	registry := newRegistryClient(credentials)
+
+	// pin the image by digest, so we know what exactly runs.  Like the docker cli, we still deploy the tag when the registry can't be reached.
+	pinnedImage, dgst, err := registry.ResolveDigest(ctx, service.Spec.Image)
+	if err != nil {
+		logger.Warnf("abb: image %s could not be accessed on a registry to record its digest: %v", service.Spec.Image, err)
+	} else {
+		dockerSvcSpec.TaskTemplate.ContainerSpec.Image = pinnedImage
+		deployment.Digest = dgst.String()
+	}
+
+	// private registry needs the credential to pull the image on every node
+	encodedAuth := ""
+	if cred := registry.credentialFor(imageHost(service.Spec.Image)); cred != nil {
+		encodedAuth, err = encodeRegistryAuth(cred)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.deploy(ctx, service, dockerSvcSpec, encodedAuth)
+}
+
+// recordDeployment stores the result of the deployment; the deployments aren't stored by mongo.
+func (m *ServiceManager) recordDeployment(ctx context.Context, deployment *types.Deployment, err error) {
+	if err != nil {
+		deployment.State = "failed"
+		deployment.Message = err.Error()
+	} else {
+		deployment.State = "success"
+	}
+	_deploymentsTotal.Inc(m.cluster.Name, deployment.ServiceName, deployment.State)
+
+	if m.deploymentRepo == nil {
+		return
+	}
+	if repoErr := m.deploymentRepo.Insert(ctx, deployment); repoErr != nil {
+		log.FromContext(ctx).Errorf("abb: record deployment fail: %v", repoErr)
+	}
+}
+
+func (m *ServiceManager) deploy(ctx context.Context, service *types.Service, dockerSvcSpec swarm.ServiceSpec, encodedAuth string) error {
+	logger := log.FromContext(ctx)
+
 	// get old spec
 	serviceInspectOptions := dockerTypes.ServiceInspectOptions{}
 	dockerOldSvc, _, err := m.client.ServiceInspectWithRaw(ctx, service.Name, serviceInspectOptions)
 	if err != nil {
 		if client.IsErrNotFound(err) {
 			// create new docker service
-			createOptions := dockerTypes.ServiceCreateOptions{}
+			createOptions := dockerTypes.ServiceCreateOptions{
+				EncodedRegistryAuth: encodedAuth,
+				QueryRegistry:       len(encodedAuth) > 0,
+			}
 			_, err := m.client.ServiceCreate(ctx, dockerSvcSpec, createOptions)
 			if err != nil {
 				return err
@@ -505,15 +613,171 @@ func (m *ServiceManager) Redeploy(ctx context.Context, id string) error {
 
 	// new spec with force update
 	dockerSvcSpec.TaskTemplate.ForceUpdate = dockerOldSvc.Spec.TaskTemplate.ForceUpdate + 1
-	updateOpt := dockerTypes.ServiceUpdateOptions{}
+	updateOpt := dockerTypes.ServiceUpdateOptions{
+		EncodedRegistryAuth: encodedAuth,
+		QueryRegistry:       len(encodedAuth) > 0,
+	}
 	_, err = m.client.ServiceUpdate(ctx, dockerOldSvc.ID, dockerOldSvc.Version, dockerSvcSpec, updateOpt)
 	if err != nil {
-		logger.Panicf("abb: update service fail: %s", err.Error())
+		logger.Errorf("abb: update service fail: %v", err)
+		return err
 	}
 
 	return nil
 }
 
+// Scale changes the replicas of the swarm service and the stored spec.  Only the replicas are changed,
+// so the running tasks aren't restarted like Redeploy does.  The version is the version of the swarm service
+// which the caller read; zero means the current version.
+func (m *ServiceManager) Scale(ctx context.Context, id string, replicas uint64, version uint64) (*types.ServiceScaleResult, error) {
+	logger := log.FromContext(ctx)
+
+	service, err := m.ServiceGetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if service == nil {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+	}
+
+	dockerSvc, _, err := m.client.ServiceInspectWithRaw(ctx, service.Name, dockerTypes.ServiceInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, app.AppError{ErrorCode: "not_found", Message: fmt.Sprintf("service %s isn't deployed", service.Name)}
+		}
+		logger.Errorf("abb: get service error: %v", err)
+		return nil, err
+	}
+	if dockerSvc.Spec.Mode.Replicated == nil || dockerSvc.Spec.Mode.Replicated.Replicas == nil {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: fmt.Sprintf("service %s is global and can't be scaled", service.Name)}
+	}
+
+	if version > 0 && version != dockerSvc.Version.Index {
+		msg := fmt.Sprintf("service %s was changed by others, read it and try again", service.Name)
+		return nil, app.AppError{ErrorCode: "conflict", Message: msg}
+	}
+
+	result := &types.ServiceScaleResult{
+		ServiceID:        service.ID,
+		Service:          service.Name,
+		PreviousReplicas: *dockerSvc.Spec.Mode.Replicated.Replicas,
+		Replicas:         replicas,
+	}
+
+	// the version makes the update fail when the service was changed after it was read
+	dockerSpec := dockerSvc.Spec
+	dockerSpec.Mode.Replicated.Replicas = &replicas
+	_, err = m.client.ServiceUpdate(ctx, dockerSvc.ID, dockerSvc.Version, dockerSpec, dockerTypes.ServiceUpdateOptions{})
+	if err != nil {
+		logger.Errorf("abb: scale service fail: %v", err)
+		return nil, err
+	}
+
+	// the update increases the version, it is read again so the caller can scale the service again
+	dockerSvc, _, err = m.client.ServiceInspectWithRaw(ctx, dockerSvc.ID, dockerTypes.ServiceInspectOptions{})
+	if err != nil {
+		logger.Errorf("abb: get service error: %v", err)
+		return nil, err
+	}
+	result.Version = dockerSvc.Version.Index
+
+	// keep the stored spec in sync, or the next deployment would change the replicas back
+	service.Spec.Deploy.Replicas = replicas
+	err = m.repo.Update(ctx, service)
+	if err != nil {
+		logger.Errorf("abb: update replicas of service fail: %v", err)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (m *ServiceManager) DeploymentList(ctx context.Context, id string) ([]*types.Deployment, error) {
+	service, err := m.ServiceGetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if service == nil {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+	}
+
+	if m.deploymentRepo == nil {
+		// the deployments aren't stored by mongo
+		return []*types.Deployment{}, nil
+	}
+
+	opts := types.DeploymentFilterOptions{
+		ClusterID: m.cluster.ID,
+		ServiceID: service.ID,
+	}
+	return m.deploymentRepo.Find(ctx, opts)
+}
+
+// ImageUpdate compares the image of the service with the tags in the registry.
+func (m *ServiceManager) ImageUpdate(ctx context.Context, id string) (*types.ImageUpdate, error) {
+	service, err := m.ServiceGetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if service == nil {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+	}
+
+	named, err := reference.ParseNormalizedNamed(service.Spec.Image)
+	if err != nil {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "image of the service was invalid"}
+	}
+	named = reference.TagNameOnly(named)
+
+	result := &types.ImageUpdate{
+		Image:      service.Spec.Image,
+		Repository: reference.FamiliarName(named),
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		result.CurrentTag = tagged.Tag()
+	}
+
+	credentials, err := loadRegistryCredentials(ctx, m.credentialRepo, m.cluster.ID)
+	if err != nil {
+		return nil, err
+	}
+	result.Tags, err = newRegistryClient(credentials).Tags(ctx, reference.TrimNamed(named))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Tags) == 0 {
+		return result, nil
+	}
+	result.LatestTag = result.Tags[0].Name
+
+	var current *types.ImageTag
+	for _, tag := range result.Tags {
+		if tag.Name == result.CurrentTag {
+			current = tag
+			break
+		}
+	}
+	if current == nil || current.CreatedAt == nil {
+		return result, nil
+	}
+
+	// the tag was pushed again after the running image was deployed
+	runningDigest := service.DeploymentStatus.Digest
+	if len(runningDigest) > 0 && len(current.Digest) > 0 && runningDigest != current.Digest {
+		result.NewerTagAvailable = true
+		return result, nil
+	}
+
+	for _, tag := range result.Tags {
+		if tag.CreatedAt != nil && tag.CreatedAt.After(*current.CreatedAt) && tag.Digest != current.Digest {
+			result.NewerTagAvailable = true
+			break
+		}
+	}
+
+	return result, nil
+}
+
 func (m *ServiceManager) ServiceDelete(ctx context.Context, id string) error {
 	logger := log.FromContext(ctx)
 
@@ -556,7 +820,7 @@ func newServiceDAO(db *sqlx.DB) types.ServiceRepository {
 	}
 }
 
-const insertServiceSQL = "INSERT INTO `services` (`id`, `cluster_id`, `name`, `specJSON`, `created_at`, `updated_at`) VALUES (UNHEX(:id), UNHEX(:cluster_id), :name, :specJSON, :created_at, :updated_at);"
+const insertServiceSQL = "INSERT INTO `services` (`id`, `cluster_id`, `name`, `team`, `specJSON`, `created_at`, `updated_at`) VALUES (UNHEX(:id), UNHEX(:cluster_id), :name, :team, :specJSON, :created_at, :updated_at);"
 
 func (repo *serviceDAO) Insert(ctx context.Context, entity *types.Service) error {
 	logger := log.FromContext(ctx)
@@ -586,7 +850,7 @@ func (repo *serviceDAO) Insert(ctx context.Context, entity *types.Service) error
 	return nil
 }
 
-const updateServiceSQL = "UPDATE `services` SET `cluster_id`=  UNHEX(:cluster_id), `name`= :name, `specJSON`= :specJSON, `updated_at`= :updated_at WHERE id = UNHEX(:id);"
+const updateServiceSQL = "UPDATE `services` SET `cluster_id`=  UNHEX(:cluster_id), `name`= :name, `team`= :team, `specJSON`= :specJSON, `updated_at`= :updated_at WHERE id = UNHEX(:id);"
 
 func (repo *serviceDAO) Update(ctx context.Context, entity *types.Service) error {
 	logger := log.FromContext(ctx)
@@ -624,7 +888,7 @@ func (repo *serviceDAO) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
-const listServiceListSQL = "SELECT LOWER(HEX(id)) as `id`, LOWER(HEX(cluster_id)) as `cluster_id`, `name`, `specJSON`, created_at, updated_at FROM services WHERE 1=1"
+const listServiceListSQL = "SELECT LOWER(HEX(id)) as `id`, LOWER(HEX(cluster_id)) as `cluster_id`, `name`, `team`, `specJSON`, created_at, updated_at FROM services WHERE 1=1"
 
 func (repo *serviceDAO) Find(ctx context.Context, opts types.ServiceFilterOptions) ([]*types.Service, error) {
 	logger := log.FromContext(ctx)
@@ -0,0 +1,208 @@
+package abb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+)
+
+type fakeServiceRepo struct {
+	types.ServiceRepository
+	service *types.Service
+}
+
+func (repo *fakeServiceRepo) FindOne(ctx context.Context, opts types.ServiceFilterOptions) (*types.Service, error) {
+	return repo.service, nil
+}
+
+func (repo *fakeServiceRepo) Update(ctx context.Context, target *types.Service) error {
+	repo.service = target
+	return nil
+}
+
+// newFakeSwarm serves one replicated service, every update increases its version.
+func newFakeSwarm(t *testing.T, version uint64) (*httptest.Server, *swarm.Service) {
+	replicas := uint64(2)
+	service := &swarm.Service{ID: "svc-id"}
+	service.Version.Index = version
+	service.Spec.Name = "myapp"
+	service.Spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{Image: "myapp:1.0"}
+	service.Spec.Mode.Replicated = &swarm.ReplicatedService{Replicas: &replicas}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/nodes"), strings.HasSuffix(r.URL.Path, "/tasks"),
+			strings.HasSuffix(r.URL.Path, "/networks"), strings.HasSuffix(r.URL.Path, "/configs"), strings.HasSuffix(r.URL.Path, "/secrets"):
+			w.Write([]byte(`[]`))
+		case strings.HasSuffix(r.URL.Path, "/services"):
+			json.NewEncoder(w).Encode([]*swarm.Service{service})
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/services/"+service.Spec.Name), r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/services/"+service.ID):
+			json.NewEncoder(w).Encode(service)
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/services/"+service.ID+"/update"):
+			if r.URL.Query().Get("version") != strconv.FormatUint(service.Version.Index, 10) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"message":"update out of sequence"}`))
+				return
+			}
+			err := json.NewDecoder(r.Body).Decode(&service.Spec)
+			if err != nil {
+				t.Error(err)
+			}
+			service.Version.Index++
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, service
+}
+
+type fakeDeploymentRepo struct {
+	deployments []*types.Deployment
+}
+
+func (repo *fakeDeploymentRepo) Insert(ctx context.Context, target *types.Deployment) error {
+	repo.deployments = append(repo.deployments, target)
+	return nil
+}
+
+func (repo *fakeDeploymentRepo) Find(ctx context.Context, opts types.DeploymentFilterOptions) ([]*types.Deployment, error) {
+	return repo.deployments, nil
+}
+
+func newTestServiceManager(t *testing.T, server *httptest.Server) (*ServiceManager, *fakeServiceRepo) {
+	dockerClient, err := client.NewClient(strings.Replace(server.URL, "http://", "tcp://", 1), "1.30", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakeServiceRepo{service: &types.Service{ID: "abc", Name: "myapp"}}
+	manager := &ServiceManager{
+		client:  dockerClient,
+		cluster: &types.Cluster{ID: "cluster"},
+		repo:    repo,
+	}
+	return manager, repo
+}
+
+func TestScaleReturnsNewVersion(t *testing.T) {
+	server, dockerSvc := newFakeSwarm(t, 10)
+	defer server.Close()
+	manager, repo := newTestServiceManager(t, server)
+
+	result, err := manager.Scale(context.Background(), "abc", 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PreviousReplicas != 2 || result.Replicas != 5 {
+		t.Errorf("expected 2 to 5 replicas, got %d to %d", result.PreviousReplicas, result.Replicas)
+	}
+	if *dockerSvc.Spec.Mode.Replicated.Replicas != 5 || repo.service.Spec.Deploy.Replicas != 5 {
+		t.Error("expected the swarm service and the stored spec to be scaled")
+	}
+	if result.Version != 11 {
+		t.Fatalf("expected the version after the update, got %d", result.Version)
+	}
+
+	// the returned version can be used to scale again
+	_, err = manager.Scale(context.Background(), "abc", 3, result.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScaleRejectsChangedService(t *testing.T) {
+	server, dockerSvc := newFakeSwarm(t, 10)
+	defer server.Close()
+	manager, _ := newTestServiceManager(t, server)
+
+	_, err := manager.Scale(context.Background(), "abc", 5, 9)
+	appErr, ok := err.(app.AppError)
+	if !ok || appErr.ErrorCode != "conflict" {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if *dockerSvc.Spec.Mode.Replicated.Replicas != 2 {
+		t.Error("expected the changed service not to be scaled")
+	}
+}
+
+func TestRedeployPinsResolvedDigest(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/myapp/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", testManifestDigest)
+	}))
+	defer registry.Close()
+	server, dockerService := newFakeSwarm(t, 10)
+	defer server.Close()
+
+	manager, repo := newTestServiceManager(t, server)
+	deploymentRepo := &fakeDeploymentRepo{}
+	manager.deploymentRepo = deploymentRepo
+	image := strings.TrimPrefix(registry.URL, "http://") + "/myapp:1.0"
+	repo.service.Spec.Image = image
+
+	err := manager.Redeploy(context.Background(), "abc", types.RedeployOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the swarm runs the digest, the stored spec keeps the tag
+	if expected := image + "@" + testManifestDigest; dockerService.Spec.TaskTemplate.ContainerSpec.Image != expected {
+		t.Errorf("expected the swarm to run %s, got %s", expected, dockerService.Spec.TaskTemplate.ContainerSpec.Image)
+	}
+	if repo.service.Spec.Image != image {
+		t.Errorf("expected the stored image %s, got %s", image, repo.service.Spec.Image)
+	}
+	if len(deploymentRepo.deployments) != 1 {
+		t.Fatalf("expected one deployment, got %d", len(deploymentRepo.deployments))
+	}
+	deployment := deploymentRepo.deployments[0]
+	if deployment.State != "success" || deployment.Digest != testManifestDigest || deployment.Image != image {
+		t.Errorf("unexpected deployment: %+v", deployment)
+	}
+}
+
+func TestRedeployRecordsFailure(t *testing.T) {
+	server, _ := newFakeSwarm(t, 10)
+	defer server.Close()
+
+	manager, repo := newTestServiceManager(t, server)
+	deploymentRepo := &fakeDeploymentRepo{}
+	manager.deploymentRepo = deploymentRepo
+	repo.service.Spec.Image = "myapp:1.0"
+	repo.service.Spec.Networks = []string{"missing"}
+
+	err := manager.Redeploy(context.Background(), "abc", types.RedeployOptions{})
+	if err == nil {
+		t.Fatal("expected the missing network to fail the redeploy")
+	}
+	if len(deploymentRepo.deployments) != 1 || deploymentRepo.deployments[0].State != "failed" {
+		t.Fatalf("expected the failed deployment to be recorded, got %+v", deploymentRepo.deployments)
+	}
+}
+
+func TestDeploymentListWithoutRepository(t *testing.T) {
+	server, _ := newFakeSwarm(t, 10)
+	defer server.Close()
+
+	manager, _ := newTestServiceManager(t, server)
+	deployments, err := manager.DeploymentList(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments) != 0 {
+		t.Errorf("expected no deployments, got %d", len(deployments))
+	}
+}
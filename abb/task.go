@@ -20,7 +20,7 @@ type TaskManager struct {
 }
 
 func newTaskManager(cluster *types.Cluster) (types.TaskService, error) {
-	client, err := client.NewClient(cluster.Host, "1.30", nil, nil)
+	client, err := newDockerClient(cluster)
 	if err != nil {
 		return nil, err
 	}
@@ -109,6 +109,93 @@ func (m *TaskManager) List(ctx context.Context, opts types.TaskListOption) ([]ty
 	return result, nil
 }
 
+// Get returns the task with its container, ports, addresses and the previous tasks of the same slot
+func (m *TaskManager) Get(ctx context.Context, taskID string) (*types.TaskDetail, error) {
+	logger := log.FromContext(ctx)
+
+	task, _, err := m.client.TaskInspectWithRaw(ctx, taskID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, nil
+		}
+		logger.Errorf("abb: get task fail: %v", err)
+		return nil, err
+	}
+
+	dockerService, _, err := m.client.ServiceInspectWithRaw(ctx, task.ServiceID, dockerTypes.ServiceInspectOptions{})
+	if err != nil && !client.IsErrNotFound(err) {
+		logger.Errorf("abb: get task fail: %v", err)
+		return nil, err
+	}
+
+	nodes, err := m.client.NodeList(ctx, dockerTypes.NodeListOptions{})
+	if err != nil {
+		logger.Errorf("abb: get task fail: %v", err)
+		return nil, err
+	}
+	hostnames := map[string]string{}
+	for _, node := range nodes {
+		hostnames[node.ID] = node.Description.Hostname
+	}
+
+	result := &types.TaskDetail{
+		TaskHistory: newTaskHistory(task, hostnames[task.NodeID]),
+		ServiceID:   task.ServiceID,
+		ServiceName: dockerService.Spec.Name,
+		NodeID:      task.NodeID,
+		Ports:       []types.PortInfo{},
+		Networks:    []types.TaskNetworkAddress{},
+		History:     []types.TaskHistory{},
+		CreatedAt:   task.CreatedAt,
+		UpdatedAt:   task.UpdatedAt,
+	}
+
+	if task.Status.ContainerStatus != nil {
+		result.ContainerID = task.Status.ContainerStatus.ContainerID
+		result.PID = task.Status.ContainerStatus.PID
+	}
+
+	for _, port := range task.Status.PortStatus.Ports {
+		result.Ports = append(result.Ports, types.PortInfo{
+			Target:    port.TargetPort,
+			Published: port.PublishedPort,
+			Protocol:  string(port.Protocol),
+			Mode:      string(port.PublishMode),
+		})
+	}
+
+	for _, attachment := range task.NetworksAttachments {
+		result.Networks = append(result.Networks, types.TaskNetworkAddress{
+			Network:   attachment.Network.Spec.Name,
+			Addresses: attachment.Addresses,
+		})
+	}
+
+	// the previous tasks of the slot were replaced by this task, global services have a task per node instead
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("service", task.ServiceID)
+	tasks, err := m.client.TaskList(ctx, dockerTypes.TaskListOptions{Filters: filterArgs})
+	if err != nil {
+		logger.Errorf("abb: get task fail: %v", err)
+		return nil, err
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Status.Timestamp.After(tasks[j].Status.Timestamp)
+	})
+	for _, previous := range tasks {
+		if previous.ID == task.ID {
+			continue
+		}
+		sameSlot := task.Slot > 0 && previous.Slot == task.Slot
+		sameNode := task.Slot == 0 && previous.NodeID == task.NodeID
+		if sameSlot || sameNode {
+			result.History = append(result.History, newTaskHistory(previous, hostnames[previous.NodeID]))
+		}
+	}
+
+	return result, nil
+}
+
 func (m *TaskManager) Close(ctx context.Context) error {
 	return m.client.Close()
 }
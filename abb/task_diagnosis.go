@@ -0,0 +1,253 @@
+package abb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+)
+
+// the scheduler appends the node count to its errors, such as "no suitable node (... on 3 nodes)"
+var nodeCountRegexp = regexp.MustCompile(`on \d+ nodes?`)
+
+// crashLoopThreshold is how many times the tasks must exit by the same error before it is a crash loop
+const crashLoopThreshold = 3
+
+// Diagnose explains why the tasks of the service are pending or failing.  The service id is the id of docker service.
+func (m *TaskManager) Diagnose(ctx context.Context, serviceID string) (*types.TaskDiagnosis, error) {
+	logger := log.FromContext(ctx)
+
+	dockerService, _, err := m.client.ServiceInspectWithRaw(ctx, serviceID, dockerTypes.ServiceInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+		}
+		logger.Errorf("abb: diagnose service fail: %v", err)
+		return nil, err
+	}
+
+	nodes, err := m.client.NodeList(ctx, dockerTypes.NodeListOptions{})
+	if err != nil {
+		logger.Errorf("abb: diagnose service fail: %v", err)
+		return nil, err
+	}
+	hostnames := map[string]string{}
+	for _, node := range nodes {
+		hostnames[node.ID] = node.Description.Hostname
+	}
+
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("service", dockerService.ID)
+	tasks, err := m.client.TaskList(ctx, dockerTypes.TaskListOptions{Filters: filterArgs})
+	if err != nil {
+		logger.Errorf("abb: diagnose service fail: %v", err)
+		return nil, err
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].Status.Timestamp.After(tasks[j].Status.Timestamp)
+	})
+
+	result := &types.TaskDiagnosis{
+		ServiceID: dockerService.ID,
+		Service:   dockerService.Spec.Name,
+		Failures:  []types.TaskFailureGroup{},
+		Tasks:     []types.TaskHistory{},
+	}
+
+	groups := map[string]*types.TaskFailureGroup{}
+	keys := []string{}
+
+	for _, task := range tasks {
+		history := newTaskHistory(task, hostnames[task.NodeID])
+		result.Tasks = append(result.Tasks, history)
+
+		if task.DesiredState == swarm.TaskStateRunning {
+			result.Replicas++
+			if task.Status.State == swarm.TaskStateRunning {
+				result.Running++
+			}
+		}
+
+		if !taskHasFailed(task) {
+			continue
+		}
+
+		cause := taskFailureCause(history)
+		errMsg := nodeCountRegexp.ReplaceAllString(taskError(history), "on N nodes")
+		key := cause + "|" + errMsg
+		group, found := groups[key]
+		if !found {
+			group = &types.TaskFailureGroup{
+				Cause:    cause,
+				Error:    errMsg,
+				TaskIDs:  []string{},
+				LastSeen: history.TimeStamp,
+			}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		group.Count++
+		group.TaskIDs = append(group.TaskIDs, history.ID)
+		if history.ExitCode != 0 && !containsInt(group.ExitCodes, history.ExitCode) {
+			group.ExitCodes = append(group.ExitCodes, history.ExitCode)
+		}
+	}
+
+	// global services have one task per eligible node, replicated services have the desired replicas
+	if dockerService.Spec.Mode.Replicated != nil && dockerService.Spec.Mode.Replicated.Replicas != nil {
+		result.Replicas = int(*dockerService.Spec.Mode.Replicated.Replicas)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		// the containers which exit over and over are a crash loop instead of unrelated failures
+		if group.Cause == types.TaskCauseUnknown && len(group.ExitCodes) > 0 && group.Count >= crashLoopThreshold {
+			group.Cause = types.TaskCauseCrashLoop
+		}
+		group.Hint = taskFailureHint(group)
+		result.Failures = append(result.Failures, *group)
+	}
+	sort.SliceStable(result.Failures, func(i, j int) bool {
+		return result.Failures[i].LastSeen.After(result.Failures[j].LastSeen)
+	})
+
+	result.Healthy = result.Running >= result.Replicas
+	switch {
+	case result.Healthy:
+		result.Summary = fmt.Sprintf("%d/%d tasks are running", result.Running, result.Replicas)
+	case len(result.Failures) > 0:
+		result.Summary = fmt.Sprintf("%d/%d tasks are running, the latest failure is %s: %s", result.Running, result.Replicas, result.Failures[0].Cause, result.Failures[0].Error)
+	default:
+		result.Summary = fmt.Sprintf("%d/%d tasks are running, the other tasks are still starting", result.Running, result.Replicas)
+	}
+
+	return result, nil
+}
+
+func newTaskHistory(task swarm.Task, hostname string) types.TaskHistory {
+	history := types.TaskHistory{
+		ID:           task.ID,
+		Node:         hostname,
+		Slot:         task.Slot,
+		DesiredState: string(task.DesiredState),
+		State:        string(task.Status.State),
+		Message:      task.Status.Message,
+		Error:        task.Status.Err,
+		TimeStamp:    task.Status.Timestamp,
+	}
+	if task.Spec.ContainerSpec != nil {
+		history.Image = task.Spec.ContainerSpec.Image
+	}
+	if task.Status.ContainerStatus != nil {
+		history.ExitCode = task.Status.ContainerStatus.ExitCode
+	}
+	return history
+}
+
+// taskHasFailed tells whether the task failed, or is stuck in pending by the scheduler
+func taskHasFailed(task swarm.Task) bool {
+	switch task.Status.State {
+	case swarm.TaskStateFailed, swarm.TaskStateRejected:
+		return true
+	case swarm.TaskStatePending:
+		return len(task.Status.Err) > 0
+	}
+	return false
+}
+
+func taskError(history types.TaskHistory) string {
+	if len(history.Error) > 0 {
+		return history.Error
+	}
+	return history.Message
+}
+
+func taskFailureCause(history types.TaskHistory) string {
+	errMsg := strings.ToLower(taskError(history))
+
+	switch {
+	case strings.Contains(errMsg, "unauthorized") || strings.Contains(errMsg, "pull access denied") || strings.Contains(errMsg, "authentication required"):
+		return types.TaskCauseUnauthorized
+	case strings.Contains(errMsg, "no such image") || strings.Contains(errMsg, "manifest unknown") || strings.Contains(errMsg, "image not found") || strings.Contains(errMsg, "error pulling image") || strings.Contains(errMsg, "pull"):
+		return types.TaskCauseImagePull
+	case strings.Contains(errMsg, "insufficient resources"):
+		return types.TaskCauseInsufficientResources
+	case strings.Contains(errMsg, "port already in use") || strings.Contains(errMsg, "port is already allocated") || strings.Contains(errMsg, "address already in use"):
+		return types.TaskCausePortConflict
+	case strings.Contains(errMsg, "no suitable node"):
+		return types.TaskCauseNoSuitableNode
+	case strings.Contains(errMsg, "secret") && strings.Contains(errMsg, "not found"):
+		return types.TaskCauseMissingSecret
+	case strings.Contains(errMsg, "config") && strings.Contains(errMsg, "not found"):
+		return types.TaskCauseMissingConfig
+	}
+	return types.TaskCauseUnknown
+}
+
+func taskFailureHint(group *types.TaskFailureGroup) string {
+	switch group.Cause {
+	case types.TaskCauseUnauthorized:
+		return "the nodes can't pull the image from the private registry, add or fix the registry credential of the cluster and redeploy the service"
+	case types.TaskCauseImagePull:
+		return "the image or tag doesn't exist on the registry, check the image of the service"
+	case types.TaskCauseNoSuitableNode:
+		return "no active node matches the placement constraints, check the constraints of the service and the labels of the nodes"
+	case types.TaskCauseInsufficientResources:
+		return "the nodes don't have enough free cpu or memory for the reservations, lower the reservations or add nodes; see the capacity of the cluster"
+	case types.TaskCausePortConflict:
+		return "the published host port is already used on the nodes, use ingress mode or another port"
+	case types.TaskCauseMissingSecret:
+		return "the secret doesn't exist on the cluster, create it before the service is deployed"
+	case types.TaskCauseMissingConfig:
+		return "the config doesn't exist on the cluster, create it before the service is deployed"
+	case types.TaskCauseCrashLoop:
+		hints := []string{}
+		for _, code := range group.ExitCodes {
+			hints = append(hints, exitCodeHint(code))
+		}
+		return "the container keeps exiting: " + strings.Join(hints, "; ") + "; check the logs of the service"
+	}
+
+	if len(group.ExitCodes) > 0 {
+		return exitCodeHint(group.ExitCodes[0]) + "; check the logs of the service"
+	}
+	return "check the error and the logs of the service"
+}
+
+func exitCodeHint(code int) string {
+	switch code {
+	case 1:
+		return "exit code 1 is an error of the application"
+	case 125:
+		return "exit code 125 means the container failed to run"
+	case 126:
+		return "exit code 126 means the command isn't executable"
+	case 127:
+		return "exit code 127 means the command wasn't found in the image"
+	case 137:
+		return "exit code 137 means the container was killed, often out of memory; raise the memory limit"
+	case 139:
+		return "exit code 139 means the application crashed with a segmentation fault"
+	case 143:
+		return "exit code 143 means the container was terminated by SIGTERM"
+	}
+	return fmt.Sprintf("exit code %d", code)
+}
+
+func containsInt(values []int, target int) bool {
+	for _, val := range values {
+		if val == target {
+			return true
+		}
+	}
+	return false
+}
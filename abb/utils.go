@@ -1,16 +1,20 @@
 package abb
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/jasonsoft/abb/identity"
 	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
 	"github.com/nlopes/slack"
 )
 
 func getServicesStatus(services []swarm.Service, nodes []swarm.Node, tasks []swarm.Task) map[string]types.DeploymentStatus {
 	running := map[string]int{}
 	tasksNoShutdown := map[string]int{}
+	runningDigests := map[string]map[string]int{}
 
 	activeNodes := make(map[string]struct{})
 	for _, n := range nodes {
@@ -26,6 +30,15 @@ func getServicesStatus(services []swarm.Service, nodes []swarm.Node, tasks []swa
 
 		if _, nodeActive := activeNodes[task.NodeID]; nodeActive && task.Status.State == swarm.TaskStateRunning {
 			running[task.ServiceID]++
+
+			if task.Spec.ContainerSpec != nil {
+				if dgst := imageDigest(task.Spec.ContainerSpec.Image); len(dgst) > 0 {
+					if runningDigests[task.ServiceID] == nil {
+						runningDigests[task.ServiceID] = map[string]int{}
+					}
+					runningDigests[task.ServiceID][dgst]++
+				}
+			}
 		}
 	}
 
@@ -35,6 +48,7 @@ func getServicesStatus(services []swarm.Service, nodes []swarm.Node, tasks []swa
 			deploymentStatus := types.DeploymentStatus{
 				ServiceName:       service.Spec.Name,
 				Image:             service.Spec.TaskTemplate.ContainerSpec.Image,
+				Digest:            runningDigest(runningDigests[service.ID]),
 				Mode:              "replicated",
 				AvailableReplicas: running[service.ID],
 				Replicas:          (int)(*service.Spec.Mode.Replicated.Replicas),
@@ -47,6 +61,7 @@ func getServicesStatus(services []swarm.Service, nodes []swarm.Node, tasks []swa
 			deploymentStatus := types.DeploymentStatus{
 				ServiceName:       service.Spec.Name,
 				Image:             service.Spec.TaskTemplate.ContainerSpec.Image,
+				Digest:            runningDigest(runningDigests[service.ID]),
 				Mode:              "global",
 				AvailableReplicas: running[service.ID],
 				Replicas:          tasksNoShutdown[service.ID],
@@ -60,6 +75,37 @@ func getServicesStatus(services []swarm.Service, nodes []swarm.Node, tasks []swa
 	return info
 }
 
+// runningDigest returns the digest most of the running tasks use; during a rolling update the tasks may run different digests.
+func runningDigest(digests map[string]int) string {
+	result := ""
+	count := 0
+	for dgst, val := range digests {
+		if val > count || (val == count && dgst < result) {
+			result = dgst
+			count = val
+		}
+	}
+	return result
+}
+
+func actorFromContext(ctx context.Context) string {
+	claims, found := identity.FromContext(ctx)
+	if !found {
+		return ""
+	}
+	actor, _ := claims["sub"].(string)
+	return actor
+}
+
+// sendSlackMessage sends the message to the configured slack channel.
+func sendSlackMessage(msg string) {
+	log.Info(msg)
+	if len(_config.Slack.Token) == 0 || len(_config.Slack.ChannelName) == 0 {
+		return
+	}
+	_slack.SendMessage(_slack.NewOutgoingMessage(msg, GetGroupIDByName(_slack)[_config.Slack.ChannelName]))
+}
+
 func GetGroupIDByName(api *slack.RTM) map[string]string {
 	result := map[string]string{}
 	groups, err := api.GetGroups(false)
@@ -0,0 +1,465 @@
+package abb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/identity"
+	"github.com/jasonsoft/abb/types"
+	"github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ************************
+// Business
+// ************************
+
+// stackNamespaceLabel is set by docker stack deploy on the services of the stack
+const stackNamespaceLabel = "com.docker.stack.namespace"
+
+type WebhookManager struct {
+	cluster *types.Cluster
+	repo    types.WebhookRepository
+}
+
+func NewWebhookManager(cluster *types.Cluster, repo types.WebhookRepository) types.WebhookService {
+	return &WebhookManager{
+		cluster: cluster,
+		repo:    repo,
+	}
+}
+
+// Create creates the webhook and generates its secret; the secret is only returned here and in RegenerateSecret.
+// The secret redeploys the services of the webhook, so the caller must be allowed to redeploy all of them.
+func (m *WebhookManager) Create(ctx context.Context, entity *types.Webhook) error {
+	if len(entity.ServiceID) == 0 && len(entity.Stack) == 0 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "service_id or stack is required"}
+	}
+	if len(entity.ServiceID) > 0 && len(entity.Stack) > 0 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "service_id and stack can't be both set"}
+	}
+
+	serviceManager, err := NewServiceManager(m.cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		return err
+	}
+	services, err := webhookServices(ctx, serviceManager, entity)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		req := identity.AccessRequest{Cluster: m.cluster.Name, Namespace: m.cluster.Name, Resource: "services", ResourceName: service.Name, Labels: service.Spec.Labels, Verb: "redeploy"}
+		if !identity.IsAllowed(ctx, req) {
+			return app.AppError{ErrorCode: "forbidden", Message: fmt.Sprintf("service %s can't be redeployed by you", service.Name)}
+		}
+	}
+	if len(entity.ServiceID) > 0 {
+		entity.ServiceID = services[0].ID
+	}
+
+	secret, err := app.RandomHex(32)
+	if err != nil {
+		return err
+	}
+
+	entity.ID = uuid.NewV4().String()
+	entity.ClusterID = m.cluster.ID
+	entity.SecretEncrypted, err = encryptWebhookSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	err = m.repo.Insert(ctx, entity)
+	if err != nil {
+		return err
+	}
+
+	entity.Secret = secret
+	return nil
+}
+
+// Delete revokes the webhook.
+func (m *WebhookManager) Delete(ctx context.Context, id string) error {
+	old, err := m.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "webhook was not found"}
+	}
+	return m.repo.Delete(ctx, old.ID)
+}
+
+func (m *WebhookManager) Get(ctx context.Context, id string) (*types.Webhook, error) {
+	opts := types.WebhookFilterOptions{
+		ID:        id,
+		ClusterID: m.cluster.ID,
+	}
+	return m.repo.FindOne(ctx, opts)
+}
+
+func (m *WebhookManager) List(ctx context.Context) ([]*types.Webhook, error) {
+	opts := types.WebhookFilterOptions{
+		ClusterID: m.cluster.ID,
+	}
+	return m.repo.Find(ctx, opts)
+}
+
+// RegenerateSecret replaces the secret of the webhook, the old secret stops working immediately.
+func (m *WebhookManager) RegenerateSecret(ctx context.Context, id string) (*types.Webhook, error) {
+	webhook, err := m.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if webhook == nil {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "webhook was not found"}
+	}
+
+	secret, err := app.RandomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	webhook.SecretEncrypted, err = encryptWebhookSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.repo.Update(ctx, webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook.Secret = secret
+	return webhook, nil
+}
+
+// encryptWebhookSecret refuses to store the secret when the secret key isn't configured, otherwise everyone could
+// decrypt it with the empty key and sign the requests.
+func encryptWebhookSecret(secret string) (string, error) {
+	if len(_config.Webhook.SecretKey) == 0 {
+		return "", app.AppError{ErrorCode: "invalid_config", Message: "webhook secret key isn't configured"}
+	}
+	return app.AESEncryptToBase64(secret, _config.Webhook.SecretKey)
+}
+
+// verifyWebhookRequest checks the signature of GitHub, the token of GitLab, or the token in the url which is used by
+// Docker Hub because Docker Hub can't sign the request.
+func verifyWebhookRequest(webhook *types.Webhook, header http.Header, token string, body []byte) bool {
+	secret, err := app.AESDecryptFromBase64(webhook.SecretEncrypted, _config.Webhook.SecretKey)
+	if err != nil {
+		log.Errorf("abb: decrypt webhook secret fail: %v", err)
+		return false
+	}
+
+	if signature := header.Get("X-Hub-Signature-256"); len(signature) > 0 {
+		return verifyHMAC(sha256.New, "sha256=", secret, signature, body)
+	}
+	if signature := header.Get("X-Hub-Signature"); len(signature) > 0 {
+		return verifyHMAC(sha1.New, "sha1=", secret, signature, body)
+	}
+	if gitlabToken := header.Get("X-Gitlab-Token"); len(gitlabToken) > 0 {
+		return subtle.ConstantTimeCompare([]byte(gitlabToken), []byte(secret)) == 1
+	}
+	if len(token) > 0 {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+func verifyHMAC(h func() hash.Hash, prefix string, secret string, signature string, body []byte) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// webhookPayload is the union of the payloads we understand: our own {"image": "org/app:1.2"} or {"tag": "1.2"},
+// GitHub and GitLab tag push events, and Docker Hub push events.
+type webhookPayload struct {
+	Image    string `json:"image"`
+	Tag      string `json:"tag"`
+	Ref      string `json:"ref"`
+	PushData *struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository *struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+// parseWebhookPayload returns the repository, which can be empty, and the tag of the image to deploy.
+func parseWebhookPayload(body []byte) (string, string, error) {
+	payload := webhookPayload{}
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return "", "", app.AppError{ErrorCode: "invalid_input", Message: "payload was invalid"}
+	}
+
+	switch {
+	case len(payload.Image) > 0:
+		named, err := reference.ParseNormalizedNamed(payload.Image)
+		if err != nil {
+			return "", "", app.AppError{ErrorCode: "invalid_input", Message: "image was invalid"}
+		}
+		tagged, ok := named.(reference.Tagged)
+		if !ok {
+			return "", "", app.AppError{ErrorCode: "invalid_input", Message: "image must contain a tag"}
+		}
+		return reference.FamiliarName(named), tagged.Tag(), nil
+	case len(payload.Tag) > 0:
+		return "", payload.Tag, nil
+	case payload.PushData != nil && len(payload.PushData.Tag) > 0:
+		repository := ""
+		if payload.Repository != nil {
+			repository = payload.Repository.RepoName
+		}
+		return repository, payload.PushData.Tag, nil
+	case strings.HasPrefix(payload.Ref, "refs/tags/"):
+		return "", strings.TrimPrefix(payload.Ref, "refs/tags/"), nil
+	}
+
+	return "", "", app.AppError{ErrorCode: "invalid_input", Message: "image tag was not found in the payload"}
+}
+
+// webhookServices returns the service of the webhook, or the services of its stack.
+func webhookServices(ctx context.Context, serviceManager types.ServiceService, webhook *types.Webhook) ([]*types.Service, error) {
+	if len(webhook.ServiceID) > 0 {
+		service, err := serviceManager.ServiceGetByID(ctx, webhook.ServiceID)
+		if err != nil {
+			return nil, err
+		}
+		if service == nil {
+			return nil, app.AppError{ErrorCode: "not_found", Message: "service was not found"}
+		}
+		return []*types.Service{service}, nil
+	}
+
+	list, err := serviceManager.List(ctx, types.ServiceFilterOptions{})
+	if err != nil {
+		return nil, err
+	}
+	services := []*types.Service{}
+	for _, service := range list {
+		// the names can't be used, the services of stack app_v2 start with app_ as well
+		if service.Spec.Labels[stackNamespaceLabel] == webhook.Stack {
+			services = append(services, service)
+		}
+	}
+	if len(services) == 0 {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "stack was not found"}
+	}
+	return services, nil
+}
+
+// triggerWebhook stores the new tag in the specs of the webhook services and redeploys them.
+// The names of the redeployed services are returned.
+func triggerWebhook(ctx context.Context, cluster *types.Cluster, webhook *types.Webhook, repository string, tag string) ([]string, error) {
+	serviceManager, err := NewServiceManager(cluster, _serviceRepo, _deploymentRepo, _credentialRepo)
+	if err != nil {
+		return nil, err
+	}
+	return redeployWebhookServices(ctx, serviceManager, webhook, repository, tag)
+}
+
+func redeployWebhookServices(ctx context.Context, serviceManager types.ServiceService, webhook *types.Webhook, repository string, tag string) ([]string, error) {
+	services, err := webhookServices(ctx, serviceManager, webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, service := range services {
+		named, err := reference.ParseNormalizedNamed(service.Spec.Image)
+		if err != nil {
+			return result, err
+		}
+		named = reference.TrimNamed(named)
+
+		// a stack contains different images, so only the services of the pushed repository are deployed
+		if len(repository) > 0 && !sameRepository(named, repository) {
+			continue
+		}
+
+		tagged, err := reference.WithTag(named, tag)
+		if err != nil {
+			return result, app.AppError{ErrorCode: "invalid_input", Message: "tag was invalid"}
+		}
+		image := reference.FamiliarString(tagged)
+		if image != service.Spec.Image {
+			service.Spec.Image = image
+			err = serviceManager.ServiceUpdate(ctx, service)
+			if err != nil {
+				return result, err
+			}
+		}
+
+		err = serviceManager.Redeploy(ctx, service.ID, types.RedeployOptions{CreateNetworks: _config.Network.AutoCreate})
+		if err != nil {
+			return result, err
+		}
+		result = append(result, service.Name)
+	}
+
+	if len(result) == 0 {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "no service matches the image"}
+	}
+	return result, nil
+}
+
+// clusterByID returns the cluster of the webhook; clusters are few, so they are listed.
+func clusterByID(ctx context.Context, id string) (*types.Cluster, error) {
+	clusters, err := _clusterManager.ClusterList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cluster := range clusters {
+		if cluster.ID == id {
+			return cluster, nil
+		}
+	}
+	return nil, nil
+}
+
+func sameRepository(named reference.Named, repository string) bool {
+	other, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return false
+	}
+	return named.Name() == reference.TrimNamed(other).Name()
+}
+
+// ************************
+// Database
+// ************************
+
+type webhookDAO struct {
+	db *sqlx.DB
+}
+
+func newWebhookDAO(db *sqlx.DB) types.WebhookRepository {
+	return &webhookDAO{
+		db: db,
+	}
+}
+
+const insertWebhookSQL = "INSERT INTO `webhooks` (`id`, `cluster_id`, `name`, `service_id`, `stack`, `secret_encrypted`, `created_at`, `updated_at`) VALUES (UNHEX(:id), UNHEX(:cluster_id), :name, UNHEX(:service_id), :stack, :secret_encrypted, :created_at, :updated_at);"
+
+func (repo *webhookDAO) Insert(ctx context.Context, entity *types.Webhook) error {
+	logger := log.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.ID = strings.Replace(entity.ID, "-", "", -1)
+	entity.CreatedAt = &nowUTC
+	entity.UpdatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertWebhookSQL, entity)
+	if err != nil {
+		logger.Errorf("abb: insert webhook fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const updateWebhookSQL = "UPDATE `webhooks` SET `name` = :name, `secret_encrypted` = :secret_encrypted, `updated_at` = :updated_at WHERE id = UNHEX(:id);"
+
+func (repo *webhookDAO) Update(ctx context.Context, entity *types.Webhook) error {
+	logger := log.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.UpdatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(updateWebhookSQL, entity)
+	if err != nil {
+		logger.Errorf("abb: update webhook fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const deleteWebhookSQL = "DELETE FROM `webhooks` WHERE `id` = UNHEX(:id);"
+
+func (repo *webhookDAO) Delete(ctx context.Context, id string) error {
+	logger := log.FromContext(ctx)
+	m := map[string]interface{}{
+		"id": id,
+	}
+
+	_, err := repo.db.NamedExec(deleteWebhookSQL, m)
+	if err != nil {
+		logger.Errorf("abb: delete webhook fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const findWebhookSQL = "SELECT LOWER(HEX(id)) as `id`, LOWER(HEX(cluster_id)) as `cluster_id`, `name`, LOWER(HEX(service_id)) as `service_id`, `stack`, `secret_encrypted`, `created_at`, `updated_at` FROM webhooks WHERE 1=1"
+
+func (repo *webhookDAO) Find(ctx context.Context, opts types.WebhookFilterOptions) ([]*types.Webhook, error) {
+	logger := log.FromContext(ctx)
+
+	findSQL := findWebhookSQL
+	param := map[string]interface{}{}
+
+	if len(opts.ID) > 0 {
+		findSQL += " AND id = UNHEX(:id)"
+		param["id"] = strings.Replace(opts.ID, "-", "", -1)
+	}
+
+	if len(opts.ClusterID) > 0 {
+		findSQL += " AND cluster_id = UNHEX(:cluster_id)"
+		param["cluster_id"] = opts.ClusterID
+	}
+
+	webhooks := []*types.Webhook{}
+	findSQLStmt, err := repo.db.PrepareNamed(findSQL)
+	if err != nil {
+		logger.Errorf("abb: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer findSQLStmt.Close()
+
+	err = findSQLStmt.Select(&webhooks, param)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return webhooks, nil
+		}
+		logger.Errorf("abb: list webhooks fail: %v", err)
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (repo *webhookDAO) FindOne(ctx context.Context, opts types.WebhookFilterOptions) (*types.Webhook, error) {
+	result, err := repo.Find(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	return result[0], nil
+}
@@ -0,0 +1,151 @@
+package abb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"testing"
+
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/types"
+)
+
+func newTestWebhook(t *testing.T, secret string) *types.Webhook {
+	secretKey := _config.Webhook.SecretKey
+	_config.Webhook.SecretKey = "test-key"
+	t.Cleanup(func() { _config.Webhook.SecretKey = secretKey })
+
+	encrypted, err := encryptWebhookSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.Webhook{ID: "hook", SecretEncrypted: encrypted}
+}
+
+func sign(h func() hash.Hash, secret string, body []byte) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookRequest(t *testing.T) {
+	secret := "s3cret"
+	webhook := newTestWebhook(t, secret)
+	body := []byte(`{"tag":"1.2.0"}`)
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		token  string
+		valid  bool
+	}{
+		{name: "github sha256", header: map[string]string{"X-Hub-Signature-256": "sha256=" + sign(sha256.New, secret, body)}, valid: true},
+		{name: "github sha1", header: map[string]string{"X-Hub-Signature": "sha1=" + sign(sha1.New, secret, body)}, valid: true},
+		{name: "github signed by other secret", header: map[string]string{"X-Hub-Signature-256": "sha256=" + sign(sha256.New, "other", body)}, valid: false},
+		{name: "github signature without prefix", header: map[string]string{"X-Hub-Signature-256": sign(sha256.New, secret, body)}, valid: false},
+		{name: "github signature isn't hex", header: map[string]string{"X-Hub-Signature-256": "sha256=zz"}, valid: false},
+		{name: "github signature wins over token", header: map[string]string{"X-Hub-Signature-256": "sha256=00"}, token: secret, valid: false},
+		{name: "gitlab token", header: map[string]string{"X-Gitlab-Token": secret}, valid: true},
+		{name: "gitlab wrong token", header: map[string]string{"X-Gitlab-Token": "other"}, valid: false},
+		{name: "token in url", token: secret, valid: true},
+		{name: "wrong token in url", token: "other", valid: false},
+		{name: "unsigned", valid: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			for key, val := range tc.header {
+				header.Set(key, val)
+			}
+			if valid := verifyWebhookRequest(webhook, header, tc.token, body); valid != tc.valid {
+				t.Errorf("expected valid %v, got %v", tc.valid, valid)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookRequestDetectsChangedBody(t *testing.T) {
+	secret := "s3cret"
+	webhook := newTestWebhook(t, secret)
+
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", "sha256="+sign(sha256.New, secret, []byte(`{"tag":"1.2.0"}`)))
+	if verifyWebhookRequest(webhook, header, "", []byte(`{"tag":"6.6.6"}`)) {
+		t.Error("expected the changed body to be rejected")
+	}
+}
+
+func TestEncryptWebhookSecretNeedsSecretKey(t *testing.T) {
+	secretKey := _config.Webhook.SecretKey
+	defer func() { _config.Webhook.SecretKey = secretKey }()
+
+	_config.Webhook.SecretKey = ""
+	if _, err := encryptWebhookSecret("s3cret"); err == nil {
+		t.Fatal("expected an error when the secret key is empty")
+	}
+}
+
+type fakeStackServices struct {
+	types.ServiceService
+	services   []*types.Service
+	redeployed []string
+}
+
+func (m *fakeStackServices) List(ctx context.Context, opts types.ServiceFilterOptions) ([]*types.Service, error) {
+	return m.services, nil
+}
+
+func (m *fakeStackServices) ServiceUpdate(ctx context.Context, target *types.Service) error {
+	return nil
+}
+
+func (m *fakeStackServices) Redeploy(ctx context.Context, id string, opts types.RedeployOptions) error {
+	m.redeployed = append(m.redeployed, id)
+	return nil
+}
+
+func newStackService(id string, stack string) *types.Service {
+	service := &types.Service{ID: id, Name: stack + "_web"}
+	service.Spec.Image = "org/web:1.0"
+	service.Spec.Labels = map[string]string{stackNamespaceLabel: stack}
+	return service
+}
+
+func TestWebhookRedeploysServicesOfStackLabel(t *testing.T) {
+	// the services of app_v2 start with app_ as well
+	manager := &fakeStackServices{services: []*types.Service{newStackService("a", "app"), newStackService("b", "app_v2")}}
+
+	services, err := redeployWebhookServices(context.Background(), manager, &types.Webhook{Stack: "app"}, "", "1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manager.redeployed) != 1 || manager.redeployed[0] != "a" {
+		t.Errorf("expected only the service of app to be redeployed, got %v", manager.redeployed)
+	}
+	if manager.services[0].Spec.Image != "org/web:1.1" || manager.services[1].Spec.Image != "org/web:1.0" {
+		t.Errorf("expected only the image of app to be changed, got %s and %s", manager.services[0].Spec.Image, manager.services[1].Spec.Image)
+	}
+	if len(services) != 1 || services[0] != "app_web" {
+		t.Errorf("expected app_web, got %v", services)
+	}
+}
+
+func TestWebhookRejectsInvalidTag(t *testing.T) {
+	for _, tag := range []string{"1.1@sha256:abc", "../1.1", "1.1 latest", ""} {
+		manager := &fakeStackServices{services: []*types.Service{newStackService("a", "app")}}
+
+		_, err := redeployWebhookServices(context.Background(), manager, &types.Webhook{Stack: "app"}, "", tag)
+		appErr, ok := err.(app.AppError)
+		if !ok || appErr.ErrorCode != "invalid_input" {
+			t.Errorf("expected invalid_input for tag %q, got %v", tag, err)
+		}
+		if len(manager.redeployed) > 0 {
+			t.Errorf("expected nothing to be redeployed for tag %q", tag)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/jasonsoft/go-audit"
 
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/jasonsoft/abb/config"
 	"github.com/jasonsoft/go-audit/auditers/mysql"
 	"github.com/jmoiron/sqlx"
@@ -19,9 +20,9 @@ var (
 func init() {
 	_config = config.Config()
 
-	// set database database
+	// set database database, the connection is verified by the main, so the packages can be tested without a database
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8&parseTime=true&multiStatements=true", _config.Database.Username, _config.Database.Password, _config.Database.Address, _config.Database.DBName)
-	DBX = sqlx.MustConnect("mysql", connectionString)
+	DBX = sqlx.MustOpen("mysql", connectionString)
 	DBX.SetMaxIdleConns(150)
 	DBX.SetMaxOpenConns(300)
 	DBX.SetConnMaxLifetime(14400 * time.Second)
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The metrics are written in the text format of prometheus, so abb can be scraped without the client library.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// DefaultBuckets are the upper bounds of the histograms in seconds, they are the same as the prometheus client.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var _metricsRegistry = &metricsRegistry{}
+
+type metricFamily interface {
+	write(w *bufio.Writer)
+}
+
+type metricsRegistry struct {
+	mutex    sync.Mutex
+	families []metricFamily
+}
+
+func (r *metricsRegistry) register(family metricFamily) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, family)
+}
+
+// WriteMetrics writes all the registered metrics in the prometheus text format.
+func WriteMetrics(w io.Writer) error {
+	_metricsRegistry.mutex.Lock()
+	families := append([]metricFamily{}, _metricsRegistry.families...)
+	_metricsRegistry.mutex.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, family := range families {
+		family.write(buf)
+	}
+	return buf.Flush()
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+}
+
+// metricVec is the counters or gauges which share the name and are split by the label values.
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	mutex      sync.Mutex
+	values     map[string]*metricValue
+}
+
+func newMetricVec(name, help, metricType string, labels []string) *metricVec {
+	vec := &metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		values:     map[string]*metricValue{},
+	}
+	_metricsRegistry.register(vec)
+	return vec
+}
+
+func (v *metricVec) value(labelValues []string) *metricValue {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values but got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	val, found := v.values[key]
+	if !found {
+		val = &metricValue{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = val
+	}
+	return val
+}
+
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	writeHeader(w, v.name, v.help, v.metricType)
+	for _, key := range sortedKeys(v.values) {
+		val := v.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, val.labelValues, "", ""), formatFloat(val.value))
+	}
+}
+
+type CounterVec struct {
+	vec *metricVec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newMetricVec(name, help, "counter", labels)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.vec.mutex.Lock()
+	defer c.vec.mutex.Unlock()
+	c.vec.value(labelValues).value += delta
+}
+
+type GaugeVec struct {
+	vec *metricVec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newMetricVec(name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.mutex.Lock()
+	defer g.vec.mutex.Unlock()
+	g.vec.value(labelValues).value = value
+}
+
+// Replace drops all the values of the gauge and sets the new ones, so the series which are gone aren't exposed anymore.
+func (g *GaugeVec) Replace(fn func(set func(value float64, labelValues ...string))) {
+	g.vec.mutex.Lock()
+	defer g.vec.mutex.Unlock()
+
+	g.vec.values = map[string]*metricValue{}
+	fn(func(value float64, labelValues ...string) {
+		g.vec.value(labelValues).value = value
+	})
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // the count of each bucket, they are summed up when written
+	sum         float64
+	count       uint64
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: append([]float64{}, buckets...),
+		values:  map[string]*histogramValue{},
+	}
+	sort.Float64s(histogram.buckets)
+	_metricsRegistry.register(histogram)
+	return histogram
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values but got %d", h.name, len(h.labels), len(labelValues)))
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	val, found := h.values[key]
+	if !found {
+		val = &histogramValue{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = val
+	}
+
+	idx := sort.SearchFloat64s(h.buckets, value)
+	if idx < len(h.buckets) {
+		val.counts[idx]++
+	}
+	val.sum += value
+	val.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		val := h.values[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += val.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, val.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, val.labelValues, "le", "+Inf"), val.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, val.labelValues, "", ""), formatFloat(val.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, val.labelValues, "", ""), val.count)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, metricType string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatLabels formats the labels like {cluster="prod",route="/v1/clusters"}, the extra label is the le of the histograms.
+func formatLabels(labels []string, labelValues []string, extraLabel, extraValue string) string {
+	pairs := []string{}
+	for i, label := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, labelValueReplacer.Replace(labelValues[i])))
+	}
+	if len(extraLabel) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraLabel, labelValueReplacer.Replace(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values interface{}) []string {
+	keys := []string{}
+	switch m := values.(type) {
+	case map[string]*metricValue:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows a fixed number of events per key in each window.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	buckets map[string]*rateBucket
+	sweptAt time.Time
+}
+
+type rateBucket struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Allow records an event of the key and reports whether the event is under the limit.  A limit less than one means no limit.
+func (l *RateLimiter) Allow(key string) bool {
+	if l.limit < 1 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// the expired buckets are dropped once a window, so a call doesn't walk all the keys
+	if now.Sub(l.sweptAt) >= l.window {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.start) >= l.window {
+				delete(l.buckets, k)
+			}
+		}
+		l.sweptAt = now
+	}
+
+	bucket, found := l.buckets[key]
+	if !found || now.Sub(bucket.start) >= l.window {
+		bucket = &rateBucket{start: now}
+		l.buckets[key] = bucket
+	}
+	if bucket.count >= l.limit {
+		return false
+	}
+	bucket.count++
+	return true
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(2, time.Minute)
+
+	if !limiter.Allow("a") || !limiter.Allow("a") {
+		t.Fatal("expected the first two events to be allowed")
+	}
+	if limiter.Allow("a") {
+		t.Error("expected the third event to be limited")
+	}
+	if !limiter.Allow("b") {
+		t.Error("expected the other key to have its own limit")
+	}
+}
+
+func TestRateLimiterStartsNewWindow(t *testing.T) {
+	limiter := NewRateLimiter(1, 20*time.Millisecond)
+
+	if !limiter.Allow("a") || limiter.Allow("a") {
+		t.Fatal("expected only one event in the window")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !limiter.Allow("a") {
+		t.Error("expected the event to be allowed in the next window")
+	}
+}
+
+func TestRateLimiterSweepsExpiredBuckets(t *testing.T) {
+	limiter := NewRateLimiter(1, 20*time.Millisecond)
+	limiter.Allow("a")
+	limiter.Allow("b")
+
+	time.Sleep(30 * time.Millisecond)
+	limiter.Allow("c")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected the expired buckets to be dropped, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterWithoutLimit(t *testing.T) {
+	limiter := NewRateLimiter(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow("a") {
+			t.Fatal("expected no limit")
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jasonsoft/napnap"
+)
+
+// routeKey is the key of the route pattern in the napnap context
+const routeKey = "app.route"
+
+var (
+	_httpRequestsTotal   = NewCounterVec("abb_http_requests_total", "Count of the http requests by route, method and status code.", "route", "method", "code")
+	_httpRequestDuration = NewHistogramVec("abb_http_request_duration_seconds", "Latency of the http requests by route and method.", DefaultBuckets, "route", "method")
+)
+
+// Router registers the routes to the napnap router, and records the route pattern of the request,
+// so the metrics of the requests are labeled by the pattern instead of the path which has the ids.
+type Router struct {
+	*napnap.Router
+}
+
+func NewRouter() *Router {
+	return &Router{
+		Router: napnap.NewRouter(),
+	}
+}
+
+func withRoute(path string, handler napnap.HandlerFunc) napnap.HandlerFunc {
+	return func(c *napnap.Context) {
+		c.Set(routeKey, path)
+		handler(c)
+	}
+}
+
+func (r *Router) Get(path string, handler napnap.HandlerFunc) {
+	r.Router.Get(path, withRoute(path, handler))
+}
+
+func (r *Router) Post(path string, handler napnap.HandlerFunc) {
+	r.Router.Post(path, withRoute(path, handler))
+}
+
+func (r *Router) Put(path string, handler napnap.HandlerFunc) {
+	r.Router.Put(path, withRoute(path, handler))
+}
+
+func (r *Router) Delete(path string, handler napnap.HandlerFunc) {
+	r.Router.Delete(path, withRoute(path, handler))
+}
+
+func (r *Router) Patch(path string, handler napnap.HandlerFunc) {
+	r.Router.Patch(path, withRoute(path, handler))
+}
+
+type HttpMetricsMiddleware struct {
+}
+
+// NewHttpMetricsMiddleware records the count and latency of the requests, it must be used before the error handling middleware
+// to see the status code of the errors.
+func NewHttpMetricsMiddleware() *HttpMetricsMiddleware {
+	return &HttpMetricsMiddleware{}
+}
+
+func (m *HttpMetricsMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
+	start := time.Now()
+	defer func() {
+		route := "unmatched"
+		if val, found := c.Get(routeKey); found {
+			route = val.(string)
+		}
+		method := c.Request.Method
+		_httpRequestsTotal.Inc(route, method, strconv.Itoa(c.Status()))
+		_httpRequestDuration.Observe(time.Since(start).Seconds(), route, method)
+	}()
+	next(c)
+}
@@ -1,10 +1,15 @@
 package app
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/jasonsoft/log"
 )
@@ -26,6 +31,68 @@ func SHA256EncodeToBase64(text string) string {
 	return sha256Hash(text, "base64")
 }
 
+// RandomHex returns a random hex string of n bytes, it is used to generate secrets and tokens.
+func RandomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func newGCM(secretKey string) (cipher.AEAD, error) {
+	if len(secretKey) == 0 {
+		return nil, errors.New("app: secret key can't be empty")
+	}
+	// derive a 256 bits key, so any length of secret key can be used
+	key := sha256.Sum256([]byte(secretKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AESEncryptToBase64 encrypts the text with AES-GCM and returns nonce and cipher text as base64 string.
+func AESEncryptToBase64(text string, secretKey string) (string, error) {
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(text), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// AESDecryptFromBase64 decrypts the text which is encrypted by AESEncryptToBase64.
+func AESDecryptFromBase64(text string, secretKey string) (string, error) {
+	gcm, err := newGCM(secretKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("app: cipher text is too short")
+	}
+
+	nonce, cipherText := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
 var RecoverError = func() {
 	if r := recover(); r != nil {
 		// unknown error
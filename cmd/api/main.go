@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -10,6 +11,7 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jasonsoft/abb/abb"
+	"github.com/jasonsoft/abb/app"
 	"github.com/jasonsoft/abb/config"
 	"github.com/jasonsoft/abb/identity"
 	"github.com/jasonsoft/log"
@@ -28,18 +30,28 @@ func main() {
 		}
 	}()
 
+	flag.Parse()
 	config := config.Config()
 
 	// set up the log
 	log.SetAppID("abb") // unique id for the app
 
+	// the database is opened lazily, so it is checked before the api starts
+	if err := app.DBX.Ping(); err != nil {
+		log.Fatalf("abb: connect database fail: %v", err)
+	}
+
 	go abb.EnableHealthCheck()
+	go abb.EnableImageWatcher()
+	go abb.EnableMetricsCollector()
+	go abb.EnableAutoscaler()
 
 	// set up the napnap
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGKILL, syscall.SIGHUP, syscall.SIGTERM)
 	nap := napnap.New()
 	nap.Use(napnap.NewHealth())
+	nap.Use(app.NewHttpMetricsMiddleware())
 
 	corsOpts := napnap.Options{
 		AllowedOrigins: []string{"*"},
@@ -49,6 +61,8 @@ func main() {
 	nap.Use(napnap.NewCors(corsOpts))
 	nap.Use(abb.NewErrorHandlingMiddleware())
 	nap.Use(identity.NewPublicIdentityRouter())
+	nap.Use(abb.NewWebhookRouter())
+	nap.Use(abb.NewMetricsRouter())
 
 	// private router which needs to be authorized.
 	jwtOpts := identity.JwtOptions{
@@ -72,7 +86,8 @@ func main() {
 	<-stopChan
 	log.Info("Shutting down server...")
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	httpEngine.Shutdown(ctx)
 
 	log.Info("gracefully stopped")
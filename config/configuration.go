@@ -14,11 +14,124 @@ type Slack struct {
 	ChannelName string `yaml:"channel_name"`
 }
 
+type Registry struct {
+	SecretKey          string   `yaml:"secret_key"` // encrypts the registry credentials at rest
+	InsecureRegistries []string `yaml:"insecure_registries"`
+	WatchIntervalInSec int      `yaml:"watch_interval_in_sec"` // how often the image watcher polls the registries
+}
+
+type Webhook struct {
+	SecretKey       string `yaml:"secret_key"` // encrypts the webhook secrets at rest
+	RateLimitPerMin int    `yaml:"rate_limit_per_min"`
+}
+
+// RoleMapping grants the role to the user whose claim, or ldap group, contains the value.
+type RoleMapping struct {
+	Claim string `yaml:"claim"` // oidc only, the groups claim is used when it is empty
+	Value string `yaml:"value"`
+	Role  string `yaml:"role"`
+}
+
+type OIDC struct {
+	Issuer       string        `yaml:"issuer"`
+	ClientID     string        `yaml:"client_id"`
+	ClientSecret string        `yaml:"client_secret"`
+	RedirectURL  string        `yaml:"redirect_url"`
+	Scopes       []string      `yaml:"scopes"`
+	GroupsClaim  string        `yaml:"groups_claim"`
+	RoleMappings []RoleMapping `yaml:"role_mappings"`
+}
+
+type LDAP struct {
+	URL                  string        `yaml:"url"` // ldaps://host:636, or ldap://host:389 with start_tls
+	BindDN               string        `yaml:"bind_dn"`
+	BindPassword         string        `yaml:"bind_password"`
+	BaseDN               string        `yaml:"base_dn"`
+	UserFilter           string        `yaml:"user_filter"` // such as (uid=%s) or (sAMAccountName=%s)
+	DisplayNameAttribute string        `yaml:"display_name_attribute"`
+	GroupAttribute       string        `yaml:"group_attribute"` // memberOf by default
+	StartTLS             bool          `yaml:"start_tls"`       // ldap:// urls are refused without it, the passwords aren't sent in cleartext
+	InsecureSkipVerify   bool          `yaml:"insecure_skip_verify"`
+	RoleMappings         []RoleMapping `yaml:"role_mappings"` // the value is the dn of the group
+}
+
+type PasswordPolicy struct {
+	MinLength             int    `yaml:"min_length"`
+	MaxLength             int    `yaml:"max_length"`
+	RequireUppercase      bool   `yaml:"require_uppercase"`
+	RequireLowercase      bool   `yaml:"require_lowercase"`
+	RequireDigit          bool   `yaml:"require_digit"`
+	RequireSymbol         bool   `yaml:"require_symbol"`
+	BreachedPasswordsFile string `yaml:"breached_passwords_file"` // one password per line
+	HistoryCount          int    `yaml:"history_count"`           // the last N passwords can't be reused
+}
+
+type MFA struct {
+	Issuer        string   `yaml:"issuer"`         // shown in the authenticator apps
+	RequiredRoles []string `yaml:"required_roles"` // users of these roles must use 2fa
+}
+
+type Lockout struct {
+	MaxFailedAttempts    int `yaml:"max_failed_attempts"`
+	DurationInMin        int `yaml:"duration_in_min"`          // 0 means the account is locked until an admin unlocks it
+	TokenRateLimitPerMin int `yaml:"token_rate_limit_per_min"` // requests of /v1/token per client ip
+}
+
+type Mail struct {
+	Host     string `yaml:"host"` // the mails are written to the log when the host is empty
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+type PasswordReset struct {
+	URL           string `yaml:"url"` // the page of the ui, the token is appended as query string
+	DurationInMin int    `yaml:"duration_in_min"`
+}
+
+type Network struct {
+	AutoCreate bool `yaml:"auto_create"` // redeploy creates the overlay networks which are declared in the service spec but missing
+	Encrypted  bool `yaml:"encrypted"`   // the auto created networks encrypt the traffic between nodes
+}
+
+type Exec struct {
+	NodeEndpointLabel string `yaml:"node_endpoint_label"` // the node label which holds the docker endpoint of the node, such as tcp://10.0.0.5:2375
+	RecordingDir      string `yaml:"recording_dir"`       // exec sessions are recorded as asciicast files in <cluster id>/<service>/ when it is set
+}
+
+type Metrics struct {
+	CollectIntervalInSec int    `yaml:"collect_interval_in_sec"` // how often the stats of the containers are polled, 0 disables the collector
+	RetentionInMin       int    `yaml:"retention_in_min"`        // how long the samples are kept in memory
+	ScrapeToken          string `yaml:"scrape_token"`            // the bearer token prometheus sends to /metrics, /metrics is disabled when it is empty
+}
+
+type Autoscaling struct {
+	IntervalInSec int `yaml:"interval_in_sec"` // how often the autoscaling policies are evaluated, 0 disables the autoscaler
+}
+
 type Configuration struct {
 	Database Database
 	Logs     []LogTarget `yaml:"logs"`
 	Jwt      JwtConfig
-	Slack    Slack `yaml:"slack"`
+	Slack    Slack    `yaml:"slack"`
+	Registry Registry `yaml:"registry"`
+	Webhook  Webhook  `yaml:"webhook"`
+	OIDC     OIDC     `yaml:"oidc"`
+	LDAP     LDAP     `yaml:"ldap"`
+
+	PasswordPolicy PasswordPolicy `yaml:"password_policy"`
+	MFA            MFA            `yaml:"mfa"`
+	Lockout        Lockout        `yaml:"lockout"`
+	Mail           Mail           `yaml:"mail"`
+	PasswordReset  PasswordReset  `yaml:"password_reset"`
+	Network        Network        `yaml:"network"`
+	Exec           Exec           `yaml:"exec"`
+	Metrics        Metrics        `yaml:"metrics"`
+	Autoscaling    Autoscaling    `yaml:"autoscaling"`
+
+	// Authenticators are tried in order when users login with password, such as local and ldap
+	Authenticators []string `yaml:"authenticators"`
 }
 
 type LogTarget struct {
@@ -29,8 +142,9 @@ type LogTarget struct {
 }
 
 type JwtConfig struct {
-	SecretKey     string `yaml:"secret_key"`
-	DurationInMin int    `yaml:"duration_in_min"`
+	SecretKey             string `yaml:"secret_key"`
+	DurationInMin         int    `yaml:"duration_in_min"`
+	RefreshDurationInHour int    `yaml:"refresh_duration_in_hour"`
 }
 
 func newConfiguration() *Configuration {
@@ -39,8 +153,38 @@ func newConfiguration() *Configuration {
 			Type: "mysql",
 		},
 		Jwt: JwtConfig{
-			SecretKey:     "",
-			DurationInMin: 60,
+			SecretKey:             "",
+			DurationInMin:         60,
+			RefreshDurationInHour: 720,
+		},
+		Registry: Registry{
+			WatchIntervalInSec: 300,
+		},
+		Webhook: Webhook{
+			RateLimitPerMin: 10,
+		},
+		PasswordPolicy: PasswordPolicy{
+			MinLength:    8,
+			MaxLength:    128,
+			HistoryCount: 5,
+		},
+		Lockout: Lockout{
+			MaxFailedAttempts:    5,
+			DurationInMin:        15,
+			TokenRateLimitPerMin: 20,
+		},
+		PasswordReset: PasswordReset{
+			DurationInMin: 30,
+		},
+		Exec: Exec{
+			NodeEndpointLabel: "abb.docker.endpoint",
+		},
+		Metrics: Metrics{
+			CollectIntervalInSec: 30,
+			RetentionInMin:       60,
+		},
+		Autoscaling: Autoscaling{
+			IntervalInSec: 30,
 		},
 	}
 }
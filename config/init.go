@@ -1,12 +1,12 @@
 package config
 
 import (
-	"flag"
 	"io/ioutil"
 	stdlog "log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -19,8 +19,6 @@ var (
 )
 
 func init() {
-	flag.Parse()
-
 	//read and parse config file
 	var err error
 	rootDirPath, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -63,12 +61,149 @@ func init() {
 				Token:       os.Getenv("ABB_SLACK_TOKEN"),
 				ChannelName: os.Getenv("ABB_SLACK_CHANNEL_NAME"),
 			},
+			Registry: Registry{
+				SecretKey: os.Getenv("ABB_REGISTRY_SECRET_KEY"),
+			},
+			Webhook: Webhook{
+				SecretKey: os.Getenv("ABB_WEBHOOK_SECRET_KEY"),
+			},
+			OIDC: OIDC{
+				Issuer:       os.Getenv("ABB_OIDC_ISSUER"),
+				ClientID:     os.Getenv("ABB_OIDC_CLIENT_ID"),
+				ClientSecret: os.Getenv("ABB_OIDC_CLIENT_SECRET"),
+				RedirectURL:  os.Getenv("ABB_OIDC_REDIRECT_URL"),
+				GroupsClaim:  os.Getenv("ABB_OIDC_GROUPS_CLAIM"),
+			},
+			Mail: Mail{
+				Host:     os.Getenv("ABB_MAIL_HOST"),
+				Username: os.Getenv("ABB_MAIL_USERNAME"),
+				Password: os.Getenv("ABB_MAIL_PASSWORD"),
+				From:     os.Getenv("ABB_MAIL_FROM"),
+			},
+			PasswordReset: PasswordReset{
+				URL:           os.Getenv("ABB_PASSWORD_RESET_URL"),
+				DurationInMin: 30,
+			},
+			LDAP: LDAP{
+				URL:          os.Getenv("ABB_LDAP_URL"),
+				BindDN:       os.Getenv("ABB_LDAP_BIND_DN"),
+				BindPassword: os.Getenv("ABB_LDAP_BIND_PASSWORD"),
+				BaseDN:       os.Getenv("ABB_LDAP_BASE_DN"),
+				UserFilter:   os.Getenv("ABB_LDAP_USER_FILTER"),
+				StartTLS:     os.Getenv("ABB_LDAP_START_TLS") == "true",
+			},
 		}
 
 		dInMinStr := os.Getenv("ABB_JWT_DURATION_IN_MIN")
 		if len(dInMinStr) > 0 {
 			_config.Jwt.DurationInMin, _ = strconv.Atoi(dInMinStr)
 		}
+
+		_config.Jwt.RefreshDurationInHour = 720
+		refreshInHourStr := os.Getenv("ABB_JWT_REFRESH_DURATION_IN_HOUR")
+		if len(refreshInHourStr) > 0 {
+			_config.Jwt.RefreshDurationInHour, _ = strconv.Atoi(refreshInHourStr)
+		}
+
+		_config.PasswordPolicy = PasswordPolicy{
+			MinLength:             8,
+			MaxLength:             128,
+			HistoryCount:          5,
+			RequireUppercase:      os.Getenv("ABB_PASSWORD_REQUIRE_UPPERCASE") == "true",
+			RequireLowercase:      os.Getenv("ABB_PASSWORD_REQUIRE_LOWERCASE") == "true",
+			RequireDigit:          os.Getenv("ABB_PASSWORD_REQUIRE_DIGIT") == "true",
+			RequireSymbol:         os.Getenv("ABB_PASSWORD_REQUIRE_SYMBOL") == "true",
+			BreachedPasswordsFile: os.Getenv("ABB_PASSWORD_BREACHED_PASSWORDS_FILE"),
+		}
+		minLengthStr := os.Getenv("ABB_PASSWORD_MIN_LENGTH")
+		if len(minLengthStr) > 0 {
+			_config.PasswordPolicy.MinLength, _ = strconv.Atoi(minLengthStr)
+		}
+		historyCountStr := os.Getenv("ABB_PASSWORD_HISTORY_COUNT")
+		if len(historyCountStr) > 0 {
+			_config.PasswordPolicy.HistoryCount, _ = strconv.Atoi(historyCountStr)
+		}
+
+		_config.Network = Network{
+			AutoCreate: os.Getenv("ABB_NETWORK_AUTO_CREATE") == "true",
+			Encrypted:  os.Getenv("ABB_NETWORK_ENCRYPTED") == "true",
+		}
+
+		_config.Exec = Exec{
+			NodeEndpointLabel: "abb.docker.endpoint",
+			RecordingDir:      os.Getenv("ABB_EXEC_RECORDING_DIR"),
+		}
+		if label := os.Getenv("ABB_EXEC_NODE_ENDPOINT_LABEL"); len(label) > 0 {
+			_config.Exec.NodeEndpointLabel = label
+		}
+
+		_config.Metrics = Metrics{
+			CollectIntervalInSec: 30,
+			RetentionInMin:       60,
+		}
+		if intervalStr := os.Getenv("ABB_METRICS_COLLECT_INTERVAL_IN_SEC"); len(intervalStr) > 0 {
+			_config.Metrics.CollectIntervalInSec, _ = strconv.Atoi(intervalStr)
+		}
+		if retentionStr := os.Getenv("ABB_METRICS_RETENTION_IN_MIN"); len(retentionStr) > 0 {
+			_config.Metrics.RetentionInMin, _ = strconv.Atoi(retentionStr)
+		}
+		_config.Metrics.ScrapeToken = os.Getenv("ABB_METRICS_SCRAPE_TOKEN")
+
+		_config.Autoscaling.IntervalInSec = 30
+		if intervalStr := os.Getenv("ABB_AUTOSCALING_INTERVAL_IN_SEC"); len(intervalStr) > 0 {
+			_config.Autoscaling.IntervalInSec, _ = strconv.Atoi(intervalStr)
+		}
+
+		_config.MFA.Issuer = os.Getenv("ABB_MFA_ISSUER")
+		mfaRequiredRoles := os.Getenv("ABB_MFA_REQUIRED_ROLES")
+		if len(mfaRequiredRoles) > 0 {
+			_config.MFA.RequiredRoles = strings.Split(mfaRequiredRoles, ",")
+		}
+
+		_config.Lockout = Lockout{
+			MaxFailedAttempts:    5,
+			DurationInMin:        15,
+			TokenRateLimitPerMin: 20,
+		}
+		maxFailedAttemptsStr := os.Getenv("ABB_LOCKOUT_MAX_FAILED_ATTEMPTS")
+		if len(maxFailedAttemptsStr) > 0 {
+			_config.Lockout.MaxFailedAttempts, _ = strconv.Atoi(maxFailedAttemptsStr)
+		}
+		lockoutDurationStr := os.Getenv("ABB_LOCKOUT_DURATION_IN_MIN")
+		if len(lockoutDurationStr) > 0 {
+			_config.Lockout.DurationInMin, _ = strconv.Atoi(lockoutDurationStr)
+		}
+		tokenRateLimitStr := os.Getenv("ABB_LOCKOUT_TOKEN_RATE_LIMIT_PER_MIN")
+		if len(tokenRateLimitStr) > 0 {
+			_config.Lockout.TokenRateLimitPerMin, _ = strconv.Atoi(tokenRateLimitStr)
+		}
+
+		mailPortStr := os.Getenv("ABB_MAIL_PORT")
+		if len(mailPortStr) > 0 {
+			_config.Mail.Port, _ = strconv.Atoi(mailPortStr)
+		}
+
+		authenticators := os.Getenv("ABB_AUTHENTICATORS")
+		if len(authenticators) > 0 {
+			_config.Authenticators = strings.Split(authenticators, ",")
+		}
+
+		insecureRegistries := os.Getenv("ABB_REGISTRY_INSECURE_REGISTRIES")
+		if len(insecureRegistries) > 0 {
+			_config.Registry.InsecureRegistries = strings.Split(insecureRegistries, ",")
+		}
+
+		_config.Registry.WatchIntervalInSec = 300
+		watchIntervalStr := os.Getenv("ABB_REGISTRY_WATCH_INTERVAL_IN_SEC")
+		if len(watchIntervalStr) > 0 {
+			_config.Registry.WatchIntervalInSec, _ = strconv.Atoi(watchIntervalStr)
+		}
+
+		_config.Webhook.RateLimitPerMin = 10
+		rateLimitStr := os.Getenv("ABB_WEBHOOK_RATE_LIMIT_PER_MIN")
+		if len(rateLimitStr) > 0 {
+			_config.Webhook.RateLimitPerMin, _ = strconv.Atoi(rateLimitStr)
+		}
 	}
 
 	// set up log target
@@ -2,25 +2,34 @@ package identity
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"database/sql"
 
 	xlog "github.com/jasonsoft/log"
 	"github.com/jmoiron/sqlx"
+	sqlxTypes "github.com/jmoiron/sqlx/types"
 )
 
 type Account struct {
 	ID                         string
 	UserID                     int `db:"user_id"`
 	Username                   string
-	PasswordHash               string     `db:"password_hash"`
-	PasswordSalt               string     `db:"password_salt"`
-	IsLockedOut                bool       `db:"is_locked_out"`
-	LastLoginTime              *time.Time `db:"last_login_time"`
-	FailedPasswordAttemptCount int        `db:"failed_password_attempt_count"`
-	CreatedAt                  *time.Time `json:"created_at,omitempty" db:"created_at"`
-	UpdatedAt                  *time.Time `json:"updated_at" db:"updated_at"`
+	PasswordHash               string             `db:"password_hash"`
+	PasswordSalt               string             `db:"password_salt"`
+	IsLockedOut                bool               `db:"is_locked_out"`
+	LastLoginTime              *time.Time         `db:"last_login_time"`
+	FailedPasswordAttemptCount int                `db:"failed_password_attempt_count"`
+	LockedUntil                *time.Time         `db:"locked_until"` // nil means the lock doesn't expire
+	IsDisabled                 bool               `db:"is_disabled"`
+	TOTPSecret                 string             `db:"totp_secret"` // encrypted with the jwt secret key
+	TOTPEnabled                bool               `db:"totp_enabled"`
+	TOTPLastStep               int64              `db:"totp_last_step"`
+	RecoveryCodes              []string           `db:"-"` // hashes of the unused recovery codes
+	RecoveryCodesJSON          sqlxTypes.JSONText `db:"recovery_codesJSON"`
+	CreatedAt                  *time.Time         `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt                  *time.Time         `json:"updated_at" db:"updated_at"`
 }
 
 type AccountRepo struct {
@@ -127,13 +136,13 @@ func (repo *AccountRepo) UpdateLastLoginTime(ctx context.Context, entity *Accoun
 
 const deleteAccountSQL = "DELETE FROM `accounts` WHERE `user_id` = :user_id"
 
-func (repo *AccountRepo) Delete(ctx context.Context, userID int) error {
+func (repo *AccountRepo) Delete(ctx context.Context, userID int, tx *sqlx.Tx) error {
 	log := xlog.FromContext(ctx)
 	m := map[string]interface{}{
 		"user_id": userID,
 	}
 
-	_, err := repo.db.NamedExec(deleteAccountSQL, m)
+	_, err := tx.NamedExec(deleteAccountSQL, m)
 	if err != nil {
 		log.Errorf("membership: delete account fail: %v", err)
 		return err
@@ -141,15 +150,12 @@ func (repo *AccountRepo) Delete(ctx context.Context, userID int) error {
 	return nil
 }
 
-const updateAccountFailPasswordSQL = "UPDATE `accounts` SET `is_locked_out` = :is_locked_out, `failed_password_attempt_count` = :failed_password_attempt_count,`updated_at` = :updated_at WHERE `user_id` = :user_id;"
+const updateAccountFailPasswordSQL = "UPDATE `accounts` SET `is_locked_out` = :is_locked_out, `failed_password_attempt_count` = :failed_password_attempt_count, `locked_until` = :locked_until, `updated_at` = :updated_at WHERE `user_id` = :user_id;"
 
 func (repo *AccountRepo) UpdateAccountFailPassword(ctx context.Context, entity *Account) error {
 	log := xlog.FromContext(ctx)
 	nowUTC := time.Now().UTC()
 	entity.UpdatedAt = &nowUTC
-	if entity.FailedPasswordAttemptCount > 4 {
-		entity.IsLockedOut = true
-	}
 	_, err := repo.db.NamedExec(updateAccountFailPasswordSQL, entity)
 	if err != nil {
 		log.Errorf("membership: update last login time fail: %v", err)
@@ -157,3 +163,42 @@ func (repo *AccountRepo) UpdateAccountFailPassword(ctx context.Context, entity *
 	}
 	return nil
 }
+
+const updateAccountMFASQL = "UPDATE `accounts` SET `totp_secret` = :totp_secret, `totp_enabled` = :totp_enabled, `totp_last_step` = :totp_last_step, `recovery_codesJSON` = :recovery_codesJSON, `updated_at` = :updated_at WHERE `user_id` = :user_id;"
+
+func (repo *AccountRepo) UpdateMFA(ctx context.Context, entity *Account) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.UpdatedAt = &nowUTC
+
+	if entity.RecoveryCodes == nil {
+		entity.RecoveryCodes = []string{}
+	}
+	strB, err := json.Marshal(entity.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	entity.RecoveryCodesJSON = strB
+
+	_, err = repo.db.NamedExec(updateAccountMFASQL, entity)
+	if err != nil {
+		log.Errorf("membership: update account mfa fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const updateAccountDisabledSQL = "UPDATE `accounts` SET `is_disabled` = :is_disabled, `updated_at` = :updated_at WHERE `user_id` = :user_id;"
+
+func (repo *AccountRepo) UpdateDisabled(ctx context.Context, entity *Account) error {
+	log := xlog.FromContext(ctx)
+	nowUTC := time.Now().UTC()
+	entity.UpdatedAt = &nowUTC
+	_, err := repo.db.NamedExec(updateAccountDisabledSQL, entity)
+	if err != nil {
+		log.Errorf("membership: update account disabled fail: %v", err)
+		return err
+	}
+	return nil
+}
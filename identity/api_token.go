@@ -0,0 +1,334 @@
+package identity
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jasonsoft/abb/app"
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+	sqlxTypes "github.com/jmoiron/sqlx/types"
+	uuid "github.com/satori/go.uuid"
+)
+
+// apiTokenPrefix tells the api tokens from the jwt tokens, the format of api token is abb_<id>_<secret>
+const apiTokenPrefix = "abb_"
+
+// APIToken is a long-lived token of a user or a service account.  A service account token doesn't belong to any user.
+type APIToken struct {
+	ID         string             `json:"id" db:"id"`
+	Name       string             `json:"name" db:"name"`
+	UserID     int                `json:"user_id" db:"user_id"` // 0 means a service account
+	Roles      []string           `json:"roles" db:"-"`
+	RolesJSON  sqlxTypes.JSONText `json:"-" db:"rolesJSON"`
+	Token      string             `json:"token,omitempty" db:"-"` // only returned when the token is created
+	TokenHash  string             `json:"-" db:"token_hash"`
+	CreatedBy  string             `json:"created_by" db:"created_by"`
+	ExpiresAt  *time.Time         `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time         `json:"last_used_at" db:"last_used_at"`
+	RevokedAt  *time.Time         `json:"revoked_at" db:"revoked_at"`
+	CreatedAt  *time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt  *time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+func (t *APIToken) isServiceAccount() bool {
+	return t.UserID == 0
+}
+
+type FindAPITokensOptions struct {
+	ID     string
+	UserID int // -1 means all users
+}
+
+// CreateAPIToken creates a personal token when the UserID is set, otherwise a service account token.
+// The roles of a personal token must be a subset of the roles of the user; empty means all of them.
+// The creator must hold all the roles of the token, so a token can't grant more than its creator has.
+func (ms *MembershipService) CreateAPIToken(ctx context.Context, token *APIToken) error {
+	if len(token.Name) == 0 || len(token.Name) > 50 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "name field is invalid"}
+	}
+	if token.ExpiresAt != nil && token.ExpiresAt.Before(time.Now()) {
+		return app.AppError{ErrorCode: "invalid_input", Message: "expires_at must be in the future"}
+	}
+
+	if token.isServiceAccount() {
+		if len(token.Roles) == 0 {
+			return app.AppError{ErrorCode: "invalid_input", Message: "roles of service account can't be empty"}
+		}
+		for _, roleName := range token.Roles {
+			role, err := ms.GetRoleByName(ctx, roleName)
+			if err != nil {
+				return err
+			}
+			if role == nil {
+				msg := fmt.Sprintf("%s can't be found", roleName)
+				return app.AppError{ErrorCode: "role_not_found", Message: msg}
+			}
+		}
+	} else {
+		userRoles, err := ms.GetUserRoles(ctx, token.UserID)
+		if err != nil {
+			return err
+		}
+		if len(token.Roles) == 0 {
+			token.Roles = userRoles
+		}
+		for _, roleName := range token.Roles {
+			if !containsFold(userRoles, roleName) {
+				msg := fmt.Sprintf("user doesn't have the role %s", roleName)
+				return app.AppError{ErrorCode: "invalid_input", Message: msg}
+			}
+		}
+	}
+
+	claims, found := FromContext(ctx)
+	if !found {
+		return app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+	}
+	heldRoles, err := RolesFromClaims(claims)
+	if err != nil {
+		return err
+	}
+	for _, roleName := range token.Roles {
+		if !holdsRole(heldRoles, roleName, token.isServiceAccount()) {
+			msg := fmt.Sprintf("you don't have the role %s", roleName)
+			return app.AppError{ErrorCode: "invalid_input", Message: msg}
+		}
+	}
+
+	secret, err := app.RandomHex(32)
+	if err != nil {
+		return err
+	}
+
+	token.ID = strings.Replace(uuid.NewV4().String(), "-", "", -1)
+	token.Token = apiTokenPrefix + token.ID + "_" + secret
+	token.TokenHash = app.SHA256EncodeToBase64(secret)
+	token.CreatedBy, _ = claims["sub"].(string)
+
+	return _apiTokenRepo.Insert(ctx, token)
+}
+
+func (ms *MembershipService) GetAPITokens(ctx context.Context, opts FindAPITokensOptions) ([]*APIToken, error) {
+	return _apiTokenRepo.Find(ctx, opts)
+}
+
+// RevokeAPIToken revokes the token; when userID isn't -1, the token must belong to the user.
+func (ms *MembershipService) RevokeAPIToken(ctx context.Context, id string, userID int) error {
+	opts := FindAPITokensOptions{
+		ID:     id,
+		UserID: userID,
+	}
+	tokens, err := _apiTokenRepo.Find(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return app.AppError{ErrorCode: "not_found", Message: "token was not found"}
+	}
+
+	token := tokens[0]
+	if token.RevokedAt != nil {
+		return nil
+	}
+	nowUTC := time.Now().UTC()
+	token.RevokedAt = &nowUTC
+	return _apiTokenRepo.Update(ctx, token)
+}
+
+// AuthenticateAPIToken returns the same claims as the jwt token, so the api token can be used anywhere.
+func (ms *MembershipService) AuthenticateAPIToken(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	invalidErr := app.AppError{ErrorCode: "invalid_token", Message: "token was invalid"}
+
+	parts := strings.SplitN(strings.TrimPrefix(tokenString, apiTokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, invalidErr
+	}
+
+	tokens, err := _apiTokenRepo.Find(ctx, FindAPITokensOptions{ID: parts[0], UserID: -1})
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, invalidErr
+	}
+
+	token := tokens[0]
+	hash := app.SHA256EncodeToBase64(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.TokenHash)) != 1 {
+		return nil, invalidErr
+	}
+	nowUTC := time.Now().UTC()
+	if token.RevokedAt != nil || (token.ExpiresAt != nil && token.ExpiresAt.Before(nowUTC)) {
+		return nil, invalidErr
+	}
+
+	subject := "sa:" + token.Name
+	var roles []*Role
+	if token.isServiceAccount() {
+		for _, roleName := range token.Roles {
+			role, err := ms.GetRoleByName(ctx, roleName)
+			if err != nil {
+				return nil, err
+			}
+			if role != nil {
+				roles = append(roles, role)
+			}
+		}
+	} else {
+		// the token can't have more roles than its user currently has, the clusters of the bindings are kept
+		user, err := ms.GetUserByID(ctx, token.UserID)
+		if err != nil || user.IsDisabled {
+			return nil, invalidErr
+		}
+		subject = user.Username
+		boundRoles, err := ms.boundRoles(ctx, token.UserID)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range boundRoles {
+			if containsFold(token.Roles, role.Name) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	// last_used_at is only written once a minute, so busy tokens don't write the database on every request
+	if token.LastUsedAt == nil || nowUTC.Sub(*token.LastUsedAt) > time.Minute {
+		token.LastUsedAt = &nowUTC
+		err = _apiTokenRepo.Update(ctx, token)
+		if err != nil {
+			xlog.FromContext(ctx).Errorf("membership: update token last used time fail: %v", err)
+		}
+	}
+
+	// the claims are decoded from json in jwt tokens, so numbers are float64 here as well
+	claims := jwt.MapClaims{
+		"sub":      subject,
+		"user_id":  float64(token.UserID),
+		"roles":    roles,
+		"token_id": token.ID,
+	}
+	return claims, nil
+}
+
+// holdsRole tells whether the role is one of the roles.  A service account token applies in all the clusters,
+// so its roles must be held in all the clusters as well.
+func holdsRole(roles []*Role, roleName string, allClusters bool) bool {
+	for _, role := range roles {
+		if !strings.EqualFold(role.Name, roleName) {
+			continue
+		}
+		if !allClusters || len(role.Clusters) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, val := range list {
+		if strings.EqualFold(val, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type APITokenRepo struct {
+	db *sqlx.DB
+}
+
+func NewAPITokenRepo(db *sqlx.DB) *APITokenRepo {
+	return &APITokenRepo{
+		db: db,
+	}
+}
+
+const insertAPITokenSQL = "INSERT INTO `api_tokens` (`id`, `name`, `user_id`, `rolesJSON`, `token_hash`, `created_by`, `expires_at`, `last_used_at`, `revoked_at`, `created_at`, `updated_at`) VALUES (:id, :name, :user_id, :rolesJSON, :token_hash, :created_by, :expires_at, :last_used_at, :revoked_at, :created_at, :updated_at);"
+
+func (repo *APITokenRepo) Insert(ctx context.Context, entity *APIToken) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+	entity.UpdatedAt = &nowUTC
+
+	strB, err := json.Marshal(entity.Roles)
+	if err != nil {
+		return err
+	}
+	entity.RolesJSON = strB
+
+	_, err = repo.db.NamedExec(insertAPITokenSQL, entity)
+	if err != nil {
+		log.Errorf("membership: insert api token fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const updateAPITokenSQL = "UPDATE `api_tokens` SET `last_used_at` = :last_used_at, `revoked_at` = :revoked_at, `updated_at` = :updated_at WHERE `id` = :id;"
+
+func (repo *APITokenRepo) Update(ctx context.Context, entity *APIToken) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.UpdatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(updateAPITokenSQL, entity)
+	if err != nil {
+		log.Errorf("membership: update api token fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const findAPITokensSQL = "SELECT `id`, `name`, `user_id`, `rolesJSON`, `token_hash`, `created_by`, `expires_at`, `last_used_at`, `revoked_at`, `created_at`, `updated_at` FROM `api_tokens` WHERE 1=1"
+
+func (repo *APITokenRepo) Find(ctx context.Context, opts FindAPITokensOptions) ([]*APIToken, error) {
+	log := xlog.FromContext(ctx)
+
+	findSQL := findAPITokensSQL
+	param := map[string]interface{}{}
+	if len(opts.ID) > 0 {
+		findSQL += " AND id = :id"
+		param["id"] = opts.ID
+	}
+	if opts.UserID > -1 {
+		findSQL += " AND user_id = :user_id"
+		param["user_id"] = opts.UserID
+	}
+	findSQL += " ORDER BY created_at DESC"
+
+	tokens := []*APIToken{}
+	findStmt, err := repo.db.PrepareNamed(findSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer findStmt.Close()
+
+	err = findStmt.Select(&tokens, param)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return tokens, nil
+		}
+		log.Errorf("membership: find api tokens fail: %v", err)
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		if err := json.Unmarshal(token.RolesJSON, &token.Roles); err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,72 @@
+package identity
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jasonsoft/abb/config"
+	xlog "github.com/jasonsoft/log"
+)
+
+// Authenticator verifies the username and password.  The user id is returned when the password is correct, otherwise 0.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, username string, password string) (int, error)
+}
+
+// newAuthenticators builds the authenticator chain in the configured order; local is used when nothing is configured.
+func newAuthenticators(ms *MembershipService, cfg *config.Configuration) []Authenticator {
+	names := cfg.Authenticators
+	if len(names) == 0 {
+		names = []string{"local"}
+	}
+
+	result := []Authenticator{}
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "local":
+			result = append(result, &localAuthenticator{})
+		case "ldap":
+			result = append(result, &ldapAuthenticator{ms: ms, config: cfg.LDAP})
+		default:
+			xlog.Warnf("membership: unknown authenticator: %s", name)
+		}
+	}
+	return result
+}
+
+// localAuthenticator verifies the password against the accounts table.
+type localAuthenticator struct{}
+
+func (a *localAuthenticator) Name() string {
+	return "local"
+}
+
+func (a *localAuthenticator) Authenticate(ctx context.Context, username string, password string) (int, error) {
+	account, err := _accountRepo.Get(ctx, &Account{Username: username})
+	if err != nil {
+		return 0, err
+	}
+	if account == nil {
+		return 0, nil
+	}
+
+	ok, rehash := verifyPassword(password, account.PasswordHash, account.PasswordSalt)
+	if !ok {
+		return 0, nil
+	}
+	if rehash {
+		// the legacy hash is upgraded while the plain password is known
+		hash, err := hashPassword(password)
+		if err != nil {
+			return 0, err
+		}
+		account.PasswordHash = hash
+		account.PasswordSalt = ""
+		err = _accountRepo.Update(ctx, account)
+		if err != nil {
+			xlog.FromContext(ctx).Errorf("membership: rehash password fail: %v", err)
+		}
+	}
+	return account.UserID, nil
+}
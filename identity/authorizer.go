@@ -0,0 +1,232 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jasonsoft/abb/app"
+)
+
+// AccessRequest is the action to authorize.  Namespace is the cluster name of the resources inside a cluster and
+// empty for the clusters themselves.  ResourceName is empty when the whole collection is requested.
+type AccessRequest struct {
+	Cluster      string            `json:"cluster"`
+	Namespace    string            `json:"namespace"`
+	Resource     string            `json:"resource"`
+	ResourceName string            `json:"resource_name"`
+	Labels       map[string]string `json:"labels"`
+	Verb         string            `json:"verb"`
+}
+
+// Decision tells which rule granted or denied the request.  Role and Rule are empty when no rule matched.
+type Decision struct {
+	Allowed   bool   `json:"allowed"`
+	Role      string `json:"role,omitempty"`
+	RuleIndex int    `json:"rule_index"`
+	Rule      *Rule  `json:"rule,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// Authorize evaluates the rules of the roles.  Any matching deny rule denies the request, otherwise the first
+// matching allow rule grants it; nothing matched means denied.
+func Authorize(roles []*Role, req AccessRequest) Decision {
+	var allowed *Decision
+	for _, role := range roles {
+		if !roleBoundIn(role, req.Cluster) {
+			continue
+		}
+		for i := range role.Rules {
+			rule := &role.Rules[i]
+			if !ruleMatches(rule, req) {
+				continue
+			}
+			if rule.Effect == RuleEffectDeny {
+				return Decision{
+					Allowed:   false,
+					Role:      role.Name,
+					RuleIndex: i,
+					Rule:      rule,
+					Reason:    fmt.Sprintf("denied by rule %d of role %s", i, role.Name),
+				}
+			}
+			if allowed == nil {
+				allowed = &Decision{
+					Allowed:   true,
+					Role:      role.Name,
+					RuleIndex: i,
+					Rule:      rule,
+					Reason:    fmt.Sprintf("allowed by rule %d of role %s", i, role.Name),
+				}
+			}
+		}
+	}
+
+	if allowed != nil {
+		return *allowed
+	}
+	return Decision{Allowed: false, RuleIndex: -1, Reason: "no rule allows the request"}
+}
+
+// RolesFromClaims returns the roles in the claims of the access token or the api token.
+func RolesFromClaims(claims jwt.MapClaims) ([]*Role, error) {
+	buf, err := json.Marshal(claims["roles"])
+	if err != nil {
+		return nil, err
+	}
+	var roles []*Role
+	err = json.Unmarshal(buf, &roles)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// IsAllowed authorizes the request with the roles of the current user.
+func IsAllowed(ctx context.Context, req AccessRequest) bool {
+	claims, found := FromContext(ctx)
+	if !found {
+		return false
+	}
+	roles, err := RolesFromClaims(claims)
+	if err != nil {
+		return false
+	}
+	return Authorize(roles, req).Allowed
+}
+
+// boundRoles returns the roles of the user with the clusters of the bindings, they are put in the claims.
+func (ms *MembershipService) boundRoles(ctx context.Context, userID int) ([]*Role, error) {
+	bindings, err := ms.effectiveRoleBindings(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles []*Role
+	for _, binding := range bindings {
+		role, err := ms.GetRoleByName(ctx, binding.RoleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		role.Clusters = binding.Clusters
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// effectiveRoleBindings merges the direct roles of the user and the roles of the teams.
+func (ms *MembershipService) effectiveRoleBindings(ctx context.Context, userID int) ([]*RoleBinding, error) {
+	bindings, err := _roleRepo.GetRoleBindingsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	teamBindings, err := _teamRepo.FindRoleBindingsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return mergeRoleBindings(append(bindings, teamBindings...)), nil
+}
+
+// GetRoleBindings returns the direct roles of the user and the clusters where they are bound.
+func (ms *MembershipService) GetRoleBindings(ctx context.Context, userID int) ([]*RoleBinding, error) {
+	return _roleRepo.GetRoleBindingsByUser(ctx, userID)
+}
+
+// ExplainAccess evaluates the request with the current roles of the user.
+func (ms *MembershipService) ExplainAccess(ctx context.Context, userID int, req AccessRequest) (Decision, error) {
+	roles, err := ms.boundRoles(ctx, userID)
+	if err != nil {
+		return Decision{}, err
+	}
+	return Authorize(roles, req), nil
+}
+
+// validateRules checks the effects and the glob patterns of the rules.
+func validateRules(rules []Rule) error {
+	for i, rule := range rules {
+		if len(rule.Effect) > 0 && rule.Effect != RuleEffectAllow && rule.Effect != RuleEffectDeny {
+			msg := fmt.Sprintf("effect of rule %d must be allow or deny", i)
+			return app.AppError{ErrorCode: "invalid_input", Message: msg}
+		}
+		patterns := append([]string{rule.Namespace}, rule.ResourceNames...)
+		for _, val := range rule.Selector {
+			patterns = append(patterns, val)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				msg := fmt.Sprintf("pattern %s of rule %d is invalid", pattern, i)
+				return app.AppError{ErrorCode: "invalid_input", Message: msg}
+			}
+		}
+	}
+	return nil
+}
+
+// roleBoundIn tells whether the role applies in the cluster.  A role bound to clusters doesn't apply to the
+// requests outside the clusters, such as the users and the roles.
+func roleBoundIn(role *Role, cluster string) bool {
+	if len(role.Clusters) == 0 {
+		return true
+	}
+	if len(cluster) == 0 {
+		return false
+	}
+	return matchAnyPattern(role.Clusters, cluster)
+}
+
+func ruleMatches(rule *Rule, req AccessRequest) bool {
+	if !matchPattern(rule.Namespace, req.Namespace) {
+		return false
+	}
+	if !matchAnyPattern(rule.Resources, req.Resource) {
+		return false
+	}
+	if !matchAnyPattern(rule.Verbs, req.Verb) {
+		return false
+	}
+
+	// rules without resource names and selector cover every resource of the type
+	if len(rule.ResourceNames) == 0 && len(rule.Selector) == 0 {
+		return true
+	}
+	// the scoped rules never match a collection request, the items of the collection are authorized one by one
+	if len(req.ResourceName) == 0 {
+		return false
+	}
+	if len(rule.ResourceNames) > 0 && !matchAnyPattern(rule.ResourceNames, req.ResourceName) {
+		return false
+	}
+	return matchSelector(rule.Selector, req.Labels)
+}
+
+func matchSelector(selector map[string]string, labels map[string]string) bool {
+	for key, val := range selector {
+		labelVal, found := labels[key]
+		if !found || !matchPattern(val, labelVal) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAnyPattern(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern string, s string) bool {
+	if pattern == "*" || pattern == s {
+		return true
+	}
+	matched, err := path.Match(pattern, s)
+	return err == nil && matched
+}
@@ -0,0 +1,148 @@
+package identity
+
+import "testing"
+
+func TestAuthorize(t *testing.T) {
+	developer := &Role{
+		Name: "developer",
+		Rules: []Rule{
+			{Namespace: "*", Resources: []string{"services"}, Verbs: []string{"*"}},
+			{Effect: RuleEffectDeny, Namespace: "*", Resources: []string{"services"}, ResourceNames: []string{"db-*"}, Verbs: []string{"delete"}},
+			{Effect: RuleEffectDeny, Namespace: "*", Resources: []string{"services"}, Selector: map[string]string{"tier": "critical"}, Verbs: []string{"update"}},
+		},
+	}
+	webOwner := &Role{
+		Name: "web-owner",
+		Rules: []Rule{
+			{Namespace: "prod", Resources: []string{"services"}, ResourceNames: []string{"web-*"}, Verbs: []string{"get", "list"}},
+		},
+	}
+	prodAdmin := &Role{
+		Name:     "prod-admin",
+		Clusters: []string{"prod*"},
+		Rules: []Rule{
+			{Namespace: "*", Resources: []string{"*"}, Verbs: []string{"*"}},
+		},
+	}
+
+	testCases := []struct {
+		name    string
+		roles   []*Role
+		req     AccessRequest
+		allowed bool
+	}{
+		{
+			name:    "allow rule covers every service",
+			roles:   []*Role{developer},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", ResourceName: "web-api", Verb: "delete"},
+			allowed: true,
+		},
+		{
+			name:    "deny rule by name wins over allow rule",
+			roles:   []*Role{developer},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", ResourceName: "db-main", Verb: "delete"},
+			allowed: false,
+		},
+		{
+			name:    "deny rule by selector wins over allow rule",
+			roles:   []*Role{developer},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", ResourceName: "web-api", Labels: map[string]string{"tier": "critical"}, Verb: "update"},
+			allowed: false,
+		},
+		{
+			name:    "scoped deny rules don't deny the collection",
+			roles:   []*Role{developer},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", Verb: "delete"},
+			allowed: true,
+		},
+		{
+			name:    "scoped allow rule doesn't grant the collection",
+			roles:   []*Role{webOwner},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", Verb: "list"},
+			allowed: false,
+		},
+		{
+			name:    "scoped allow rule grants the matched item",
+			roles:   []*Role{webOwner},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", ResourceName: "web-api", Verb: "list"},
+			allowed: true,
+		},
+		{
+			name:    "scoped allow rule doesn't grant other items",
+			roles:   []*Role{webOwner},
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", ResourceName: "db-main", Verb: "list"},
+			allowed: false,
+		},
+		{
+			name:    "namespace must match",
+			roles:   []*Role{webOwner},
+			req:     AccessRequest{Cluster: "dev", Namespace: "dev", Resource: "services", ResourceName: "web-api", Verb: "get"},
+			allowed: false,
+		},
+		{
+			name:    "role bound in the cluster",
+			roles:   []*Role{prodAdmin},
+			req:     AccessRequest{Cluster: "prod-eu", Namespace: "prod-eu", Resource: "nodes", Verb: "list"},
+			allowed: true,
+		},
+		{
+			name:    "role isn't bound in other clusters",
+			roles:   []*Role{prodAdmin},
+			req:     AccessRequest{Cluster: "dev", Namespace: "dev", Resource: "nodes", Verb: "list"},
+			allowed: false,
+		},
+		{
+			name:    "role bound to clusters doesn't apply outside the clusters",
+			roles:   []*Role{prodAdmin},
+			req:     AccessRequest{Resource: "users", Verb: "delete"},
+			allowed: false,
+		},
+		{
+			name:    "nothing matched means denied",
+			roles:   nil,
+			req:     AccessRequest{Cluster: "prod", Namespace: "prod", Resource: "services", Verb: "list"},
+			allowed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decision := Authorize(tc.roles, tc.req)
+			if decision.Allowed != tc.allowed {
+				t.Errorf("expected allowed %v, got %v: %s", tc.allowed, decision.Allowed, decision.Reason)
+			}
+		})
+	}
+}
+
+func TestAuthorizeReportsDenyRule(t *testing.T) {
+	role := &Role{
+		Name: "viewer",
+		Rules: []Rule{
+			{Namespace: "*", Resources: []string{"*"}, Verbs: []string{"*"}},
+			{Effect: RuleEffectDeny, Namespace: "*", Resources: []string{"users"}, Verbs: []string{"delete"}},
+		},
+	}
+
+	decision := Authorize([]*Role{role}, AccessRequest{Resource: "users", ResourceName: "admin", Verb: "delete"})
+	if decision.Allowed || decision.Role != "viewer" || decision.RuleIndex != 1 {
+		t.Errorf("expected denied by rule 1 of viewer, got %+v", decision)
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	err := validateRules([]Rule{{Effect: "maybe", Resources: []string{"*"}, Verbs: []string{"*"}}})
+	if err == nil {
+		t.Error("expected an error for the unknown effect")
+	}
+
+	err = validateRules([]Rule{{Namespace: "[prod", Resources: []string{"*"}, Verbs: []string{"*"}}})
+	if err == nil {
+		t.Error("expected an error for the invalid pattern")
+	}
+
+	err = validateRules([]Rule{{Effect: RuleEffectDeny, Namespace: "prod-*", Resources: []string{"services"}, ResourceNames: []string{"web-?"}, Verbs: []string{"delete"}}})
+	if err != nil {
+		t.Errorf("expected the rule to be valid, got %v", err)
+	}
+}
@@ -1,28 +1,53 @@
 package identity
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jasonsoft/abb/app"
 	audit "github.com/jasonsoft/go-audit"
 	"github.com/jasonsoft/napnap"
 )
 
 func NewPublicIdentityRouter() *napnap.Router {
-	router := napnap.NewRouter()
+	router := app.NewRouter()
 	router.Post("/v1/token", createTokenEndpoint)
-	return router
+	router.Post("/v1/password/forgot", forgotPasswordEndpoint)
+	router.Post("/v1/password/reset", resetPasswordEndpoint)
+
+	// oidc
+	router.Get("/v1/oidc/login", oidcLoginEndpoint)
+	router.Get("/v1/oidc/callback", oidcCallbackEndpoint)
+	return router.Router
 }
 
 func NewPrivateIdentityRouter() *napnap.Router {
-	router := napnap.NewRouter()
+	router := app.NewRouter()
 
 	// token
 	router.Post("/v1/logout", logoutEndpoint)
+	router.Post("/v1/logout/all", logoutAllEndpoint)
 
 	// me
 	router.Get("/v1/me/menus", getMenuEndpoint)
 	router.Get("/v1/me", getMeEndpoint)
 	router.Post("/v1/me/password", updateMePasswordEndpoint)
 	router.Post("/v1/me", updateMeEndpoint)
+	router.Get("/v1/me/tokens", getMeTokensEndpoint)
+	router.Post("/v1/me/tokens", createMeTokenEndpoint)
+	router.Delete("/v1/me/tokens/:id", revokeMeTokenEndpoint)
+	router.Post("/v1/me/mfa/totp", enrollMeTOTPEndpoint)
+	router.Post("/v1/me/mfa/totp/enable", enableMeTOTPEndpoint)
+	router.Post("/v1/me/mfa/totp/disable", disableMeTOTPEndpoint)
+	router.Post("/v1/me/mfa/recovery_codes", regenerateMeRecoveryCodesEndpoint)
+
+	// api tokens
+	router.Get("/v1/tokens", getTokensEndpoint)
+	router.Post("/v1/tokens", createTokenForAccountEndpoint)
+	router.Delete("/v1/tokens/:id", revokeTokenEndpoint)
 
 	// users
 	router.Post("/v1/users", createUserEndpoint)
@@ -32,14 +57,37 @@ func NewPrivateIdentityRouter() *napnap.Router {
 	router.Post("/v1/users/:id/password", updatePasswordEndpoint)
 	router.Post("/v1/users/:id/unlock", updateUnlockEndpoint)
 	router.Post("/v1/users/:id/roles", updateUserRoleEndpoint)
+	router.Get("/v1/users/:id/roles", getUserRoleBindingsEndpoint)
+	router.Get("/v1/users/:id/identities", getUserIdentitiesEndpoint)
+	router.Post("/v1/users/:id/identities", linkUserIdentityEndpoint)
+	router.Delete("/v1/users/:id/identities/:identity_id", unlinkUserIdentityEndpoint)
+	router.Post("/v1/users/:id/mfa/reset", resetUserMFAEndpoint)
+	router.Post("/v1/users/:id/disable", disableUserEndpoint)
+	router.Post("/v1/users/:id/enable", enableUserEndpoint)
+	router.Delete("/v1/users/:id", deleteUserEndpoint)
+
+	// login logs
+	router.Get("/v1/login-logs", getLoginLogsEndpoint)
 
 	// roles
 	router.Get("/v1/roles/:name", roleGetEndpoint)
 	router.Put("/v1/roles/:name", roleUpdateEndpoint)
 	router.Get("/v1/roles", getRolesEndpoint)
 	router.Post("/v1/roles", createRolesEndpoint)
+	router.Delete("/v1/roles/:name", roleDeleteEndpoint)
+	router.Post("/v1/rbac/explain", explainAccessEndpoint)
 
-	return router
+	// teams
+	router.Get("/v1/me/teams", getMeTeamsEndpoint)
+	router.Get("/v1/teams", getTeamsEndpoint)
+	router.Post("/v1/teams", createTeamEndpoint)
+	router.Get("/v1/teams/:id", getTeamEndpoint)
+	router.Put("/v1/teams/:id", updateTeamEndpoint)
+	router.Delete("/v1/teams/:id", deleteTeamEndpoint)
+	router.Post("/v1/teams/:id/members", addTeamMemberEndpoint)
+	router.Delete("/v1/teams/:id/members/:user_id", removeTeamMemberEndpoint)
+
+	return router.Router
 }
 
 func getUsersEndpoint(c *napnap.Context) {
@@ -215,6 +263,12 @@ func updatePasswordEndpoint(c *napnap.Context) {
 		panic(err)
 	}
 
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userid), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
 	var cpo ChangePwdOption
 	err = c.BindJSON(&cpo)
 
@@ -226,6 +280,7 @@ func updatePasswordEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
+	auditUser(ctx, userid, "change_password")
 	c.SetStatus(200)
 }
 func updateUnlockEndpoint(c *napnap.Context) {
@@ -266,6 +321,13 @@ func updateUserRoleEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userid), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
 	var eul EditUserRole
 	err = c.BindJSON(&eul)
 	if err != nil {
@@ -314,10 +376,18 @@ func createRolesEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
+
+	req := AccessRequest{Resource: "roles", ResourceName: role.Name, Verb: "create"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
 	err = _membershipSvc.CreateRole(ctx, &role)
 	if err != nil {
 		panic(err)
 	}
+	auditRole(ctx, role.Name, "create")
 	c.JSON(201, role)
 }
 
@@ -335,6 +405,12 @@ func roleUpdateEndpoint(c *napnap.Context) {
 	// }
 	roleName := c.Param("name")
 
+	req := AccessRequest{Resource: "roles", ResourceName: roleName, Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
 	role, err := _membershipSvc.GetRoleByName(ctx, roleName)
 	if err != nil {
 		panic(err)
@@ -352,6 +428,7 @@ func roleUpdateEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
+	auditRole(ctx, roleName, "update")
 	c.JSON(200, role)
 
 }
@@ -420,6 +497,13 @@ func createUserEndpoint(c *napnap.Context) {
 	// 	c.SetStatus(403)
 	// 	return
 	// }
+	// the roles of the new user are bound as well, so creating users is as powerful as updating them
+	req := AccessRequest{Resource: "users", Verb: "create"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
 	var user User
 	err := c.BindJSON(&user)
 	if err != nil {
@@ -429,6 +513,7 @@ func createUserEndpoint(c *napnap.Context) {
 	if err != nil {
 		panic(err)
 	}
+	auditUser(ctx, user.ID, "create")
 
 	resp, err := _membershipSvc.GetUserByID(ctx, user.ID)
 	if err != nil {
@@ -439,13 +524,27 @@ func createUserEndpoint(c *napnap.Context) {
 
 func createTokenEndpoint(c *napnap.Context) {
 	ctx := c.StdContext()
+
+	if !_tokenLimiter.Allow(c.RemoteIPAddress()) {
+		panic(app.AppError{ErrorCode: "too_many_requests", Message: "too many login requests, please try again later"})
+	}
+
 	granttype := c.Form("grant_type")
-	username := c.Form("username")
-	password := c.Form("password")
 
-	if granttype != "password" {
+	switch granttype {
+	case "password":
+	case "refresh_token":
+		refreshTokenEndpoint(c)
+		return
+	case "mfa":
+		mfaTokenEndpoint(c)
+		return
+	default:
 		panic(app.AppError{ErrorCode: "invalid_input", Message: "grant_type is not support"})
 	}
+
+	username := c.Form("username")
+	password := c.Form("password")
 	if len(username) == 0 {
 		panic(app.AppError{ErrorCode: "login_fail", Message: "username field is invalid"})
 	}
@@ -473,6 +572,22 @@ func createTokenEndpoint(c *napnap.Context) {
 		panic(app.AppError{ErrorCode: "login_fail", Message: "username or password is invalid"})
 	}
 
+	challenge, err := _membershipSvc.MFAChallenge(ctx, userid)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+	if challenge != nil {
+		// the tokens are issued by the mfa grant type after the code is verified
+		event.State = audit.SUCCESS
+		event.Message = "mfa required"
+		audit.Log(event)
+		c.JSON(200, challenge)
+		return
+	}
+
 	result, err := _membershipSvc.GenerateToken(ctx, userid)
 	if err != nil {
 		event.State = audit.FAILED
@@ -487,16 +602,1082 @@ func createTokenEndpoint(c *napnap.Context) {
 	c.JSON(200, result)
 }
 
+func mfaTokenEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	mfaToken := c.Form("mfa_token")
+	code := c.Form("code")
+	if len(mfaToken) == 0 || len(code) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "mfa_token and code are required"})
+	}
+
+	// audit the action
+	event := &audit.Event{
+		Namespace: "auth",
+		Actor:     "",
+		Action:    "mfa_login",
+	}
+
+	userID, recoveryCodes, err := _membershipSvc.VerifyMFAChallenge(ctx, mfaToken, code)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+	event.TargetID = fmt.Sprintf("%d", userID)
+
+	result, err := _membershipSvc.GenerateToken(ctx, userID)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+	result.RecoveryCodes = recoveryCodes
+
+	event.State = audit.SUCCESS
+	audit.Log(event)
+
+	c.JSON(200, result)
+}
+
+func oidcLoginEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	authURL, browserKey, err := _membershipSvc.OIDCAuthURL(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	secure := strings.HasPrefix(_membershipSvc.config.OIDC.RedirectURL, "https://")
+	c.SetCookie(OIDCBrowserCookie, browserKey, int(oidcStateDuration/time.Second), "/v1/oidc", "", secure, true)
+	c.Redirect(302, authURL)
+}
+
+func oidcCallbackEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	if errCode := c.Query("error"); len(errCode) > 0 {
+		panic(app.AppError{ErrorCode: "login_fail", Message: errCode + ": " + c.Query("error_description")})
+	}
+
+	code := c.Query("code")
+	state := c.Query("state")
+	if len(code) == 0 || len(state) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "code and state are required"})
+	}
+
+	// the state can only be used once by the browser
+	browserKey, _ := c.Cookie(OIDCBrowserCookie)
+	c.SetCookie(OIDCBrowserCookie, "", -1, "/v1/oidc", "", false, true)
+
+	// audit the action
+	event := &audit.Event{
+		Namespace: "auth",
+		Actor:     "",
+		Action:    "oidc_login",
+	}
+
+	userID, err := _membershipSvc.OIDCLogin(ctx, code, state, browserKey)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+	event.TargetID = fmt.Sprintf("%d", userID)
+
+	challenge, err := _membershipSvc.MFAChallenge(ctx, userID)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+	if challenge != nil {
+		// the external login doesn't replace the 2fa, the tokens are issued by the mfa grant type as well
+		event.State = audit.SUCCESS
+		event.Message = "mfa required"
+		audit.Log(event)
+		c.JSON(200, challenge)
+		return
+	}
+
+	result, err := _membershipSvc.GenerateToken(ctx, userID)
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+
+	event.State = audit.SUCCESS
+	audit.Log(event)
+
+	c.JSON(200, result)
+}
+
+func refreshTokenEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	refreshToken := c.Form("refresh_token")
+	if len(refreshToken) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "refresh_token field is invalid"})
+	}
+
+	result, err := _membershipSvc.Refresh(ctx, refreshToken)
+	if err != nil {
+		panic(err)
+	}
+
+	c.JSON(200, result)
+}
+
 func logoutEndpoint(c *napnap.Context) {
-	// ctx := c.StdContext()
-	// claim, found := FromContext(ctx)
-	// if !found {
-	// 	appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
-	// 	panic(appError)
-	// }
-	// err := _membershipSvc.Logout(ctx, claim.ConsumerID)
-	// if err != nil {
-	// 	panic(err)
-	// }
-	// c.SetStatus(200)
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	err := _membershipSvc.Logout(ctx, claim)
+	if err != nil {
+		panic(err)
+	}
+
+	auditLogout(ctx, "logout")
+	c.SetStatus(200)
+}
+
+func logoutAllEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	if userID == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service account doesn't have sessions"})
+	}
+
+	err := _membershipSvc.LogoutAll(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditLogout(ctx, "logout_all")
+	c.SetStatus(200)
+}
+
+func auditLogout(ctx context.Context, action string) {
+	claims, _ := FromContext(ctx)
+	actor, _ := claims["sub"].(string)
+	event := &audit.Event{
+		Namespace: "auth",
+		TargetID:  actor,
+		Actor:     actor,
+		Action:    action,
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+}
+
+func getMeTokensEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	if userID == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service account doesn't have personal tokens"})
+	}
+
+	opts := FindAPITokensOptions{
+		UserID: userID,
+	}
+	tokens, err := _membershipSvc.GetAPITokens(ctx, opts)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, tokens)
+}
+
+func createMeTokenEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	if userID == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service account doesn't have personal tokens"})
+	}
+
+	var token APIToken
+	err := c.BindJSON(&token)
+	if err != nil {
+		panic(err)
+	}
+	token.UserID = userID
+
+	err = _membershipSvc.CreateAPIToken(ctx, &token)
+	if err != nil {
+		panic(err)
+	}
+
+	auditToken(ctx, token.ID, "create")
+	c.JSON(201, token)
+}
+
+func revokeMeTokenEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	if userID == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "service account doesn't have personal tokens"})
+	}
+
+	tokenID := c.Param("id")
+	err := _membershipSvc.RevokeAPIToken(ctx, tokenID, userID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditToken(ctx, tokenID, "revoke")
+	c.SetStatus(204)
+}
+
+func getTokensEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	req := AccessRequest{Resource: "tokens", Verb: "list"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	userID, err := c.QueryIntWithDefault("user_id", -1)
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "user_id was invalid"})
+	}
+
+	opts := FindAPITokensOptions{
+		UserID: userID,
+	}
+	tokens, err := _membershipSvc.GetAPITokens(ctx, opts)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, tokens)
+}
+
+// createTokenForAccountEndpoint creates a token of a service account, or of the user when user_id is set.
+func createTokenForAccountEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	var token APIToken
+	err := c.BindJSON(&token)
+	if err != nil {
+		panic(err)
+	}
+
+	req := AccessRequest{Resource: "tokens", ResourceName: token.Name, Verb: "create"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.CreateAPIToken(ctx, &token)
+	if err != nil {
+		panic(err)
+	}
+
+	auditToken(ctx, token.ID, "create")
+	c.JSON(201, token)
+}
+
+func revokeTokenEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	tokenID := c.Param("id")
+	req := AccessRequest{Resource: "tokens", ResourceName: tokenID, Verb: "delete"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err := _membershipSvc.RevokeAPIToken(ctx, tokenID, -1)
+	if err != nil {
+		panic(err)
+	}
+
+	auditToken(ctx, tokenID, "revoke")
+	c.SetStatus(204)
+}
+
+func auditToken(ctx context.Context, tokenID string, action string) {
+	claims, _ := FromContext(ctx)
+	actor, _ := claims["sub"].(string)
+	event := &audit.Event{
+		Namespace: "auth.tokens",
+		TargetID:  tokenID,
+		Actor:     actor,
+		Action:    action,
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func enrollMeTOTPEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	enrollment, err := _membershipSvc.EnrollTOTP(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, enrollment)
+}
+
+func enableMeTOTPEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	var req mfaCodeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		panic(err)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	codes, err := _membershipSvc.EnableTOTP(ctx, userID, req.Code)
+	if err != nil {
+		panic(err)
+	}
+
+	auditMFA(ctx, userID, "mfa_enable")
+	c.JSON(200, map[string][]string{"recovery_codes": codes})
+}
+
+func disableMeTOTPEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	var req mfaCodeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		panic(err)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	err = _membershipSvc.DisableTOTP(ctx, userID, req.Code)
+	if err != nil {
+		panic(err)
+	}
+
+	auditMFA(ctx, userID, "mfa_disable")
+	c.SetStatus(200)
+}
+
+func regenerateMeRecoveryCodesEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	var req mfaCodeRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		panic(err)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	codes, err := _membershipSvc.RegenerateRecoveryCodes(ctx, userID, req.Code)
+	if err != nil {
+		panic(err)
+	}
+
+	auditMFA(ctx, userID, "mfa_recovery_codes")
+	c.JSON(200, map[string][]string{"recovery_codes": codes})
+}
+
+func resetUserMFAEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.ResetMFA(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditMFA(ctx, userID, "mfa_reset")
+	c.SetStatus(200)
+}
+
+func auditMFA(ctx context.Context, userID int, action string) {
+	claims, _ := FromContext(ctx)
+	actor, _ := claims["sub"].(string)
+	event := &audit.Event{
+		Namespace: "auth",
+		TargetID:  fmt.Sprintf("%d", userID),
+		Actor:     actor,
+		Action:    action,
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+}
+
+func getLoginLogsEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	req := AccessRequest{Resource: "users", Verb: "list"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	status, err := c.QueryIntWithDefault("status", -1)
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "status was invalid"})
+	}
+	pagination := app.GetPaginationFromContext(c)
+
+	opt := &GetLoginLogOption{
+		Username: c.Query("username"),
+		ClientIP: c.Query("client_ip"),
+		Status:   status,
+		Skip:     pagination.Skip(),
+		Take:     pagination.PerPage,
+	}
+	if startTime := c.Query("start_time"); len(startTime) > 0 {
+		opt.StartTime, err = time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			panic(app.AppError{ErrorCode: "invalid_input", Message: "start_time was invalid, it must be RFC3339 format"})
+		}
+	}
+	if endTime := c.Query("end_time"); len(endTime) > 0 {
+		opt.EndTime, err = time.Parse(time.RFC3339, endTime)
+		if err != nil {
+			panic(app.AppError{ErrorCode: "invalid_input", Message: "end_time was invalid, it must be RFC3339 format"})
+		}
+	}
+
+	loginLogs, total, err := _membershipSvc.GetLoginLogs(ctx, opt)
+	if err != nil {
+		panic(err)
+	}
+	pagination.SetTotalCount(total)
+
+	result := app.ApiPagiationResult{
+		Pagination: pagination,
+		Data:       loginLogs,
+	}
+	c.JSON(200, result)
+}
+
+func deleteUserEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "delete"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.DeleteUser(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditUser(ctx, userID, "delete")
+	c.SetStatus(204)
+}
+
+func disableUserEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.SetUserDisabled(ctx, userID, true)
+	if err != nil {
+		panic(err)
+	}
+
+	auditUser(ctx, userID, "disable")
+	c.SetStatus(200)
+}
+
+func enableUserEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.SetUserDisabled(ctx, userID, false)
+	if err != nil {
+		panic(err)
+	}
+
+	auditUser(ctx, userID, "enable")
+	c.SetStatus(200)
+}
+
+func auditUser(ctx context.Context, userID int, action string) {
+	claims, _ := FromContext(ctx)
+	actor, _ := claims["sub"].(string)
+	event := &audit.Event{
+		Namespace: "auth.users",
+		TargetID:  fmt.Sprintf("%d", userID),
+		Actor:     actor,
+		Action:    action,
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+}
+
+func roleDeleteEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	roleName := c.Param("name")
+	req := AccessRequest{Resource: "roles", ResourceName: roleName, Verb: "delete"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err := _membershipSvc.DeleteRole(ctx, roleName)
+	if err != nil {
+		panic(err)
+	}
+	auditRole(ctx, roleName, "delete")
+	c.SetStatus(204)
+}
+
+func auditRole(ctx context.Context, roleName string, action string) {
+	claims, _ := FromContext(ctx)
+	actor, _ := claims["sub"].(string)
+	event := &audit.Event{
+		Namespace: "auth.roles",
+		TargetID:  roleName,
+		Actor:     actor,
+		Action:    action,
+		State:     audit.SUCCESS,
+	}
+	audit.Log(event)
+}
+
+func forgotPasswordEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	if !_tokenLimiter.Allow(c.RemoteIPAddress()) {
+		panic(app.AppError{ErrorCode: "too_many_requests", Message: "too many requests, please try again later"})
+	}
+
+	var req struct {
+		Login string `json:"login"` // username or email
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		panic(err)
+	}
+	if len(req.Login) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "login field is invalid"})
+	}
+
+	err = _membershipSvc.RequestPasswordReset(ctx, req.Login)
+	if err != nil {
+		panic(err)
+	}
+
+	// the same response whether the user exists or not
+	c.SetStatus(202)
+}
+
+func resetPasswordEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	if !_tokenLimiter.Allow(c.RemoteIPAddress()) {
+		panic(app.AppError{ErrorCode: "too_many_requests", Message: "too many requests, please try again later"})
+	}
+
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+		Confirm     string `json:"confirm"`
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		panic(err)
+	}
+
+	err = _membershipSvc.ResetPassword(ctx, req.Token, req.NewPassword, req.Confirm)
+
+	event := &audit.Event{
+		Namespace: "auth",
+		Actor:     "",
+		Action:    "password_reset",
+		State:     audit.SUCCESS,
+	}
+	if err != nil {
+		event.State = audit.FAILED
+		event.Message = err.Error()
+		audit.Log(event)
+		panic(err)
+	}
+	audit.Log(event)
+	c.SetStatus(200)
+}
+
+func getUserRoleBindingsEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "get"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	bindings, err := _membershipSvc.GetRoleBindings(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, bindings)
+}
+
+func getUserIdentitiesEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "get"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	identities, err := _membershipSvc.GetExternalIdentities(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, identities)
+}
+
+// linkUserIdentityEndpoint lets the existing user login through the provider, the users of the providers are
+// never linked to existing users by the username.
+func linkUserIdentityEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	identity := &ExternalIdentity{}
+	err = c.BindJSON(identity)
+	if err != nil {
+		panic(err)
+	}
+	identity.UserID = userID
+
+	err = _membershipSvc.LinkExternalIdentity(ctx, identity)
+	if err != nil {
+		panic(err)
+	}
+
+	auditUser(ctx, userID, "identity_link")
+	c.JSON(201, identity)
+}
+
+func unlinkUserIdentityEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	userID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+	identityID, err := c.ParamInt("identity_id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "identity_id field is invalid"})
+	}
+
+	req := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.UnlinkExternalIdentity(ctx, userID, identityID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditUser(ctx, userID, "identity_unlink")
+	c.SetStatus(204)
+}
+
+// explainAccessEndpoint tells which rule grants or denies the request; the current user is used when user_id is 0.
+func explainAccessEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	var req struct {
+		UserID int `json:"user_id"`
+		AccessRequest
+	}
+	err := c.BindJSON(&req)
+	if err != nil {
+		panic(err)
+	}
+	if len(req.Resource) == 0 || len(req.Verb) == 0 {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "resource and verb are required"})
+	}
+
+	claimUserID, ok := claim["user_id"].(float64)
+	if !ok {
+		c.SetStatus(401)
+		return
+	}
+	userID := req.UserID
+	if userID == 0 {
+		userID = int(claimUserID)
+	}
+	if userID != int(claimUserID) {
+		// the roles of other users can only be explained by who can read the users
+		accessReq := AccessRequest{Resource: "users", ResourceName: strconv.Itoa(userID), Verb: "get"}
+		if !IsAllowed(ctx, accessReq) {
+			c.SetStatus(403)
+			return
+		}
+	}
+	if userID == 0 {
+		// service accounts only have the roles in the claims
+		roles, err := RolesFromClaims(claim)
+		if err != nil {
+			panic(err)
+		}
+		c.JSON(200, Authorize(roles, req.AccessRequest))
+		return
+	}
+
+	decision, err := _membershipSvc.ExplainAccess(ctx, userID, req.AccessRequest)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, decision)
+}
+
+func getMeTeamsEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+	claim, found := FromContext(ctx)
+	if !found {
+		appError := app.AppError{ErrorCode: "invalid_input", Message: "user not found."}
+		panic(appError)
+	}
+
+	userID := int(claim["user_id"].(float64))
+	teams, err := _membershipSvc.GetTeams(ctx, FindTeamsOptions{UserID: userID})
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, teams)
+}
+
+func getTeamsEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	req := AccessRequest{Resource: "teams", Verb: "list"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	opts := FindTeamsOptions{
+		Name: c.Query("name"),
+	}
+	teams, err := _membershipSvc.GetTeams(ctx, opts)
+	if err != nil {
+		panic(err)
+	}
+	c.JSON(200, teams)
+}
+
+func getTeamEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	teamID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+	team, err := _membershipSvc.GetTeam(ctx, teamID)
+	if err != nil {
+		panic(err)
+	}
+	if team == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "team not found"})
+	}
+
+	req := AccessRequest{Resource: "teams", ResourceName: team.Name, Verb: "get"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	c.JSON(200, team)
+}
+
+func createTeamEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	var team Team
+	err := c.BindJSON(&team)
+	if err != nil {
+		panic(err)
+	}
+
+	req := AccessRequest{Resource: "teams", ResourceName: team.Name, Verb: "create"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.CreateTeam(ctx, &team)
+	if err != nil {
+		panic(err)
+	}
+
+	auditTeam(ctx, team.Name, "create", "")
+	c.JSON(201, team)
+}
+
+func updateTeamEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	teamID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+	team, err := _membershipSvc.GetTeam(ctx, teamID)
+	if err != nil {
+		panic(err)
+	}
+	if team == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "team not found"})
+	}
+
+	req := AccessRequest{Resource: "teams", ResourceName: team.Name, Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = c.BindJSON(team)
+	if err != nil {
+		panic(err)
+	}
+	team.ID = teamID
+	err = _membershipSvc.UpdateTeam(ctx, team)
+	if err != nil {
+		panic(err)
+	}
+
+	auditTeam(ctx, team.Name, "update", "")
+	c.JSON(200, team)
+}
+
+func deleteTeamEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	teamID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+	team, err := _membershipSvc.GetTeam(ctx, teamID)
+	if err != nil {
+		panic(err)
+	}
+	if team == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "team not found"})
+	}
+
+	req := AccessRequest{Resource: "teams", ResourceName: team.Name, Verb: "delete"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	err = _membershipSvc.DeleteTeam(ctx, teamID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditTeam(ctx, team.Name, "delete", "")
+	c.SetStatus(204)
+}
+
+func addTeamMemberEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	teamID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+	team, err := _membershipSvc.GetTeam(ctx, teamID)
+	if err != nil {
+		panic(err)
+	}
+	if team == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "team not found"})
+	}
+
+	req := AccessRequest{Resource: "teams", ResourceName: team.Name, Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	var member TeamMember
+	err = c.BindJSON(&member)
+	if err != nil {
+		panic(err)
+	}
+
+	err = _membershipSvc.AddTeamMember(ctx, teamID, member.UserID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditTeam(ctx, fmt.Sprintf("%d", teamID), "add_member", fmt.Sprintf("user_id: %d", member.UserID))
+	c.SetStatus(200)
+}
+
+func removeTeamMemberEndpoint(c *napnap.Context) {
+	ctx := c.StdContext()
+
+	teamID, err := c.ParamInt("id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "id field is invalid"})
+	}
+	team, err := _membershipSvc.GetTeam(ctx, teamID)
+	if err != nil {
+		panic(err)
+	}
+	if team == nil {
+		panic(app.AppError{ErrorCode: "not_found", Message: "team not found"})
+	}
+
+	req := AccessRequest{Resource: "teams", ResourceName: team.Name, Verb: "update"}
+	if !IsAllowed(ctx, req) {
+		c.SetStatus(403)
+		return
+	}
+
+	userID, err := c.ParamInt("user_id")
+	if err != nil {
+		panic(app.AppError{ErrorCode: "invalid_input", Message: "user_id field is invalid"})
+	}
+
+	err = _membershipSvc.RemoveTeamMember(ctx, teamID, userID)
+	if err != nil {
+		panic(err)
+	}
+
+	auditTeam(ctx, fmt.Sprintf("%d", teamID), "remove_member", fmt.Sprintf("user_id: %d", userID))
+	c.SetStatus(204)
+}
+
+func auditTeam(ctx context.Context, targetID string, action string, message string) {
+	claims, _ := FromContext(ctx)
+	actor, _ := claims["sub"].(string)
+	event := &audit.Event{
+		Namespace: "auth.teams",
+		TargetID:  targetID,
+		Actor:     actor,
+		Action:    action,
+		State:     audit.SUCCESS,
+		Message:   message,
+	}
+	audit.Log(event)
 }
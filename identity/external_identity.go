@@ -0,0 +1,224 @@
+package identity
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jasonsoft/abb/app"
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+)
+
+// ExternalIdentity links the user to the account of an external provider.  The users of the providers are looked up
+// by the subject, which the provider keeps stable, instead of the username which anyone may be able to change.
+type ExternalIdentity struct {
+	ID        int        `json:"id" db:"id"`
+	Provider  string     `json:"provider" db:"provider"` // the issuer of oidc, or ldap
+	Subject   string     `json:"subject" db:"subject"`   // the sub claim of oidc, or the lower case dn of ldap
+	UserID    int        `json:"user_id" db:"user_id"`
+	CreatedAt *time.Time `json:"created_at,omitempty" db:"created_at"`
+}
+
+// externalUser returns the id of the user who is linked to the external identity.  The user is created on first
+// login; an existing user is only used when an administrator linked the identity to the user, otherwise everyone
+// who can choose the username on the provider could take over the local user.
+func (ms *MembershipService) externalUser(ctx context.Context, provider string, subject string, username string, displayName string) (int, error) {
+	log := xlog.FromContext(ctx)
+
+	if len(provider) == 0 || len(subject) == 0 {
+		return 0, app.AppError{ErrorCode: "login_fail", Message: "the external identity is invalid"}
+	}
+
+	identity, err := _externalIdentityRepo.Get(ctx, provider, subject)
+	if err != nil {
+		return 0, err
+	}
+	if identity != nil {
+		return identity.UserID, nil
+	}
+
+	account, err := _accountRepo.Get(ctx, &Account{Username: username})
+	if err != nil {
+		return 0, err
+	}
+	if account != nil {
+		log.Warnf("membership: %s of %s isn't linked to the user %s", subject, provider, username)
+		msg := fmt.Sprintf("user %s already exists, ask the administrator to link your account to it", username)
+		return 0, app.AppError{ErrorCode: "login_fail", Message: msg}
+	}
+
+	// provisioned users get a random password, so they can only login through their provider
+	password, err := app.RandomHex(16)
+	if err != nil {
+		return 0, err
+	}
+	user := &User{
+		Username:    username,
+		DisplayName: displayName,
+		Password:    password,
+		externalIdentity: &ExternalIdentity{
+			Provider: provider,
+			Subject:  subject,
+		},
+	}
+	err = ms.insertUser(ctx, user)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("membership: user %s was provisioned by %s", username, provider)
+	return user.ID, nil
+}
+
+// LinkExternalIdentity lets the existing user login through the provider.
+func (ms *MembershipService) LinkExternalIdentity(ctx context.Context, identity *ExternalIdentity) error {
+	if len(identity.Provider) == 0 || len(identity.Subject) == 0 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "provider and subject are required"}
+	}
+
+	account, err := _accountRepo.GetAccountByID(ctx, identity.UserID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "user not found"}
+	}
+
+	tx, err := ms.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = _externalIdentityRepo.Insert(ctx, identity, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnlinkExternalIdentity removes the identity from the user.
+func (ms *MembershipService) UnlinkExternalIdentity(ctx context.Context, userID int, id int) error {
+	deleted, err := _externalIdentityRepo.Delete(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return app.AppError{ErrorCode: "not_found", Message: "identity not found"}
+	}
+	return nil
+}
+
+// GetExternalIdentities returns the identities which are linked to the user.
+func (ms *MembershipService) GetExternalIdentities(ctx context.Context, userID int) ([]*ExternalIdentity, error) {
+	return _externalIdentityRepo.FindByUser(ctx, userID)
+}
+
+type ExternalIdentityRepo struct {
+	db *sqlx.DB
+}
+
+func NewExternalIdentityRepo(db *sqlx.DB) *ExternalIdentityRepo {
+	return &ExternalIdentityRepo{
+		db: db,
+	}
+}
+
+const getExternalIdentitySQL = "SELECT * FROM `external_identities` WHERE `provider` = :provider AND `subject` = :subject"
+
+func (repo *ExternalIdentityRepo) Get(ctx context.Context, provider string, subject string) (*ExternalIdentity, error) {
+	log := xlog.FromContext(ctx)
+	getStmt, err := repo.db.PrepareNamed(getExternalIdentitySQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer getStmt.Close()
+
+	m := map[string]interface{}{
+		"provider": provider,
+		"subject":  subject,
+	}
+	identity := &ExternalIdentity{}
+	err = getStmt.Get(identity, m)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Errorf("membership: get external identity fail: %v", err)
+		return nil, err
+	}
+	return identity, nil
+}
+
+const findExternalIdentitiesSQL = "SELECT * FROM `external_identities` WHERE `user_id` = ? ORDER BY `id`"
+
+func (repo *ExternalIdentityRepo) FindByUser(ctx context.Context, userID int) ([]*ExternalIdentity, error) {
+	log := xlog.FromContext(ctx)
+
+	identities := []*ExternalIdentity{}
+	err := repo.db.Select(&identities, findExternalIdentitiesSQL, userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("membership: find external identities fail: %v", err)
+		return nil, err
+	}
+	return identities, nil
+}
+
+// the provider and subject are unique
+const insertExternalIdentitySQL = "INSERT INTO `external_identities` (`provider`, `subject`, `user_id`, `created_at`) VALUES (:provider, :subject, :user_id, :created_at);"
+
+func (repo *ExternalIdentityRepo) Insert(ctx context.Context, entity *ExternalIdentity, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+
+	result, err := tx.NamedExec(insertExternalIdentitySQL, entity)
+	if err != nil {
+		mysqlerr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlerr.Number == 1062 {
+			return app.AppError{ErrorCode: "invalid_input", Message: "the identity is already linked"}
+		}
+		log.Errorf("membership: insert external identity fail: %v", err)
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	entity.ID = int(id)
+	return nil
+}
+
+const deleteExternalIdentitySQL = "DELETE FROM `external_identities` WHERE `id` = ? AND `user_id` = ?;"
+
+func (repo *ExternalIdentityRepo) Delete(ctx context.Context, userID int, id int) (bool, error) {
+	log := xlog.FromContext(ctx)
+
+	result, err := repo.db.Exec(deleteExternalIdentitySQL, id, userID)
+	if err != nil {
+		log.Errorf("membership: delete external identity fail: %v", err)
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+const deleteExternalIdentitiesByUserSQL = "DELETE FROM `external_identities` WHERE `user_id` = ?;"
+
+func (repo *ExternalIdentityRepo) DeleteByUser(ctx context.Context, userID int, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	_, err := tx.Exec(deleteExternalIdentitiesByUserSQL, userID)
+	if err != nil {
+		log.Errorf("membership: delete external identities of user fail: %v", err)
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package identity
 
 import (
+	"time"
+
 	"github.com/jasonsoft/abb/app"
 	"github.com/jasonsoft/abb/config"
 )
@@ -9,8 +11,22 @@ var (
 	_userProfileRepo *UserProfileRepo
 	_accountRepo     *AccountRepo
 	_roleRepo        *RoleRepo
+	_apiTokenRepo    *APITokenRepo
+
+	_passwordHistoryRepo *PasswordHistoryRepo
+	_loginLogRepo        *LoginLogRepo
+	_teamRepo            *TeamRepo
+
+	_passwordResetTokenRepo *PasswordResetTokenRepo
+	_mailSender             MailSender
+
+	_refreshTokenRepo    *RefreshTokenRepo
+	_tokenRevocationRepo *TokenRevocationRepo
+
+	_externalIdentityRepo *ExternalIdentityRepo
 	//_modulesRepo     *modules.ModulesRepo
 	_membershipSvc *MembershipService
+	_tokenLimiter  *app.RateLimiter
 )
 
 func init() {
@@ -20,7 +36,17 @@ func init() {
 	_userProfileRepo = NewUserProfileRepo(dbx)
 	_roleRepo = NewRoleRepo(dbx)
 	_accountRepo = NewAccountRepo(dbx)
+	_apiTokenRepo = NewAPITokenRepo(dbx)
+	_passwordHistoryRepo = NewPasswordHistoryRepo(dbx)
+	_loginLogRepo = NewLoginLogRepo(dbx)
+	_teamRepo = NewTeamRepo(dbx)
+	_passwordResetTokenRepo = NewPasswordResetTokenRepo(dbx)
+	_mailSender = newMailSender(config.Mail)
+	_refreshTokenRepo = NewRefreshTokenRepo(dbx)
+	_tokenRevocationRepo = NewTokenRevocationRepo(dbx)
+	_externalIdentityRepo = NewExternalIdentityRepo(dbx)
 	// _modulesRepo = modules.NewModulesRepo(dbx)
 
 	_membershipSvc = NewMembershipService(dbx, config)
+	_tokenLimiter = app.NewRateLimiter(config.Lockout.TokenRateLimitPerMin, time.Minute)
 }
@@ -0,0 +1,597 @@
+package identity
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/abb/config"
+	xlog "github.com/jasonsoft/log"
+)
+
+// ldapProvider is the provider of the external identities of the ldap users
+const ldapProvider = "ldap"
+
+// ldapAuthenticator binds with the service account, searches the user, verifies the password by binding as the user
+// and syncs the groups of the user into the mapped roles.  Only the few LDAPv3 operations we need are implemented.
+type ldapAuthenticator struct {
+	ms     *MembershipService
+	config config.LDAP
+}
+
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *ldapAuthenticator) Authenticate(ctx context.Context, username string, password string) (int, error) {
+	if len(password) == 0 {
+		// an empty password is an anonymous bind which always succeeds
+		return 0, nil
+	}
+
+	conn, err := dialLDAP(a.config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	err = conn.Bind(a.config.BindDN, a.config.BindPassword)
+	if err != nil {
+		return 0, fmt.Errorf("ldap: bind service account fail: %v", err)
+	}
+
+	userFilter := a.config.UserFilter
+	if len(userFilter) == 0 {
+		userFilter = "(uid=%s)"
+	}
+	displayNameAttr := a.config.DisplayNameAttribute
+	if len(displayNameAttr) == 0 {
+		displayNameAttr = "cn"
+	}
+	groupAttr := a.config.GroupAttribute
+	if len(groupAttr) == 0 {
+		groupAttr = "memberOf"
+	}
+
+	filter := strings.Replace(userFilter, "%s", escapeLDAPFilter(username), -1)
+	entries, err := conn.Search(a.config.BaseDN, filter, []string{displayNameAttr, groupAttr})
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) != 1 {
+		// the user doesn't exist, or the filter isn't unique
+		return 0, nil
+	}
+	entry := entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if _, ok := err.(ldapResultError); ok {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	displayName := entry.first(displayNameAttr)
+	if len(displayName) == 0 {
+		displayName = username
+	}
+	// the dn identifies the user, the local users with the same username aren't taken over
+	userID, err := a.ms.externalUser(ctx, ldapProvider, strings.ToLower(entry.DN), username, displayName)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(a.config.RoleMappings) > 0 {
+		groups := entry.Attributes[strings.ToLower(groupAttr)]
+		roles := []string{}
+		for _, mapping := range a.config.RoleMappings {
+			for _, group := range groups {
+				if strings.EqualFold(group, mapping.Value) && !containsString(roles, mapping.Role) {
+					roles = append(roles, mapping.Role)
+				}
+			}
+		}
+		err = a.ms.syncUserRoles(ctx, userID, a.config.RoleMappings, roles)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	xlog.FromContext(ctx).Debugf("ldap: %s logins as %s", username, entry.DN)
+	return userID, nil
+}
+
+// escapeLDAPFilter escapes the special characters of RFC 4515.
+func escapeLDAPFilter(s string) string {
+	buf := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&buf, "\\%02x", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// ************************
+// LDAP protocol
+// ************************
+
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchResultItem = 0x64
+	ldapSearchResultDone = 0x65
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	ldapFilterAnd      = 0xa0
+	ldapFilterOr       = 0xa1
+	ldapFilterNot      = 0xa2
+	ldapFilterEquality = 0xa3
+	ldapFilterPresent  = 0x87
+
+	ldapTimeout = 10 * time.Second
+)
+
+type ldapResultError struct {
+	code    int
+	message string
+}
+
+func (e ldapResultError) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.code, e.message)
+}
+
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string // the keys are lower case
+}
+
+func (e *ldapEntry) first(attr string) string {
+	vals := e.Attributes[strings.ToLower(attr)]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+// dialLDAP connects to ldaps://host:port, or to ldap://host:port with StartTLS.  The passwords are sent by the
+// binds, so cleartext connections are refused.
+func dialLDAP(cfg config.LDAP) (*ldapConn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	switch u.Scheme {
+	case "ldap":
+		if !cfg.StartTLS {
+			return nil, fmt.Errorf("ldap: %s is cleartext, use ldaps:// or enable start_tls", cfg.URL)
+		}
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err := dialer.Dial("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		l := &ldapConn{
+			conn:   conn,
+			reader: bufio.NewReader(conn),
+		}
+		err = l.startTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return l, nil
+	case "ldaps":
+		host := u.Host
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err := tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &ldapConn{
+			conn:   conn,
+			reader: bufio.NewReader(conn),
+		}, nil
+	}
+	return nil, fmt.Errorf("ldap: unsupported scheme: %s", u.Scheme)
+}
+
+// startTLS upgrades the connection as RFC 4511 4.14 describes, nothing else may be sent before.
+func (l *ldapConn) startTLS(tlsConfig *tls.Config) error {
+	op := berTLV(ldapExtendedRequest, berTLV(0x80, []byte(ldapStartTLSOID)))
+	messageID, err := l.send(op)
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if resp.tag != ldapExtendedResponse {
+		return fmt.Errorf("ldap: unexpected response: %x", resp.tag)
+	}
+	err = ldapResult(resp)
+	if err != nil {
+		return fmt.Errorf("ldap: start tls fail: %v", err)
+	}
+
+	tlsConn := tls.Client(l.conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(ldapTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	l.conn = tlsConn
+	l.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (l *ldapConn) Close() error {
+	l.send(berTLV(ldapUnbindRequest, nil))
+	return l.conn.Close()
+}
+
+func (l *ldapConn) send(op []byte) (int, error) {
+	l.messageID++
+	packet := berTLV(berSequence, berInt(berInteger, l.messageID), op)
+	l.conn.SetDeadline(time.Now().Add(ldapTimeout))
+	_, err := l.conn.Write(packet)
+	return l.messageID, err
+}
+
+// receive reads the next message and returns its protocol operation.
+func (l *ldapConn) receive(messageID int) (*berNode, error) {
+	for {
+		packet, err := readBER(l.reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(packet.children) < 2 {
+			return nil, fmt.Errorf("ldap: invalid message")
+		}
+		if packet.children[0].int() != messageID {
+			continue
+		}
+		return packet.children[1], nil
+	}
+}
+
+func (l *ldapConn) Bind(dn string, password string) error {
+	op := berTLV(ldapBindRequest,
+		berInt(berInteger, 3),
+		berTLV(berOctetString, []byte(dn)),
+		berTLV(0x80, []byte(password)),
+	)
+	messageID, err := l.send(op)
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.receive(messageID)
+	if err != nil {
+		return err
+	}
+	if resp.tag != ldapBindResponse {
+		return fmt.Errorf("ldap: unexpected response: %x", resp.tag)
+	}
+	return ldapResult(resp)
+}
+
+func (l *ldapConn) Search(baseDN string, filter string, attributes []string) ([]*ldapEntry, error) {
+	encodedFilter, rest, err := encodeLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("ldap: invalid filter: %s", filter)
+	}
+
+	attrs := [][]byte{}
+	for _, attr := range attributes {
+		attrs = append(attrs, berTLV(berOctetString, []byte(attr)))
+	}
+
+	op := berTLV(ldapSearchRequest,
+		berTLV(berOctetString, []byte(baseDN)),
+		berInt(berEnumerated, 2), // whole subtree
+		berInt(berEnumerated, 0), // never deref aliases
+		berInt(berInteger, 2),    // size limit, we only need to know whether the user is unique
+		berInt(berInteger, int(ldapTimeout/time.Second)),
+		berTLV(berBoolean, []byte{0}),
+		encodedFilter,
+		berTLV(berSequence, attrs...),
+	)
+	messageID, err := l.send(op)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*ldapEntry{}
+	for {
+		resp, err := l.receive(messageID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.tag {
+		case ldapSearchResultItem:
+			if len(resp.children) < 2 {
+				return nil, fmt.Errorf("ldap: invalid search entry")
+			}
+			entry := &ldapEntry{
+				DN:         string(resp.children[0].value),
+				Attributes: map[string][]string{},
+			}
+			for _, attr := range resp.children[1].children {
+				if len(attr.children) < 2 {
+					continue
+				}
+				name := strings.ToLower(string(attr.children[0].value))
+				for _, val := range attr.children[1].children {
+					entry.Attributes[name] = append(entry.Attributes[name], string(val.value))
+				}
+			}
+			entries = append(entries, entry)
+		case ldapSearchResultDone:
+			err = ldapResult(resp)
+			// size limit exceeded still tells us the user isn't unique
+			if resultErr, ok := err.(ldapResultError); ok && resultErr.code == 4 {
+				return entries, nil
+			}
+			return entries, err
+		}
+	}
+}
+
+func ldapResult(resp *berNode) error {
+	if len(resp.children) < 3 {
+		return fmt.Errorf("ldap: invalid result")
+	}
+	code := resp.children[0].int()
+	if code != 0 {
+		return ldapResultError{code: code, message: string(resp.children[2].value)}
+	}
+	return nil
+}
+
+// encodeLDAPFilter encodes the filter of RFC 4515; and, or, not, equality and presence are supported.
+func encodeLDAPFilter(filter string) ([]byte, string, error) {
+	filter = strings.TrimSpace(filter)
+	if len(filter) < 2 || filter[0] != '(' {
+		return nil, "", fmt.Errorf("ldap: invalid filter: %s", filter)
+	}
+	filter = filter[1:]
+
+	switch filter[0] {
+	case '&', '|', '!':
+		tag := byte(ldapFilterAnd)
+		if filter[0] == '|' {
+			tag = ldapFilterOr
+		} else if filter[0] == '!' {
+			tag = ldapFilterNot
+		}
+
+		rest := filter[1:]
+		children := [][]byte{}
+		for {
+			rest = strings.TrimSpace(rest)
+			if len(rest) == 0 {
+				return nil, "", fmt.Errorf("ldap: filter isn't closed")
+			}
+			if rest[0] == ')' {
+				break
+			}
+			child, next, err := encodeLDAPFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			rest = next
+		}
+		if len(children) == 0 || (tag == ldapFilterNot && len(children) != 1) {
+			return nil, "", fmt.Errorf("ldap: invalid filter")
+		}
+		return berTLV(tag, children...), rest[1:], nil
+	}
+
+	end := strings.Index(filter, ")")
+	if end < 0 {
+		return nil, "", fmt.Errorf("ldap: filter isn't closed")
+	}
+	item := filter[:end]
+	rest := filter[end+1:]
+
+	idx := strings.Index(item, "=")
+	if idx <= 0 {
+		return nil, "", fmt.Errorf("ldap: invalid filter item: %s", item)
+	}
+	attr := item[:idx]
+	value := item[idx+1:]
+
+	if value == "*" {
+		return berTLV(ldapFilterPresent, []byte(attr)), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("ldap: substring filter isn't supported: %s", item)
+	}
+
+	unescaped, err := unescapeLDAPFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berTLV(ldapFilterEquality,
+		berTLV(berOctetString, []byte(attr)),
+		berTLV(berOctetString, unescaped),
+	), rest, nil
+}
+
+func unescapeLDAPFilter(s string) ([]byte, error) {
+	result := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			result = append(result, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return nil, fmt.Errorf("ldap: invalid escape in filter: %s", s)
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("ldap: invalid escape in filter: %s", s)
+		}
+		result = append(result, b...)
+		i += 2
+	}
+	return result, nil
+}
+
+// ************************
+// BER
+// ************************
+
+type berNode struct {
+	tag      byte
+	value    []byte
+	children []*berNode
+}
+
+func (n *berNode) int() int {
+	result := 0
+	for i, b := range n.value {
+		if i == 0 && b&0x80 != 0 {
+			result = -1
+		}
+		result = result<<8 | int(b)
+	}
+	return result
+}
+
+func berTLV(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, content := range contents {
+		length += len(content)
+	}
+
+	result := []byte{tag}
+	result = append(result, berLength(length)...)
+	for _, content := range contents {
+		result = append(result, content...)
+	}
+	return result
+}
+
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	buf := []byte{}
+	for l := length; l > 0; l >>= 8 {
+		buf = append([]byte{byte(l)}, buf...)
+	}
+	return append([]byte{0x80 | byte(len(buf))}, buf...)
+}
+
+func berInt(tag byte, n int) []byte {
+	buf := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		buf = append([]byte{byte(n)}, buf...)
+	}
+	if buf[0]&0x80 != 0 {
+		buf = append([]byte{0}, buf...)
+	}
+	return berTLV(tag, buf)
+}
+
+func readBER(r io.Reader) (*berNode, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return nil, fmt.Errorf("ldap: unsupported length")
+		}
+		buf := make([]byte, size)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range buf {
+			length = length<<8 | int(b)
+		}
+	}
+
+	value := make([]byte, length)
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		return nil, err
+	}
+	return parseBER(header[0], value)
+}
+
+func parseBER(tag byte, value []byte) (*berNode, error) {
+	node := &berNode{
+		tag:   tag,
+		value: value,
+	}
+	if tag&0x20 == 0 {
+		// primitive
+		return node, nil
+	}
+
+	reader := strings.NewReader(string(value))
+	for reader.Len() > 0 {
+		child, err := readBER(reader)
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, child)
+	}
+	return node, nil
+}
@@ -0,0 +1,319 @@
+package identity
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jasonsoft/abb/config"
+)
+
+const (
+	testBindDN   = "cn=abb,dc=example,dc=com"
+	testBaseDN   = "dc=example,dc=com"
+	testAliceDN  = "uid=alice,ou=people,dc=example,dc=com"
+	testAdminsDN = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+type ldapTestUser struct {
+	uid      string
+	password string
+	groups   []string
+}
+
+// mockDirectory is an ldap server which supports StartTLS, simple binds and searches by an equality filter.
+type mockDirectory struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	users     map[string]ldapTestUser // the keys are the dn
+
+	mu             sync.Mutex
+	cleartextBinds int
+}
+
+func newMockDirectory(t *testing.T) *mockDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	directory := &mockDirectory{
+		listener:  listener,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}},
+		users: map[string]ldapTestUser{
+			testBindDN:  {password: "service"},
+			testAliceDN: {uid: "alice", password: "wonderland", groups: []string{testAdminsDN}},
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go directory.serve(conn)
+		}
+	}()
+	return directory
+}
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (d *mockDirectory) config() config.LDAP {
+	return config.LDAP{
+		URL:                "ldap://" + d.listener.Addr().String(),
+		BindDN:             testBindDN,
+		BindPassword:       "service",
+		BaseDN:             testBaseDN,
+		StartTLS:           true,
+		InsecureSkipVerify: true,
+	}
+}
+
+func (d *mockDirectory) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	reader := bufio.NewReader(conn)
+	secure := false
+	for {
+		packet, err := readBER(reader)
+		if err != nil || len(packet.children) < 2 {
+			return
+		}
+		messageID := packet.children[0].int()
+		op := packet.children[1]
+		reply := func(ops ...[]byte) {
+			for _, op := range ops {
+				conn.Write(berTLV(berSequence, berInt(berInteger, messageID), op))
+			}
+		}
+		result := func(tag byte, code int) []byte {
+			return berTLV(tag, berInt(berEnumerated, code), berTLV(berOctetString, nil), berTLV(berOctetString, nil))
+		}
+
+		switch op.tag {
+		case ldapExtendedRequest:
+			if secure || len(op.children) == 0 || string(op.children[0].value) != ldapStartTLSOID {
+				reply(result(ldapExtendedResponse, 2))
+				continue
+			}
+			reply(result(ldapExtendedResponse, 0))
+			tlsConn := tls.Server(conn, d.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, reader, secure = tlsConn, bufio.NewReader(tlsConn), true
+		case ldapBindRequest:
+			if !secure {
+				d.mu.Lock()
+				d.cleartextBinds++
+				d.mu.Unlock()
+			}
+			user, found := d.users[string(op.children[1].value)]
+			if !found || user.password != string(op.children[2].value) {
+				reply(result(ldapBindResponse, 49)) // invalid credentials
+				continue
+			}
+			reply(result(ldapBindResponse, 0))
+		case ldapSearchRequest:
+			// the filter of the tests is (uid=value)
+			filter := op.children[6]
+			for dn, user := range d.users {
+				if filter.tag != ldapFilterEquality || user.uid != string(filter.children[1].value) {
+					continue
+				}
+				groups := [][]byte{}
+				for _, group := range user.groups {
+					groups = append(groups, berTLV(berOctetString, []byte(group)))
+				}
+				reply(berTLV(ldapSearchResultItem,
+					berTLV(berOctetString, []byte(dn)),
+					berTLV(berSequence,
+						berTLV(berSequence, berTLV(berOctetString, []byte("cn")), berTLV(berSet, berTLV(berOctetString, []byte("Alice")))),
+						berTLV(berSequence, berTLV(berOctetString, []byte("memberOf")), berTLV(berSet, groups...)),
+					),
+				))
+			}
+			reply(result(ldapSearchResultDone, 0))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func (d *mockDirectory) assertNoCleartextBinds(t *testing.T) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cleartextBinds > 0 {
+		t.Errorf("expected the binds to be sent over tls, got %d cleartext binds", d.cleartextBinds)
+	}
+}
+
+func newTestLDAPAuthenticator(cfg config.LDAP) *ldapAuthenticator {
+	return &ldapAuthenticator{ms: _membershipSvc, config: cfg}
+}
+
+func TestLDAPRefusesCleartextBind(t *testing.T) {
+	directory := newMockDirectory(t)
+	cfg := directory.config()
+	cfg.StartTLS = false
+
+	_, err := newTestLDAPAuthenticator(cfg).Authenticate(context.Background(), "alice", "wonderland")
+	if err == nil || !strings.Contains(err.Error(), "cleartext") {
+		t.Fatalf("expected the cleartext url to be refused, got %v", err)
+	}
+	directory.assertNoCleartextBinds(t)
+}
+
+func TestLDAPLoginUsesLinkedIdentity(t *testing.T) {
+	directory := newMockDirectory(t)
+	mock := mockMembershipDB(t)
+
+	// the user is found by the dn, the username isn't used
+	expectExternalIdentity(mock, ldapProvider, testAliceDN, sqlmock.NewRows(externalIdentityColumns).AddRow(1, ldapProvider, testAliceDN, 7, time.Now()))
+
+	userID, err := newTestLDAPAuthenticator(directory.config()).Authenticate(context.Background(), "alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 7 {
+		t.Errorf("expected user 7, got %d", userID)
+	}
+	directory.assertNoCleartextBinds(t)
+}
+
+func TestLDAPLoginRejectsWrongPassword(t *testing.T) {
+	directory := newMockDirectory(t)
+	mockMembershipDB(t)
+
+	userID, err := newTestLDAPAuthenticator(directory.config()).Authenticate(context.Background(), "alice", "guess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 0 {
+		t.Errorf("expected the password to be rejected, got user %d", userID)
+	}
+}
+
+func TestLDAPLoginRefusesExistingUserWithoutLink(t *testing.T) {
+	directory := newMockDirectory(t)
+	mock := mockMembershipDB(t)
+
+	expectExternalIdentity(mock, ldapProvider, testAliceDN, sqlmock.NewRows(externalIdentityColumns))
+	expectAccountByName(mock, "alice", sqlmock.NewRows([]string{"user_id", "username"}).AddRow(1, "alice"))
+
+	_, err := newTestLDAPAuthenticator(directory.config()).Authenticate(context.Background(), "alice", "wonderland")
+	assertLoginFail(t, err)
+}
+
+func TestLoginUsesAccountLinkedToLDAPUser(t *testing.T) {
+	directory := newMockDirectory(t)
+	mock := mockMembershipDB(t)
+	loginLogRepo, authenticators := _loginLogRepo, _membershipSvc.authenticators
+	_loginLogRepo = NewLoginLogRepo(_membershipSvc.db)
+	_membershipSvc.authenticators = []Authenticator{&localAuthenticator{}, newTestLDAPAuthenticator(directory.config())}
+	t.Cleanup(func() {
+		_loginLogRepo, _membershipSvc.authenticators = loginLogRepo, authenticators
+	})
+
+	// the local alice is user 1, the ldap alice was linked to user 7
+	expectAccountByName(mock, "alice", sqlmock.NewRows([]string{"user_id", "username"}).AddRow(1, "alice"))
+	// the local authenticator doesn't accept the password of ldap
+	expectAccountByName(mock, "alice", sqlmock.NewRows([]string{"user_id", "username"}).AddRow(1, "alice"))
+	expectExternalIdentity(mock, ldapProvider, testAliceDN, sqlmock.NewRows(externalIdentityColumns).AddRow(1, ldapProvider, testAliceDN, 7, time.Now()))
+	expectAccountLogin(mock, 7, "alice.smith")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `login_logs`")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	ok, userID, err := _membershipSvc.Login(context.Background(), "alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || userID != 7 {
+		t.Errorf("expected the linked user 7, got %v %d", ok, userID)
+	}
+}
+
+func TestLDAPSyncsOnlyMappedRoles(t *testing.T) {
+	directory := newMockDirectory(t)
+	mock := mockMembershipDB(t)
+	cfg := directory.config()
+	cfg.RoleMappings = []config.RoleMapping{
+		{Value: testAdminsDN, Role: "admin"},
+		{Value: "cn=ops,ou=groups,dc=example,dc=com", Role: "ops"},
+	}
+
+	expectExternalIdentity(mock, ldapProvider, testAliceDN, sqlmock.NewRows(externalIdentityColumns).AddRow(1, ldapProvider, testAliceDN, 7, time.Now()))
+	// ops is managed by the mappings, viewer was granted in abb
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT `users_roles`.`role_id`")).ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"role_id", "name", "clustersJSON"}).
+			AddRow(2, "ops", `[]`).
+			AddRow(3, "viewer", `["prod"]`))
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT roles.id")).ExpectQuery().WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "rulesJSON", "created_at", "updated_at"}).AddRow(1, "admin", `[]`, time.Now(), time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `users_roles`")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `users_roles`")).WithArgs(7, 1, `[]`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `users_roles`")).WithArgs(7, 3, `["prod"]`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	userID, err := newTestLDAPAuthenticator(cfg).Authenticate(context.Background(), "alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 7 {
+		t.Errorf("expected user 7, got %d", userID)
+	}
+}
+
+func TestLDAPKeepsRolesWhenNoMappingMatches(t *testing.T) {
+	directory := newMockDirectory(t)
+	mock := mockMembershipDB(t)
+	cfg := directory.config()
+	cfg.RoleMappings = []config.RoleMapping{
+		{Value: "cn=ops,ou=groups,dc=example,dc=com", Role: "ops"},
+	}
+
+	// nothing else is queried, so the roles aren't touched
+	expectExternalIdentity(mock, ldapProvider, testAliceDN, sqlmock.NewRows(externalIdentityColumns).AddRow(1, ldapProvider, testAliceDN, 7, time.Now()))
+
+	userID, err := newTestLDAPAuthenticator(cfg).Authenticate(context.Background(), "alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 7 {
+		t.Errorf("expected user 7, got %d", userID)
+	}
+}
@@ -0,0 +1,99 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	audit "github.com/jasonsoft/go-audit"
+	xlog "github.com/jasonsoft/log"
+)
+
+// AccountLockedHandler is called when an account is locked by failed login attempts, lockedUntil is nil when
+// the account is locked until an admin unlocks it.
+type AccountLockedHandler func(username string, lockedUntil *time.Time)
+
+var _accountLockedHandlers []AccountLockedHandler
+
+// OnAccountLocked registers the handler, such as sending a slack message.
+func OnAccountLocked(handler AccountLockedHandler) {
+	_accountLockedHandlers = append(_accountLockedHandlers, handler)
+}
+
+func (ms *MembershipService) maxFailedAttempts() int {
+	if ms.config.Lockout.MaxFailedAttempts <= 0 {
+		return 5
+	}
+	return ms.config.Lockout.MaxFailedAttempts
+}
+
+// isAccountLocked reports whether the account is locked now; the lock expires after the lockout duration.
+func (ms *MembershipService) isAccountLocked(account *Account) bool {
+	if !account.IsLockedOut && account.FailedPasswordAttemptCount < ms.maxFailedAttempts() {
+		return false
+	}
+	if account.LockedUntil != nil && time.Now().UTC().After(*account.LockedUntil) {
+		return false
+	}
+	return true
+}
+
+// recordFailedAttempt counts the failed attempt and locks the account when there are too many of them.
+func (ms *MembershipService) recordFailedAttempt(ctx context.Context, account *Account) {
+	log := xlog.FromContext(ctx)
+
+	if account.LockedUntil != nil && !ms.isAccountLocked(account) {
+		// the previous lock was expired, so the counting starts again
+		account.FailedPasswordAttemptCount = 0
+		account.IsLockedOut = false
+		account.LockedUntil = nil
+	}
+
+	account.FailedPasswordAttemptCount++
+	locked := false
+	if !account.IsLockedOut && account.FailedPasswordAttemptCount >= ms.maxFailedAttempts() {
+		locked = true
+		account.IsLockedOut = true
+		if ms.config.Lockout.DurationInMin > 0 {
+			lockedUntil := time.Now().UTC().Add(time.Duration(ms.config.Lockout.DurationInMin) * time.Minute)
+			account.LockedUntil = &lockedUntil
+		}
+	}
+
+	err := _accountRepo.UpdateAccountFailPassword(ctx, account)
+	if err != nil {
+		return
+	}
+
+	if locked {
+		log.Warnf("membership: account %s was locked", account.Username)
+		msg := "account was locked until an admin unlocks it"
+		if account.LockedUntil != nil {
+			msg = fmt.Sprintf("account was locked until %s", account.LockedUntil.Format(time.RFC3339))
+		}
+		event := &audit.Event{
+			Namespace: "auth",
+			TargetID:  account.Username,
+			Actor:     "",
+			Action:    "account_locked",
+			State:     audit.SUCCESS,
+			Message:   msg,
+		}
+		audit.Log(event)
+
+		for _, handler := range _accountLockedHandlers {
+			handler(account.Username, account.LockedUntil)
+		}
+	}
+}
+
+// resetFailedAttempts clears the counter and the expired lock after a successful login.
+func (ms *MembershipService) resetFailedAttempts(ctx context.Context, account *Account) {
+	if account.FailedPasswordAttemptCount == 0 && !account.IsLockedOut {
+		return
+	}
+	account.FailedPasswordAttemptCount = 0
+	account.IsLockedOut = false
+	account.LockedUntil = nil
+	_accountRepo.UpdateAccountFailPassword(ctx, account)
+}
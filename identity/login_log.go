@@ -0,0 +1,113 @@
+package identity
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+)
+
+type LoginLogRepo struct {
+	db *sqlx.DB
+}
+
+func NewLoginLogRepo(db *sqlx.DB) *LoginLogRepo {
+	return &LoginLogRepo{
+		db: db,
+	}
+}
+
+const insertLoginLogSQL = "INSERT INTO `login_logs` (`username`, `status`, `client_ip`, `created_at`) VALUES (:username, :status, :client_ip, :created_at);"
+
+func (repo *LoginLogRepo) Insert(ctx context.Context, entity *LoginLog) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertLoginLogSQL, entity)
+	if err != nil {
+		log.Errorf("membership: insert login log fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+func buildLoginLogWhere(opt *GetLoginLogOption) (string, map[string]interface{}) {
+	where := " WHERE 1=1"
+	param := map[string]interface{}{}
+	if len(opt.Username) > 0 {
+		where += " AND username = :username"
+		param["username"] = opt.Username
+	}
+	if len(opt.ClientIP) > 0 {
+		where += " AND client_ip = :client_ip"
+		param["client_ip"] = opt.ClientIP
+	}
+	if opt.Status > -1 {
+		where += " AND status = :status"
+		param["status"] = opt.Status
+	}
+	if !opt.StartTime.IsZero() {
+		where += " AND created_at >= :start_time"
+		param["start_time"] = opt.StartTime.UTC()
+	}
+	if !opt.EndTime.IsZero() {
+		where += " AND created_at < :end_time"
+		param["end_time"] = opt.EndTime.UTC()
+	}
+	return where, param
+}
+
+const findLoginLogsSQL = "SELECT `id`, `username`, `status`, `client_ip`, `created_at` FROM `login_logs`"
+
+func (repo *LoginLogRepo) Find(ctx context.Context, opt *GetLoginLogOption) ([]*LoginLog, error) {
+	log := xlog.FromContext(ctx)
+
+	where, param := buildLoginLogWhere(opt)
+	findSQL := findLoginLogsSQL + where + " ORDER BY id DESC LIMIT :skip, :take"
+	param["skip"] = opt.Skip
+	param["take"] = opt.Take
+
+	loginLogs := []*LoginLog{}
+	findStmt, err := repo.db.PrepareNamed(findSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer findStmt.Close()
+
+	err = findStmt.Select(&loginLogs, param)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return loginLogs, nil
+		}
+		log.Errorf("membership: find login logs fail: %v", err)
+		return nil, err
+	}
+	return loginLogs, nil
+}
+
+const countLoginLogsSQL = "SELECT COUNT(1) FROM `login_logs`"
+
+func (repo *LoginLogRepo) Count(ctx context.Context, opt *GetLoginLogOption) (int, error) {
+	log := xlog.FromContext(ctx)
+
+	where, param := buildLoginLogWhere(opt)
+	countStmt, err := repo.db.PrepareNamed(countLoginLogsSQL + where)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return 0, err
+	}
+	defer countStmt.Close()
+
+	count := 0
+	err = countStmt.Get(&count, param)
+	if err != nil {
+		log.Errorf("membership: count login logs fail: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,66 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"github.com/jasonsoft/abb/config"
+	xlog "github.com/jasonsoft/log"
+)
+
+// MailSender sends the mails of the membership, such as password reset mails.
+type MailSender interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// SetMailSender replaces the mail sender, it is useful to stub the mails.
+func SetMailSender(sender MailSender) {
+	_mailSender = sender
+}
+
+// newMailSender uses smtp when the host is configured, otherwise the mails are only written to the log.
+func newMailSender(cfg config.Mail) MailSender {
+	if len(cfg.Host) == 0 {
+		return &logMailSender{}
+	}
+	return &smtpMailSender{config: cfg}
+}
+
+type logMailSender struct{}
+
+func (s *logMailSender) Send(ctx context.Context, to string, subject string, body string) error {
+	xlog.FromContext(ctx).Infof("membership: mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type smtpMailSender struct {
+	config config.Mail
+}
+
+func (s *smtpMailSender) Send(ctx context.Context, to string, subject string, body string) error {
+	port := s.config.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if len(s.config.Username) > 0 {
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)
+	}
+
+	// the header values can't contain new lines, otherwise other headers could be injected
+	subject = strings.NewReplacer("\r", "", "\n", "").Replace(subject)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s", s.config.From, to, subject, body)
+
+	err := smtp.SendMail(addr, auth, s.config.From, []string{to}, []byte(msg))
+	if err != nil {
+		xlog.FromContext(ctx).Errorf("membership: send mail fail: %v", err)
+		return err
+	}
+	return nil
+}
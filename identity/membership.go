@@ -25,9 +25,13 @@ type User struct {
 	LastLoginTime *time.Time `json:"last_login_time,omitempty" db:"last_login_time"`
 	TimeZone      string     `json:"time_zone" db:"time_zone"`
 	IsLockedOut   int        `json:"is_locked_out" db:"is_locked_out"`
+	IsDisabled    bool       `json:"is_disabled" db:"is_disabled"`
+	Email         string     `json:"email" db:"email"`
 	ClientIP      string     `json:"client_ip"`
 	CreatedAt     *time.Time `json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt     *time.Time `json:"updated_at" db:"updated_at"`
+
+	externalIdentity *ExternalIdentity // linked in the same transaction when the user is provisioned
 }
 type Claim struct {
 	UserID     int      `json:"user_id"`
@@ -37,19 +41,25 @@ type Claim struct {
 	Modules    []string `json:"modules"`
 }
 type AuthorizationResult struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int64  `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	// RecoveryCodes are only returned once, when the 2fa enrollment is finished by the login
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
 }
 
 type EditUserRole struct {
-	UserID  int   `json:"user_id"`
-	RoleIDs []int `json:"role_ids"`
+	UserID   int           `json:"user_id"`
+	RoleIDs  []int         `json:"role_ids"` // the roles are bound in all clusters
+	Bindings []RoleBinding `json:"bindings"` // the roles are only bound in the clusters
 }
 
 type MembershipService struct {
-	db     *sqlx.DB
-	config *config.Configuration
-	Code   string
+	db             *sqlx.DB
+	config         *config.Configuration
+	authenticators []Authenticator
+	Code           string
 }
 
 func NewMembershipService(db *sqlx.DB, cfg *config.Configuration) *MembershipService {
@@ -58,30 +68,20 @@ func NewMembershipService(db *sqlx.DB, cfg *config.Configuration) *MembershipSer
 		config: cfg,
 		Code:   "membership.mgmt",
 	}
+	result.authenticators = newAuthenticators(result, cfg)
 	return result
 }
 
 type LoginLog struct {
-	ID        string     `json:"id,omitempty"`
-	Username  string     `json:"username"`
-	Status    int        `json:"status"` // 0: fail, 1: success
-	ClientIP  string     `json:"client_ip"`
-	CreatedAt *time.Time `json:"created_at"`
+	ID        string     `json:"id,omitempty" db:"id"`
+	Username  string     `json:"username" db:"username"`
+	Status    int        `json:"status" db:"status"` // 0: fail, 1: success
+	ClientIP  string     `json:"client_ip" db:"client_ip"`
+	CreatedAt *time.Time `json:"created_at" db:"created_at"`
 }
 
-func (ms *MembershipService) createLoginLog(entity *LoginLog) error {
-	// nowUTC := time.Now().UTC()
-	// entity.CreatedAt = &nowUTC
-
-	// _, err := ms.es.Index().
-	// 	Index("membership").
-	// 	Type("login").
-	// 	BodyJson(entity).
-	// 	Do(context.TODO())
-	// if err != nil {
-	// 	return err
-	// }
-	return nil
+func (ms *MembershipService) createLoginLog(ctx context.Context, entity *LoginLog) error {
+	return _loginLogRepo.Insert(ctx, entity)
 }
 
 type GetLoginLogOption struct {
@@ -102,67 +102,15 @@ type ChangePwdOption struct {
 }
 
 func (ms *MembershipService) GetLoginLogs(ctx context.Context, opt *GetLoginLogOption) ([]*LoginLog, int, error) {
-	// log := xlog.FromContext(ctx)
-
-	// bq := elastic.NewBoolQuery()
-	// usernameTerm := elastic.NewMatchQuery("username", opt.Username)
-	// statusTerm := elastic.NewMatchQuery("status", opt.Status)
-	// ipTerm := elastic.NewMatchQuery("client_ip", opt.ClientIP)
-	// timeRange := elastic.NewRangeQuery("created_at").Gte(opt.StartTime).Lt(opt.EndTime)
-
-	// queries := []elastic.Query{}
-
-	// if len(opt.Username) > 0 {
-	// 	queries = append(queries, usernameTerm)
-	// }
-	// if len(opt.ClientIP) > 0 {
-	// 	queries = append(queries, ipTerm)
-	// }
-	// if opt.Status > -1 {
-	// 	queries = append(queries, statusTerm)
-	// }
-
-	// queries = append(queries, timeRange)
-	// bq.Filter(queries...)
-
-	// loginLogs := []*LoginLog{}
-	// totalCount := 0
-
-	// searchResult, err := ms.es.Search().
-	// 	Index("membership").
-	// 	Type("login").
-	// 	From(opt.Skip).
-	// 	Size(opt.Take). // elastic doesn't allow you to use more than 10000 by default. unless, you change the default setting.
-	// 	Query(bq).
-	// 	Sort("created_at", false).
-	// 	Do(context.TODO())
-
-	// if err != nil {
-	// 	log.Errorf("membership: search membership login fail: %s", err.Error())
-	// 	return nil, 0, err
-	// }
-
-	// if searchResult.Hits == nil {
-	// 	log.Debug("membership: loginlog no search result")
-	// 	return nil, 0, nil
-	// }
-
-	// totalCount = int(searchResult.Hits.TotalHits)
-	// log.Debugf("membership: loginlog %d; this count: %d", totalCount, len(searchResult.Hits.Hits))
-
-	// for _, val := range searchResult.Hits.Hits {
-	// 	loginlog := LoginLog{}
-	// 	err := json.Unmarshal(*val.Source, &loginlog)
-	// 	if err != nil {
-	// 		log.Errorf("membership: get loginlog fail: %s", err.Error())
-	// 	}
-	// 	//loginlog.ID = val.Id
-	// 	loginLogs = append(loginLogs, &loginlog)
-	// }
-
-	// log.Debugf("membership: loginlog count: %d", len(loginLogs))
-	// return loginLogs, totalCount, nil
-	return nil, 0, nil
+	totalCount, err := _loginLogRepo.Count(ctx, opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	loginLogs, err := _loginLogRepo.Find(ctx, opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	return loginLogs, totalCount, nil
 }
 
 type EditRole struct {
@@ -175,11 +123,15 @@ func (ms *MembershipService) CreateRole(ctx context.Context, role *Role) error {
 	log := xlog.FromContext(ctx)
 	// c, found := napnap.FromContext(ctx)
 	// currentUser, _ := FromContext(ctx)
+	err := validateRules(role.Rules)
+	if err != nil {
+		return err
+	}
 	nowUTC := time.Now().UTC()
 	role.CreatedAt = &nowUTC
 	role.UpdatedAt = &nowUTC
 
-	err := _roleRepo.InsertRole(ctx, role)
+	err = _roleRepo.InsertRole(ctx, role)
 	if err != nil {
 		log.Errorf("membership: create role fail: %v", err)
 		return err
@@ -193,7 +145,11 @@ func (ms *MembershipService) UpdateRole(ctx context.Context, originalName string
 	// c, found := napnap.FromContext(ctx)
 	// currentUser, _ := FromContext(ctx)
 
-	err := _roleRepo.UpdateRole(ctx, originalName, role)
+	err := validateRules(role.Rules)
+	if err != nil {
+		return err
+	}
+	err = _roleRepo.UpdateRole(ctx, originalName, role)
 	if err != nil {
 		return err
 	}
@@ -207,7 +163,6 @@ func (ms *MembershipService) UpdateRole(ctx context.Context, originalName string
 }
 
 func (ms *MembershipService) CreateUser(ctx context.Context, user *User) error {
-	log := xlog.FromContext(ctx)
 	// c, found := napnap.FromContext(ctx)
 	// currentUser, _ := FromContext(ctx)
 	if len(user.Username) == 0 || len(user.Username) > 20 {
@@ -218,11 +173,18 @@ func (ms *MembershipService) CreateUser(ctx context.Context, user *User) error {
 		apperr := app.AppError{ErrorCode: "invalid_input", Message: "display_name field is invalid"}
 		return apperr
 	}
-	if len(user.Password) == 0 || len(user.Password) > 20 {
-		apperr := app.AppError{ErrorCode: "invalid_input", Message: "password field is invalid"}
-		return apperr
+	err := ms.ValidatePassword(ctx, 0, user.Password)
+	if err != nil {
+		return err
 	}
 
+	return ms.insertUser(ctx, user)
+}
+
+// insertUser creates the user profile, the account and the roles of the user without validating the input.
+func (ms *MembershipService) insertUser(ctx context.Context, user *User) error {
+	log := xlog.FromContext(ctx)
+
 	if len(user.TimeZone) == 0 {
 		user.TimeZone = "+0800"
 	}
@@ -237,6 +199,7 @@ func (ms *MembershipService) CreateUser(ctx context.Context, user *User) error {
 	userProfile := UserProfile{
 		DisplayName: user.DisplayName,
 		Timezone:    user.TimeZone,
+		Email:       user.Email,
 	}
 	err = _userProfileRepo.Insert(ctx, &userProfile, tx)
 	if err != nil {
@@ -245,14 +208,15 @@ func (ms *MembershipService) CreateUser(ctx context.Context, user *User) error {
 	user.ID = userProfile.ID
 
 	// insert account
-	salt := uuid.NewV4().String()
-	hash := app.SHA256EncodeToBase64(user.Password + salt)
+	hash, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
 	account := Account{
 		ID:           uuid.NewV4().String(),
 		UserID:       user.ID,
 		Username:     user.Username,
 		PasswordHash: hash,
-		PasswordSalt: salt,
 	}
 	err = _accountRepo.Insert(ctx, &account, tx)
 	if err != nil {
@@ -265,6 +229,14 @@ func (ms *MembershipService) CreateUser(ctx context.Context, user *User) error {
 	}
 	user.Password = ""
 
+	if user.externalIdentity != nil {
+		user.externalIdentity.UserID = user.ID
+		err = _externalIdentityRepo.Insert(ctx, user.externalIdentity, tx)
+		if err != nil {
+			return err
+		}
+	}
+
 	// insert roles
 	opts := FindRolesOptions{}
 	roles, err := _roleRepo.FindRoles(ctx, opts)
@@ -308,6 +280,8 @@ func (ms *MembershipService) CreateUser(ctx context.Context, user *User) error {
 	return nil
 }
 
+// Login tries the authenticators in order, the first one which accepts the password wins.  Users of external
+// authenticators are provisioned on first login, so the lock of the account applies to every authenticator.
 func (ms *MembershipService) Login(ctx context.Context, username string, password string) (bool, int, error) {
 	log := xlog.FromContext(ctx)
 
@@ -316,13 +290,10 @@ func (ms *MembershipService) Login(ctx context.Context, username string, passwor
 	if err != nil {
 		return false, 0, err
 	}
-	if account == nil {
-		return false, 0, app.AppError{ErrorCode: "invalid_input", Message: "username or password is invalid"}
-	}
-	if account.FailedPasswordAttemptCount > 4 {
-		return false, 0, app.AppError{ErrorCode: "invalid_account", Message: "account is locked"}
+	if account != nil && account.IsDisabled {
+		return false, 0, app.AppError{ErrorCode: "invalid_account", Message: "account is disabled"}
 	}
-	if account.IsLockedOut {
+	if account != nil && ms.isAccountLocked(account) {
 		return false, 0, app.AppError{ErrorCode: "invalid_account", Message: "account is locked"}
 	}
 	c, found := napnap.FromContext(ctx)
@@ -333,28 +304,56 @@ func (ms *MembershipService) Login(ctx context.Context, username string, passwor
 		loginLog.ClientIP = c.RemoteIPAddress()
 	}
 
-	hash := app.SHA256EncodeToBase64(password + account.PasswordSalt)
-	if account.PasswordHash != hash {
-		account.FailedPasswordAttemptCount++
+	userID := 0
+	for _, authenticator := range ms.authenticators {
+		userID, err = authenticator.Authenticate(ctx, username, password)
+		if err != nil {
+			// the other authenticators can still be used when a backend is down
+			log.Errorf("membership: %s authenticator fail: %v", authenticator.Name(), err)
+			continue
+		}
+		if userID > 0 {
+			break
+		}
+	}
+
+	if userID == 0 {
+		if account == nil {
+			return false, 0, app.AppError{ErrorCode: "invalid_input", Message: "username or password is invalid"}
+		}
+		ms.recordFailedAttempt(ctx, account)
 		loginLog.Status = 0
-		err = ms.createLoginLog(loginLog)
+		err = ms.createLoginLog(ctx, loginLog)
 		if err != nil {
 			log.Errorf("membership: create login log fail: %v", err)
 			return false, 0, err
 		}
-		_accountRepo.UpdateAccountFailPassword(ctx, account)
 		return false, 0, nil
 	}
+
+	if account == nil || account.UserID != userID {
+		// the account was provisioned by the authenticator, or the external user is linked to another username
+		account, err = _accountRepo.GetAccountByID(ctx, userID)
+		if err != nil {
+			return false, 0, err
+		}
+		if account == nil {
+			return false, 0, app.AppError{ErrorCode: "invalid_account", Message: "account not found"}
+		}
+		if account.IsDisabled {
+			return false, 0, app.AppError{ErrorCode: "invalid_account", Message: "account is disabled"}
+		}
+		if ms.isAccountLocked(account) {
+			return false, 0, app.AppError{ErrorCode: "invalid_account", Message: "account is locked"}
+		}
+	}
 	_accountRepo.UpdateLastLoginTime(ctx, account)
 	//登入成功清除登入失敗次數
-	if account.FailedPasswordAttemptCount > 0 {
-		account.FailedPasswordAttemptCount = 0
-		_accountRepo.UpdateAccountFailPassword(ctx, account)
-	}
+	ms.resetFailedAttempts(ctx, account)
 
 	// login log
 	loginLog.Status = 1
-	err = ms.createLoginLog(loginLog)
+	err = ms.createLoginLog(ctx, loginLog)
 	if err != nil {
 		log.Errorf("membership: create login log fail: %v", err)
 		return true, 0, err
@@ -362,31 +361,37 @@ func (ms *MembershipService) Login(ctx context.Context, username string, passwor
 	return true, account.UserID, nil
 }
 
-func (ms *MembershipService) Logout(ctx context.Context, consumerID string) error {
-	//log := xlog.FromContext(ctx)
-	return nil
-}
+// GenerateToken issues the access token and the refresh token of a new session.
 func (ms *MembershipService) GenerateToken(ctx context.Context, userID int) (*AuthorizationResult, error) {
+	familyID := strings.Replace(uuid.NewV4().String(), "-", "", -1)
+	return ms.generateToken(ctx, userID, familyID, newRefreshTokenID())
+}
+
+func (ms *MembershipService) generateToken(ctx context.Context, userID int, familyID string, refreshTokenID string) (*AuthorizationResult, error) {
 	log := xlog.FromContext(ctx)
 	user, err := ms.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
+	if user.IsDisabled {
+		// covers the password, refresh token, mfa and oidc logins
+		return nil, app.AppError{ErrorCode: "invalid_account", Message: "account is disabled"}
+	}
 
-	var roles []*Role
-	for _, roleName := range user.Roles {
-		role, err := ms.GetRoleByName(ctx, roleName)
-		if err != nil {
-			return nil, err
-		}
-		roles = append(roles, role)
+	roles, err := ms.boundRoles(ctx, userID)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create a new token object, specifying signing method and the claims
 	// you would like it to contain.
-	exp := time.Now().UTC().Add(time.Duration(ms.config.Jwt.DurationInMin) * time.Minute).Unix()
+	nowUTC := time.Now().UTC()
+	exp := nowUTC.Add(time.Duration(ms.config.Jwt.DurationInMin) * time.Minute).Unix()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"exp":     exp,
+		"iat":     nowUTC.Unix(),
+		"jti":     uuid.NewV4().String(),
+		"sid":     familyID,
 		"sub":     user.Username,
 		"user_id": user.ID,
 		"roles":   roles,
@@ -399,9 +404,15 @@ func (ms *MembershipService) GenerateToken(ctx context.Context, userID int) (*Au
 		log.Error(err)
 	}
 
+	refreshToken, err := ms.newRefreshToken(ctx, refreshTokenID, userID, familyID)
+	if err != nil {
+		return nil, err
+	}
+
 	result := &AuthorizationResult{
-		AccessToken: tokenString,
-		ExpiresIn:   exp,
+		AccessToken:  tokenString,
+		ExpiresIn:    exp,
+		RefreshToken: refreshToken,
 	}
 	return result, nil
 }
@@ -420,11 +431,17 @@ func (ms *MembershipService) GetUserByID(ctx context.Context, userID int) (*User
 	user.Roles = roles
 	return user, nil
 }
+
+// GetUserRoles returns the effective roles of the user, which are the direct roles and the roles of the teams.
 func (ms *MembershipService) GetUserRoles(ctx context.Context, userID int) ([]string, error) {
-	roles, err := _roleRepo.GetRolesByUser(ctx, userID)
+	bindings, err := ms.effectiveRoleBindings(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
+	roles := []string{}
+	for _, binding := range bindings {
+		roles = append(roles, binding.RoleName)
+	}
 	return roles, nil
 }
 func (ms *MembershipService) GetUserCount(ctx context.Context, opt UserOption) (int, error) {
@@ -508,9 +525,6 @@ func (ms *MembershipService) UpdateAccountPassword(ctx context.Context, opt *Cha
 	// if found {
 	// 	eventlog.ClientIP = c.RemoteIPAddress()
 	// }
-	if len(opt.NewPassword) > 20 {
-		return app.AppError{ErrorCode: "invalid_input", Message: "new_password is invalid"}
-	}
 	if opt.NewPassword != opt.Confirm {
 		return app.AppError{ErrorCode: "invalid_input", Message: "new_password and confirm is invalid"}
 	}
@@ -524,9 +538,7 @@ func (ms *MembershipService) UpdateAccountPassword(ctx context.Context, opt *Cha
 	}
 
 	if opt.ValidatePassword {
-		hash := app.SHA256EncodeToBase64(opt.OldPassword + account.PasswordSalt)
-
-		if hash != account.PasswordHash {
+		if ok, _ := verifyPassword(opt.OldPassword, account.PasswordHash, account.PasswordSalt); !ok {
 
 			//eventlog.Message = "修改密码失败"
 			//_auditSvc.CreateEventLog(ctx, eventlog)
@@ -536,11 +548,12 @@ func (ms *MembershipService) UpdateAccountPassword(ctx context.Context, opt *Cha
 		}
 	}
 
-	account.PasswordSalt = uuid.NewV4().String()
-	newhash := app.SHA256EncodeToBase64(opt.NewPassword + account.PasswordSalt)
-	account.PasswordHash = newhash
-	err = _accountRepo.Update(ctx, account)
+	err = ms.ValidatePassword(ctx, account.UserID, opt.NewPassword)
+	if err != nil {
+		return err
+	}
 
+	err = ms.setAccountPassword(ctx, account, opt.NewPassword)
 	if err != nil {
 		log.Errorf("membership: update account passowrd: %v", err)
 		return err
@@ -571,7 +584,8 @@ func (ms *MembershipService) UpdateAccountLock(ctx context.Context, userid int)
 	}
 	account.FailedPasswordAttemptCount = 0
 	account.IsLockedOut = false
-	err = _accountRepo.Update(ctx, account)
+	account.LockedUntil = nil
+	err = _accountRepo.UpdateAccountFailPassword(ctx, account)
 
 	if err != nil {
 		log.Errorf("membership: update userprofiles: %v", err)
@@ -611,6 +625,13 @@ func (ms *MembershipService) UpdateUserRole(ctx context.Context, eul EditUserRol
 			return err
 		}
 	}
+	for i := range eul.Bindings {
+		err := _roleRepo.AddRoleBinding(ctx, eul.UserID, &eul.Bindings[i], tx)
+		if err != nil {
+			log.Errorf("membership: update user role: %v", err)
+			return err
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
 		log.Errorf("membership: update user role fail: %v", err)
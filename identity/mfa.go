@@ -0,0 +1,402 @@
+package identity
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/abb/app"
+)
+
+const (
+	// mfaChallengeDuration is how long the user can take to enter the code after the password
+	mfaChallengeDuration = 5 * time.Minute
+	totpPeriod           = 30
+	totpDigits           = 6
+	totpSecretLength     = 20
+	recoveryCodeCount    = 10
+)
+
+// MFAChallenge is returned by the token endpoint instead of the tokens when the user must enter a totp code.
+// When EnrollmentRequired is true, the role of the user enforces 2fa, so the user has to enrol before login.
+type MFAChallenge struct {
+	MFARequired        bool   `json:"mfa_required"`
+	MFAToken           string `json:"mfa_token"`
+	ExpiresIn          int64  `json:"expires_in"`
+	EnrollmentRequired bool   `json:"enrollment_required,omitempty"`
+	Secret             string `json:"secret,omitempty"`
+	ProvisioningURI    string `json:"provisioning_uri,omitempty"`
+}
+
+// TOTPEnrollment is the secret of the authenticator app, the provisioning uri can be rendered as qr code.
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// mfaChallengeState is kept in the encrypted mfa token, it can't be used as access token.
+type mfaChallengeState struct {
+	UserID    int   `json:"user_id"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// EnrollTOTP creates a new secret for the user; 2fa isn't enabled until the first code is verified by EnableTOTP.
+func (ms *MembershipService) EnrollTOTP(ctx context.Context, userID int) (*TOTPEnrollment, error) {
+	account, err := ms.mfaAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if account.TOTPEnabled {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "2fa is already enabled"}
+	}
+	return ms.newTOTPSecret(ctx, account)
+}
+
+// EnableTOTP verifies the code of the enrolled secret and returns the recovery codes, they are only shown once.
+func (ms *MembershipService) EnableTOTP(ctx context.Context, userID int, code string) ([]string, error) {
+	account, err := ms.mfaAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if account.TOTPEnabled {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "2fa is already enabled"}
+	}
+	if len(account.TOTPSecret) == 0 {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "2fa is not enrolled"}
+	}
+	if !ms.verifyTOTP(ctx, account, code) {
+		return nil, app.AppError{ErrorCode: "invalid_mfa_code", Message: "code is invalid"}
+	}
+
+	codes, err := newRecoveryCodes(account)
+	if err != nil {
+		return nil, err
+	}
+	account.TOTPEnabled = true
+	err = _accountRepo.UpdateMFA(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns 2fa off, the user must enter a totp code or a recovery code.
+func (ms *MembershipService) DisableTOTP(ctx context.Context, userID int, code string) error {
+	account, err := ms.mfaAccount(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !account.TOTPEnabled {
+		return app.AppError{ErrorCode: "invalid_input", Message: "2fa is not enabled"}
+	}
+	if ms.mfaRequiredByRole(ctx, userID) {
+		return app.AppError{ErrorCode: "invalid_input", Message: "2fa is required by the roles of the user"}
+	}
+	if !ms.verifyMFACode(ctx, account, code) {
+		return app.AppError{ErrorCode: "invalid_mfa_code", Message: "code is invalid"}
+	}
+	return ms.ResetMFA(ctx, userID)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user.
+func (ms *MembershipService) RegenerateRecoveryCodes(ctx context.Context, userID int, code string) ([]string, error) {
+	account, err := ms.mfaAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !account.TOTPEnabled {
+		return nil, app.AppError{ErrorCode: "invalid_input", Message: "2fa is not enabled"}
+	}
+	if !ms.verifyTOTP(ctx, account, code) {
+		return nil, app.AppError{ErrorCode: "invalid_mfa_code", Message: "code is invalid"}
+	}
+
+	codes, err := newRecoveryCodes(account)
+	if err != nil {
+		return nil, err
+	}
+	err = _accountRepo.UpdateMFA(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ResetMFA removes the secret and the recovery codes, admins use it when users lose their devices.
+func (ms *MembershipService) ResetMFA(ctx context.Context, userID int) error {
+	account, err := ms.mfaAccount(ctx, userID)
+	if err != nil {
+		return err
+	}
+	account.TOTPEnabled = false
+	account.TOTPSecret = ""
+	account.TOTPLastStep = 0
+	account.RecoveryCodes = []string{}
+	return _accountRepo.UpdateMFA(ctx, account)
+}
+
+// MFAChallenge returns nil when the user can get the tokens without 2fa.
+func (ms *MembershipService) MFAChallenge(ctx context.Context, userID int) (*MFAChallenge, error) {
+	account, err := ms.mfaAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &MFAChallenge{MFARequired: true}
+	if !account.TOTPEnabled {
+		if !ms.mfaRequiredByRole(ctx, userID) {
+			return nil, nil
+		}
+		// the pending secret is kept until its first code is verified, so every login doesn't need a new secret
+		enrollment, err := ms.pendingTOTPEnrollment(ctx, account)
+		if err != nil {
+			return nil, err
+		}
+		challenge.EnrollmentRequired = true
+		challenge.Secret = enrollment.Secret
+		challenge.ProvisioningURI = enrollment.ProvisioningURI
+	}
+
+	state := mfaChallengeState{
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(mfaChallengeDuration).Unix(),
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	challenge.MFAToken, err = app.AESEncryptToBase64(string(buf), ms.config.Jwt.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	challenge.ExpiresIn = int64(mfaChallengeDuration.Seconds())
+	return challenge, nil
+}
+
+// VerifyMFAChallenge returns the user id when the code of the challenge is valid.  Wrong codes count as failed
+// password attempts, so the account is locked the same way.  When the code finishes the enrollment, the recovery
+// codes are returned as well, like EnableTOTP does.
+func (ms *MembershipService) VerifyMFAChallenge(ctx context.Context, mfaToken string, code string) (int, []string, error) {
+	invalidErr := app.AppError{ErrorCode: "invalid_mfa_code", Message: "mfa_token or code is invalid"}
+
+	plain, err := app.AESDecryptFromBase64(mfaToken, ms.config.Jwt.SecretKey)
+	if err != nil {
+		return 0, nil, invalidErr
+	}
+	state := mfaChallengeState{}
+	err = json.Unmarshal([]byte(plain), &state)
+	if err != nil || state.ExpiresAt < time.Now().Unix() {
+		return 0, nil, app.AppError{ErrorCode: "invalid_mfa_code", Message: "mfa_token is invalid or expired"}
+	}
+
+	account, err := ms.mfaAccount(ctx, state.UserID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ms.isAccountLocked(account) {
+		return 0, nil, app.AppError{ErrorCode: "invalid_account", Message: "account is locked"}
+	}
+
+	if account.TOTPEnabled {
+		if !ms.verifyMFACode(ctx, account, code) {
+			ms.recordFailedAttempt(ctx, account)
+			return 0, nil, invalidErr
+		}
+		return account.UserID, nil, nil
+	}
+
+	// the enrollment is finished by the first valid code
+	if len(account.TOTPSecret) == 0 || !ms.verifyTOTP(ctx, account, code) {
+		ms.recordFailedAttempt(ctx, account)
+		return 0, nil, invalidErr
+	}
+	codes, err := newRecoveryCodes(account)
+	if err != nil {
+		return 0, nil, err
+	}
+	account.TOTPEnabled = true
+	err = _accountRepo.UpdateMFA(ctx, account)
+	if err != nil {
+		return 0, nil, err
+	}
+	return account.UserID, codes, nil
+}
+
+func (ms *MembershipService) mfaAccount(ctx context.Context, userID int) (*Account, error) {
+	account, err := _accountRepo.GetAccountByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, app.AppError{ErrorCode: "not_found", Message: "user is not exist"}
+	}
+	account.RecoveryCodes = []string{}
+	if len(account.RecoveryCodesJSON) > 0 {
+		err = json.Unmarshal(account.RecoveryCodesJSON, &account.RecoveryCodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return account, nil
+}
+
+func (ms *MembershipService) mfaRequiredByRole(ctx context.Context, userID int) bool {
+	if len(ms.config.MFA.RequiredRoles) == 0 {
+		return false
+	}
+	roles, err := ms.GetUserRoles(ctx, userID)
+	if err != nil {
+		// fail closed, so a database error doesn't turn 2fa off
+		return true
+	}
+	for _, role := range roles {
+		if containsFold(ms.config.MFA.RequiredRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingTOTPEnrollment returns the secret which was enrolled but isn't verified yet, a new secret is created
+// when the account has none.
+func (ms *MembershipService) pendingTOTPEnrollment(ctx context.Context, account *Account) (*TOTPEnrollment, error) {
+	if len(account.TOTPSecret) == 0 {
+		return ms.newTOTPSecret(ctx, account)
+	}
+	secret, err := app.AESDecryptFromBase64(account.TOTPSecret, ms.config.Jwt.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return ms.totpEnrollment(account, secret), nil
+}
+
+func (ms *MembershipService) newTOTPSecret(ctx context.Context, account *Account) (*TOTPEnrollment, error) {
+	buf := make([]byte, totpSecretLength)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return nil, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+
+	account.TOTPSecret, err = app.AESEncryptToBase64(secret, ms.config.Jwt.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	account.TOTPEnabled = false
+	account.TOTPLastStep = 0
+	err = _accountRepo.UpdateMFA(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	return ms.totpEnrollment(account, secret), nil
+}
+
+// totpEnrollment returns the secret with its provisioning uri, the uri can be rendered as qr code.
+func (ms *MembershipService) totpEnrollment(account *Account, secret string) *TOTPEnrollment {
+	issuer := ms.config.MFA.Issuer
+	if len(issuer) == 0 {
+		issuer = "abb"
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := url.PathEscape(issuer + ":" + account.Username)
+
+	return &TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: "otpauth://totp/" + label + "?" + params.Encode(),
+	}
+}
+
+// verifyMFACode accepts a totp code or an unused recovery code.
+func (ms *MembershipService) verifyMFACode(ctx context.Context, account *Account, code string) bool {
+	if ms.verifyTOTP(ctx, account, code) {
+		return true
+	}
+	return useRecoveryCode(ctx, account, code)
+}
+
+// verifyTOTP allows one step of clock skew; a step can only be used once, so the codes can't be replayed.
+// The last used step is saved in the account when the code is valid.
+func (ms *MembershipService) verifyTOTP(ctx context.Context, account *Account, code string) bool {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits || len(account.TOTPSecret) == 0 {
+		return false
+	}
+	secret, err := app.AESDecryptFromBase64(account.TOTPSecret, ms.config.Jwt.SecretKey)
+	if err != nil {
+		return false
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step <= account.TOTPLastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			account.TOTPLastStep = step
+			_accountRepo.UpdateMFA(ctx, account)
+			return true
+		}
+	}
+	return false
+}
+
+// totpCode generates the code as RFC 6238 describes.
+func totpCode(key []byte, step int64) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// newRecoveryCodes replaces the recovery codes of the account, only the hashes are kept.
+func newRecoveryCodes(account *Account) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := app.RandomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = app.SHA256EncodeToBase64(codes[i])
+	}
+	account.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// useRecoveryCode removes the code from the account when it is valid, so every code can be used once.
+func useRecoveryCode(ctx context.Context, account *Account, code string) bool {
+	hash := app.SHA256EncodeToBase64(strings.ToLower(strings.TrimSpace(code)))
+	for i, val := range account.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(val), []byte(hash)) == 1 {
+			account.RecoveryCodes = append(account.RecoveryCodes[:i], account.RecoveryCodes[i+1:]...)
+			_accountRepo.UpdateMFA(ctx, account)
+			return true
+		}
+	}
+	return false
+}
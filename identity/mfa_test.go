@@ -0,0 +1,165 @@
+package identity
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/jasonsoft/abb/app"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the sha1 vectors of RFC 6238 appendix B, truncated to 6 digits
+	key := []byte("12345678901234567890")
+	testCases := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+		{unix: 20000000000, code: "353130"},
+	}
+
+	for _, tc := range testCases {
+		if code := totpCode(key, tc.unix/totpPeriod); code != tc.code {
+			t.Errorf("expected code %s at %d, got %s", tc.code, tc.unix, code)
+		}
+	}
+}
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func withJwtSecretKey(t *testing.T) {
+	secretKey := _membershipSvc.config.Jwt.SecretKey
+	_membershipSvc.config.Jwt.SecretKey = "test-key"
+	t.Cleanup(func() { _membershipSvc.config.Jwt.SecretKey = secretKey })
+}
+
+func mockAccountRepo(t *testing.T) sqlmock.Sqlmock {
+	db, mock := newMockDB(t)
+	repo := _accountRepo
+	_accountRepo = NewAccountRepo(db)
+	t.Cleanup(func() { _accountRepo = repo })
+	return mock
+}
+
+func newTOTPAccount(t *testing.T, enabled bool) *Account {
+	encrypted, err := app.AESEncryptToBase64(testTOTPSecret, _membershipSvc.config.Jwt.SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Account{UserID: 7, Username: "alice", TOTPSecret: encrypted, TOTPEnabled: enabled}
+}
+
+func currentTOTPCode(t *testing.T) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod)
+}
+
+var updateAccountMFA = regexp.QuoteMeta("UPDATE `accounts` SET `totp_secret` = ?")
+
+func TestVerifyTOTPRejectsReplayedCode(t *testing.T) {
+	withJwtSecretKey(t)
+	mock := mockAccountRepo(t)
+	account := newTOTPAccount(t, true)
+	code := currentTOTPCode(t)
+
+	mock.ExpectExec(updateAccountMFA).WillReturnResult(sqlmock.NewResult(0, 1))
+	if !_membershipSvc.verifyTOTP(context.Background(), account, code) {
+		t.Fatal("expected the current code to be valid")
+	}
+	if _membershipSvc.verifyTOTP(context.Background(), account, code) {
+		t.Error("expected the used code to be rejected")
+	}
+}
+
+func TestVerifyTOTPRejectsWrongCode(t *testing.T) {
+	withJwtSecretKey(t)
+	mockAccountRepo(t)
+	account := newTOTPAccount(t, true)
+
+	for _, code := range []string{"", "12345", "abcdef", "1234567"} {
+		if _membershipSvc.verifyTOTP(context.Background(), account, code) {
+			t.Errorf("expected code %q to be rejected", code)
+		}
+	}
+}
+
+func TestPendingTOTPEnrollmentKeepsSecret(t *testing.T) {
+	withJwtSecretKey(t)
+	// nothing is written, the sqlmock fails on any statement
+	mockAccountRepo(t)
+	account := newTOTPAccount(t, false)
+
+	enrollment, err := _membershipSvc.pendingTOTPEnrollment(context.Background(), account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrollment.Secret != testTOTPSecret {
+		t.Errorf("expected the pending secret to be kept, got %s", enrollment.Secret)
+	}
+}
+
+func TestVerifyMFAChallengeReturnsRecoveryCodesWhenEnrolled(t *testing.T) {
+	withJwtSecretKey(t)
+	mock := mockAccountRepo(t)
+	account := newTOTPAccount(t, false)
+
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM accounts WHERE user_id = ?")).ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "totp_secret", "totp_enabled", "totp_last_step", "recovery_codesJSON"}).
+			AddRow(7, "alice", account.TOTPSecret, false, 0, "[]"))
+	// the used step, then the enabled 2fa with the recovery codes
+	mock.ExpectExec(updateAccountMFA).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateAccountMFA).WithArgs(account.TOTPSecret, true, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	buf, err := json.Marshal(mfaChallengeState{UserID: 7, ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfaToken, err := app.AESEncryptToBase64(string(buf), _membershipSvc.config.Jwt.SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID, codes, err := _membershipSvc.VerifyMFAChallenge(context.Background(), mfaToken, currentTOTPCode(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 7 {
+		t.Errorf("expected user 7, got %d", userID)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("expected %d recovery codes, got %d", recoveryCodeCount, len(codes))
+	}
+}
+
+func TestUseRecoveryCodeOnce(t *testing.T) {
+	mock := mockAccountRepo(t)
+	account := &Account{UserID: 7}
+	codes, err := newRecoveryCodes(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectExec(updateAccountMFA).WillReturnResult(sqlmock.NewResult(0, 1))
+	if !useRecoveryCode(context.Background(), account, codes[0]) {
+		t.Fatal("expected the recovery code to be valid")
+	}
+	if useRecoveryCode(context.Background(), account, codes[0]) {
+		t.Error("expected the used recovery code to be rejected")
+	}
+	if len(account.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, len(account.RecoveryCodes))
+	}
+}
@@ -3,6 +3,7 @@ package identity
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/jasonsoft/napnap"
@@ -44,12 +45,32 @@ func NewJWTMiddleware(opts JwtOptions) *JWTMiddleware {
 func (jwtMW *JWTMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
 
 	tokenString := c.RequestHeader("Authorization")
+	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+
+	// browsers can't set the headers of websocket, so the token is passed by query string instead
+	if len(tokenString) == 0 && strings.EqualFold(c.RequestHeader("Upgrade"), "websocket") {
+		tokenString = c.Query("access_token")
+	}
 
 	if len(tokenString) == 0 {
 		c.SetStatus(401)
 		return
 	}
 
+	// api tokens of users and service accounts
+	if strings.HasPrefix(tokenString, apiTokenPrefix) {
+		ctx := c.StdContext()
+		claims, err := _membershipSvc.AuthenticateAPIToken(ctx, tokenString)
+		if err != nil {
+			c.SetStatus(401)
+			return
+		}
+		ctx = NewContext(ctx, claims)
+		c.SetStdContext(ctx)
+		next(c)
+		return
+	}
+
 	// Parse takes the token string and a function for looking up the key. The latter is especially
 	// useful if you use multiple keys for your application.  The standard is to use 'kid' in the
 	// head of the token to identify which key to use, but the parsed token (head and claims) is provided
@@ -70,6 +91,14 @@ func (jwtMW *JWTMiddleware) Invoke(c *napnap.Context, next napnap.HandlerFunc) {
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 		ctx := c.StdContext()
+
+		// the token was revoked by logout
+		revoked, err := _membershipSvc.IsTokenRevoked(ctx, claims)
+		if err != nil || revoked {
+			c.SetStatus(401)
+			return
+		}
+
 		ctx = NewContext(ctx, claims)
 		c.SetStdContext(ctx)
 		next(c)
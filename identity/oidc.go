@@ -0,0 +1,407 @@
+package identity
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/config"
+	xlog "github.com/jasonsoft/log"
+)
+
+// oidcStateDuration is how long the user can take to login on the provider
+const oidcStateDuration = 10 * time.Minute
+
+// OIDCBrowserCookie holds the key which binds the state to the browser that started the login, so a state and
+// code can't be replayed in another browser.
+const OIDCBrowserCookie = "abb_oidc"
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is kept in the encrypted state parameter, so abb doesn't store anything before the callback.
+type oidcState struct {
+	Verifier    string `json:"verifier"`
+	Nonce       string `json:"nonce"`
+	BrowserHash string `json:"browser_hash"` // hash of the key in the browser cookie
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+func (ms *MembershipService) oidcEnabled() bool {
+	return len(ms.config.OIDC.Issuer) > 0 && len(ms.config.OIDC.ClientID) > 0
+}
+
+func (ms *MembershipService) oidcDiscover(ctx context.Context) (*oidcDiscovery, error) {
+	discoveryURL := strings.TrimSuffix(ms.config.OIDC.Issuer, "/") + "/.well-known/openid-configuration"
+	discovery := &oidcDiscovery{}
+	err := oidcGetJSON(ctx, discoveryURL, discovery)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(ms.config.OIDC.Issuer, "/") {
+		return nil, fmt.Errorf("oidc: issuer of discovery doesn't match: %s", discovery.Issuer)
+	}
+	return discovery, nil
+}
+
+// OIDCAuthURL returns the url of the provider where the user logins and the key which must be kept in the
+// OIDCBrowserCookie until the callback.  PKCE (S256) is always used.
+func (ms *MembershipService) OIDCAuthURL(ctx context.Context) (string, string, error) {
+	if !ms.oidcEnabled() {
+		return "", "", app.AppError{ErrorCode: "not_found", Message: "oidc isn't enabled"}
+	}
+
+	discovery, err := ms.oidcDiscover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	verifier, err := app.RandomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := app.RandomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	browserKey, err := app.RandomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	state := oidcState{
+		Verifier:    verifier,
+		Nonce:       nonce,
+		BrowserHash: app.SHA256EncodeToBase64(browserKey),
+		ExpiresAt:   time.Now().Add(oidcStateDuration).Unix(),
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return "", "", err
+	}
+	encryptedState, err := app.AESEncryptToBase64(string(buf), ms.config.Jwt.SecretKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := ms.config.OIDC.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email", "groups"}
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", ms.config.OIDC.ClientID)
+	params.Set("redirect_uri", ms.config.OIDC.RedirectURL)
+	params.Set("scope", strings.Join(scopes, " "))
+	params.Set("state", encryptedState)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), browserKey, nil
+}
+
+// OIDCLogin exchanges the code for the id token, provisions the user on first login, syncs the mapped roles and
+// returns the user id.  The browserKey is the value of the OIDCBrowserCookie.
+func (ms *MembershipService) OIDCLogin(ctx context.Context, code string, encryptedState string, browserKey string) (int, error) {
+	log := xlog.FromContext(ctx)
+	loginErr := app.AppError{ErrorCode: "login_fail", Message: "oidc login failed"}
+
+	if !ms.oidcEnabled() {
+		return 0, app.AppError{ErrorCode: "not_found", Message: "oidc isn't enabled"}
+	}
+
+	plain, err := app.AESDecryptFromBase64(encryptedState, ms.config.Jwt.SecretKey)
+	if err != nil {
+		return 0, app.AppError{ErrorCode: "login_fail", Message: "state is invalid"}
+	}
+	state := oidcState{}
+	err = json.Unmarshal([]byte(plain), &state)
+	if err != nil || state.ExpiresAt < time.Now().Unix() {
+		return 0, app.AppError{ErrorCode: "login_fail", Message: "state is invalid or expired"}
+	}
+	browserHash := app.SHA256EncodeToBase64(browserKey)
+	if len(browserKey) == 0 || subtle.ConstantTimeCompare([]byte(browserHash), []byte(state.BrowserHash)) != 1 {
+		return 0, app.AppError{ErrorCode: "login_fail", Message: "the login wasn't started by this browser"}
+	}
+
+	discovery, err := ms.oidcDiscover(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// exchange the code
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", ms.config.OIDC.RedirectURL)
+	form.Set("client_id", ms.config.OIDC.ClientID)
+	form.Set("code_verifier", state.Verifier)
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(ms.config.OIDC.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(ms.config.OIDC.ClientID), url.QueryEscape(ms.config.OIDC.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("oidc: exchange code fail: %s", resp.Status)
+		return 0, loginErr
+	}
+
+	tokenResp := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil || len(tokenResp.IDToken) == 0 {
+		log.Errorf("oidc: id_token is missing: %v", err)
+		return 0, loginErr
+	}
+
+	claims, err := ms.verifyIDToken(ctx, discovery, tokenResp.IDToken, state.Nonce)
+	if err != nil {
+		log.Errorf("oidc: verify id_token fail: %v", err)
+		return 0, loginErr
+	}
+
+	username := oidcClaimString(claims, "preferred_username")
+	if len(username) == 0 {
+		username = oidcClaimString(claims, "email")
+	}
+	if len(username) == 0 {
+		username = oidcClaimString(claims, "sub")
+	}
+	displayName := oidcClaimString(claims, "name")
+	if len(displayName) == 0 {
+		displayName = username
+	}
+
+	// the issuer and subject identify the user, the username can be changed on the provider
+	userID, err := ms.externalUser(ctx, oidcClaimString(claims, "iss"), oidcClaimString(claims, "sub"), username, displayName)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ms.config.OIDC.RoleMappings) > 0 {
+		roles := mapOIDCRoles(claims, ms.config.OIDC.GroupsClaim, ms.config.OIDC.RoleMappings)
+		err = ms.syncUserRoles(ctx, userID, ms.config.OIDC.RoleMappings, roles)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	account, err := _accountRepo.GetAccountByID(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if ms.isAccountLocked(account) {
+		return 0, app.AppError{ErrorCode: "invalid_account", Message: "account is locked"}
+	}
+	_accountRepo.UpdateLastLoginTime(ctx, account)
+
+	return userID, nil
+}
+
+// verifyIDToken verifies the RS256 signature with the keys of the provider and the standard claims.
+func (ms *MembershipService) verifyIDToken(ctx context.Context, discovery *oidcDiscovery, idToken string, nonce string) (jwt.MapClaims, error) {
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err := oidcGetJSON(ctx, discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range jwks.Keys {
+			if key.Kty != "RSA" || (len(kid) > 0 && key.Kid != kid) {
+				continue
+			}
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			if err != nil {
+				return nil, err
+			}
+			return &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}, nil
+		}
+		return nil, fmt.Errorf("key %s was not found", kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("id_token is invalid")
+	}
+	if oidcClaimString(claims, "iss") != discovery.Issuer {
+		return nil, fmt.Errorf("issuer doesn't match")
+	}
+	if !containsString(oidcClaimStrings(claims, "aud"), ms.config.OIDC.ClientID) {
+		return nil, fmt.Errorf("audience doesn't match")
+	}
+	if oidcClaimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("nonce doesn't match")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("exp is missing")
+	}
+
+	return claims, nil
+}
+
+// mapOIDCRoles returns the roles whose mapping matches the claims.
+func mapOIDCRoles(claims jwt.MapClaims, groupsClaim string, mappings []config.RoleMapping) []string {
+	if len(groupsClaim) == 0 {
+		groupsClaim = "groups"
+	}
+
+	roles := []string{}
+	for _, mapping := range mappings {
+		claim := mapping.Claim
+		if len(claim) == 0 {
+			claim = groupsClaim
+		}
+		if containsString(oidcClaimStrings(claims, claim), mapping.Value) && !containsString(roles, mapping.Role) {
+			roles = append(roles, mapping.Role)
+		}
+	}
+	return roles
+}
+
+// syncUserRoles replaces the roles which are managed by the mappings with the roles which are mapped from the
+// external groups; the roles which were granted in abb are kept.  Nothing is changed when no mapping matches, so
+// the roles aren't removed when the provider doesn't return the groups.
+func (ms *MembershipService) syncUserRoles(ctx context.Context, userID int, mappings []config.RoleMapping, roleNames []string) error {
+	if len(roleNames) == 0 {
+		return nil
+	}
+
+	bindings, err := _roleRepo.GetRoleBindingsByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	eul := EditUserRole{
+		UserID:   userID,
+		RoleIDs:  []int{},
+		Bindings: []RoleBinding{},
+	}
+	for _, binding := range bindings {
+		if !isMappedRole(mappings, binding.RoleName) {
+			eul.Bindings = append(eul.Bindings, *binding)
+		}
+	}
+
+	for _, roleName := range roleNames {
+		role, err := ms.GetRoleByName(ctx, roleName)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			xlog.FromContext(ctx).Warnf("membership: mapped role %s can't be found", roleName)
+			continue
+		}
+		eul.RoleIDs = append(eul.RoleIDs, role.ID)
+	}
+	return ms.UpdateUserRole(ctx, eul)
+}
+
+func isMappedRole(mappings []config.RoleMapping, roleName string) bool {
+	for _, mapping := range mappings {
+		if strings.EqualFold(mapping.Role, roleName) {
+			return true
+		}
+	}
+	return false
+}
+
+func oidcGetJSON(ctx context.Context, target string, out interface{}) error {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: get %s fail: %s", target, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func oidcClaimString(claims jwt.MapClaims, key string) string {
+	val, _ := claims[key].(string)
+	return val
+}
+
+// oidcClaimStrings returns the claim as a list, because claims such as aud and groups can be a string or a list.
+func oidcClaimStrings(claims jwt.MapClaims, key string) []string {
+	switch val := claims[key].(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		result := []string{}
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, val := range list {
+		if val == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jasonsoft/abb/app"
+	"github.com/jasonsoft/abb/config"
+	"github.com/jasonsoft/napnap"
+)
+
+// mockIssuer is an oidc provider which issues the id token of the subject for any code.
+type mockIssuer struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	subject   string
+	username  string
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, subject: "sub-1", username: "alice"}
+
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcDiscovery{
+				Issuer:                issuer.server.URL,
+				AuthorizationEndpoint: issuer.server.URL + "/authorize",
+				TokenEndpoint:         issuer.server.URL + "/token",
+				JWKSURI:               issuer.server.URL + "/jwks",
+			})
+		case "/jwks":
+			e := big.NewInt(int64(key.E)).Bytes()
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kid": "test",
+					"kty": "RSA",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(e),
+				}},
+			})
+		case "/token":
+			sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != issuer.challenge {
+				t.Error("code_verifier doesn't match the code_challenge")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+				"iss":                issuer.server.URL,
+				"sub":                issuer.subject,
+				"aud":                "abb",
+				"exp":                time.Now().Add(time.Minute).Unix(),
+				"nonce":              issuer.nonce,
+				"preferred_username": issuer.username,
+			})
+			token.Header["kid"] = "test"
+			idToken, err := token.SignedString(key)
+			if err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(issuer.server.Close)
+
+	cfg := _membershipSvc.config
+	oidc, jwtConfig := cfg.OIDC, cfg.Jwt
+	cfg.OIDC = config.OIDC{Issuer: issuer.server.URL, ClientID: "abb", RedirectURL: "https://abb.example.com/v1/oidc/callback"}
+	cfg.Jwt.SecretKey = "test-key"
+	t.Cleanup(func() {
+		cfg.OIDC = oidc
+		cfg.Jwt = jwtConfig
+	})
+	return issuer
+}
+
+// startLogin returns the state and the browser key, like the browser gets them from the login endpoint.
+func (issuer *mockIssuer) startLogin(t *testing.T) (string, string) {
+	authURL, browserKey, err := _membershipSvc.OIDCAuthURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.nonce = u.Query().Get("nonce")
+	issuer.challenge = u.Query().Get("code_challenge")
+	return u.Query().Get("state"), browserKey
+}
+
+// mockMembershipDB replaces the database of the membership service and its repositories.
+func mockMembershipDB(t *testing.T) sqlmock.Sqlmock {
+	db, mock := newMockDB(t)
+	svcDB, accountRepo, userProfileRepo, roleRepo, identityRepo := _membershipSvc.db, _accountRepo, _userProfileRepo, _roleRepo, _externalIdentityRepo
+	_membershipSvc.db = db
+	_accountRepo = NewAccountRepo(db)
+	_userProfileRepo = NewUserProfileRepo(db)
+	_roleRepo = NewRoleRepo(db)
+	_externalIdentityRepo = NewExternalIdentityRepo(db)
+	t.Cleanup(func() {
+		_membershipSvc.db, _accountRepo, _userProfileRepo, _roleRepo, _externalIdentityRepo = svcDB, accountRepo, userProfileRepo, roleRepo, identityRepo
+	})
+	return mock
+}
+
+var externalIdentityColumns = []string{"id", "provider", "subject", "user_id", "created_at"}
+
+func expectExternalIdentity(mock sqlmock.Sqlmock, provider string, subject string, rows *sqlmock.Rows) {
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM `external_identities` WHERE `provider` = ? AND `subject` = ?")).
+		ExpectQuery().WithArgs(provider, subject).WillReturnRows(rows)
+}
+
+func expectAccountByName(mock sqlmock.Sqlmock, username string, rows *sqlmock.Rows) {
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM accounts WHERE username = ?")).
+		ExpectQuery().WithArgs(username).WillReturnRows(rows)
+}
+
+func expectAccountLogin(mock sqlmock.Sqlmock, userID int, username string) {
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM accounts WHERE user_id = ?")).ExpectQuery().WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username"}).AddRow(userID, username))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `accounts` SET  `last_login_time` = ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestOIDCLoginUsesLinkedIdentity(t *testing.T) {
+	issuer := newMockIssuer(t)
+	mock := mockMembershipDB(t)
+	state, browserKey := issuer.startLogin(t)
+
+	// the user is found by the issuer and subject, the username isn't used
+	expectExternalIdentity(mock, issuer.server.URL, "sub-1", sqlmock.NewRows(externalIdentityColumns).AddRow(1, issuer.server.URL, "sub-1", 7, time.Now()))
+	expectAccountLogin(mock, 7, "alice.smith")
+
+	userID, err := _membershipSvc.OIDCLogin(context.Background(), "code", state, browserKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 7 {
+		t.Errorf("expected user 7, got %d", userID)
+	}
+}
+
+func TestOIDCLoginRefusesExistingUserWithoutLink(t *testing.T) {
+	issuer := newMockIssuer(t)
+	mock := mockMembershipDB(t)
+	issuer.username = "admin"
+	state, browserKey := issuer.startLogin(t)
+
+	expectExternalIdentity(mock, issuer.server.URL, "sub-1", sqlmock.NewRows(externalIdentityColumns))
+	expectAccountByName(mock, "admin", sqlmock.NewRows([]string{"user_id", "username"}).AddRow(1, "admin"))
+
+	_, err := _membershipSvc.OIDCLogin(context.Background(), "code", state, browserKey)
+	assertLoginFail(t, err)
+}
+
+func TestOIDCLoginProvisionsNewUser(t *testing.T) {
+	issuer := newMockIssuer(t)
+	mock := mockMembershipDB(t)
+	state, browserKey := issuer.startLogin(t)
+
+	expectExternalIdentity(mock, issuer.server.URL, "sub-1", sqlmock.NewRows(externalIdentityColumns))
+	expectAccountByName(mock, "alice", sqlmock.NewRows([]string{"user_id", "username"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `userprofiles`")).WillReturnResult(sqlmock.NewResult(8, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `accounts`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `external_identities`")).
+		WithArgs(issuer.server.URL, "sub-1", 8, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT roles.id")).ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "rulesJSON", "created_at", "updated_at"}))
+	mock.ExpectCommit()
+	expectAccountLogin(mock, 8, "alice")
+
+	userID, err := _membershipSvc.OIDCLogin(context.Background(), "code", state, browserKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 8 {
+		t.Errorf("expected the new user 8, got %d", userID)
+	}
+}
+
+func TestOIDCLoginNeedsBrowserOfLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	mockMembershipDB(t)
+	state, browserKey := issuer.startLogin(t)
+
+	for _, key := range []string{"", browserKey + "0"} {
+		_, err := _membershipSvc.OIDCLogin(context.Background(), "code", state, key)
+		assertLoginFail(t, err)
+	}
+}
+
+func TestOIDCLoginRejectsTamperedState(t *testing.T) {
+	issuer := newMockIssuer(t)
+	mockMembershipDB(t)
+	_, browserKey := issuer.startLogin(t)
+
+	buf, _ := json.Marshal(oidcState{Verifier: "v", Nonce: "n", BrowserHash: app.SHA256EncodeToBase64(browserKey), ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	expired, err := app.AESEncryptToBase64(string(buf), "test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state := range []string{"garbage", expired} {
+		_, err := _membershipSvc.OIDCLogin(context.Background(), "code", state, browserKey)
+		assertLoginFail(t, err)
+	}
+}
+
+func TestOIDCCallbackRequiresMFA(t *testing.T) {
+	issuer := newMockIssuer(t)
+	mock := mockMembershipDB(t)
+	recorder := recordAudit(t)
+	state, browserKey := issuer.startLogin(t)
+
+	expectExternalIdentity(mock, issuer.server.URL, "sub-1", sqlmock.NewRows(externalIdentityColumns).AddRow(1, issuer.server.URL, "sub-1", 7, time.Now()))
+	expectAccountLogin(mock, 7, "alice")
+	// the user has 2fa, so the tokens are not issued by the callback
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM accounts WHERE user_id = ?")).ExpectQuery().WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "totp_enabled"}).AddRow(7, "alice", true))
+
+	nap := napnap.New()
+	nap.Use(NewPublicIdentityRouter())
+	req := httptest.NewRequest("GET", "/v1/oidc/callback?code=code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: OIDCBrowserCookie, Value: browserKey})
+	w := httptest.NewRecorder()
+	nap.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	result := map[string]interface{}{}
+	err := json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["mfa_required"] != true || result["access_token"] != nil {
+		t.Errorf("expected the mfa challenge instead of the tokens, got %s", w.Body.String())
+	}
+	if len(recorder.events) != 1 || recorder.events[0].Message != "mfa required" {
+		t.Errorf("expected the challenge to be audited, got %+v", recorder.events)
+	}
+}
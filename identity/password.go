@@ -0,0 +1,283 @@
+package identity
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jasonsoft/abb/app"
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// passwordHashPrefix is stored in front of the password hash, so the algorithm can be changed later.  Hashes
+// without any prefix are the legacy sha256(password + salt) hashes, they and the pbkdf2 hashes are rehashed on
+// the next login.
+const (
+	passwordHashPrefix       = "bcrypt$"
+	passwordHashCost         = 12
+	pbkdf2HashPrefix         = "pbkdf2-sha256$"
+	passwordHistoryMaxLength = 24
+)
+
+// hashPassword returns the hash in the format bcrypt$<bcrypt hash>.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(prehashPassword(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return passwordHashPrefix + string(hash), nil
+}
+
+// prehashPassword keeps the whole password, bcrypt only uses the first 72 bytes.  The digest is base64 encoded,
+// bcrypt stops at a zero byte.
+func prehashPassword(password string) []byte {
+	return []byte(app.SHA256EncodeToBase64(password))
+}
+
+// verifyPassword compares the password with the hash; rehash is true when the hash should be upgraded.
+func verifyPassword(password string, passwordHash string, legacySalt string) (ok bool, rehash bool) {
+	switch {
+	case strings.HasPrefix(passwordHash, passwordHashPrefix):
+		hash := []byte(strings.TrimPrefix(passwordHash, passwordHashPrefix))
+		if bcrypt.CompareHashAndPassword(hash, prehashPassword(password)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost(hash)
+		return true, err == nil && cost < passwordHashCost
+	case strings.HasPrefix(passwordHash, pbkdf2HashPrefix):
+		ok = verifyPBKDF2Password(password, strings.TrimPrefix(passwordHash, pbkdf2HashPrefix))
+		return ok, ok
+	default:
+		legacyHash := app.SHA256EncodeToBase64(password + legacySalt)
+		ok = subtle.ConstantTimeCompare([]byte(legacyHash), []byte(passwordHash)) == 1
+		return ok, ok
+	}
+}
+
+// verifyPBKDF2Password checks the hashes in the format pbkdf2-sha256$<iterations>$<salt>$<key>.
+func verifyPBKDF2Password(password string, passwordHash string) bool {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	encoding := base64.RawStdEncoding
+	salt, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	expected, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha256.New)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// ValidatePassword checks the password against the password policy; the history is only checked when userID isn't 0.
+func (ms *MembershipService) ValidatePassword(ctx context.Context, userID int, password string) error {
+	policy := ms.config.PasswordPolicy
+
+	length := len([]rune(password))
+	if length == 0 || length < policy.MinLength {
+		msg := fmt.Sprintf("password must be at least %d characters", policy.MinLength)
+		return app.AppError{ErrorCode: "invalid_password", Message: msg}
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		msg := fmt.Sprintf("password must be at most %d characters", policy.MaxLength)
+		return app.AppError{ErrorCode: "invalid_password", Message: msg}
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUppercase && !hasUpper {
+		return app.AppError{ErrorCode: "invalid_password", Message: "password must contain an uppercase letter"}
+	}
+	if policy.RequireLowercase && !hasLower {
+		return app.AppError{ErrorCode: "invalid_password", Message: "password must contain a lowercase letter"}
+	}
+	if policy.RequireDigit && !hasDigit {
+		return app.AppError{ErrorCode: "invalid_password", Message: "password must contain a digit"}
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		return app.AppError{ErrorCode: "invalid_password", Message: "password must contain a symbol"}
+	}
+
+	if isBreachedPassword(ctx, policy.BreachedPasswordsFile, password) {
+		return app.AppError{ErrorCode: "invalid_password", Message: "password is too common, please choose another one"}
+	}
+
+	if userID > 0 && policy.HistoryCount > 0 {
+		// only the last passwordHistoryMaxLength passwords are kept
+		count := policy.HistoryCount
+		if count > passwordHistoryMaxLength {
+			count = passwordHistoryMaxLength
+		}
+		histories, err := _passwordHistoryRepo.Find(ctx, userID, count)
+		if err != nil {
+			return err
+		}
+		// the current password is part of the history as well
+		account, err := _accountRepo.GetAccountByID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if account != nil {
+			histories = append(histories, &PasswordHistory{PasswordHash: account.PasswordHash, PasswordSalt: account.PasswordSalt})
+		}
+		for _, history := range histories {
+			if ok, _ := verifyPassword(password, history.PasswordHash, history.PasswordSalt); ok {
+				msg := fmt.Sprintf("password can't be one of the last %d passwords", policy.HistoryCount)
+				return app.AppError{ErrorCode: "invalid_password", Message: msg}
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_breachedPasswordsOnce sync.Once
+	_breachedPasswords     map[string]bool
+)
+
+// isBreachedPassword looks the password up in the breached password list, one password per line.  The file
+// is only read once.
+func isBreachedPassword(ctx context.Context, path string, password string) bool {
+	if len(path) == 0 {
+		return false
+	}
+
+	_breachedPasswordsOnce.Do(func() {
+		_breachedPasswords = map[string]bool{}
+		file, err := os.Open(path)
+		if err != nil {
+			xlog.FromContext(ctx).Errorf("membership: open breached passwords file fail: %v", err)
+			return
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) > 0 {
+				_breachedPasswords[strings.ToLower(line)] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			xlog.FromContext(ctx).Errorf("membership: read breached passwords file fail: %v", err)
+		}
+	})
+	return _breachedPasswords[strings.ToLower(password)]
+}
+
+// setAccountPassword hashes the new password and keeps the old hash in the password history.
+func (ms *MembershipService) setAccountPassword(ctx context.Context, account *Account, password string) error {
+	newHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if len(account.PasswordHash) > 0 && ms.config.PasswordPolicy.HistoryCount > 0 {
+		history := &PasswordHistory{
+			UserID:       account.UserID,
+			PasswordHash: account.PasswordHash,
+			PasswordSalt: account.PasswordSalt,
+		}
+		err = _passwordHistoryRepo.Insert(ctx, history)
+		if err != nil {
+			return err
+		}
+	}
+
+	account.PasswordHash = newHash
+	account.PasswordSalt = ""
+	return _accountRepo.Update(ctx, account)
+}
+
+// PasswordHistory keeps the previous password hashes of the user
+type PasswordHistory struct {
+	ID           int        `db:"id"`
+	UserID       int        `db:"user_id"`
+	PasswordHash string     `db:"password_hash"`
+	PasswordSalt string     `db:"password_salt"`
+	CreatedAt    *time.Time `db:"created_at"`
+}
+
+type PasswordHistoryRepo struct {
+	db *sqlx.DB
+}
+
+func NewPasswordHistoryRepo(db *sqlx.DB) *PasswordHistoryRepo {
+	return &PasswordHistoryRepo{
+		db: db,
+	}
+}
+
+const insertPasswordHistorySQL = "INSERT INTO `password_histories` (`user_id`, `password_hash`, `password_salt`, `created_at`) VALUES (:user_id, :password_hash, :password_salt, :created_at);"
+
+// the ids are auto increment, so the histories beyond the max length are removed by id
+const cleanPasswordHistoriesSQL = "DELETE FROM `password_histories` WHERE `user_id` = ? AND `id` NOT IN (SELECT `id` FROM (SELECT `id` FROM `password_histories` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT ?) AS t);"
+
+func (repo *PasswordHistoryRepo) Insert(ctx context.Context, entity *PasswordHistory) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertPasswordHistorySQL, entity)
+	if err != nil {
+		log.Errorf("membership: insert password history fail: %v", err)
+		return err
+	}
+
+	_, err = repo.db.Exec(cleanPasswordHistoriesSQL, entity.UserID, entity.UserID, passwordHistoryMaxLength)
+	if err != nil {
+		log.Errorf("membership: clean password histories fail: %v", err)
+	}
+	return nil
+}
+
+const findPasswordHistoriesSQL = "SELECT `id`, `user_id`, `password_hash`, `password_salt`, `created_at` FROM `password_histories` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT ?"
+
+func (repo *PasswordHistoryRepo) Find(ctx context.Context, userID int, limit int) ([]*PasswordHistory, error) {
+	log := xlog.FromContext(ctx)
+
+	histories := []*PasswordHistory{}
+	err := repo.db.Select(&histories, findPasswordHistoriesSQL, userID, limit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return histories, nil
+		}
+		log.Errorf("membership: find password histories fail: %v", err)
+		return nil, err
+	}
+	return histories, nil
+}
@@ -0,0 +1,192 @@
+package identity
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jasonsoft/abb/app"
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+)
+
+// PasswordResetToken is a single-use token which is sent to the email of the user, the format is <id>.<secret>
+type PasswordResetToken struct {
+	ID        string     `db:"id"`
+	UserID    int        `db:"user_id"`
+	TokenHash string     `db:"token_hash"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt *time.Time `db:"created_at"`
+}
+
+// RequestPasswordReset sends the reset mail to the user found by the username or the email.  Nothing is returned
+// when the user can't be found, so the endpoint can't be used to find out the users.
+func (ms *MembershipService) RequestPasswordReset(ctx context.Context, login string) error {
+	log := xlog.FromContext(ctx)
+
+	var user *User
+	var err error
+	if strings.Contains(login, "@") {
+		user, err = _userProfileRepo.GetUserByEmail(ctx, login)
+	}
+	if err == nil && user == nil {
+		user, err = _userProfileRepo.GetUserByName(ctx, login)
+	}
+	if err != nil {
+		return err
+	}
+	if user == nil || user.IsDisabled || len(user.Email) == 0 {
+		log.Infof("membership: password reset of %s was skipped", login)
+		return nil
+	}
+
+	secret, err := app.RandomHex(32)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(ms.config.PasswordReset.DurationInMin) * time.Minute)
+	token := &PasswordResetToken{
+		ID:        strings.Replace(uuid.NewV4().String(), "-", "", -1),
+		UserID:    user.ID,
+		TokenHash: app.SHA256EncodeToBase64(secret),
+		ExpiresAt: &expiresAt,
+	}
+	err = _passwordResetTokenRepo.Insert(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	tokenString := token.ID + "." + secret
+	link := tokenString
+	if len(ms.config.PasswordReset.URL) > 0 {
+		link = ms.config.PasswordReset.URL + "?token=" + url.QueryEscape(tokenString)
+	}
+	body := fmt.Sprintf("Hi %s,\n\nSomeone requested to reset the password of your abb account %s.  Use the link below to choose a new password, it expires in %d minutes.\n\n%s\n\nIf you didn't request it, please ignore this mail.\n", user.DisplayName, user.Username, ms.config.PasswordReset.DurationInMin, link)
+	return _mailSender.Send(ctx, user.Email, "Reset your abb password", body)
+}
+
+// ResetPassword sets the new password with the reset token; the token can only be used once and all sessions of
+// the user are revoked.
+func (ms *MembershipService) ResetPassword(ctx context.Context, tokenString string, newPassword string, confirm string) error {
+	invalidErr := app.AppError{ErrorCode: "invalid_token", Message: "token is invalid or expired"}
+
+	if newPassword != confirm {
+		return app.AppError{ErrorCode: "invalid_input", Message: "new_password and confirm is invalid"}
+	}
+
+	parts := strings.SplitN(tokenString, ".", 2)
+	if len(parts) != 2 {
+		return invalidErr
+	}
+	token, err := _passwordResetTokenRepo.Get(ctx, parts[0])
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return invalidErr
+	}
+	hash := app.SHA256EncodeToBase64(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.TokenHash)) != 1 {
+		return invalidErr
+	}
+	if token.UsedAt != nil || token.ExpiresAt.Before(time.Now().UTC()) {
+		return invalidErr
+	}
+
+	account, err := _accountRepo.GetAccountByID(ctx, token.UserID)
+	if err != nil {
+		return err
+	}
+	if account == nil || account.IsDisabled {
+		return invalidErr
+	}
+
+	err = ms.ValidatePassword(ctx, account.UserID, newPassword)
+	if err != nil {
+		return err
+	}
+
+	// the token is used before the password is changed, so it can't be used twice at the same time
+	used, err := _passwordResetTokenRepo.Use(ctx, token.ID)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return invalidErr
+	}
+
+	err = ms.setAccountPassword(ctx, account, newPassword)
+	if err != nil {
+		return err
+	}
+	// the user proves the ownership of the email, so the lock of failed logins is cleared
+	ms.resetFailedAttempts(ctx, account)
+	return ms.LogoutAll(ctx, account.UserID)
+}
+
+type PasswordResetTokenRepo struct {
+	db *sqlx.DB
+}
+
+func NewPasswordResetTokenRepo(db *sqlx.DB) *PasswordResetTokenRepo {
+	return &PasswordResetTokenRepo{
+		db: db,
+	}
+}
+
+const insertPasswordResetTokenSQL = "INSERT INTO `password_reset_tokens` (`id`, `user_id`, `token_hash`, `expires_at`, `used_at`, `created_at`) VALUES (:id, :user_id, :token_hash, :expires_at, :used_at, :created_at);"
+
+func (repo *PasswordResetTokenRepo) Insert(ctx context.Context, entity *PasswordResetToken) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertPasswordResetTokenSQL, entity)
+	if err != nil {
+		log.Errorf("membership: insert password reset token fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const getPasswordResetTokenSQL = "SELECT `id`, `user_id`, `token_hash`, `expires_at`, `used_at`, `created_at` FROM `password_reset_tokens` WHERE `id` = ?"
+
+func (repo *PasswordResetTokenRepo) Get(ctx context.Context, id string) (*PasswordResetToken, error) {
+	log := xlog.FromContext(ctx)
+
+	token := &PasswordResetToken{}
+	err := repo.db.Get(token, getPasswordResetTokenSQL, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Errorf("membership: get password reset token fail: %v", err)
+		return nil, err
+	}
+	return token, nil
+}
+
+const usePasswordResetTokenSQL = "UPDATE `password_reset_tokens` SET `used_at` = ? WHERE `id` = ? AND `used_at` IS NULL"
+
+// Use marks the token as used, false is returned when the token was already used.
+func (repo *PasswordResetTokenRepo) Use(ctx context.Context, id string) (bool, error) {
+	log := xlog.FromContext(ctx)
+
+	result, err := repo.db.Exec(usePasswordResetTokenSQL, time.Now().UTC(), id)
+	if err != nil {
+		log.Errorf("membership: use password reset token fail: %v", err)
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
@@ -0,0 +1,76 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/jasonsoft/abb/app"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, passwordHashPrefix) {
+		t.Fatalf("expected the hash to start with %s, got %s", passwordHashPrefix, hash)
+	}
+
+	ok, rehash := verifyPassword("correct horse", hash, "")
+	if !ok || rehash {
+		t.Errorf("expected the password to be valid without rehash, got %v %v", ok, rehash)
+	}
+	if ok, _ := verifyPassword("wrong horse", hash, ""); ok {
+		t.Error("expected the wrong password to be rejected")
+	}
+}
+
+func TestHashPasswordKeepsLongPassword(t *testing.T) {
+	// bcrypt alone only uses the first 72 bytes
+	password := strings.Repeat("a", 80)
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := verifyPassword(password[:79]+"b", hash, ""); ok {
+		t.Error("expected the password with a different ending to be rejected")
+	}
+}
+
+func TestVerifyPasswordRehashesOldHashes(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	encoding := base64.RawStdEncoding
+	key := pbkdf2.Key([]byte("secret"), salt, 1000, 32, sha256.New)
+	pbkdf2Hash := pbkdf2HashPrefix + "1000$" + encoding.EncodeToString(salt) + "$" + encoding.EncodeToString(key)
+
+	cheapHash, err := bcrypt.GenerateFromPassword(prehashPassword("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		hash   string
+		salt   string
+		ok     bool
+		rehash bool
+	}{
+		{name: "legacy sha256 hash", hash: app.SHA256EncodeToBase64("secret" + "salt"), salt: "salt", ok: true, rehash: true},
+		{name: "pbkdf2 hash", hash: pbkdf2Hash, ok: true, rehash: true},
+		{name: "bcrypt hash with lower cost", hash: passwordHashPrefix + string(cheapHash), ok: true, rehash: true},
+		{name: "malformed pbkdf2 hash", hash: pbkdf2HashPrefix + "1000$salt", ok: false, rehash: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, rehash := verifyPassword("secret", tc.hash, tc.salt)
+			if ok != tc.ok || rehash != tc.rehash {
+				t.Errorf("expected %v %v, got %v %v", tc.ok, tc.rehash, ok, rehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package identity
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jasonsoft/abb/app"
+	audit "github.com/jasonsoft/go-audit"
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+)
+
+// RefreshToken is stored server-side.  Every refresh token is used once; the tokens which come from the same login
+// belong to the same family, so the whole family is revoked when a used token is presented again.
+type RefreshToken struct {
+	ID         string     `db:"id"`
+	FamilyID   string     `db:"family_id"`
+	UserID     int        `db:"user_id"`
+	TokenHash  string     `db:"token_hash"`
+	ReplacedBy string     `db:"replaced_by"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+	CreatedAt  *time.Time `db:"created_at"`
+	UpdatedAt  *time.Time `db:"updated_at"`
+}
+
+// userRevocationKey is the key of the revocation which invalidates all tokens of the user issued before it
+func userRevocationKey(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+func newRefreshTokenID() string {
+	return strings.Replace(uuid.NewV4().String(), "-", "", -1)
+}
+
+// newRefreshToken creates a refresh token in the family and returns the token string.
+func (ms *MembershipService) newRefreshToken(ctx context.Context, id string, userID int, familyID string) (string, error) {
+	secret, err := app.RandomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	durationInHour := ms.config.Jwt.RefreshDurationInHour
+	if durationInHour <= 0 {
+		durationInHour = 720
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(durationInHour) * time.Hour)
+
+	token := &RefreshToken{
+		ID:        id,
+		FamilyID:  familyID,
+		UserID:    userID,
+		TokenHash: app.SHA256EncodeToBase64(secret),
+		ExpiresAt: &expiresAt,
+	}
+	err = _refreshTokenRepo.Insert(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	return token.ID + "." + secret, nil
+}
+
+// Refresh rotates the refresh token and issues a new access token.  A refresh token which was already used means
+// it was stolen, so all tokens of the login are revoked.
+func (ms *MembershipService) Refresh(ctx context.Context, tokenString string) (*AuthorizationResult, error) {
+	invalidErr := app.AppError{ErrorCode: "login_fail", Message: "refresh_token is invalid"}
+
+	parts := strings.SplitN(tokenString, ".", 2)
+	if len(parts) != 2 {
+		return nil, invalidErr
+	}
+
+	token, err := _refreshTokenRepo.Get(ctx, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, invalidErr
+	}
+
+	hash := app.SHA256EncodeToBase64(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(token.TokenHash)) != 1 {
+		return nil, invalidErr
+	}
+	if token.RevokedAt != nil || token.ExpiresAt.Before(time.Now().UTC()) {
+		return nil, invalidErr
+	}
+
+	if len(token.ReplacedBy) > 0 {
+		return nil, ms.revokeReusedRefreshToken(ctx, token)
+	}
+
+	// the token is claimed before the new tokens are issued; when two requests use the token at the same time,
+	// only one of them claims it and the other one is a reuse
+	replacedBy := newRefreshTokenID()
+	claimed, err := _refreshTokenRepo.Replace(ctx, token.ID, replacedBy)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ms.revokeReusedRefreshToken(ctx, token)
+	}
+
+	return ms.generateToken(ctx, token.UserID, token.FamilyID, replacedBy)
+}
+
+// revokeReusedRefreshToken revokes the session of the refresh token which was used twice and returns the error
+// of the request.
+func (ms *MembershipService) revokeReusedRefreshToken(ctx context.Context, token *RefreshToken) error {
+	log := xlog.FromContext(ctx)
+	log.Warnf("membership: refresh token %s of user %d was reused, the session is revoked", token.ID, token.UserID)
+
+	err := _refreshTokenRepo.RevokeFamily(ctx, token.FamilyID)
+	if err != nil {
+		return err
+	}
+
+	event := &audit.Event{
+		Namespace: "auth",
+		TargetID:  fmt.Sprintf("%d", token.UserID),
+		Action:    "refresh_token_reuse",
+		State:     audit.FAILED,
+		Message:   "the session " + token.FamilyID + " was revoked",
+	}
+	audit.Log(event)
+	return app.AppError{ErrorCode: "login_fail", Message: "refresh_token is invalid"}
+}
+
+// Logout revokes the access token and the refresh tokens of the session.
+func (ms *MembershipService) Logout(ctx context.Context, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if len(jti) > 0 {
+		exp, _ := claims["exp"].(float64)
+		expiresAt := time.Unix(int64(exp), 0).UTC()
+		err := _tokenRevocationRepo.Insert(ctx, jti, &expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	sid, _ := claims["sid"].(string)
+	if len(sid) > 0 {
+		return _refreshTokenRepo.RevokeFamily(ctx, sid)
+	}
+	return nil
+}
+
+// LogoutAll revokes every access token and refresh token of the user.
+func (ms *MembershipService) LogoutAll(ctx context.Context, userID int) error {
+	// the access tokens live at most DurationInMin, so the revocation can be removed after that
+	expiresAt := time.Now().UTC().Add(time.Duration(ms.config.Jwt.DurationInMin) * time.Minute)
+	err := _tokenRevocationRepo.Insert(ctx, userRevocationKey(userID), &expiresAt)
+	if err != nil {
+		return err
+	}
+	return _refreshTokenRepo.RevokeUser(ctx, userID)
+}
+
+// IsTokenRevoked checks the jti of the access token and the revocation of all sessions of the user.
+func (ms *MembershipService) IsTokenRevoked(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+	jti, _ := claims["jti"].(string)
+	if len(jti) > 0 {
+		revocation, err := _tokenRevocationRepo.Get(ctx, jti)
+		if err != nil {
+			return false, err
+		}
+		if revocation != nil {
+			return true, nil
+		}
+	}
+
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return false, nil
+	}
+	revocation, err := _tokenRevocationRepo.Get(ctx, userRevocationKey(int(userID)))
+	if err != nil {
+		return false, err
+	}
+	if revocation == nil {
+		return false, nil
+	}
+
+	// tokens issued after the revocation are still valid. iat has only seconds, so the tokens issued in the same
+	// second are decided by their session: the sessions of the revocation were revoked, the new logins weren't.
+	iat, _ := claims["iat"].(float64)
+	switch {
+	case int64(iat) < revocation.CreatedAt.Unix():
+		return true, nil
+	case int64(iat) > revocation.CreatedAt.Unix():
+		return false, nil
+	}
+	sid, _ := claims["sid"].(string)
+	if len(sid) == 0 {
+		return true, nil
+	}
+	return _refreshTokenRepo.IsFamilyRevoked(ctx, sid)
+}
+
+type RefreshTokenRepo struct {
+	db *sqlx.DB
+}
+
+func NewRefreshTokenRepo(db *sqlx.DB) *RefreshTokenRepo {
+	return &RefreshTokenRepo{
+		db: db,
+	}
+}
+
+const insertRefreshTokenSQL = "INSERT INTO `refresh_tokens` (`id`, `family_id`, `user_id`, `token_hash`, `replaced_by`, `expires_at`, `revoked_at`, `created_at`, `updated_at`) VALUES (:id, :family_id, :user_id, :token_hash, :replaced_by, :expires_at, :revoked_at, :created_at, :updated_at);"
+
+func (repo *RefreshTokenRepo) Insert(ctx context.Context, entity *RefreshToken) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+	entity.UpdatedAt = &nowUTC
+
+	_, err := repo.db.NamedExec(insertRefreshTokenSQL, entity)
+	if err != nil {
+		log.Errorf("membership: insert refresh token fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const replaceRefreshTokenSQL = "UPDATE `refresh_tokens` SET `replaced_by` = :replaced_by, `updated_at` = :updated_at WHERE `id` = :id AND `replaced_by` = '' AND `revoked_at` IS NULL;"
+
+// Replace marks the token as replaced by the new token.  It returns false when the token was replaced or revoked
+// already, the check and the update are done in one statement, so only one caller can replace the token.
+func (repo *RefreshTokenRepo) Replace(ctx context.Context, id string, replacedBy string) (bool, error) {
+	log := xlog.FromContext(ctx)
+	m := map[string]interface{}{
+		"id":          id,
+		"replaced_by": replacedBy,
+		"updated_at":  time.Now().UTC(),
+	}
+
+	result, err := repo.db.NamedExec(replaceRefreshTokenSQL, m)
+	if err != nil {
+		log.Errorf("membership: replace refresh token fail: %v", err)
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+const revokeRefreshTokenFamilySQL = "UPDATE `refresh_tokens` SET `revoked_at` = :revoked_at, `updated_at` = :revoked_at WHERE `family_id` = :family_id AND `revoked_at` IS NULL;"
+
+func (repo *RefreshTokenRepo) RevokeFamily(ctx context.Context, familyID string) error {
+	log := xlog.FromContext(ctx)
+	m := map[string]interface{}{
+		"family_id":  familyID,
+		"revoked_at": time.Now().UTC(),
+	}
+
+	_, err := repo.db.NamedExec(revokeRefreshTokenFamilySQL, m)
+	if err != nil {
+		log.Errorf("membership: revoke refresh tokens fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const revokeRefreshTokenUserSQL = "UPDATE `refresh_tokens` SET `revoked_at` = :revoked_at, `updated_at` = :revoked_at WHERE `user_id` = :user_id AND `revoked_at` IS NULL;"
+
+func (repo *RefreshTokenRepo) RevokeUser(ctx context.Context, userID int) error {
+	log := xlog.FromContext(ctx)
+	m := map[string]interface{}{
+		"user_id":    userID,
+		"revoked_at": time.Now().UTC(),
+	}
+
+	_, err := repo.db.NamedExec(revokeRefreshTokenUserSQL, m)
+	if err != nil {
+		log.Errorf("membership: revoke refresh tokens fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const countRevokedRefreshTokenFamilySQL = "SELECT COUNT(1) FROM `refresh_tokens` WHERE `family_id` = ? AND `revoked_at` IS NOT NULL;"
+
+// IsFamilyRevoked returns whether the session was revoked.
+func (repo *RefreshTokenRepo) IsFamilyRevoked(ctx context.Context, familyID string) (bool, error) {
+	log := xlog.FromContext(ctx)
+
+	count := 0
+	err := repo.db.Get(&count, countRevokedRefreshTokenFamilySQL, familyID)
+	if err != nil {
+		log.Errorf("membership: count revoked refresh tokens fail: %v", err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+const getRefreshTokenSQL = "SELECT * FROM `refresh_tokens` WHERE `id` = :id"
+
+func (repo *RefreshTokenRepo) Get(ctx context.Context, id string) (*RefreshToken, error) {
+	log := xlog.FromContext(ctx)
+	getStmt, err := repo.db.PrepareNamed(getRefreshTokenSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer getStmt.Close()
+
+	m := map[string]interface{}{
+		"id": id,
+	}
+	token := &RefreshToken{}
+	err = getStmt.Get(token, m)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Errorf("membership: get refresh token fail: %v", err)
+		return nil, err
+	}
+	return token, nil
+}
+
+// TokenRevocation is the revocation of an access token by its jti, or of all tokens of a user.
+type TokenRevocation struct {
+	ID        string     `db:"id"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	CreatedAt *time.Time `db:"created_at"`
+}
+
+type TokenRevocationRepo struct {
+	db *sqlx.DB
+}
+
+func NewTokenRevocationRepo(db *sqlx.DB) *TokenRevocationRepo {
+	return &TokenRevocationRepo{
+		db: db,
+	}
+}
+
+const insertTokenRevocationSQL = "REPLACE INTO `token_revocations` (`id`, `expires_at`, `created_at`) VALUES (:id, :expires_at, :created_at);"
+const deleteExpiredTokenRevocationSQL = "DELETE FROM `token_revocations` WHERE `expires_at` < :now;"
+
+// Insert adds the revocation and removes the expired ones, because tokens can't outlive their exp.
+func (repo *TokenRevocationRepo) Insert(ctx context.Context, id string, expiresAt *time.Time) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity := &TokenRevocation{
+		ID:        id,
+		ExpiresAt: expiresAt,
+		CreatedAt: &nowUTC,
+	}
+	_, err := repo.db.NamedExec(insertTokenRevocationSQL, entity)
+	if err != nil {
+		log.Errorf("membership: insert token revocation fail: %v", err)
+		return err
+	}
+
+	m := map[string]interface{}{
+		"now": nowUTC,
+	}
+	_, err = repo.db.NamedExec(deleteExpiredTokenRevocationSQL, m)
+	if err != nil {
+		log.Errorf("membership: delete expired token revocations fail: %v", err)
+	}
+	return nil
+}
+
+const getTokenRevocationSQL = "SELECT * FROM `token_revocations` WHERE `id` = :id"
+
+func (repo *TokenRevocationRepo) Get(ctx context.Context, id string) (*TokenRevocation, error) {
+	log := xlog.FromContext(ctx)
+	getStmt, err := repo.db.PrepareNamed(getTokenRevocationSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer getStmt.Close()
+
+	m := map[string]interface{}{
+		"id": id,
+	}
+	revocation := &TokenRevocation{}
+	err = getStmt.Get(revocation, m)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Errorf("membership: get token revocation fail: %v", err)
+		return nil, err
+	}
+	return revocation, nil
+}
@@ -0,0 +1,183 @@
+package identity
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jasonsoft/abb/app"
+	audit "github.com/jasonsoft/go-audit"
+	"github.com/jmoiron/sqlx"
+)
+
+type auditRecorder struct {
+	events []*audit.Event
+}
+
+func (r *auditRecorder) Log(event *audit.Event) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func recordAudit(t *testing.T) *auditRecorder {
+	recorder := &auditRecorder{}
+	audit.SetAuditer(recorder)
+	t.Cleanup(func() { audit.SetAuditer(&auditRecorder{}) })
+	return recorder
+}
+
+func newMockDB(t *testing.T) (*sqlx.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return sqlx.NewDb(db, "mysql"), mock
+}
+
+func mockRefreshTokenRepo(t *testing.T) sqlmock.Sqlmock {
+	db, mock := newMockDB(t)
+	repo := _refreshTokenRepo
+	_refreshTokenRepo = NewRefreshTokenRepo(db)
+	t.Cleanup(func() { _refreshTokenRepo = repo })
+	return mock
+}
+
+var refreshTokenColumns = []string{"id", "family_id", "user_id", "token_hash", "replaced_by", "expires_at", "revoked_at", "created_at", "updated_at"}
+
+func expectGetRefreshToken(mock sqlmock.Sqlmock, id string, secret string, replacedBy string) {
+	now := time.Now().UTC()
+	rows := sqlmock.NewRows(refreshTokenColumns).
+		AddRow(id, "family", 7, app.SHA256EncodeToBase64(secret), replacedBy, now.Add(time.Hour), nil, now, now)
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT * FROM `refresh_tokens` WHERE `id` = ?")).
+		ExpectQuery().WithArgs(id).WillReturnRows(rows)
+}
+
+func expectRevokeFamily(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `refresh_tokens` SET `revoked_at` = ?, `updated_at` = ? WHERE `family_id` = ? AND `revoked_at` IS NULL")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "family").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+func assertLoginFail(t *testing.T, err error) {
+	appErr, ok := err.(app.AppError)
+	if !ok || appErr.ErrorCode != "login_fail" {
+		t.Fatalf("expected login_fail, got %v", err)
+	}
+}
+
+func TestRefreshRevokesSessionWhenTokenWasUsed(t *testing.T) {
+	mock := mockRefreshTokenRepo(t)
+	recorder := recordAudit(t)
+
+	expectGetRefreshToken(mock, "old", "secret", "new")
+	expectRevokeFamily(mock)
+
+	_, err := _membershipSvc.Refresh(context.Background(), "old.secret")
+	assertLoginFail(t, err)
+
+	if len(recorder.events) != 1 || recorder.events[0].Action != "refresh_token_reuse" {
+		t.Errorf("expected the reuse to be audited, got %+v", recorder.events)
+	}
+}
+
+func TestRefreshRevokesSessionWhenTokenIsUsedConcurrently(t *testing.T) {
+	mock := mockRefreshTokenRepo(t)
+	recorder := recordAudit(t)
+
+	// the token looked unused when it was read, but another request claimed it first
+	expectGetRefreshToken(mock, "old", "secret", "")
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `refresh_tokens` SET `replaced_by` = ?, `updated_at` = ? WHERE `id` = ? AND `replaced_by` = '' AND `revoked_at` IS NULL")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "old").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectRevokeFamily(mock)
+
+	_, err := _membershipSvc.Refresh(context.Background(), "old.secret")
+	assertLoginFail(t, err)
+
+	if len(recorder.events) != 1 || recorder.events[0].Action != "refresh_token_reuse" {
+		t.Errorf("expected the reuse to be audited, got %+v", recorder.events)
+	}
+}
+
+func TestRefreshRejectsWrongSecret(t *testing.T) {
+	mock := mockRefreshTokenRepo(t)
+
+	expectGetRefreshToken(mock, "old", "secret", "")
+
+	_, err := _membershipSvc.Refresh(context.Background(), "old.guess")
+	assertLoginFail(t, err)
+}
+
+func TestRefreshRejectsMalformedToken(t *testing.T) {
+	mockRefreshTokenRepo(t)
+
+	_, err := _membershipSvc.Refresh(context.Background(), "malformed")
+	assertLoginFail(t, err)
+}
+
+func TestIsTokenRevokedByLogoutAll(t *testing.T) {
+	revokedAt := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name           string
+		iat            time.Time
+		sid            string
+		sessionRevoked bool
+		revoked        bool
+	}{
+		{name: "issued before the revocation", iat: revokedAt.Add(-time.Second), sid: "old", revoked: true},
+		{name: "issued in the same second by the revoked session", iat: revokedAt, sid: "old", sessionRevoked: true, revoked: true},
+		{name: "issued in the same second by a new login", iat: revokedAt, sid: "new", sessionRevoked: false, revoked: false},
+		{name: "issued in the same second without session", iat: revokedAt, revoked: true},
+		{name: "issued after the revocation", iat: revokedAt.Add(time.Second), sid: "new", revoked: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			repo, refreshRepo := _tokenRevocationRepo, _refreshTokenRepo
+			_tokenRevocationRepo = NewTokenRevocationRepo(db)
+			_refreshTokenRepo = NewRefreshTokenRepo(db)
+			defer func() { _tokenRevocationRepo, _refreshTokenRepo = repo, refreshRepo }()
+
+			getSQL := regexp.QuoteMeta("SELECT * FROM `token_revocations` WHERE `id` = ?")
+			mock.ExpectPrepare(getSQL).ExpectQuery().WithArgs("jti").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "created_at"}))
+			mock.ExpectPrepare(getSQL).ExpectQuery().WithArgs("user:7").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "expires_at", "created_at"}).AddRow("user:7", revokedAt.Add(time.Hour), revokedAt))
+			if tc.iat.Equal(revokedAt) && len(tc.sid) > 0 {
+				count := 0
+				if tc.sessionRevoked {
+					count = 2
+				}
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(1) FROM `refresh_tokens` WHERE `family_id` = ? AND `revoked_at` IS NOT NULL")).
+					WithArgs(tc.sid).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+			}
+
+			claims := jwt.MapClaims{
+				"jti":     "jti",
+				"user_id": float64(7),
+				"iat":     float64(tc.iat.Unix()),
+			}
+			if len(tc.sid) > 0 {
+				claims["sid"] = tc.sid
+			}
+			revoked, err := _membershipSvc.IsTokenRevoked(context.Background(), claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if revoked != tc.revoked {
+				t.Errorf("expected revoked %v, got %v", tc.revoked, revoked)
+			}
+		})
+	}
+}
@@ -14,16 +14,34 @@ type Role struct {
 	ID        int                `json:"id" db:"id"`
 	Name      string             `json:"name" db:"name"`
 	Rules     []Rule             `json:"rules" db:"-"`
+	Clusters  []string           `json:"clusters,omitempty" db:"-"` // only set in the claims, empty means the role is bound in all clusters
 	RulesJSON sqlxTypes.JSONText `json:"-" db:"rulesJSON"`
 	CreatedAt *time.Time         `json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt *time.Time         `json:"updated_at" db:"updated_at"`
 }
 
+const (
+	RuleEffectAllow = "allow"
+	RuleEffectDeny  = "deny"
+)
+
+// Rule allows or denies the verbs on the resources.  Namespace and resource names can be glob patterns such as
+// prod-*, and the selector matches the labels of the resource.  Deny rules win over allow rules.
 type Rule struct {
-	Namespace     string   `json:"namespace"`
-	Resources     []string `json:"resources"`
-	ResourceNames []string `json:"resource_names"`
-	Verbs         []string `json:"verbs"`
+	Effect        string            `json:"effect,omitempty"` // allow or deny; empty means allow
+	Namespace     string            `json:"namespace"`
+	Resources     []string          `json:"resources"`
+	ResourceNames []string          `json:"resource_names"`
+	Selector      map[string]string `json:"selector,omitempty"`
+	Verbs         []string          `json:"verbs"`
+}
+
+// RoleBinding grants the role to the user in the clusters; empty clusters means all clusters.
+type RoleBinding struct {
+	RoleID       int                `json:"role_id" db:"role_id"`
+	RoleName     string             `json:"role_name" db:"name"`
+	Clusters     []string           `json:"clusters" db:"-"`
+	ClustersJSON sqlxTypes.JSONText `json:"-" db:"clustersJSON"`
 }
 
 type RoleRepo struct {
@@ -135,16 +153,28 @@ func (repo *RoleRepo) DeleteAllUserRoles(ctx context.Context, userID int) error
 	return nil
 }
 
-const insertUserRoleSQL = "INSERT INTO `users_roles` (`user_id`, `role_id`) VALUES (:user_id, :role_id);"
+const insertUserRoleSQL = "INSERT INTO `users_roles` (`user_id`, `role_id`, `clustersJSON`) VALUES (:user_id, :role_id, :clustersJSON);"
 
 func (repo *RoleRepo) AddUserToRole(ctx context.Context, userID int, roleID int, tx *sqlx.Tx) error {
+	return repo.AddRoleBinding(ctx, userID, &RoleBinding{RoleID: roleID}, tx)
+}
+
+func (repo *RoleRepo) AddRoleBinding(ctx context.Context, userID int, binding *RoleBinding, tx *sqlx.Tx) error {
 	log := xlog.FromContext(ctx)
+	if binding.Clusters == nil {
+		binding.Clusters = []string{}
+	}
+	strB, err := json.Marshal(binding.Clusters)
+	if err != nil {
+		return err
+	}
 	m := map[string]interface{}{
-		"user_id": userID,
-		"role_id": roleID,
+		"user_id":      userID,
+		"role_id":      binding.RoleID,
+		"clustersJSON": string(strB),
 	}
 
-	_, err := tx.NamedExec(insertUserRoleSQL, m)
+	_, err = tx.NamedExec(insertUserRoleSQL, m)
 	if err != nil {
 		log.Errorf("membership: insert user role fail: %v", err)
 		return err
@@ -199,6 +229,36 @@ func (repo *RoleRepo) GetRolesByUser(ctx context.Context, userID int) ([]string,
 	return rn, nil
 }
 
+const getRoleBindingsByUserSQL = "SELECT `users_roles`.`role_id`, `roles`.`name`, `users_roles`.`clustersJSON` FROM `users_roles` JOIN roles ON `users_roles`.`role_id` = `roles`.`id` AND `users_roles`.`user_id` = :user_id;"
+
+func (repo *RoleRepo) GetRoleBindingsByUser(ctx context.Context, userID int) ([]*RoleBinding, error) {
+	log := xlog.FromContext(ctx)
+	getRoleBindingsStmt, err := repo.db.PrepareNamed(getRoleBindingsByUserSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer getRoleBindingsStmt.Close()
+	m := map[string]interface{}{
+		"user_id": userID,
+	}
+	bindings := []*RoleBinding{}
+	err = getRoleBindingsStmt.Select(&bindings, m)
+	if err != nil {
+		log.Errorf("membership: get role bindings by user fail: %v", err)
+		return nil, err
+	}
+	for _, binding := range bindings {
+		binding.Clusters = []string{}
+		if len(binding.ClustersJSON) > 0 {
+			if err := json.Unmarshal(binding.ClustersJSON, &binding.Clusters); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bindings, nil
+}
+
 const updateRoleSQL = "UPDATE `roles` SET `name` = :name, rulesJSON = :rulesJSON, `updated_at` = :updated_at WHERE `name` = :original_name"
 
 func (repo *RoleRepo) UpdateRole(ctx context.Context, originalName string, entity *Role) error {
@@ -258,6 +318,28 @@ func (repo *RoleRepo) DeleteRole(ctx context.Context, id int) error {
 	return nil
 }
 
+const countUsersByRoleSQL = "SELECT COUNT(1) FROM `users_roles` WHERE role_id = :role_id;"
+
+func (repo *RoleRepo) CountUsersByRole(ctx context.Context, roleID int) (int, error) {
+	log := xlog.FromContext(ctx)
+	countStmt, err := repo.db.PrepareNamed(countUsersByRoleSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return 0, err
+	}
+	defer countStmt.Close()
+	m := map[string]interface{}{
+		"role_id": roleID,
+	}
+	count := 0
+	err = countStmt.Get(&count, m)
+	if err != nil {
+		log.Errorf("membership: count users by role fail: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
 const deleteRoleByUserSQL = "DELETE FROM `users_roles` WHERE user_id = :user_id;"
 
 func (repo *RoleRepo) DeleteRoleByUser(ctx context.Context, userID int, tx *sqlx.Tx) error {
@@ -0,0 +1,481 @@
+package identity
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jasonsoft/abb/app"
+	xlog "github.com/jasonsoft/log"
+	"github.com/jmoiron/sqlx"
+)
+
+// Team groups users, the roles of the team are granted to all members.
+type Team struct {
+	ID          int           `json:"id" db:"id"`
+	Name        string        `json:"name" db:"name"`
+	Description string        `json:"description" db:"description"`
+	Members     []*TeamMember `json:"members" db:"-"`
+	Roles       []RoleBinding `json:"roles" db:"-"`
+	CreatedAt   *time.Time    `json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt   *time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+type TeamMember struct {
+	UserID   int    `json:"user_id" db:"user_id"`
+	Username string `json:"username" db:"username"`
+}
+
+type FindTeamsOptions struct {
+	ID     int
+	Name   string
+	UserID int // teams of the user
+}
+
+func (ms *MembershipService) CreateTeam(ctx context.Context, team *Team) error {
+	if len(team.Name) == 0 || len(team.Name) > 50 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "name field is invalid"}
+	}
+
+	tx, err := ms.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = _teamRepo.Insert(ctx, team, tx)
+	if err != nil {
+		return err
+	}
+	err = ms.setTeamRoles(ctx, team, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateTeam updates the name, the description and the roles of the team; members are managed by AddTeamMember
+// and RemoveTeamMember.
+func (ms *MembershipService) UpdateTeam(ctx context.Context, team *Team) error {
+	if len(team.Name) == 0 || len(team.Name) > 50 {
+		return app.AppError{ErrorCode: "invalid_input", Message: "name field is invalid"}
+	}
+
+	tx, err := ms.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = _teamRepo.Update(ctx, team, tx)
+	if err != nil {
+		return err
+	}
+	err = ms.setTeamRoles(ctx, team, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ms *MembershipService) setTeamRoles(ctx context.Context, team *Team, tx *sqlx.Tx) error {
+	err := _teamRepo.DeleteRoles(ctx, team.ID, tx)
+	if err != nil {
+		return err
+	}
+	for i := range team.Roles {
+		binding := &team.Roles[i]
+		if binding.RoleID == 0 && len(binding.RoleName) > 0 {
+			role, err := ms.GetRoleByName(ctx, binding.RoleName)
+			if err != nil {
+				return err
+			}
+			if role == nil {
+				return app.AppError{ErrorCode: "role_not_found", Message: binding.RoleName + " can't be found"}
+			}
+			binding.RoleID = role.ID
+		}
+		err = _teamRepo.AddRole(ctx, team.ID, binding, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MembershipService) DeleteTeam(ctx context.Context, teamID int) error {
+	log := xlog.FromContext(ctx)
+
+	tx, err := ms.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = _teamRepo.Delete(ctx, teamID, tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("membership: delete team fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetTeam returns the team with the members and the roles, nil is returned when the team can't be found.
+func (ms *MembershipService) GetTeam(ctx context.Context, teamID int) (*Team, error) {
+	teams, err := _teamRepo.Find(ctx, FindTeamsOptions{ID: teamID})
+	if err != nil {
+		return nil, err
+	}
+	if len(teams) == 0 {
+		return nil, nil
+	}
+
+	team := teams[0]
+	team.Members, err = _teamRepo.FindMembers(ctx, team.ID)
+	if err != nil {
+		return nil, err
+	}
+	team.Roles, err = _teamRepo.FindRoles(ctx, team.ID)
+	if err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (ms *MembershipService) GetTeams(ctx context.Context, opts FindTeamsOptions) ([]*Team, error) {
+	return _teamRepo.Find(ctx, opts)
+}
+
+// GetUserTeamNames returns the names of the teams which the user belongs to.
+func (ms *MembershipService) GetUserTeamNames(ctx context.Context, userID int) ([]string, error) {
+	teams, err := _teamRepo.Find(ctx, FindTeamsOptions{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, team := range teams {
+		names = append(names, team.Name)
+	}
+	return names, nil
+}
+
+func (ms *MembershipService) AddTeamMember(ctx context.Context, teamID int, userID int) error {
+	team, err := ms.GetTeam(ctx, teamID)
+	if err != nil {
+		return err
+	}
+	if team == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "team not found"}
+	}
+	_, err = ms.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return _teamRepo.AddMember(ctx, teamID, userID)
+}
+
+func (ms *MembershipService) RemoveTeamMember(ctx context.Context, teamID int, userID int) error {
+	return _teamRepo.RemoveMember(ctx, teamID, userID)
+}
+
+// CurrentUserTeamNames returns the teams of the current user, service accounts don't belong to any team.
+func CurrentUserTeamNames(ctx context.Context) ([]string, error) {
+	claims, found := FromContext(ctx)
+	if !found {
+		return []string{}, nil
+	}
+	userID, _ := claims["user_id"].(float64)
+	if userID == 0 {
+		return []string{}, nil
+	}
+	return _membershipSvc.GetUserTeamNames(ctx, int(userID))
+}
+
+// mergeRoleBindings merges the bindings of the same role.  A binding without clusters grants the role in all
+// clusters, so it wins over the bindings with clusters.
+func mergeRoleBindings(bindings []*RoleBinding) []*RoleBinding {
+	result := []*RoleBinding{}
+	found := map[int]*RoleBinding{}
+	for _, binding := range bindings {
+		merged, ok := found[binding.RoleID]
+		if !ok {
+			copied := *binding
+			copied.Clusters = append([]string{}, binding.Clusters...)
+			found[binding.RoleID] = &copied
+			result = append(result, &copied)
+			continue
+		}
+		if len(merged.Clusters) == 0 {
+			continue
+		}
+		if len(binding.Clusters) == 0 {
+			merged.Clusters = []string{}
+			continue
+		}
+		for _, cluster := range binding.Clusters {
+			if !containsString(merged.Clusters, cluster) {
+				merged.Clusters = append(merged.Clusters, cluster)
+			}
+		}
+	}
+	return result
+}
+
+type TeamRepo struct {
+	db *sqlx.DB
+}
+
+func NewTeamRepo(db *sqlx.DB) *TeamRepo {
+	return &TeamRepo{
+		db: db,
+	}
+}
+
+const insertTeamSQL = "INSERT INTO `teams` (`name`, `description`, `created_at`, `updated_at`) VALUES (:name, :description, :created_at, :updated_at);"
+
+func (repo *TeamRepo) Insert(ctx context.Context, entity *Team, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.CreatedAt = &nowUTC
+	entity.UpdatedAt = &nowUTC
+
+	sqlResult, err := tx.NamedExec(insertTeamSQL, entity)
+	if err != nil {
+		mysqlerr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlerr.Number == 1062 {
+			return app.AppError{ErrorCode: "invalid_input", Message: "team name already exists"}
+		}
+		log.Errorf("membership: insert team fail: %v", err)
+		return err
+	}
+	lastID, err := sqlResult.LastInsertId()
+	if err != nil {
+		return err
+	}
+	entity.ID = int(lastID)
+	return nil
+}
+
+const updateTeamSQL = "UPDATE `teams` SET `name` = :name, `description` = :description, `updated_at` = :updated_at WHERE `id` = :id;"
+
+func (repo *TeamRepo) Update(ctx context.Context, entity *Team, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	nowUTC := time.Now().UTC()
+	entity.UpdatedAt = &nowUTC
+
+	_, err := tx.NamedExec(updateTeamSQL, entity)
+	if err != nil {
+		mysqlerr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlerr.Number == 1062 {
+			return app.AppError{ErrorCode: "invalid_input", Message: "team name already exists"}
+		}
+		log.Errorf("membership: update team fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (repo *TeamRepo) Delete(ctx context.Context, teamID int, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	for _, deleteSQL := range []string{
+		"DELETE FROM `teams_users` WHERE `team_id` = ?",
+		"DELETE FROM `teams_roles` WHERE `team_id` = ?",
+		"DELETE FROM `teams` WHERE `id` = ?",
+	} {
+		_, err := tx.Exec(deleteSQL, teamID)
+		if err != nil {
+			log.Errorf("membership: delete team fail: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+const findTeamsSQL = "SELECT `teams`.`id`, `teams`.`name`, `teams`.`description`, `teams`.`created_at`, `teams`.`updated_at` FROM `teams`"
+
+func (repo *TeamRepo) Find(ctx context.Context, opts FindTeamsOptions) ([]*Team, error) {
+	log := xlog.FromContext(ctx)
+
+	findSQL := findTeamsSQL
+	param := map[string]interface{}{}
+	if opts.UserID > 0 {
+		findSQL += " JOIN `teams_users` ON `teams_users`.`team_id` = `teams`.`id` AND `teams_users`.`user_id` = :user_id"
+		param["user_id"] = opts.UserID
+	}
+	findSQL += " WHERE 1=1"
+	if opts.ID > 0 {
+		findSQL += " AND `teams`.`id` = :id"
+		param["id"] = opts.ID
+	}
+	if len(opts.Name) > 0 {
+		findSQL += " AND `teams`.`name` = :name"
+		param["name"] = opts.Name
+	}
+	findSQL += " ORDER BY `teams`.`name`"
+
+	teams := []*Team{}
+	findStmt, err := repo.db.PrepareNamed(findSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer findStmt.Close()
+
+	err = findStmt.Select(&teams, param)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return teams, nil
+		}
+		log.Errorf("membership: find teams fail: %v", err)
+		return nil, err
+	}
+	return teams, nil
+}
+
+const findTeamMembersSQL = "SELECT `teams_users`.`user_id`, `accounts`.`username` FROM `teams_users` JOIN `accounts` ON `accounts`.`user_id` = `teams_users`.`user_id` WHERE `teams_users`.`team_id` = ? ORDER BY `accounts`.`username`"
+
+func (repo *TeamRepo) FindMembers(ctx context.Context, teamID int) ([]*TeamMember, error) {
+	log := xlog.FromContext(ctx)
+
+	members := []*TeamMember{}
+	err := repo.db.Select(&members, findTeamMembersSQL, teamID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("membership: find team members fail: %v", err)
+		return nil, err
+	}
+	return members, nil
+}
+
+const insertTeamMemberSQL = "INSERT IGNORE INTO `teams_users` (`team_id`, `user_id`) VALUES (?, ?);"
+
+func (repo *TeamRepo) AddMember(ctx context.Context, teamID int, userID int) error {
+	log := xlog.FromContext(ctx)
+
+	_, err := repo.db.Exec(insertTeamMemberSQL, teamID, userID)
+	if err != nil {
+		log.Errorf("membership: add team member fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const deleteTeamMemberSQL = "DELETE FROM `teams_users` WHERE `team_id` = ? AND `user_id` = ?;"
+
+func (repo *TeamRepo) RemoveMember(ctx context.Context, teamID int, userID int) error {
+	log := xlog.FromContext(ctx)
+
+	_, err := repo.db.Exec(deleteTeamMemberSQL, teamID, userID)
+	if err != nil {
+		log.Errorf("membership: remove team member fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const deleteMembershipsByUserSQL = "DELETE FROM `teams_users` WHERE `user_id` = ?;"
+
+func (repo *TeamRepo) RemoveUser(ctx context.Context, userID int, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	_, err := tx.Exec(deleteMembershipsByUserSQL, userID)
+	if err != nil {
+		log.Errorf("membership: remove user from teams fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const insertTeamRoleSQL = "INSERT INTO `teams_roles` (`team_id`, `role_id`, `clustersJSON`) VALUES (?, ?, ?);"
+
+func (repo *TeamRepo) AddRole(ctx context.Context, teamID int, binding *RoleBinding, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	if binding.Clusters == nil {
+		binding.Clusters = []string{}
+	}
+	strB, err := json.Marshal(binding.Clusters)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertTeamRoleSQL, teamID, binding.RoleID, string(strB))
+	if err != nil {
+		log.Errorf("membership: add team role fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (repo *TeamRepo) DeleteRoles(ctx context.Context, teamID int, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
+
+	_, err := tx.Exec("DELETE FROM `teams_roles` WHERE `team_id` = ?", teamID)
+	if err != nil {
+		log.Errorf("membership: delete team roles fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+const findTeamRolesSQL = "SELECT `teams_roles`.`role_id`, `roles`.`name`, `teams_roles`.`clustersJSON` FROM `teams_roles` JOIN `roles` ON `teams_roles`.`role_id` = `roles`.`id` WHERE `teams_roles`.`team_id` = ?"
+
+func (repo *TeamRepo) FindRoles(ctx context.Context, teamID int) ([]RoleBinding, error) {
+	bindings, err := repo.findRoleBindings(ctx, findTeamRolesSQL, teamID)
+	if err != nil {
+		return nil, err
+	}
+	result := []RoleBinding{}
+	for _, binding := range bindings {
+		result = append(result, *binding)
+	}
+	return result, nil
+}
+
+const findTeamRolesByUserSQL = "SELECT `teams_roles`.`role_id`, `roles`.`name`, `teams_roles`.`clustersJSON` FROM `teams_roles` JOIN `roles` ON `teams_roles`.`role_id` = `roles`.`id` JOIN `teams_users` ON `teams_users`.`team_id` = `teams_roles`.`team_id` WHERE `teams_users`.`user_id` = ?"
+
+// FindRoleBindingsByUser returns the roles which the user gets from the teams.
+func (repo *TeamRepo) FindRoleBindingsByUser(ctx context.Context, userID int) ([]*RoleBinding, error) {
+	return repo.findRoleBindings(ctx, findTeamRolesByUserSQL, userID)
+}
+
+const countTeamsByRoleSQL = "SELECT COUNT(1) FROM `teams_roles` WHERE `role_id` = ?"
+
+func (repo *TeamRepo) CountTeamsByRole(ctx context.Context, roleID int) (int, error) {
+	log := xlog.FromContext(ctx)
+
+	count := 0
+	err := repo.db.Get(&count, countTeamsByRoleSQL, roleID)
+	if err != nil {
+		log.Errorf("membership: count teams by role fail: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+func (repo *TeamRepo) findRoleBindings(ctx context.Context, query string, arg interface{}) ([]*RoleBinding, error) {
+	log := xlog.FromContext(ctx)
+
+	bindings := []*RoleBinding{}
+	err := repo.db.Select(&bindings, query, arg)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("membership: find team roles fail: %v", err)
+		return nil, err
+	}
+	for _, binding := range bindings {
+		binding.Clusters = []string{}
+		if len(binding.ClustersJSON) > 0 {
+			if err := json.Unmarshal(binding.ClustersJSON, &binding.Clusters); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bindings, nil
+}
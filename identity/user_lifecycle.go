@@ -0,0 +1,123 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jasonsoft/abb/app"
+	xlog "github.com/jasonsoft/log"
+)
+
+// DeleteUser removes the user, the account and the roles of the user; all sessions of the user are revoked first.
+func (ms *MembershipService) DeleteUser(ctx context.Context, userID int) error {
+	log := xlog.FromContext(ctx)
+
+	claims, found := FromContext(ctx)
+	if found {
+		if currentUserID, ok := claims["user_id"].(float64); ok && int(currentUserID) == userID {
+			return app.AppError{ErrorCode: "invalid_input", Message: "you can't delete yourself"}
+		}
+	}
+
+	account, err := _accountRepo.GetAccountByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "user not found"}
+	}
+
+	err = ms.LogoutAll(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ms.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = _roleRepo.DeleteRoleByUser(ctx, userID, tx)
+	if err != nil {
+		return err
+	}
+	err = _teamRepo.RemoveUser(ctx, userID, tx)
+	if err != nil {
+		return err
+	}
+	err = _externalIdentityRepo.DeleteByUser(ctx, userID, tx)
+	if err != nil {
+		return err
+	}
+	err = _accountRepo.Delete(ctx, userID, tx)
+	if err != nil {
+		return err
+	}
+	err = _userProfileRepo.Delete(ctx, userID, tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("membership: delete user fail: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SetUserDisabled disables or enables the user.  Disabled users can't login, and their sessions are revoked,
+// so the jwt middleware rejects the access tokens which were issued before.
+func (ms *MembershipService) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	account, err := _accountRepo.GetAccountByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "user not found"}
+	}
+	if account.IsDisabled == disabled {
+		return nil
+	}
+
+	account.IsDisabled = disabled
+	err = _accountRepo.UpdateDisabled(ctx, account)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return ms.LogoutAll(ctx, userID)
+	}
+	return nil
+}
+
+// DeleteRole removes the role; roles which are still held by users can't be deleted.
+func (ms *MembershipService) DeleteRole(ctx context.Context, name string) error {
+	role, err := ms.GetRoleByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if role == nil {
+		return app.AppError{ErrorCode: "not_found", Message: "role not found"}
+	}
+
+	count, err := _roleRepo.CountUsersByRole(ctx, role.ID)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		msg := fmt.Sprintf("role is still held by %d users", count)
+		return app.AppError{ErrorCode: "invalid_input", Message: msg}
+	}
+	count, err = _teamRepo.CountTeamsByRole(ctx, role.ID)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		msg := fmt.Sprintf("role is still held by %d teams", count)
+		return app.AppError{ErrorCode: "invalid_input", Message: msg}
+	}
+
+	return _roleRepo.DeleteRole(ctx, role.ID)
+}
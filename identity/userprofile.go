@@ -14,6 +14,7 @@ type UserProfile struct {
 	ID          int        `db:"id"`
 	DisplayName string     `json:"display_name" db:"display_name"`
 	Timezone    string     `json:"time_zone" db:"time_zone"`
+	Email       string     `json:"email" db:"email"`
 	CreatedAt   *time.Time `db:"created_at"`
 	UpdatedAt   *time.Time `db:"updated_at"`
 }
@@ -37,7 +38,7 @@ func NewUserProfileRepo(db *sqlx.DB) *UserProfileRepo {
 	}
 }
 
-const insertUserProfileSQL = "INSERT INTO `userprofiles` (`display_name`, `time_zone`, `created_at`, `updated_at`) VALUES (:display_name, :time_zone, :created_at, :updated_at);"
+const insertUserProfileSQL = "INSERT INTO `userprofiles` (`display_name`, `time_zone`, `email`, `created_at`, `updated_at`) VALUES (:display_name, :time_zone, :email, :created_at, :updated_at);"
 
 func (repo *UserProfileRepo) Insert(ctx context.Context, entity *UserProfile, tx *sqlx.Tx) error {
 	log := xlog.FromContext(ctx)
@@ -60,7 +61,7 @@ func (repo *UserProfileRepo) Insert(ctx context.Context, entity *UserProfile, tx
 	return nil
 }
 
-const getUserByNameSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`created_at`,`userprofiles`.`updated_at` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE `accounts`.`username` = :username"
+const getUserByNameSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`email`,`userprofiles`.`created_at`,`userprofiles`.`updated_at`,`accounts`.`is_locked_out`,`accounts`.`is_disabled` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE `accounts`.`username` = :username"
 
 func (repo *UserProfileRepo) GetUserByName(ctx context.Context, userName string) (*User, error) {
 	log := xlog.FromContext(ctx)
@@ -76,13 +77,41 @@ func (repo *UserProfileRepo) GetUserByName(ctx context.Context, userName string)
 	user := &User{}
 	err = getUserByNameStmt.Get(user, m)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
 		log.Errorf("membership: get userbyname fail: %v", err)
 		return nil, err
 	}
 	return user, nil
 }
 
-const getUserByIDSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`created_at`,`userprofiles`.`updated_at`,`accounts`.`is_locked_out` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE `userprofiles`.`id` = :id"
+const getUserByEmailSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`email`,`userprofiles`.`created_at`,`userprofiles`.`updated_at`,`accounts`.`is_locked_out`,`accounts`.`is_disabled` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE `userprofiles`.`email` = :email LIMIT 1"
+
+func (repo *UserProfileRepo) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	log := xlog.FromContext(ctx)
+	getUserByEmailStmt, err := repo.db.PrepareNamed(getUserByEmailSQL)
+	if err != nil {
+		log.Errorf("membership: prepare sql fail: %v", err)
+		return nil, err
+	}
+	defer getUserByEmailStmt.Close()
+	m := map[string]interface{}{
+		"email": email,
+	}
+	user := &User{}
+	err = getUserByEmailStmt.Get(user, m)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Errorf("membership: get userbyemail fail: %v", err)
+		return nil, err
+	}
+	return user, nil
+}
+
+const getUserByIDSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`email`,`userprofiles`.`created_at`,`userprofiles`.`updated_at`,`accounts`.`is_locked_out`,`accounts`.`is_disabled` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE `userprofiles`.`id` = :id"
 
 func (repo *UserProfileRepo) GetUserByID(ctx context.Context, userID int) (*User, error) {
 	log := xlog.FromContext(ctx)
@@ -107,7 +136,7 @@ func (repo *UserProfileRepo) GetUserByID(ctx context.Context, userID int) (*User
 	return user, nil
 }
 
-const getUsersSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`created_at`,`userprofiles`.`updated_at`,`accounts`.`is_locked_out` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE (IFNULL(:username,-99)=-99 OR `accounts`.`username` = :username) AND (IFNULL(:display_name,-99)=-99 OR `userprofiles`.`display_name` = :display_name) AND (IFNULL(:is_locked_out,-99)=-99 OR `accounts`.`is_locked_out` = :is_locked_out) limit :skip , :take"
+const getUsersSQL = "SELECT `userprofiles`.`id`, `userprofiles`.`display_name`, `accounts`.`username`,`accounts`.`last_login_time`,`userprofiles`.`time_zone`,`userprofiles`.`email`,`userprofiles`.`created_at`,`userprofiles`.`updated_at`,`accounts`.`is_locked_out`,`accounts`.`is_disabled` FROM `userprofiles` join `accounts` on `userprofiles`.`id` = `accounts`.`user_id` WHERE (IFNULL(:username,-99)=-99 OR `accounts`.`username` = :username) AND (IFNULL(:display_name,-99)=-99 OR `userprofiles`.`display_name` = :display_name) AND (IFNULL(:is_locked_out,-99)=-99 OR `accounts`.`is_locked_out` = :is_locked_out) limit :skip , :take"
 
 func (repo *UserProfileRepo) GetUsers(ctx context.Context, opt UserOption) ([]*User, error) {
 	log := xlog.FromContext(ctx)
@@ -145,7 +174,7 @@ func (repo *UserProfileRepo) GetUserCount(ctx context.Context, opt UserOption) (
 	return ua.Count, nil
 }
 
-const updateUserProfileSQL = "UPDATE `userprofiles` SET `display_name` = :display_name, `time_zone` = :time_zone, `updated_at` = :updated_at WHERE `id` = :id;"
+const updateUserProfileSQL = "UPDATE `userprofiles` SET `display_name` = :display_name, `time_zone` = :time_zone, `email` = :email, `updated_at` = :updated_at WHERE `id` = :id;"
 
 func (repo *UserProfileRepo) Update(ctx context.Context, entity *UserProfile) error {
 	log := xlog.FromContext(ctx)
@@ -163,14 +192,15 @@ func (repo *UserProfileRepo) Update(ctx context.Context, entity *UserProfile) er
 
 const deleteUserProfileSQL = "DELETE FROM `userprofiles` WHERE id = :id;"
 
-func (repo *UserProfileRepo) Delete(id int) error {
+func (repo *UserProfileRepo) Delete(ctx context.Context, id int, tx *sqlx.Tx) error {
+	log := xlog.FromContext(ctx)
 	m := map[string]interface{}{
 		"id": id,
 	}
 
-	_, err := repo.db.NamedExec(deleteUserProfileSQL, m)
+	_, err := tx.NamedExec(deleteUserProfileSQL, m)
 	if err != nil {
-		xlog.Errorf("membership: delete userprofile fail: %v", err)
+		log.Errorf("membership: delete userprofile fail: %v", err)
 		return err
 	}
 
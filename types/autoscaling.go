@@ -0,0 +1,65 @@
+package types
+
+import "time"
+
+const (
+	AutoscalingActionScaleUp   = "scale_up"
+	AutoscalingActionScaleDown = "scale_down"
+	AutoscalingActionNone      = "none"
+)
+
+// AutoscalingPolicy changes the replicas of the service between the min and max replicas.  The desired replicas
+// are the most which any trigger asks for, and the schedules raise the min replicas while they are active.
+type AutoscalingPolicy struct {
+	Enabled                bool                  `json:"enabled" bson:"enabled"`
+	MinReplicas            uint64                `json:"min_replicas" bson:"min_replicas"`
+	MaxReplicas            uint64                `json:"max_replicas" bson:"max_replicas"`
+	TargetCPUPercent       float64               `json:"target_cpu_percent" bson:"target_cpu_percent"`       // average cpu of the tasks in percent of the cpu limit, or one cpu when there is no limit; 0 disables it
+	TargetMemoryPercent    float64               `json:"target_memory_percent" bson:"target_memory_percent"` // average memory of the tasks in percent of their memory limit; 0 disables it
+	WindowInSec            int                   `json:"window_in_sec" bson:"window_in_sec"`                 // how long the cpu and memory are averaged; 0 means 120 seconds
+	Metric                 *AutoscalingMetric    `json:"metric,omitempty" bson:"metric"`
+	Schedules              []AutoscalingSchedule `json:"schedules" bson:"schedules"`
+	ScaleUpCooldownInSec   int                   `json:"scale_up_cooldown_in_sec" bson:"scale_up_cooldown_in_sec"`     // 0 means 60 seconds
+	ScaleDownCooldownInSec int                   `json:"scale_down_cooldown_in_sec" bson:"scale_down_cooldown_in_sec"` // 0 means 300 seconds
+	MaxScaleUpStep         uint64                `json:"max_scale_up_step" bson:"max_scale_up_step"`                   // the most replicas added at a time; 0 means no limit
+	MaxScaleDownStep       uint64                `json:"max_scale_down_step" bson:"max_scale_down_step"`               // the most replicas removed at a time; 0 means no limit
+}
+
+// AutoscalingMetric is a metric which the service exposes in the prometheus text format, the samples which match
+// the name and labels are summed up and divided by the target to get the desired replicas.
+type AutoscalingMetric struct {
+	URL              string            `json:"url" bson:"url"`
+	Name             string            `json:"name" bson:"name"`
+	Labels           map[string]string `json:"labels" bson:"labels"`
+	TargetPerReplica float64           `json:"target_per_replica" bson:"target_per_replica"`
+}
+
+// AutoscalingSchedule keeps at least the min replicas for the duration after each time the cron expression matches,
+// such as "0 8 * * 1-5" with 600 minutes for the office hours.
+type AutoscalingSchedule struct {
+	Name          string `json:"name" bson:"name"`
+	Cron          string `json:"cron" bson:"cron"`         // minute hour day-of-month month day-of-week
+	Timezone      string `json:"timezone" bson:"timezone"` // such as Asia/Taipei; empty means UTC
+	DurationInMin int    `json:"duration_in_min" bson:"duration_in_min"`
+	MinReplicas   uint64 `json:"min_replicas" bson:"min_replicas"`
+}
+
+// AutoscalingDecision is the result of an evaluation of the policy, the reasons explain each trigger and limit.
+type AutoscalingDecision struct {
+	Time            time.Time `json:"time"`
+	ClusterID       string    `json:"cluster_id"`
+	ServiceID       string    `json:"service_id"`
+	Service         string    `json:"service"`
+	CurrentReplicas uint64    `json:"current_replicas"`
+	DesiredReplicas uint64    `json:"desired_replicas"`
+	Action          string    `json:"action"`
+	Applied         bool      `json:"applied"`
+	Reasons         []string  `json:"reasons"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type AutoscalingStatus struct {
+	Policy       AutoscalingPolicy      `json:"policy"`
+	LastScaledAt *time.Time             `json:"last_scaled_at"`
+	Decisions    []*AutoscalingDecision `json:"decisions"` // the latest first
+}
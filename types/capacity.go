@@ -0,0 +1,38 @@
+package types
+
+type NodeCapacity struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname"`
+	Role         string    `json:"role"`
+	Availability string    `json:"availability"`
+	State        string    `json:"state"`
+	Capacity     Resources `json:"capacity"`
+	Reserved     Resources `json:"reserved"` // sum of the reservations of the tasks on the node
+	Limited      Resources `json:"limited"`  // sum of the limits of the tasks on the node
+	RunningTasks int       `json:"running_tasks"`
+}
+
+// ClusterCapacity reports how full the cluster is, the totals only count the nodes which are ready and active.
+type ClusterCapacity struct {
+	Capacity                    Resources       `json:"capacity"`
+	Reserved                    Resources       `json:"reserved"`
+	Limited                     Resources       `json:"limited"`
+	RunningTasks                int             `json:"running_tasks"`
+	Nodes                       []*NodeCapacity `json:"nodes"`
+	ServicesWithoutReservations []string        `json:"services_without_reservations"`
+}
+
+type NodeFit struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Tasks    int    `json:"tasks"`            // how many tasks of the service the node can take; -1 means unlimited
+	Reason   string `json:"reason,omitempty"` // why the node can't take any task
+}
+
+// CapacityFit tells whether the service spec can be scheduled with the free resources of the cluster.
+type CapacityFit struct {
+	Fits     bool       `json:"fits"`
+	Replicas int        `json:"replicas"` // the tasks to schedule; the eligible nodes for global services
+	Message  string     `json:"message"`
+	Nodes    []*NodeFit `json:"nodes"`
+}
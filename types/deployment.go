@@ -0,0 +1,29 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+type Deployment struct {
+	ID          string     `json:"id" db:"id"`
+	ClusterID   string     `json:"cluster_id" db:"cluster_id"`
+	ServiceID   string     `json:"service_id" db:"service_id"`
+	ServiceName string     `json:"service_name" db:"service_name"`
+	Image       string     `json:"image" db:"image"`
+	Digest      string     `json:"digest" db:"digest"`
+	Actor       string     `json:"actor" db:"actor"`
+	State       string     `json:"state" db:"state"` // success, failed
+	Message     string     `json:"message" db:"message"`
+	CreatedAt   *time.Time `json:"created_at" db:"created_at"`
+}
+
+type DeploymentFilterOptions struct {
+	ClusterID string
+	ServiceID string
+}
+
+type DeploymentRepository interface {
+	Insert(ctx context.Context, target *Deployment) error
+	Find(ctx context.Context, opts DeploymentFilterOptions) ([]*Deployment, error)
+}
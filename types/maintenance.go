@@ -0,0 +1,44 @@
+package types
+
+import "time"
+
+const (
+	MaintenanceStateRunning   = "running"
+	MaintenanceStateCompleted = "completed"
+	MaintenanceStateAborted   = "aborted"
+	MaintenanceStateFailed    = "failed"
+
+	MaintenanceNodePending      = "pending"
+	MaintenanceNodeDraining     = "draining"     // the node is drained and the services are reconverging elsewhere
+	MaintenanceNodeWaiting      = "waiting"      // the node is ready for maintenance, waiting for the continue signal
+	MaintenanceNodeReactivating = "reactivating" // the node is set back to active
+	MaintenanceNodeDone         = "done"
+	MaintenanceNodeFailed       = "failed"
+)
+
+// MaintenanceJob drains the nodes one at a time, so they can be patched without losing the availability of the services.
+type MaintenanceJob struct {
+	ID            string             `json:"id"`
+	ClusterID     string             `json:"cluster_id"`
+	NodeIDs       []string           `json:"node_ids"`
+	TimeoutInSec  int                `json:"timeout_in_sec"` // how long the services may take to reconverge after a node is drained
+	State         string             `json:"state"`
+	Message       string             `json:"message"`
+	Nodes         []*MaintenanceNode `json:"nodes"`
+	Current       int                `json:"current"`                  // index of the node in maintenance
+	ContinueToken string             `json:"continue_token,omitempty"` // only returned when the job is created, the webhook uses it to continue the job
+	Actor         string             `json:"actor"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+	FinishedAt    *time.Time         `json:"finished_at"`
+}
+
+type MaintenanceNode struct {
+	ID        string     `json:"id"`
+	Hostname  string     `json:"hostname"`
+	State     string     `json:"state"`
+	Services  []string   `json:"services"` // the services which had tasks on the node
+	Message   string     `json:"message"`
+	StartedAt *time.Time `json:"started_at"`
+	DoneAt    *time.Time `json:"done_at"`
+}
@@ -0,0 +1,36 @@
+package types
+
+import "time"
+
+// ResourceSample is the resource usage of a container, or the sum of the containers of a service, at a point of time.
+// The network and block io are counters since the containers started.
+type ResourceSample struct {
+	Timestamp        time.Time `json:"timestamp"`
+	CPUPercent       float64   `json:"cpu_percent"` // percent of one cpu, 200 means two cpus are fully used
+	MemoryBytes      uint64    `json:"memory_bytes"`
+	MemoryLimitBytes uint64    `json:"memory_limit_bytes"`
+	NetworkRxBytes   uint64    `json:"network_rx_bytes"`
+	NetworkTxBytes   uint64    `json:"network_tx_bytes"`
+	BlockReadBytes   uint64    `json:"block_read_bytes"`
+	BlockWriteBytes  uint64    `json:"block_write_bytes"`
+}
+
+type TaskMetrics struct {
+	ID          string           `json:"id"`
+	NodeID      string           `json:"node_id"`
+	Slot        int              `json:"slot"`
+	ContainerID string           `json:"container_id"`
+	Latest      *ResourceSample  `json:"latest"`
+	Samples     []ResourceSample `json:"samples"`
+}
+
+// ServiceMetrics is the rolling time series of the resource usage of the service, the samples of the service
+// are the sum of its tasks which were collected at the same time.
+type ServiceMetrics struct {
+	ServiceID            string           `json:"service_id"`
+	Service              string           `json:"service"`
+	CollectIntervalInSec int              `json:"collect_interval_in_sec"`
+	Latest               *ResourceSample  `json:"latest"`
+	Samples              []ResourceSample `json:"samples"`
+	Tasks                []*TaskMetrics   `json:"tasks"`
+}
@@ -0,0 +1,57 @@
+package types
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+type Subnet struct {
+	Subnet  string `json:"subnet"`
+	IPRange string `json:"ip_range"`
+	Gateway string `json:"gateway"`
+}
+
+type Network struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Scope      string            `json:"scope"`
+	Attachable bool              `json:"attachable"`
+	Internal   bool              `json:"internal"`
+	Encrypted  bool              `json:"encrypted"`
+	Ingress    bool              `json:"ingress"`
+	Subnets    []Subnet          `json:"subnets"`
+	Labels     map[string]string `json:"labels"`
+	Services   []AttachedService `json:"services,omitempty"` // only filled when the network is inspected
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// AttachedService is a service attached to the network
+type AttachedService struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	VirtualIP string         `json:"virtual_ip"`
+	Tasks     []AttachedTask `json:"tasks"`
+}
+
+type AttachedTask struct {
+	ID        string   `json:"id"`
+	Slot      int      `json:"slot"`
+	NodeID    string   `json:"node_id"`
+	State     string   `json:"state"`
+	Addresses []string `json:"addresses"`
+}
+
+type NetworkListOption struct {
+}
+
+type NetworkService interface {
+	DockerClient() *client.Client
+	Get(ctx context.Context, networkID string) (*Network, error)
+	List(ctx context.Context, opts NetworkListOption) ([]*Network, error)
+	Create(ctx context.Context, target *Network) error
+	Delete(ctx context.Context, networkID string) error
+	Close(ctx context.Context) error
+}
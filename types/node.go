@@ -23,3 +23,36 @@ type NodeRepository interface {
 	Delete(ctx context.Context, id string) error
 	Find(ctx context.Context, opts NodeListOptions) ([]*Node, error)
 }
+
+// NodeSummary is the swarm node shown by abb
+type NodeSummary struct {
+	ID            string            `json:"id"`
+	Hostname      string            `json:"hostname"`
+	Role          string            `json:"role"`
+	Availability  string            `json:"availability"`
+	State         string            `json:"state"`
+	Addr          string            `json:"addr"`
+	Leader        bool              `json:"leader"`
+	Reachability  string            `json:"reachability,omitempty"` // managers only
+	EngineVersion string            `json:"engine_version"`
+	OS            string            `json:"os"`
+	Architecture  string            `json:"architecture"`
+	CPUs          float64           `json:"cpus"`
+	MemoryBytes   int64             `json:"memory_bytes"`
+	Labels        map[string]string `json:"labels"`
+	RunningTasks  int               `json:"running_tasks"`
+	TotalTasks    int               `json:"total_tasks"` // tasks which are desired to run on the node
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+type NodeAvailabilityUpdate struct {
+	Availability string `json:"availability"`   // active, pause or drain
+	Wait         bool   `json:"wait"`           // waits until the tasks have moved away from the drained node
+	TimeoutInSec int    `json:"timeout_in_sec"` // 120 seconds by default
+}
+
+type NodeLabelsUpdate struct {
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"`
+}
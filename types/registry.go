@@ -0,0 +1,71 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+type RegistryCredential struct {
+	ID                string     `json:"id" db:"id"`
+	ClusterID         string     `json:"cluster_id" db:"cluster_id"`
+	Host              string     `json:"host" db:"host"`
+	Username          string     `json:"username" db:"username"`
+	Password          string     `json:"password,omitempty" db:"-"`
+	PasswordEncrypted string     `json:"-" db:"password_encrypted"`
+	CreatedAt         *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt         *time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type RegistryCredentialFilterOptions struct {
+	ID        string
+	ClusterID string
+	Host      string
+}
+
+type ImageTag struct {
+	Name      string     `json:"name"`
+	Digest    string     `json:"digest"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+type ImageManifest struct {
+	Repository   string            `json:"repository"`
+	Tag          string            `json:"tag"`
+	Digest       string            `json:"digest"`
+	MediaType    string            `json:"media_type"`
+	Size         int64             `json:"size"`
+	Architecture string            `json:"architecture"`
+	OS           string            `json:"os"`
+	CreatedAt    *time.Time        `json:"created_at"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// ImageUpdate tells whether a newer tag of the service image was pushed to the registry.
+type ImageUpdate struct {
+	Image             string      `json:"image"`
+	Repository        string      `json:"repository"`
+	CurrentTag        string      `json:"current_tag"`
+	LatestTag         string      `json:"latest_tag"`
+	NewerTagAvailable bool        `json:"newer_tag_available"`
+	Tags              []*ImageTag `json:"tags"`
+}
+
+type RegistryCredentialService interface {
+	Create(ctx context.Context, entity *RegistryCredential) error
+	Update(ctx context.Context, entity *RegistryCredential) error
+	Delete(ctx context.Context, id string) error
+	Get(ctx context.Context, id string) (*RegistryCredential, error)
+	List(ctx context.Context) ([]*RegistryCredential, error)
+	Login(ctx context.Context, entity *RegistryCredential) error
+	Repositories(ctx context.Context, id string) ([]string, error)
+	Tags(ctx context.Context, id string, repository string) ([]*ImageTag, error)
+	Manifest(ctx context.Context, id string, repository string, tag string) (*ImageManifest, error)
+}
+
+type RegistryCredentialRepository interface {
+	Insert(ctx context.Context, target *RegistryCredential) error
+	Update(ctx context.Context, target *RegistryCredential) error
+	Delete(ctx context.Context, id string) error
+	FindOne(ctx context.Context, opts RegistryCredentialFilterOptions) (*RegistryCredential, error)
+	Find(ctx context.Context, opts RegistryCredentialFilterOptions) ([]*RegistryCredential, error)
+}
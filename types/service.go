@@ -24,7 +24,10 @@ type ServiceService interface {
 	ServiceDelete(ctx context.Context, id string) error
 	ServiceUpdate(ctx context.Context, target *Service) error
 	ServiceStop(ctx context.Context, id string) error
-	Redeploy(ctx context.Context, serviceName string) error
+	Redeploy(ctx context.Context, serviceName string, opts RedeployOptions) error
+	Scale(ctx context.Context, id string, replicas uint64, version uint64) (*ServiceScaleResult, error)
+	DeploymentList(ctx context.Context, id string) ([]*Deployment, error)
+	ImageUpdate(ctx context.Context, id string) (*ImageUpdate, error)
 	List(ctx context.Context, opts ServiceFilterOptions) ([]*Service, error)
 }
 
@@ -37,21 +40,41 @@ type ServiceRepository interface {
 }
 
 type ServiceSpec struct {
-	Image        string          `json:"image" db:"-" bson:"image"`
-	Ports        []PortInfo      `json:"ports" db:"-" bson:"ports"`
-	Volumes      []VolumeInfo    `json:"volumes" db:"-" bson:"volumes"`
-	Command      []string        `json:"command" db:"-" bson:"command"`
-	Environments []string        `json:"environments" db:"-" bson:"environments"`
-	Configs      []ServiceConfig `json:"configs" db:"-" bson:"configs"`
-	Secrets      []ServiceSecret `json:"secrets" db:"-" bson:"secrets"`
-	Networks     []string        `json:"networks" db:"-" bson:"networks"`
-	Deploy       Deploy          `json:"deploy" db:"-" bson:"deploy"`
+	Image        string            `json:"image" db:"-" bson:"image"`
+	Ports        []PortInfo        `json:"ports" db:"-" bson:"ports"`
+	Volumes      []VolumeInfo      `json:"volumes" db:"-" bson:"volumes"`
+	Command      []string          `json:"command" db:"-" bson:"command"`
+	Environments []string          `json:"environments" db:"-" bson:"environments"`
+	Configs      []ServiceConfig   `json:"configs" db:"-" bson:"configs"`
+	Secrets      []ServiceSecret   `json:"secrets" db:"-" bson:"secrets"`
+	Networks     []string          `json:"networks" db:"-" bson:"networks"`
+	Deploy       Deploy            `json:"deploy" db:"-" bson:"deploy"`
+	UpdatePolicy UpdatePolicy      `json:"update_policy" db:"-" bson:"update_policy"`
+	Autoscaling  AutoscalingPolicy `json:"autoscaling" db:"-" bson:"autoscaling"`
+	Labels       map[string]string `json:"labels" db:"-" bson:"labels"`
+}
+
+const (
+	UpdatePolicyManual = "manual"
+	UpdatePolicyNotify = "notify"
+	UpdatePolicyAuto   = "auto"
+
+	UpdateFilterSemver = "semver"
+	UpdateFilterRegex  = "regex"
+)
+
+// UpdatePolicy decides what abb does when a new image of the service is pushed to the registry.
+type UpdatePolicy struct {
+	Mode       string `json:"mode" bson:"mode"`               // manual, notify or auto; empty means manual
+	FilterType string `json:"filter_type" bson:"filter_type"` // semver or regex; empty means only the current tag is watched
+	Filter     string `json:"filter" bson:"filter"`           // semver range such as "1.x", "^1.2.0", "~1.2.0" or a regex pattern
 }
 
 type Service struct {
 	ID               string             `json:"id" db:"id" bson:"_id"`
 	ClusterID        string             `json:"cluster_id" db:"cluster_id" bson:"cluster_id"`
 	Name             string             `json:"name" db:"name" bson:"name"`
+	Team             string             `json:"team" db:"team" bson:"team"` // the team which owns the service
 	Spec             ServiceSpec        `json:"spec" db:"-" bson:"spec"`
 	SpecJSON         sqlxTypes.JSONText `json:"-" db:"specJSON" bson:"-"`
 	DeploymentStatus DeploymentStatus   `json:"deployment_status" db:"-" bson:"-"`
@@ -63,6 +86,7 @@ type Service struct {
 type DeploymentStatus struct {
 	ServiceName       string `json:"-"`
 	Image             string `json:"image"`
+	Digest            string `json:"digest"`
 	Mode              string `json:"mode"`
 	AvailableReplicas int    `json:"available_replicas"`
 	Replicas          int    `json:"replicas"`
@@ -101,12 +125,24 @@ type UpdateConfig struct {
 }
 
 type Deploy struct {
-	Mode          string        `json:"mode" bson:"mode"`
-	Replicas      uint64        `json:"replicas" bson:"replicas"`
-	EndpointMode  string        `json:"endpoint_mode"`
-	UpdateConfig  UpdateConfig  `json:"update_config"`
-	RestartPolicy RestartPolicy `json:"restart_policy" bson:"restart_policy"`
-	Constraints   []string      `json:"constraints" bson:"constraints"`
+	Mode          string               `json:"mode" bson:"mode"`
+	Replicas      uint64               `json:"replicas" bson:"replicas"`
+	EndpointMode  string               `json:"endpoint_mode"`
+	UpdateConfig  UpdateConfig         `json:"update_config"`
+	RestartPolicy RestartPolicy        `json:"restart_policy" bson:"restart_policy"`
+	Constraints   []string             `json:"constraints" bson:"constraints"`
+	Resources     ResourceRequirements `json:"resources" bson:"resources"`
+}
+
+// Resources are in cpus, such as 0.5, and bytes of memory; zero means unset
+type Resources struct {
+	CPUs        float64 `json:"cpus" bson:"cpus"`
+	MemoryBytes int64   `json:"memory_bytes" bson:"memory_bytes"`
+}
+
+type ResourceRequirements struct {
+	Limits       Resources `json:"limits" bson:"limits"`
+	Reservations Resources `json:"reservations" bson:"reservations"`
 }
 
 type ServiceConfig struct {
@@ -119,10 +155,37 @@ type ServiceSecret struct {
 	Target string `json:"target"`
 }
 
+type RedeployOptions struct {
+	CreateNetworks bool // creates the networks declared in the spec which don't exist yet
+}
+
+// ServiceScale changes the replicas of the service.  When the version is set, the scale fails if the swarm service
+// was changed after the version, so the replicas which were read aren't overwritten by others.
+type ServiceScale struct {
+	ServiceID string  `json:"service_id"`
+	Replicas  *uint64 `json:"replicas"`
+	Version   uint64  `json:"version"`
+}
+
+// ServicesScale scales many services of the cluster in one call, each service is scaled on its own.
+type ServicesScale struct {
+	Services []ServiceScale `json:"services"`
+}
+
+type ServiceScaleResult struct {
+	ServiceID        string `json:"service_id"`
+	Service          string `json:"service"`
+	PreviousReplicas uint64 `json:"previous_replicas"`
+	Replicas         uint64 `json:"replicas"`
+	Version          uint64 `json:"version"` // the version of the swarm service after it was scaled
+	Error            string `json:"error,omitempty"`
+}
+
 type ServiceFilterOptions struct {
 	ClusterID   string
 	ServiceID   string
 	ServiceName string
+	Teams       []string // services owned by any of the teams; nil means all services
 }
 
 type ServiceLogResult struct {
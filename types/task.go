@@ -20,6 +20,74 @@ type Task struct {
 	Status TaskStatus `json:"status"`
 }
 
+// TaskHistory is a task with the full status, used by the diagnosis
+type TaskHistory struct {
+	ID           string    `json:"id"`
+	Node         string    `json:"node"`
+	Slot         int       `json:"slot"`
+	Image        string    `json:"image"`
+	DesiredState string    `json:"desired_state"`
+	State        string    `json:"state"`
+	Message      string    `json:"message"`
+	Error        string    `json:"error"`
+	ExitCode     int       `json:"exit_code"`
+	TimeStamp    time.Time `json:"timestamp"`
+}
+
+const (
+	TaskCauseImagePull             = "image_pull"
+	TaskCauseUnauthorized          = "registry_unauthorized"
+	TaskCauseNoSuitableNode        = "no_suitable_node"
+	TaskCauseInsufficientResources = "insufficient_resources"
+	TaskCausePortConflict          = "port_conflict"
+	TaskCauseMissingSecret         = "missing_secret"
+	TaskCauseMissingConfig         = "missing_config"
+	TaskCauseCrashLoop             = "crash_loop"
+	TaskCauseUnknown               = "unknown"
+)
+
+// TaskFailureGroup is the tasks which failed by the same error
+type TaskFailureGroup struct {
+	Cause     string    `json:"cause"`
+	Error     string    `json:"error"`
+	Count     int       `json:"count"`
+	ExitCodes []int     `json:"exit_codes,omitempty"`
+	Hint      string    `json:"hint"`
+	TaskIDs   []string  `json:"task_ids"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type TaskDiagnosis struct {
+	ServiceID string             `json:"service_id"`
+	Service   string             `json:"service"`
+	Replicas  int                `json:"replicas"` // desired running tasks
+	Running   int                `json:"running"`
+	Healthy   bool               `json:"healthy"`
+	Summary   string             `json:"summary"`
+	Failures  []TaskFailureGroup `json:"failures"`
+	Tasks     []TaskHistory      `json:"tasks"` // newest first
+}
+
+type TaskNetworkAddress struct {
+	Network   string   `json:"network"`
+	Addresses []string `json:"addresses"`
+}
+
+// TaskDetail is the inspected task, the history is the previous tasks of the same slot, or node for global services.
+type TaskDetail struct {
+	TaskHistory
+	ServiceID   string               `json:"service_id"`
+	ServiceName string               `json:"service_name"`
+	NodeID      string               `json:"node_id"`
+	ContainerID string               `json:"container_id"`
+	PID         int                  `json:"pid"`
+	Ports       []PortInfo           `json:"ports"`
+	Networks    []TaskNetworkAddress `json:"networks"`
+	History     []TaskHistory        `json:"history"`
+	CreatedAt   time.Time            `json:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at"`
+}
+
 type TaskListOption struct {
 	ServiceID    string
 	DesiredState string
@@ -28,5 +96,7 @@ type TaskListOption struct {
 type TaskService interface {
 	DockerClient() *client.Client
 	List(ctx context.Context, opts TaskListOption) ([]Task, error)
+	Get(ctx context.Context, taskID string) (*TaskDetail, error)
+	Diagnose(ctx context.Context, serviceID string) (*TaskDiagnosis, error)
 	Close(ctx context.Context) error
 }
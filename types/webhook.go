@@ -0,0 +1,40 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+// Webhook lets CI pipelines redeploy a service, or all services of a stack, without a user token.
+type Webhook struct {
+	ID              string     `json:"id" db:"id"`
+	ClusterID       string     `json:"cluster_id" db:"cluster_id"`
+	Name            string     `json:"name" db:"name"`
+	ServiceID       string     `json:"service_id" db:"service_id"`
+	Stack           string     `json:"stack" db:"stack"`
+	Secret          string     `json:"secret,omitempty" db:"-"` // only returned when the secret is generated
+	SecretEncrypted string     `json:"-" db:"secret_encrypted"`
+	CreatedAt       *time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt       *time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type WebhookFilterOptions struct {
+	ID        string
+	ClusterID string
+}
+
+type WebhookService interface {
+	Create(ctx context.Context, entity *Webhook) error
+	Delete(ctx context.Context, id string) error
+	Get(ctx context.Context, id string) (*Webhook, error)
+	List(ctx context.Context) ([]*Webhook, error)
+	RegenerateSecret(ctx context.Context, id string) (*Webhook, error)
+}
+
+type WebhookRepository interface {
+	Insert(ctx context.Context, target *Webhook) error
+	Update(ctx context.Context, target *Webhook) error
+	Delete(ctx context.Context, id string) error
+	FindOne(ctx context.Context, opts WebhookFilterOptions) (*Webhook, error)
+	Find(ctx context.Context, opts WebhookFilterOptions) ([]*Webhook, error)
+}